@@ -1,30 +1,128 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
-	"munggonegg/credit-service-go/internal/config"
-	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"munggonegg/credit-service-go/internal/adapter/client"
 	"munggonegg/credit-service-go/internal/adapter/handler/http"
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/service"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to an optional YAML config file")
+	printConfig := flag.Bool("print-config", false, "print the resolved config with secrets redacted and exit")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	validateErr := cfg.Validate()
+
+	if *printConfig {
+		out, err := yaml.Marshal(cfg.Redacted())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(string(out))
+		if validateErr != nil {
+			fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", validateErr)
+			os.Exit(1)
+		}
+		return
+	}
 
-	config.LoadConfig()
-	mongodb.Connect()
+	if validateErr != nil {
+		log.Fatalf("invalid config:\n%v", validateErr)
+	}
+
+	mongodb.Connect(cfg)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	portkey := client.NewPortkeyClient(cfg)
+	settler := service.NewUsageSettler(cfg, portkey)
+	jobs := service.NewUsageJobQueue(cfg, settler)
+
+	// Background workers
+	var workers sync.WaitGroup
+	workers.Add(7)
+	go func() {
+		defer workers.Done()
+		jobs.Run(ctx)
+	}()
+	go func() {
+		defer workers.Done()
+		service.RunPeriodic(ctx, "B2B funding", cfg.SchedulerInterval, service.ApplyDueB2BSchedules)
+	}()
+	go func() {
+		defer workers.Done()
+		service.RunPeriodic(ctx, "package schedules", cfg.SchedulerInterval, service.ApplyDuePackageSchedules)
+	}()
+	go func() {
+		defer workers.Done()
+		service.RunPeriodic(ctx, "renewals", cfg.SchedulerInterval, service.RenewDueMainPackages)
+	}()
+	go func() {
+		defer workers.Done()
+		service.RunPeriodic(ctx, "usage rollups", cfg.SchedulerInterval, service.RecentUsageRollups(cfg.AnalyticsRollupLookbackDays))
+	}()
+	go func() {
+		defer workers.Done()
+		service.RunPeriodic(ctx, "credit lot expiry", cfg.SchedulerInterval, service.ExpireDueCreditLots)
+	}()
+	go func() {
+		defer workers.Done()
+		service.RunPeriodic(ctx, "credit lot rebuild", cfg.SchedulerInterval, service.RebuildStaleCreditLots)
+	}()
+	if cfg.BalanceStreamSource == "changestream" {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			service.WatchBalanceChanges(ctx)
+		}()
+	}
 
 	app := fiber.New()
 
 	// Middleware
 	app.Use(recover.New())
+	app.Use(requestid.New())
 	app.Use(logger.New())
 
 	// Setup Routes
-	http.SetupRoutes(app)
+	http.SetupRoutes(app, http.NewHandler(cfg, settler, jobs))
+
+	go func() {
+		<-ctx.Done()
+		// Balance streams stay open until told to end
+		service.CloseBalanceStreams()
+		if err := app.Shutdown(); err != nil {
+			log.Printf("Server shutdown failed: %v", err)
+		}
+	}()
 
 	// Start server
-	log.Fatal(app.Listen(":3000"))
+	if err := app.Listen(cfg.Addr()); err != nil {
+		log.Fatal(err)
+	}
+
+	stop()
+	workers.Wait()
 }
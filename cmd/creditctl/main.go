@@ -0,0 +1,361 @@
+// Command creditctl runs operational tasks against the credit service
+// database.
+//
+//	creditctl export -format parquet -from 2026-09-01T00:00:00Z -to 2026-10-01T00:00:00Z -out september.parquet
+//	creditctl rollup -from 2026-01-01
+//	creditctl snapshot -verify
+//	creditctl journal -check
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const usage = `usage: creditctl <command> [flags]
+
+commands:
+  export   stream user_usage_event as csv, ndjson or parquet
+  rollup   rebuild the daily usage rollups for a date range
+  snapshot rebuild or verify balance snapshots
+  quarantine  scan usage events, quarantine malformed ones and release fixed ones
+  balances every user's balance as of a moment, as csv or ndjson
+  journal  post organization pool events and check the trial balance and user accounts
+`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch os.Args[1] {
+	case "export":
+		if err := runExport(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "rollup":
+		if err := runRollup(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "snapshot":
+		if err := runSnapshot(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "balances":
+		if err := runBalances(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "quarantine":
+		if err := runQuarantine(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "journal":
+		if err := runJournal(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func runExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to an optional YAML config file")
+	format := fs.String("format", domain.ExportNDJSON, "csv, ndjson or parquet")
+	from := fs.String("from", "", "start of the range, RFC 3339 (inclusive)")
+	to := fs.String("to", "", "end of the range, RFC 3339 (exclusive)")
+	users := fs.String("user", "", "comma-separated user IDs")
+	agent := fs.String("agent", "", "agent ID")
+	outPath := fs.String("out", "", "output file (default stdout)")
+	fs.Parse(args)
+
+	var filter domain.UsageExportFilter
+	var err error
+	if filter.From, err = parseTime(*from); err != nil {
+		return fmt.Errorf("-from: %w", err)
+	}
+	if filter.To, err = parseTime(*to); err != nil {
+		return fmt.Errorf("-to: %w", err)
+	}
+	for _, id := range strings.Split(*users, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			filter.UserIDs = append(filter.UserIDs, id)
+		}
+	}
+	filter.AgentID = *agent
+	if err := service.ValidateExport(*format, filter); err != nil {
+		return err
+	}
+
+	if err := connect(*configPath); err != nil {
+		return err
+	}
+
+	var dst io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dst = f
+	}
+
+	w := bufio.NewWriterSize(dst, 1<<20)
+	n, skipped, err := service.ExportUsageEvents(ctx, *format, filter, w)
+	if err != nil {
+		return fmt.Errorf("export failed after %d events: %w", n, err)
+	}
+	log.Printf("Exported %d events, skipped %d malformed", n, skipped)
+	return nil
+}
+
+func runRollup(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rollup", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to an optional YAML config file")
+	from := fs.String("from", "", "first day to rebuild, YYYY-MM-DD")
+	to := fs.String("to", "", "last day to rebuild, YYYY-MM-DD (default today)")
+	fs.Parse(args)
+
+	start, err := time.Parse("2006-01-02", *from)
+	if err != nil {
+		return fmt.Errorf("-from: %w", err)
+	}
+	end := time.Now()
+	if *to != "" {
+		if end, err = time.Parse("2006-01-02", *to); err != nil {
+			return fmt.Errorf("-to: %w", err)
+		}
+	}
+
+	if err := connect(*configPath); err != nil {
+		return err
+	}
+
+	// One month at a time keeps each aggregation small.
+	for day := start; !day.After(end); {
+		next := day.AddDate(0, 1, 0)
+		last := next.AddDate(0, 0, -1)
+		if last.After(end) {
+			last = end
+		}
+		if err := service.RefreshUsageRollups(ctx, day, last); err != nil {
+			return err
+		}
+		log.Printf("Rebuilt rollups %s to %s", day.Format("2006-01-02"), last.Format("2006-01-02"))
+		day = next
+	}
+	return nil
+}
+
+func runSnapshot(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to an optional YAML config file")
+	user := fs.String("user", "", "user ID (default every user with a balance)")
+	verify := fs.Bool("verify", false, "compare snapshots with a full replay instead of rebuilding them")
+	fs.Parse(args)
+
+	if err := connect(*configPath); err != nil {
+		return err
+	}
+
+	users, err := balanceUsers(ctx, *user)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, id := range users {
+		var err error
+		if *verify {
+			err = service.VerifyUserBalance(ctx, id)
+		} else {
+			_, err = service.SnapshotUserBalance(ctx, id)
+		}
+		if err != nil {
+			log.Printf("%s: %v", id, err)
+			failed++
+		}
+	}
+	log.Printf("Processed %d users, %d failed", len(users), failed)
+	if failed > 0 {
+		return fmt.Errorf("%d users failed", failed)
+	}
+	return nil
+}
+
+// balanceUsers returns user, or every user with a balance when it is empty.
+func balanceUsers(ctx context.Context, user string) ([]string, error) {
+	if user != "" {
+		return []string{user}, nil
+	}
+	ids, err := mongodb.GetCollection(config.UserBalanceColl).Distinct(ctx, "userId", bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	users := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if s, ok := id.(string); ok {
+			users = append(users, s)
+		}
+	}
+	return users, nil
+}
+
+func runQuarantine(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to an optional YAML config file")
+	user := fs.String("user", "", "user ID (default every user)")
+	fs.Parse(args)
+
+	if err := connect(*configPath); err != nil {
+		return err
+	}
+	scanned, failed, err := service.ScanLedger(ctx, *user)
+	if err != nil {
+		return err
+	}
+	log.Printf("Scanned %d events, quarantined %d", scanned, failed)
+	checked, released, err := service.ReleaseQuarantinedEvents(ctx, *user)
+	if err != nil {
+		return err
+	}
+	log.Printf("Re-checked %d quarantined events, released %d", checked, released)
+	return nil
+}
+
+// runJournal posts organization pool events, checks the trial balance and
+// checks that each user's journal accounts hold their replayed balance.
+// User events are posted as they are recorded; run snapshot first to post
+// the history recorded before the journal existed.
+func runJournal(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("journal", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to an optional YAML config file")
+	check := fs.Bool("check", false, "only check the journal")
+	user := fs.String("user", "", "user ID to check (default every user with a balance)")
+	fs.Parse(args)
+
+	if err := connect(*configPath); err != nil {
+		return err
+	}
+	if !*check {
+		n, err := service.PostOrgPoolJournal(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("Posted %d organization pool events", n)
+	}
+
+	tb, err := service.TrialBalance(ctx)
+	if err != nil {
+		return err
+	}
+	for _, a := range tb.Accounts {
+		fmt.Printf("%-40s %12d %12d %12d\n", a.Account, a.Debit, a.Credit, a.Balance)
+	}
+	fmt.Printf("%-40s %12d %12d\n", "total", tb.TotalDebit, tb.TotalCredit)
+	if !tb.Balanced {
+		return fmt.Errorf("trial balance does not balance: debit %d, credit %d, %d unbalanced entries",
+			tb.TotalDebit, tb.TotalCredit, len(tb.UnbalancedEntries))
+	}
+
+	users, err := balanceUsers(ctx, *user)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, id := range users {
+		if err := service.VerifyUserJournal(ctx, id); err != nil {
+			log.Printf("%s: %v", id, err)
+			failed++
+		}
+	}
+	log.Printf("Checked %d users, %d failed", len(users), failed)
+	if failed > 0 {
+		return fmt.Errorf("%d users failed", failed)
+	}
+	return nil
+}
+
+func runBalances(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("balances", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to an optional YAML config file")
+	asOf := fs.String("as-of", "", "moment to report, RFC 3339 (default now)")
+	format := fs.String("format", domain.ExportCSV, "csv or ndjson")
+	outPath := fs.String("out", "", "output file (default stdout)")
+	fs.Parse(args)
+
+	at := time.Now()
+	if *asOf != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, *asOf); err != nil {
+			return fmt.Errorf("-as-of: %w", err)
+		}
+	}
+
+	if err := connect(*configPath); err != nil {
+		return err
+	}
+
+	var dst io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dst = f
+	}
+
+	w := bufio.NewWriterSize(dst, 1<<20)
+	n, err := service.WriteBalanceReport(ctx, at, *format, w)
+	if err != nil {
+		return fmt.Errorf("report failed after %d users: %w", n, err)
+	}
+	log.Printf("Reported %d users", n)
+	return nil
+}
+
+// connect opens the database; only the MongoDB settings are required.
+func connect(configPath string) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	if cfg.MongoURL == "" || cfg.MongoDBName == "" {
+		return fmt.Errorf("MONGO_URL and MONGO_DB_NAME are required")
+	}
+	// The API server owns the indexes; creditctl only connects, so a
+	// read-only command such as export never changes the database.
+	mongodb.Dial(cfg)
+	return nil
+}
+
+func parseTime(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
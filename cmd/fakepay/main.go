@@ -0,0 +1,78 @@
+// Command fakepay stands in for the payment gateway during local testing. It
+// signs a payment event with PAYMENT_WEBHOOK_SECRET and delivers it to the
+// service's webhook.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func main() {
+	url := flag.String("url", "http://localhost:3000/api/v1/webhooks/payments", "webhook URL")
+	eventType := flag.String("type", domain.PaymentSucceeded, "event type: payment.succeeded, payment.failed or payment.refunded")
+	eventID := flag.String("event-id", "", "event ID (random when empty); reuse one to test redelivery")
+	paymentID := flag.String("payment-id", "", "payment ID (random when empty)")
+	userID := flag.String("user", "", "user ID")
+	kind := flag.String("kind", domain.PaymentKindSubscription, "subscription or topup")
+	packageID := flag.String("package", "", "package ID")
+	amount := flag.Float64("amount", 0, "amount charged")
+	currency := flag.String("currency", "THB", "ISO 4217 currency")
+	flag.Parse()
+
+	secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	if secret == "" {
+		log.Fatal("PAYMENT_WEBHOOK_SECRET is required")
+	}
+	if *eventID == "" {
+		*eventID = "evt_" + primitive.NewObjectID().Hex()
+	}
+	if *paymentID == "" {
+		*paymentID = "pay_" + primitive.NewObjectID().Hex()
+	}
+
+	body, err := json.Marshal(domain.PaymentWebhookEvent{
+		ID:        *eventID,
+		Type:      *eventType,
+		CreatedAt: time.Now().UTC(),
+		Data: domain.PaymentData{
+			PaymentID: *paymentID,
+			UserID:    *userID,
+			Kind:      *kind,
+			PackageID: *packageID,
+			Amount:    *amount,
+			Currency:  *currency,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, *url, bytes.NewReader(body))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Payment-Signature", service.SignPayment(secret, body, time.Now()))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	out, _ := io.ReadAll(resp.Body)
+	fmt.Printf("%s\n%s\n", resp.Status, out)
+}
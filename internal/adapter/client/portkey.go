@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"munggonegg/credit-service-go/internal/config"
+)
+
+var (
+	// ErrTraceNotFound means Portkey has no cost recorded for the trace yet.
+	// Portkey logs lag behind generation, so callers may retry later.
+	ErrTraceNotFound = errors.New("No Portkey cost found for traceId.")
+	// ErrPortkeyUnavailable wraps transport failures talking to Portkey.
+	ErrPortkeyUnavailable = errors.New("Error connecting to Portkey")
+)
+
+// PortkeyAPIError is returned when Portkey answers with a non-200 status.
+type PortkeyAPIError struct {
+	StatusCode int
+	Body       map[string]interface{}
+}
+
+func (e *PortkeyAPIError) Error() string {
+	if e.Body == nil {
+		return fmt.Sprintf("Portkey API error (status %d): unable to decode error response", e.StatusCode)
+	}
+	return fmt.Sprintf("Portkey API error (status %d)", e.StatusCode)
+}
+
+// TraceCost is the summed cost Portkey recorded for a trace.
+type TraceCost struct {
+	TotalCents float64
+	AIModel    string
+}
+
+type PortkeyClient struct {
+	url           string
+	apiKey        string
+	workspaceSlug string
+	http          *http.Client
+}
+
+func NewPortkeyClient(cfg *config.Config) *PortkeyClient {
+	return &PortkeyClient{
+		url:           cfg.PortkeyURL,
+		apiKey:        cfg.PortkeyAPIKey,
+		workspaceSlug: cfg.PortkeyWorkspaceSlug,
+		http:          &http.Client{Timeout: cfg.PortkeyTimeout},
+	}
+}
+
+// FetchTraceCost sums the cost of every Portkey log row for traceID.
+func (p *PortkeyClient) FetchTraceCost(ctx context.Context, traceID string) (*TraceCost, error) {
+	now := time.Now().UTC()
+	query := url.Values{}
+	query.Set("trace_id", traceID)
+	query.Set("workspace_slug", p.workspaceSlug)
+	query.Set("time_of_generation_min", "2025-08-01T00:00:00Z")
+	query.Set("time_of_generation_max", now.Format(time.RFC3339))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create request: %w", err)
+	}
+	req.Header.Set("x-portkey-api-key", p.apiKey)
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPortkeyUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &PortkeyAPIError{StatusCode: resp.StatusCode}
+		var errorBody map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&errorBody); err == nil {
+			apiErr.Body = errorBody
+		}
+		return nil, apiErr
+	}
+
+	var portkeyResp map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&portkeyResp); err != nil {
+		return nil, fmt.Errorf("Failed to decode Portkey response: %w", err)
+	}
+
+	rows, ok := portkeyResp["data"].([]interface{})
+	if !ok || len(rows) == 0 {
+		return nil, ErrTraceNotFound
+	}
+
+	cost := &TraceCost{}
+	for _, row := range rows {
+		r, ok := row.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if cost.AIModel == "" {
+			if m, ok := r["ai_model"].(string); ok {
+				cost.AIModel = m
+			}
+		}
+		// Handle cost type safely
+		switch v := r["cost"].(type) {
+		case float64:
+			cost.TotalCents += v
+		case int:
+			cost.TotalCents += float64(v)
+		}
+	}
+
+	if cost.TotalCents == 0 {
+		return nil, ErrTraceNotFound
+	}
+
+	return cost, nil
+}
+
+// Retryable reports whether err is worth retrying later: the trace may not
+// be logged yet, or Portkey is temporarily unavailable.
+func Retryable(err error) bool {
+	if errors.Is(err, ErrTraceNotFound) || errors.Is(err, ErrPortkeyUnavailable) {
+		return true
+	}
+	var apiErr *PortkeyAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+	return false
+}
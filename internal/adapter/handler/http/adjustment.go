@@ -0,0 +1,35 @@
+package http
+
+import (
+	"errors"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handler) CreateAdjustment(c *fiber.Ctx) error {
+	var payload domain.AdjustmentIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	event, bal, err := service.CreateAdjustment(c.Context(), c.Params("userId"), payload, localString(c, localAPIKeyID))
+	if errors.Is(err, service.ErrInvalidAdjustment) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"detail": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(domain.AdjustmentResponse{Event: *event, Balance: *bal})
+}
+
+func (h *Handler) ListAdjustments(c *fiber.Ctx) error {
+	events, err := service.ListAdjustments(c.Context(), c.Params("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": events})
+}
@@ -0,0 +1,53 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetUsageAnalytics aggregates usage by interval and by any of user, agent
+// and model, e.g. ?interval=day&groupBy=user,model.
+func (h *Handler) GetUsageAnalytics(c *fiber.Ctx) error {
+	q := domain.UsageAnalyticsQuery{
+		Interval: c.Query("interval"),
+		UserID:   c.Query("userId"),
+		AgentID:  c.Query("agentId"),
+		AIModel:  c.Query("aiModel"),
+		Source:   c.Query("source"),
+	}
+	for _, g := range strings.Split(c.Query("groupBy"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			q.GroupBy = append(q.GroupBy, g)
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		raw := c.Query(p.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": fmt.Sprintf("%s must be an RFC 3339 timestamp", p.name)})
+		}
+		*p.dst = t
+	}
+
+	res, err := service.UsageAnalytics(c.Context(), q)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidAnalytics) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": err.Error()})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(res)
+}
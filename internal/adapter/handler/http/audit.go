@@ -0,0 +1,111 @@
+package http
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Audit log page sizes.
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// ListAuditLog returns audit entries, newest first. actor, action and
+// target ("param:value", e.g. userId:u1) filter them, from and to (RFC
+// 3339) bound their timestamp, and limit caps the page.
+func (h *Handler) ListAuditLog(c *fiber.Ctx) error {
+	f := domain.AuditFilter{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		Limit:  defaultAuditLimit,
+	}
+	if raw := c.Query("target"); raw != "" {
+		key, value, ok := strings.Cut(raw, ":")
+		if !ok || key == "" || strings.ContainsAny(key, ".$") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": "target must be param:value"})
+		}
+		f.TargetKey, f.Target = key, value
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		raw := c.Query(p.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": fmt.Sprintf("%s must be an RFC 3339 timestamp", p.name)})
+		}
+		*p.dst = t
+	}
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit)})
+		}
+		f.Limit = n
+	}
+
+	items, err := service.ListAuditEntries(c.Context(), f)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": items})
+}
+
+// VerifyAuditLog checks the audit log's hash chain from the first entry.
+func (h *Handler) VerifyAuditLog(c *fiber.Ctx) error {
+	v, err := service.VerifyAuditChain(c.Context())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(v)
+}
+
+// Loaders of the state audited admin routes change.
+
+func auditUserBalance(c *fiber.Ctx) (any, error) {
+	return service.GetUserBalance(c.Context(), c.Params("userId"))
+}
+
+func auditUsageEvent(c *fiber.Ctx) (any, error) {
+	return service.GetTokenUsedEvent(c.Context(), c.Params("traceId"))
+}
+
+func auditPackageSchedules(c *fiber.Ctx) (any, error) {
+	return service.ListPackageSchedules(c.Context(), c.Params("userId"), domain.SchedulePending)
+}
+
+func auditPackage(c *fiber.Ctx) (any, error) {
+	return service.GetPackage(c.Context(), c.Params("packageId"))
+}
+
+func auditPackageModels(c *fiber.Ctx) (any, error) {
+	return service.GetPackageModels(c.Context(), c.Params("packageId"))
+}
+
+func auditProvider(c *fiber.Ctx) (any, error) {
+	return service.GetProvider(c.Context(), c.Params("providerId"))
+}
+
+func auditModel(c *fiber.Ctx) (any, error) {
+	return service.GetModel(c.Context(), c.Params("modelId"))
+}
+
+func auditOrganization(c *fiber.Ctx) (any, error) {
+	return service.GetOrganizationDetail(c.Context(), c.Params("orgId"))
+}
+
+func auditB2BSchedules(c *fiber.Ctx) (any, error) {
+	return service.ListB2BSchedules(c.Context(), c.Params("orgId"))
+}
@@ -0,0 +1,149 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ExplainBalance replays a user's events and shows how each one moved the
+// main and topup balances. from and to (RFC 3339) limit the listed events.
+func (h *Handler) ExplainBalance(c *fiber.Ctx) error {
+	var from, to time.Time
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		raw := c.Query(p.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": fmt.Sprintf("%s must be an RFC 3339 timestamp", p.name)})
+		}
+		*p.dst = t
+	}
+
+	out, err := service.ExplainBalance(c.Context(), c.Params("userId"), from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(out)
+}
+
+// GetBalance returns the user's stored balance, or replays it as of ?asOf
+// (RFC 3339).
+func (h *Handler) GetBalance(c *fiber.Ctx) error {
+	raw := c.Query("asOf")
+	if raw == "" {
+		bal, err := service.CurrentBalance(c.Context(), c.Params("userId"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+		}
+		return c.Status(fiber.StatusOK).JSON(bal)
+	}
+	asOf, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": "asOf must be an RFC 3339 timestamp"})
+	}
+
+	bal, err := service.BalanceAsOf(c.Context(), c.Params("userId"), asOf)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(bal)
+}
+
+// BalanceReport streams every user's balance as of ?asOf as CSV (default) or
+// NDJSON.
+func (h *Handler) BalanceReport(c *fiber.Ctx) error {
+	asOf, err := time.Parse(time.RFC3339, c.Query("asOf"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": "asOf is required as an RFC 3339 timestamp"})
+	}
+	format := c.Query("format", domain.ExportCSV)
+	if format != domain.ExportCSV && format != domain.ExportNDJSON {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": "format must be csv or ndjson"})
+	}
+
+	c.Set(fiber.HeaderContentType, service.ExportContentType(format))
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="balances-%s.%s"`, asOf.UTC().Format("20060102T150405Z"), format))
+	c.Status(fiber.StatusOK).Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		n, err := service.WriteBalanceReport(context.Background(), asOf, format, w)
+		if err != nil {
+			log.Printf("Balance report failed after %d users: %v", n, err)
+		}
+	})
+	return nil
+}
+
+// balanceKeepAlive is how often an idle balance stream sends a comment, so
+// proxies do not close it and a gone client is noticed.
+const balanceKeepAlive = 15 * time.Second
+
+// StreamBalance sends the user's balance as Server-Sent Events: the stored
+// balance first, then a "balance" event each time it is written.
+func (h *Handler) StreamBalance(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	updates, unsubscribe := service.SubscribeBalance(userID)
+	current, err := service.GetUserBalance(c.Context(), userID)
+	if err != nil {
+		unsubscribe()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+	c.Status(fiber.StatusOK).Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+		if current != nil {
+			if err := writeBalanceEvent(w, *current); err != nil {
+				return
+			}
+		}
+
+		keepAlive := time.NewTicker(balanceKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case bal, ok := <-updates:
+				if !ok {
+					return
+				}
+				if err := writeBalanceEvent(w, bal); err != nil {
+					return
+				}
+			case <-keepAlive.C:
+				if _, err := w.WriteString(": keep-alive\n\n"); err != nil {
+					return
+				}
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	})
+	return nil
+}
+
+func writeBalanceEvent(w *bufio.Writer, bal domain.UserBalance) error {
+	data, err := json.Marshal(bal)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: balance\ndata: %s\n\n", data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,20 @@
+package http
+
+import (
+	"errors"
+
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handler) ListCreditLots(c *fiber.Ctx) error {
+	items, err := service.ListCreditLots(c.Context(), c.Params("userId"), c.Query("status"))
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidLotStatus) {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"detail": err.Error()})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": items})
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"errors"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handler) GetEntitlements(c *fiber.Ctx) error {
+	ent, err := service.GetEntitlements(c.Context(), c.Params("userId"))
+	if err != nil {
+		return entitlementError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(ent)
+}
+
+// CheckEntitlement is the preflight an agent calls before running a model.
+func (h *Handler) CheckEntitlement(c *fiber.Ctx) error {
+	var payload domain.EntitlementCheckIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if payload.UserID == "" || payload.AIModel == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "userId and aiModel are required"})
+	}
+
+	check, err := h.settler.Entitlements().CheckEntitlement(c.Context(), payload.UserID, payload.AIModel)
+	if err != nil {
+		return entitlementError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(check)
+}
+
+func (h *Handler) GetPackageModels(c *fiber.Ctx) error {
+	doc, err := service.GetPackageModels(c.Context(), c.Params("packageId"))
+	if err != nil {
+		return entitlementError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(doc)
+}
+
+func (h *Handler) SetPackageModels(c *fiber.Ctx) error {
+	var payload domain.PackageBestModels
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	doc, err := service.SetPackageModels(c.Context(), c.Params("packageId"), payload.ModelIDs)
+	if err != nil {
+		return entitlementError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(doc)
+}
+
+func (h *Handler) ClearPackageModels(c *fiber.Ctx) error {
+	if err := service.ClearPackageModels(c.Context(), c.Params("packageId")); err != nil {
+		return entitlementError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func entitlementError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, service.ErrNoMainPackage):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrPackageNotFound), errors.Is(err, service.ErrModelNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": err.Error()})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ExportUsageEvents streams usage events as CSV, NDJSON or Parquet. The
+// response is written while the cursor is read, so its status is sent
+// before the export finishes; an export that fails midway is truncated and
+// logged.
+func (h *Handler) ExportUsageEvents(c *fiber.Ctx) error {
+	format := c.Query("format", domain.ExportNDJSON)
+	filter, err := exportFilter(c)
+	if err == nil {
+		err = service.ValidateExport(format, filter)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": err.Error()})
+	}
+
+	c.Set(fiber.HeaderContentType, service.ExportContentType(format))
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="usage-events.%s"`, format))
+	c.Status(fiber.StatusOK).Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		n, skipped, err := service.ExportUsageEvents(context.Background(), format, filter, w)
+		if err != nil {
+			log.Printf("Usage export failed after %d events: %v", n, err)
+		}
+		if skipped > 0 {
+			log.Printf("Usage export left out %d malformed events", skipped)
+		}
+	})
+	return nil
+}
+
+// exportFilter reads from and to (RFC 3339), userId (comma-separated or
+// repeated) and agentId from the query string.
+func exportFilter(c *fiber.Ctx) (domain.UsageExportFilter, error) {
+	var f domain.UsageExportFilter
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		raw := c.Query(p.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return f, errors.Join(service.ErrInvalidExport, fmt.Errorf("%s must be an RFC 3339 timestamp", p.name))
+		}
+		*p.dst = t
+	}
+	for _, v := range c.Context().QueryArgs().PeekMulti("userId") {
+		for _, id := range strings.Split(string(v), ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				f.UserIDs = append(f.UserIDs, id)
+			}
+		}
+	}
+	f.AgentID = c.Query("agentId")
+	return f, nil
+}
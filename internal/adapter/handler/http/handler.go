@@ -0,0 +1,21 @@
+package http
+
+import (
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/service"
+)
+
+// Handler carries the dependencies shared by the HTTP handlers.
+type Handler struct {
+	cfg     *config.Config
+	settler *service.UsageSettler
+	jobs    *service.UsageJobQueue
+	// apiKeys maps each accepted API key to its ID.
+	apiKeys map[string]string
+}
+
+func NewHandler(cfg *config.Config, settler *service.UsageSettler, jobs *service.UsageJobQueue) *Handler {
+	// The keys were checked by cfg.Validate at startup.
+	keys, _ := cfg.APIKeys()
+	return &Handler{cfg: cfg, settler: settler, jobs: jobs, apiKeys: keys}
+}
@@ -0,0 +1,51 @@
+package http
+
+import (
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handler) ListQuarantinedEvents(c *fiber.Ctx) error {
+	items, err := service.ListQuarantinedEvents(c.Context(), c.Query("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": items})
+}
+
+// ReleaseQuarantinedEvents re-checks the quarantined events, optionally for
+// one user, and releases those fixed since.
+func (h *Handler) ReleaseQuarantinedEvents(c *fiber.Ctx) error {
+	checked, released, err := service.ReleaseQuarantinedEvents(c.Context(), c.Query("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"checked": checked, "released": released})
+}
+
+// ScanUserLedger decodes all of a user's events and quarantines the
+// malformed ones. Use creditctl quarantine to scan every user.
+func (h *Handler) ScanUserLedger(c *fiber.Ctx) error {
+	scanned, failed, err := service.ScanLedger(c.Context(), c.Params("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"scanned": scanned, "quarantined": failed})
+}
+
+func (h *Handler) GetTrialBalance(c *fiber.Ctx) error {
+	tb, err := service.TrialBalance(c.Context())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(tb)
+}
+
+func (h *Handler) ListJournalEntries(c *fiber.Ctx) error {
+	items, err := service.ListJournalEntries(c.Context(), c.Params("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": items})
+}
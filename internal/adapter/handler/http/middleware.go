@@ -0,0 +1,138 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Keys of the request locals shared by the admin middleware.
+const (
+	localAPIKeyID   = "apiKeyId"
+	localAuditName  = "auditAction"
+	localAuditPre   = "auditBefore"
+	localAuditPost  = "auditAfter"
+	localAuditParam = "auditTarget"
+)
+
+// RequireAPIKey rejects requests whose X-API-Key header matches none of the
+// configured keys, and records the ID of the key that matched. Every key is
+// compared so the time taken does not reveal which one was close.
+func (h *Handler) RequireAPIKey(c *fiber.Ctx) error {
+	key := c.Get("X-API-Key")
+	id := ""
+	for k, kid := range h.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			id = kid
+		}
+	}
+	if key == "" || id == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"detail": "Invalid API key"})
+	}
+	c.Locals(localAPIKeyID, id)
+	return c.Next()
+}
+
+// AuditAdmin records every mutating admin call in the audit log, failed
+// calls included. A pending entry is written before the call runs, and the
+// call is refused when that fails; the outcome is appended once it has run.
+// Routes wrapped in auditTarget name the action and may load the target's
+// state before and after; otherwise a successful call's JSON response is
+// recorded as the after state. A failure to write the outcome is logged,
+// since the call has already taken effect, and leaves the pending entry
+// unfinished.
+func (h *Handler) AuditAdmin(c *fiber.Ctx) error {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return c.Next()
+	}
+
+	e := domain.AuditEntry{
+		Actor:     localString(c, localAPIKeyID),
+		Method:    c.Method(),
+		Path:      c.Path(),
+		RequestID: c.GetRespHeader(fiber.HeaderXRequestID, c.Get(fiber.HeaderXRequestID)),
+		Request:   append([]byte(nil), c.Body()...),
+	}
+	seq, err := service.BeginAudit(c.Context(), e)
+	if err != nil {
+		log.Printf("Audit entry for %s %s by %s failed, refusing the call: %v", e.Method, e.Path, e.Actor, err)
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"detail": "Audit log unavailable"})
+	}
+
+	err = c.Next()
+
+	status := c.Response().StatusCode()
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		status = fe.Code
+	} else if err != nil {
+		status = fiber.StatusInternalServerError
+	}
+
+	e.Action = localString(c, localAuditName)
+	e.Status = status
+	if e.Action == "" {
+		e.Action = strings.ToLower(c.Method()) + " " + c.Route().Path
+	}
+	if target, ok := c.Locals(localAuditParam).(map[string]string); ok {
+		e.Target = target
+	} else {
+		e.Target = c.AllParams()
+	}
+	if status < fiber.StatusMultipleChoices {
+		if after, loaded := c.Locals(localAuditPost).([]byte); loaded {
+			e.Before, _ = c.Locals(localAuditPre).([]byte)
+			e.After = after
+		} else if strings.HasPrefix(string(c.Response().Header.ContentType()), fiber.MIMEApplicationJSON) {
+			e.After = append([]byte(nil), c.Response().Body()...)
+		}
+	}
+
+	if ferr := service.FinishAudit(c.Context(), seq, e); ferr != nil {
+		log.Printf("Audit outcome for %s %s by %s (entry %d) failed: %v", e.Method, e.Path, e.Actor, seq, ferr)
+	}
+	return err
+}
+
+// auditTarget names a mutating admin route for the audit log. load, when
+// given, reads the state the route changes; it is read before and after
+// the handler runs. A target that cannot be read, such as one that does not
+// exist yet, is recorded as absent.
+func auditTarget(action string, load func(c *fiber.Ctx) (any, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals(localAuditName, action)
+		c.Locals(localAuditParam, c.AllParams())
+		if load == nil {
+			return c.Next()
+		}
+		c.Locals(localAuditPre, auditState(c, load))
+		err := c.Next()
+		c.Locals(localAuditPost, auditState(c, load))
+		return err
+	}
+}
+
+func auditState(c *fiber.Ctx, load func(c *fiber.Ctx) (any, error)) []byte {
+	v, err := load(c)
+	if err != nil || v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return nil
+	}
+	return b
+}
+
+func localString(c *fiber.Ctx, key string) string {
+	s, _ := c.Locals(key).(string)
+	return s
+}
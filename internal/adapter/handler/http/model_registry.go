@@ -0,0 +1,120 @@
+package http
+
+import (
+	"errors"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handler) ListProviders(c *fiber.Ctx) error {
+	providers, err := service.ListProviders(c.Context())
+	if err != nil {
+		return registryError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": providers})
+}
+
+func (h *Handler) GetProvider(c *fiber.Ctx) error {
+	p, err := service.GetProvider(c.Context(), c.Params("providerId"))
+	if err != nil {
+		return registryError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(p)
+}
+
+func (h *Handler) CreateProvider(c *fiber.Ctx) error {
+	var payload domain.ProviderIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	p, err := service.CreateProvider(c.Context(), payload)
+	if err != nil {
+		return registryError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(p)
+}
+
+func (h *Handler) UpdateProvider(c *fiber.Ctx) error {
+	var payload domain.ProviderIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	p, err := service.UpdateProvider(c.Context(), c.Params("providerId"), payload)
+	if err != nil {
+		return registryError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(p)
+}
+
+func (h *Handler) ListModels(c *fiber.Ctx) error {
+	models, err := service.ListModels(c.Context(), c.Query("providerId"))
+	if err != nil {
+		return registryError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": models})
+}
+
+func (h *Handler) GetModel(c *fiber.Ctx) error {
+	m, err := service.GetModel(c.Context(), c.Params("modelId"))
+	if err != nil {
+		return registryError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(m)
+}
+
+func (h *Handler) CreateModel(c *fiber.Ctx) error {
+	var payload domain.ProviderModelIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	m, err := service.CreateModel(c.Context(), payload)
+	if err != nil {
+		return registryError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(m)
+}
+
+func (h *Handler) UpdateModel(c *fiber.Ctx) error {
+	var payload domain.ProviderModelIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	m, err := service.UpdateModel(c.Context(), c.Params("modelId"), payload)
+	if err != nil {
+		return registryError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(m)
+}
+
+// ResolveModel shows which canonical model a raw Portkey ai_model maps to.
+func (h *Handler) ResolveModel(c *fiber.Ctx) error {
+	m, err := service.ResolveModel(c.Context(), c.Query("aiModel"))
+	if err != nil {
+		return registryError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(m)
+}
+
+func (h *Handler) ListUnknownModels(c *fiber.Ctx) error {
+	items, err := service.ListUnknownModels(c.Context())
+	if err != nil {
+		return registryError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": items})
+}
+
+func registryError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, service.ErrProviderNotFound), errors.Is(err, service.ErrModelNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrInvalidRegistry):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrRegistryExists):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"detail": err.Error()})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+}
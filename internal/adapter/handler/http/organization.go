@@ -0,0 +1,92 @@
+package http
+
+import (
+	"errors"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handler) CreateOrganization(c *fiber.Ctx) error {
+	var payload domain.OrganizationIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	org, err := service.CreateOrganization(c.Context(), payload)
+	if err != nil {
+		return orgError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(org)
+}
+
+func (h *Handler) GetOrganization(c *fiber.Ctx) error {
+	org, err := service.GetOrganizationDetail(c.Context(), c.Params("orgId"))
+	if err != nil {
+		return orgError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(org)
+}
+
+func (h *Handler) SetOrgMember(c *fiber.Ctx) error {
+	var payload domain.OrgMemberIn
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&payload); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+	m, err := service.SetOrgMember(c.Context(), c.Params("orgId"), c.Params("userId"), payload)
+	if err != nil {
+		return orgError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(m)
+}
+
+func (h *Handler) RemoveOrgMember(c *fiber.Ctx) error {
+	if err := service.RemoveOrgMember(c.Context(), c.Params("orgId"), c.Params("userId")); err != nil {
+		return orgError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *Handler) CreateB2BSchedule(c *fiber.Ctx) error {
+	var payload domain.B2BScheduleIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	sched, err := service.CreateB2BSchedule(c.Context(), c.Params("orgId"), payload)
+	if err != nil {
+		return orgError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(sched)
+}
+
+func (h *Handler) ListB2BSchedules(c *fiber.Ctx) error {
+	items, err := service.ListB2BSchedules(c.Context(), c.Params("orgId"))
+	if err != nil {
+		return orgError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": items})
+}
+
+func (h *Handler) CancelB2BSchedule(c *fiber.Ctx) error {
+	if err := service.CancelB2BSchedule(c.Context(), c.Params("orgId"), c.Params("scheduleId")); err != nil {
+		return orgError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func orgError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, service.ErrOrgNotFound), errors.Is(err, service.ErrMemberNotFound),
+		errors.Is(err, service.ErrScheduleNotFound), errors.Is(err, service.ErrPackageNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrInvalidOrg):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrOrgExists), errors.Is(err, service.ErrAlreadyMember):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"detail": err.Error()})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+}
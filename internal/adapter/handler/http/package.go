@@ -0,0 +1,93 @@
+package http
+
+import (
+	"errors"
+	"strconv"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handler) ListPackages(c *fiber.Ctx) error {
+	activeOnly, _ := strconv.ParseBool(c.Query("active"))
+	pkgs, err := service.ListPackages(c.Context(), activeOnly)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": pkgs})
+}
+
+func (h *Handler) GetPackage(c *fiber.Ctx) error {
+	pkg, err := service.GetPackage(c.Context(), c.Params("packageId"))
+	if err != nil {
+		return packageError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(pkg)
+}
+
+func (h *Handler) CreatePackage(c *fiber.Ctx) error {
+	var payload domain.PackageIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	pkg, err := service.CreatePackage(c.Context(), payload)
+	if err != nil {
+		return packageError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(pkg)
+}
+
+func (h *Handler) UpdatePackage(c *fiber.Ctx) error {
+	var payload domain.PackageIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	pkg, err := service.UpdatePackage(c.Context(), c.Params("packageId"), payload)
+	if err != nil {
+		return packageError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(pkg)
+}
+
+func (h *Handler) DeactivatePackage(c *fiber.Ctx) error {
+	pkg, err := service.DeactivatePackage(c.Context(), c.Params("packageId"))
+	if err != nil {
+		return packageError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(pkg)
+}
+
+func (h *Handler) ListPackageVersions(c *fiber.Ctx) error {
+	versions, err := service.ListPackageVersions(c.Context(), c.Params("packageId"))
+	if err != nil {
+		return packageError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": versions})
+}
+
+func (h *Handler) GetPackageVersion(c *fiber.Ctx) error {
+	version, err := strconv.Atoi(c.Params("version"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "version must be an integer"})
+	}
+	v, err := service.GetPackageVersion(c.Context(), c.Params("packageId"), version)
+	if err != nil {
+		return packageError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(v)
+}
+
+func packageError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, service.ErrPackageNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrInvalidPackage):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrPackageExists), errors.Is(err, service.ErrVersionConflict):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"detail": err.Error()})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+}
@@ -0,0 +1,51 @@
+package http
+
+import (
+	"errors"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handler) CreatePackageSchedule(c *fiber.Ctx) error {
+	var payload domain.PackageScheduleIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	sched, err := service.SchedulePackageChange(c.Context(), c.Params("userId"), payload)
+	if err != nil {
+		return scheduleError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(sched)
+}
+
+func (h *Handler) ListPackageSchedules(c *fiber.Ctx) error {
+	items, err := service.ListPackageSchedules(c.Context(), c.Params("userId"), c.Query("status"))
+	if err != nil {
+		return scheduleError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"items": items})
+}
+
+func (h *Handler) CancelPackageSchedule(c *fiber.Ctx) error {
+	if err := service.CancelPackageSchedule(c.Context(), c.Params("userId"), c.Params("scheduleId")); err != nil {
+		return scheduleError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func scheduleError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, service.ErrScheduleNotFound), errors.Is(err, service.ErrPackageNotFound),
+		errors.Is(err, service.ErrNoMainPackage):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrInvalidSchedule):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrSchedulePending):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"detail": err.Error()})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+}
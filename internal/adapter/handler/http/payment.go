@@ -0,0 +1,49 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// PaymentWebhook receives payment gateway events. The signature is checked
+// against the raw body before it is parsed.
+func (h *Handler) PaymentWebhook(c *fiber.Ctx) error {
+	if h.cfg.PaymentWebhookSecret == "" {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"detail": "Payment webhook is not configured"})
+	}
+
+	body := c.Body()
+	if err := service.VerifyPaymentSignature(h.cfg.PaymentWebhookSecret, c.Get("X-Payment-Signature"), body, h.cfg.PaymentWebhookTolerance, time.Now()); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"detail": err.Error()})
+	}
+
+	var payload domain.PaymentWebhookEvent
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	res, err := service.RecordPaymentEvent(c.Context(), payload)
+	if err != nil {
+		return paymentError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(res)
+}
+
+func paymentError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, service.ErrInvalidPayment):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrPackageNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrPaymentConflict):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"detail": err.Error()})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+}
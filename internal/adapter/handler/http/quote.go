@@ -0,0 +1,35 @@
+package http
+
+import (
+	"errors"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Quote is the affordability preflight an orchestrator calls before a
+// costly run: the estimated charge and whether the balance covers it.
+func (h *Handler) Quote(c *fiber.Ctx) error {
+	var payload domain.QuoteIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	q, err := h.settler.Quote(c.Context(), payload)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidQuote):
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"detail": err.Error()})
+		case errors.Is(err, service.ErrNoMainPackage):
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"detail": err.Error()})
+		case errors.Is(err, service.ErrModelNotFound), errors.Is(err, service.ErrPackageNotFound),
+			errors.Is(err, service.ErrOrgNotFound):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": err.Error()})
+		default:
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+		}
+	}
+	return c.Status(fiber.StatusOK).JSON(q)
+}
@@ -0,0 +1,33 @@
+package http
+
+import (
+	"errors"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handler) RefundUsage(c *fiber.Ctx) error {
+	var payload domain.RefundIn
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&payload); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+
+	refund, err := service.RefundUsage(c.Context(), c.Params("traceId"), payload.Amount, payload.Reason, localString(c, localAPIKeyID))
+	switch {
+	case err == nil:
+		return c.Status(fiber.StatusCreated).JSON(refund)
+	case errors.Is(err, service.ErrUsageNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrInvalidRefund), errors.Is(err, service.ErrRefundExceeds):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"detail": err.Error()})
+	case errors.Is(err, service.ErrRefundConflict):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"detail": err.Error()})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+}
@@ -1,12 +1,10 @@
 package http
 
 import (
-
-
 	"github.com/gofiber/fiber/v2"
 )
 
-func SetupRoutes(app *fiber.App) {
+func SetupRoutes(app *fiber.App, h *Handler) {
 
 	api := app.Group("/api")
 	v1 := api.Group("/v1")
@@ -15,5 +13,98 @@ func SetupRoutes(app *fiber.App) {
 	app.Get("/", GetRoot)
 
 	// Token Used route
-	v1.Post("/token_used", RecordTokenUsed)
+	v1.Post("/token_used", h.RecordTokenUsed)
+	v1.Post("/token_used/batch", h.RecordTokenUsedBatch)
+
+	// Usage refunds need an API key and are audited like admin calls
+	v1.Post("/usage/:traceId/refund", h.RequireAPIKey, h.AuditAdmin, auditTarget("usage.refund", auditUsageEvent), h.RefundUsage)
+
+	// Entitlements
+	v1.Get("/users/:userId/entitlements", h.GetEntitlements)
+	v1.Post("/entitlements/check", h.CheckEntitlement)
+
+	// Affordability preflight
+	v1.Post("/quote", h.Quote)
+
+	// Balances
+	v1.Get("/users/:userId/balance", h.GetBalance)
+	v1.Get("/users/:userId/balance/stream", h.StreamBalance)
+	v1.Get("/users/:userId/credit-lots", h.ListCreditLots)
+
+	// Monthly statements
+	v1.Get("/users/:userId/statements/:month", h.GetStatement)
+
+	// Scheduled plan changes
+	v1.Get("/users/:userId/package-schedules", h.ListPackageSchedules)
+
+	// Payment gateway webhook
+	v1.Post("/webhooks/payments", h.PaymentWebhook)
+
+	// Async usage job status
+	v1.Get("/usage-jobs/:id", h.GetUsageJob)
+
+	// Admin routes
+	admin := v1.Group("/admin", h.RequireAPIKey, h.AuditAdmin)
+	admin.Post("/users/:userId/adjustments", auditTarget("adjustment.create", auditUserBalance), h.CreateAdjustment)
+	admin.Get("/users/:userId/adjustments", h.ListAdjustments)
+
+	// Scheduled plan changes
+	admin.Post("/users/:userId/package-schedules", auditTarget("package_schedule.create", auditPackageSchedules), h.CreatePackageSchedule)
+	admin.Delete("/users/:userId/package-schedules/:scheduleId", auditTarget("package_schedule.cancel", auditPackageSchedules), h.CancelPackageSchedule)
+
+	// Package catalog
+	admin.Get("/packages", h.ListPackages)
+	admin.Post("/packages", auditTarget("package.create", nil), h.CreatePackage)
+	admin.Get("/packages/:packageId", h.GetPackage)
+	admin.Put("/packages/:packageId", auditTarget("package.update", auditPackage), h.UpdatePackage)
+	admin.Delete("/packages/:packageId", auditTarget("package.deactivate", auditPackage), h.DeactivatePackage)
+	admin.Get("/packages/:packageId/versions", h.ListPackageVersions)
+	admin.Get("/packages/:packageId/versions/:version", h.GetPackageVersion)
+	admin.Get("/packages/:packageId/models", h.GetPackageModels)
+	admin.Put("/packages/:packageId/models", auditTarget("package_models.set", auditPackageModels), h.SetPackageModels)
+	admin.Delete("/packages/:packageId/models", auditTarget("package_models.clear", auditPackageModels), h.ClearPackageModels)
+
+	// Provider and model registry
+	admin.Get("/providers", h.ListProviders)
+	admin.Post("/providers", auditTarget("provider.create", nil), h.CreateProvider)
+	admin.Get("/providers/:providerId", h.GetProvider)
+	admin.Put("/providers/:providerId", auditTarget("provider.update", auditProvider), h.UpdateProvider)
+	admin.Get("/models", h.ListModels)
+	admin.Post("/models", auditTarget("model.create", nil), h.CreateModel)
+	admin.Get("/models/resolve", h.ResolveModel)
+	admin.Get("/models/unknown", h.ListUnknownModels)
+	admin.Get("/models/:modelId", h.GetModel)
+	admin.Put("/models/:modelId", auditTarget("model.update", auditModel), h.UpdateModel)
+
+	// Balance explain and as-of report
+	admin.Get("/users/:userId/balance/explain", h.ExplainBalance)
+	admin.Get("/balances", h.BalanceReport)
+
+	// Ledger quarantine
+	admin.Get("/ledger/quarantine", h.ListQuarantinedEvents)
+	admin.Post("/ledger/quarantine/release", auditTarget("ledger.quarantine_release", nil), h.ReleaseQuarantinedEvents)
+	admin.Post("/users/:userId/ledger/scan", auditTarget("ledger.scan", nil), h.ScanUserLedger)
+
+	// Double-entry journal
+	admin.Get("/ledger/trial-balance", h.GetTrialBalance)
+	admin.Get("/users/:userId/journal", h.ListJournalEntries)
+
+	// Usage analytics
+	admin.Get("/analytics/usage", h.GetUsageAnalytics)
+
+	// Bulk exports
+	admin.Get("/exports/usage-events", h.ExportUsageEvents)
+
+	// Audit log
+	admin.Get("/audit-log", h.ListAuditLog)
+	admin.Get("/audit-log/verify", h.VerifyAuditLog)
+
+	// B2B organizations
+	admin.Post("/orgs", auditTarget("org.create", nil), h.CreateOrganization)
+	admin.Get("/orgs/:orgId", h.GetOrganization)
+	admin.Put("/orgs/:orgId/members/:userId", auditTarget("org_member.set", auditOrganization), h.SetOrgMember)
+	admin.Delete("/orgs/:orgId/members/:userId", auditTarget("org_member.remove", auditOrganization), h.RemoveOrgMember)
+	admin.Get("/orgs/:orgId/schedules", h.ListB2BSchedules)
+	admin.Post("/orgs/:orgId/schedules", auditTarget("b2b_schedule.create", auditB2BSchedules), h.CreateB2BSchedule)
+	admin.Delete("/orgs/:orgId/schedules/:scheduleId", auditTarget("b2b_schedule.cancel", auditB2BSchedules), h.CancelB2BSchedule)
 }
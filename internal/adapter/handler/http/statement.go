@@ -0,0 +1,48 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetStatement returns a monthly statement as JSON, or as a CSV or PDF
+// download with ?format=csv or ?format=pdf.
+func (h *Handler) GetStatement(c *fiber.Ctx) error {
+	userID, month := c.Params("userId"), c.Params("month")
+	format := c.Query("format", "json")
+	if format != "json" && format != "csv" && format != "pdf" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": "format must be json, csv or pdf"})
+	}
+
+	st, err := service.BuildStatement(c.Context(), userID, month)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidMonth) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": err.Error()})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	if format == "json" {
+		return c.Status(fiber.StatusOK).JSON(st)
+	}
+
+	var buf bytes.Buffer
+	contentType := "text/csv; charset=utf-8"
+	if format == "pdf" {
+		contentType = "application/pdf"
+		err = service.WriteStatementPDF(&buf, st)
+	} else {
+		err = service.WriteStatementCSV(&buf, st)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="statement-%s-%s.%s"`, userID, month, format))
+	return c.Status(fiber.StatusOK).Send(buf.Bytes())
+}
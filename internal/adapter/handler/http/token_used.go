@@ -1,267 +1,132 @@
 package http
 
 import (
-	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
-	"net/http"
-	"time"
+	"strconv"
 
-	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
-	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/adapter/client"
 	"munggonegg/credit-service-go/internal/core/domain"
 	"munggonegg/credit-service-go/internal/service"
 
 	"github.com/gofiber/fiber/v2"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/sync/errgroup"
 )
 
-func RecordTokenUsed(c *fiber.Ctx) error {
+// RecordTokenUsed settles a trace synchronously, or with ?async=true queues
+// it and answers 202 Accepted with a job to poll.
+func (h *Handler) RecordTokenUsed(c *fiber.Ctx) error {
 	var payload domain.TokenUsedIn
 	if err := c.BodyParser(&payload); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
 	}
-
-	ctx := c.Context()
-	umpColl := mongodb.GetCollection(config.UserMainPackageColl)
-	balColl := mongodb.GetCollection(config.UserBalanceColl)
-	pkgColl := mongodb.GetCollection(config.PackageMasterV3Coll)
-	uueColl := mongodb.GetCollection(config.UsageEventColl)
-
-	// 1. Parallel Fetching: UserMainPackage and UserBalance
-	var ump domain.UserMainPackage
-	var bal domain.UserBalance
-
-	g, gCtx := errgroup.WithContext(ctx)
-
-	// Fetch Main Package
-	g.Go(func() error {
-		if err := umpColl.FindOne(gCtx, bson.M{"userId": payload.UserID}).Decode(&ump); err != nil {
-			return fmt.Errorf("User has no main package.")
-		}
-		return nil
-	})
-
-	// Fetch Balance
-	g.Go(func() error {
-		if err := balColl.FindOne(gCtx, bson.M{"userId": payload.UserID}).Decode(&bal); err != nil {
-			return fmt.Errorf("No token balance remaining.")
-		}
-		return nil
-	})
-
-	if err := g.Wait(); err != nil {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"detail": err.Error()})
+	if payload.UserID == "" || payload.TraceID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "userId and traceId are required"})
 	}
 
-	// Check if balance is positive
-	if bal.RemainingTokenBalance <= 0 {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"detail": "No token balance remaining."})
-	}
-
-	// 2. Call Portkey (Synchronous)
-	now := time.Now().UTC()
-	queryParams := fmt.Sprintf("trace_id=%s&workspace_slug=%s&time_of_generation_min=2025-08-01T00:00:00Z&time_of_generation_max=%s", payload.TraceID, config.AppConfig.PortkeyWorkspaceSlug, now.Format(time.RFC3339))
-	req, err := http.NewRequest("GET", config.AppConfig.PortkeyURL+"?"+queryParams, nil)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": "Failed to create request"})
-	}
-	req.Header.Set("x-portkey-api-key", config.AppConfig.PortkeyAPIKey)
-
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"detail": fmt.Sprintf("Error connecting to Portkey: %v", err)})
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		var errorBody map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&errorBody); err != nil {
-			return c.Status(resp.StatusCode).JSON(fiber.Map{
-				"detail": fmt.Sprintf("Portkey API error (status %d): unable to decode error response", resp.StatusCode),
-			})
+	if async, _ := strconv.ParseBool(c.Query("async")); async {
+		job, err := h.jobs.Enqueue(c.Context(), payload)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": "Failed to enqueue usage job"})
 		}
-		return c.Status(resp.StatusCode).JSON(fiber.Map{
-			"detail": fmt.Sprintf("Portkey API error (status %d)", resp.StatusCode),
-			"error":  errorBody,
+		statusURL := "/api/v1/usage-jobs/" + job.ID.Hex()
+		c.Location(statusURL)
+		return c.Status(fiber.StatusAccepted).JSON(domain.UsageJobAccepted{
+			JobID:     job.ID.Hex(),
+			Status:    job.Status,
+			StatusURL: statusURL,
 		})
 	}
 
-	var portkeyResp map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&portkeyResp); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": "Failed to decode Portkey response"})
-	}
-
-	rows, ok := portkeyResp["data"].([]interface{})
-	if !ok || len(rows) == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": "No Portkey cost found for traceId."})
-	}
-
-	totalCents := 0.0
-	var aiModel string
-	for _, row := range rows {
-		r, ok := row.(map[string]interface{})
-		if !ok {
-			continue
-		}
-		if aiModel == "" {
-			if m, ok := r["ai_model"].(string); ok {
-				aiModel = m
-			}
-		}
-		if cost, ok := r["cost"]; ok {
-			// Handle cost type safely
-			switch v := cost.(type) {
-			case float64:
-				totalCents += v
-			case int:
-				totalCents += float64(v)
-			}
-		}
+	response, err := h.settler.SettleTokenUsage(c.Context(), payload)
+	if err != nil {
+		return settleError(c, err)
 	}
 
-	if totalCents == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": "No Portkey cost found for traceId."})
-	}
+	return c.Status(fiber.StatusCreated).JSON(response)
+}
 
-	// 3. Fetch Package Master (for conversion ratio)
-	var pkg domain.PackageMaster
-	if err := pkgColl.FindOne(ctx, bson.M{"packageId": ump.PackageID}).Decode(&pkg); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": "Package not found"})
+// RecordTokenUsedBatch settles many traces in one call and reports each
+// item's outcome, so partial failures do not fail the whole batch.
+func (h *Handler) RecordTokenUsedBatch(c *fiber.Ctx) error {
+	var payload domain.TokenUsedBatchIn
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
 	}
-
-	eggThbPrice := 1.0
-	switch v := pkg.ConversionRatio.(type) {
-	case int:
-		eggThbPrice = float64(v)
-	case int32:
-		eggThbPrice = float64(v)
-	case int64:
-		eggThbPrice = float64(v)
-	case float64:
-		eggThbPrice = v
-	case float32:
-		eggThbPrice = float64(v)
+	if len(payload.Items) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "items must not be empty"})
 	}
-	if eggThbPrice == 0 {
-		eggThbPrice = 1.0
+	if len(payload.Items) > h.cfg.BatchMaxItems {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("at most %d items are allowed per batch", h.cfg.BatchMaxItems),
+		})
 	}
-
-	// Calculate Tokens
-	chatCost := totalCents / 100.0
-	websearchCost := 0.0
-	if payload.WebsearchCost != nil {
-		websearchCost = *payload.WebsearchCost
+	for i, item := range payload.Items {
+		if item.UserID == "" || item.TraceID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("items[%d]: userId and traceId are required", i),
+			})
+		}
 	}
 
-	totalCost := chatCost + websearchCost
-	thb := totalCost * config.ThbPerUsd
-	eggTokenFloat := thb / eggThbPrice
-	eggTokenInt := -int(math.Ceil(eggTokenFloat)) // Negative for deduction
-
-	chatTokenInt := -int(math.Ceil((chatCost * config.ThbPerUsd) / eggThbPrice))
-	websearchTokenInt := 0
-	if websearchCost > 0 {
-		websearchTokenInt = -int(math.Ceil((websearchCost * config.ThbPerUsd) / eggThbPrice))
+	results, err := h.settler.SettleTokenUsageBatch(c.Context(), payload.Items, h.cfg.BatchConcurrency)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
 	}
 
-	// 4. Calculate Split (Main vs Topup)
-	// Logic from service.RollupBalances:
-	// if main >= MainDeductionThreshold (100) -> deduct from main first
-	// else -> deduct from topup first
-
-	deduction := int(math.Abs(float64(eggTokenInt)))
-	mainDeduction := 0
-	topupDeduction := 0
-
-	currentMain := bal.MainTokenBalance
-	currentTopup := bal.TopupTokenBalance
-
-	if currentMain >= service.MainDeductionThreshold {
-		if deduction <= currentMain {
-			mainDeduction = deduction
-		} else {
-			mainDeduction = currentMain
-			topupDeduction = deduction - currentMain
-		}
-	} else {
-		if deduction <= currentTopup {
-			topupDeduction = deduction
+	response := domain.TokenUsedBatchResponse{Results: make([]domain.TokenUsedBatchItem, len(results))}
+	for i, r := range results {
+		item := domain.TokenUsedBatchItem{TraceID: r.Item.TraceID, UserID: r.Item.UserID}
+		if r.Err != nil {
+			item.TransactionStatus = "Failed"
+			item.StatusCode, item.Detail = settleStatus(r.Err)
+			response.Failed++
 		} else {
-			topupDeduction = currentTopup
-			mainDeduction = deduction - currentTopup
+			item.TransactionStatus = r.Response.TransactionStatus
+			item.TotalCostUsd = r.Response.TotalCostUsd
+			item.TotalToken = r.Response.TotalToken
+			item.Flags = r.Response.Flags
+			if item.TransactionStatus == service.TxnDuplicate {
+				item.StatusCode = fiber.StatusOK
+				response.Duplicates++
+			} else {
+				item.StatusCode = fiber.StatusCreated
+				response.Succeeded++
+			}
 		}
+		response.Results[i] = item
 	}
 
-	// 5. Atomic Update
-	update := bson.M{
-		"$inc": bson.M{
-			"totalToken":            eggTokenInt,
-			"remainingTokenBalance": eggTokenInt,
-			"mainTokenBalance":      -mainDeduction,
-			"topupTokenBalance":     -topupDeduction,
-		},
-		"$set": bson.M{
-			"updatedAt": time.Now(),
-		},
-	}
-
-	// We use UpdateOne. If the user's balance changed concurrently, this update will still apply the deduction.
-	// This might cause main/topup to go slightly negative if they were near 0, but Total/Remaining will be correct relative to usage.
-	_, err = balColl.UpdateOne(ctx, bson.M{"userId": payload.UserID}, update)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": fmt.Sprintf("DB update failed: %v", err)})
-	}
-
-	// 6. Async Create Usage Event
-	subID := ump.SubscriptionID
-	pkgIDStr := ump.PackageID
-
-	// Convert float64 to Decimal128
-	totalCostDec, _ := primitive.ParseDecimal128(fmt.Sprintf("%.6f", totalCost))
-	chatCostDec, _ := primitive.ParseDecimal128(fmt.Sprintf("%.6f", chatCost))
-	websearchCostDec, _ := primitive.ParseDecimal128(fmt.Sprintf("%.6f", websearchCost))
-
-	doc := domain.UsageEventOut{
-		EventTimeStamp:   time.Now(),
-		UserID:           payload.UserID,
-		EventType:        "Token Used",
-		SubscriptionID:   &subID,
-		PackageID:        &pkgIDStr,
-		EggToken:         eggTokenInt,
-		ChatToken:        &chatTokenInt,
-		WebsearchToken:   &websearchTokenInt,
-		TotalCostUSD:     &totalCostDec,
-		ChatCostUSD:      &chatCostDec,
-		WebsearchCostUSD: &websearchCostDec,
-		TraceID:          &payload.TraceID,
-		AIModel:          &aiModel,
-		AgentID:          payload.AgentID,
-	}
+	return c.Status(fiber.StatusOK).JSON(response)
+}
 
-	// Fire and forget
-	// Synchronous Create Usage Event with Timeout
-	// We use a detached context (context.Background) with a timeout to ensure the insert attempts to complete
-	// even if the client disconnects, as the balance has already been deducted.
-	bgCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// settleError maps a settlement failure onto the response the client sees.
+func settleError(c *fiber.Ctx, err error) error {
+	status, detail := settleStatus(err)
+	body := fiber.Map{"detail": detail}
 
-	if _, err := uueColl.InsertOne(bgCtx, doc); err != nil {
-		// Log error but do not fail the request since deduction succeeded
-		fmt.Printf("Failed to insert usage event: %v\n", err)
+	var apiErr *client.PortkeyAPIError
+	if errors.As(err, &apiErr) && apiErr.Body != nil {
+		body["error"] = apiErr.Body
 	}
+	return c.Status(status).JSON(body)
+}
 
-	// 7. Return simplified response
-	response := domain.TokenUsedResponse{
-		TraceID:           payload.TraceID,
-		TotalCostUsd:      fmt.Sprintf("%.6f", totalCost),
-		TotalToken:        eggTokenInt,
-		TransactionStatus: "Success",
+func settleStatus(err error) (int, string) {
+	var apiErr *client.PortkeyAPIError
+
+	switch {
+	case errors.Is(err, service.ErrNoMainPackage), errors.Is(err, service.ErrNoTokenBalance),
+		errors.Is(err, service.ErrOrgPoolExhausted), errors.Is(err, service.ErrMemberCapReached):
+		return fiber.StatusForbidden, err.Error()
+	case errors.Is(err, client.ErrTraceNotFound):
+		return fiber.StatusNotFound, err.Error()
+	case errors.Is(err, client.ErrPortkeyUnavailable):
+		return fiber.StatusBadGateway, err.Error()
+	case errors.Is(err, service.ErrDuplicateInBatch):
+		return fiber.StatusConflict, err.Error()
+	case errors.As(err, &apiErr):
+		return apiErr.StatusCode, apiErr.Error()
+	default:
+		return fiber.StatusInternalServerError, err.Error()
 	}
-
-	return c.Status(fiber.StatusCreated).JSON(response)
 }
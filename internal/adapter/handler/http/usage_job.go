@@ -0,0 +1,20 @@
+package http
+
+import (
+	"errors"
+
+	"munggonegg/credit-service-go/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handler) GetUsageJob(c *fiber.Ctx) error {
+	job, err := h.jobs.Get(c.Context(), c.Params("id"))
+	if errors.Is(err, service.ErrJobNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"detail": err.Error()})
+	}
+	return c.Status(fiber.StatusOK).JSON(job)
+}
@@ -15,11 +15,18 @@ import (
 var Client *mongo.Client
 var DB *mongo.Database
 
-func Connect() {
+// Connect connects to MongoDB and ensures the service's indexes.
+func Connect(cfg *config.Config) {
+	Dial(cfg)
+	EnsureIndexes()
+}
+
+// Dial connects to MongoDB without touching the schema.
+func Dial(cfg *config.Config) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	clientOptions := options.Client().ApplyURI(config.AppConfig.MongoURL)
+	clientOptions := options.Client().ApplyURI(cfg.MongoURL)
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		log.Fatal(err)
@@ -32,10 +39,8 @@ func Connect() {
 	}
 
 	Client = client
-	DB = client.Database(config.AppConfig.MongoDBName)
+	DB = client.Database(cfg.MongoDBName)
 	log.Println("Connected to MongoDB")
-
-	EnsureIndexes()
 }
 
 func EnsureIndexes() {
@@ -44,10 +49,44 @@ func EnsureIndexes() {
 
 	createIndex(ctx, config.UsageEventColl, bson.D{{Key: "userId", Value: 1}}, false)
 	createIndex(ctx, config.UserBalanceColl, bson.D{{Key: "userId", Value: 1}}, true)
+	createIndex(ctx, config.UserBalanceColl, bson.D{{Key: "lotsStale", Value: 1}}, false)
 	createIndex(ctx, config.UserMainPackageColl, bson.D{{Key: "userId", Value: 1}}, true)
 	createIndex(ctx, config.UserTopupPackageColl, bson.D{{Key: "userId", Value: 1}}, true)
 	createIndex(ctx, config.TopupPackageEventColl, bson.D{{Key: "topupId", Value: 1}}, true)
 	createIndex(ctx, config.SubsPackageEventColl, bson.D{{Key: "subscriptionEventId", Value: 1}}, true)
+	createIndex(ctx, config.PackageMasterV3Coll, bson.D{{Key: "packageId", Value: 1}}, true)
+	createIndex(ctx, config.PackageVersionColl, bson.D{{Key: "packageId", Value: 1}, {Key: "version", Value: 1}}, true)
+	createIndex(ctx, config.ProviderMasterColl, bson.D{{Key: "providerId", Value: 1}}, true)
+	createIndex(ctx, config.ProviderModelsColl, bson.D{{Key: "modelId", Value: 1}}, true)
+	createIndex(ctx, config.ProviderModelsColl, bson.D{{Key: "aliases", Value: 1}}, true)
+	createIndex(ctx, config.PackageBestModelsColl, bson.D{{Key: "packageId", Value: 1}}, true)
+	createIndex(ctx, config.OrganizationColl, bson.D{{Key: "orgId", Value: 1}}, true)
+	createIndex(ctx, config.OrgMemberColl, bson.D{{Key: "userId", Value: 1}}, true)
+	createIndex(ctx, config.B2BScheduleColl, bson.D{{Key: "status", Value: 1}, {Key: "nextRunAt", Value: 1}}, false)
+	createPartialIndex(ctx, config.OrgPoolEventColl, bson.D{{Key: "scheduleId", Value: 1}, {Key: "periodStart", Value: 1}}, bson.M{"eventType": "Fund"})
+	createPartialIndex(ctx, config.PackageScheduleColl, bson.D{{Key: "userId", Value: 1}}, bson.M{"status": "pending"})
+	createIndex(ctx, config.PackageScheduleColl, bson.D{{Key: "status", Value: 1}, {Key: "effectiveAt", Value: 1}}, false)
+	createPartialIndex(ctx, config.UsageEventColl, bson.D{{Key: "userId", Value: 1}, {Key: "renewalPeriod", Value: 1}, {Key: "eventType", Value: 1}}, bson.M{"renewalPeriod": bson.M{"$exists": true}})
+	createPartialIndex(ctx, config.UsageEventColl, bson.D{{Key: "scheduleId", Value: 1}, {Key: "eventType", Value: 1}}, bson.M{"scheduleId": bson.M{"$exists": true}})
+	createPartialIndex(ctx, config.UsageEventColl, bson.D{{Key: "traceId", Value: 1}}, bson.M{"eventType": "Token Used"})
+	createIndex(ctx, config.PaymentColl, bson.D{{Key: "paymentId", Value: 1}}, true)
+	createPartialIndex(ctx, config.PaymentColl, bson.D{{Key: "userId", Value: 1}, {Key: "renewalPeriod", Value: 1}}, bson.M{"renewalPeriod": bson.M{"$exists": true}})
+	createIndex(ctx, config.SubsColl, bson.D{{Key: "subscriptionId", Value: 1}}, true)
+	createPartialIndex(ctx, config.UsageEventColl, bson.D{{Key: "paymentId", Value: 1}, {Key: "eventType", Value: 1}}, bson.M{"paymentId": bson.M{"$exists": true}})
+	createPartialIndex(ctx, config.UsageEventColl, bson.D{{Key: "lotId", Value: 1}, {Key: "eventType", Value: 1}}, bson.M{"lotId": bson.M{"$exists": true}})
+	createIndex(ctx, config.CreditLotColl, bson.D{{Key: "userId", Value: 1}, {Key: "grantedAt", Value: 1}}, false)
+	createIndex(ctx, config.CreditLotColl, bson.D{{Key: "status", Value: 1}, {Key: "expiresAt", Value: 1}}, false)
+	createIndex(ctx, config.JournalEntryColl, bson.D{{Key: "userId", Value: 1}, {Key: "eventAt", Value: 1}}, false)
+	createIndex(ctx, config.AuditLogColl, bson.D{{Key: "seq", Value: 1}}, true)
+	createIndex(ctx, config.AuditLogColl, bson.D{{Key: "actor", Value: 1}, {Key: "seq", Value: -1}}, false)
+	createIndex(ctx, config.UsageDailyRollupColl, bson.D{{Key: "day", Value: 1}, {Key: "userId", Value: 1}, {Key: "agentId", Value: 1}, {Key: "aiModel", Value: 1}}, true)
+	createIndex(ctx, config.UsageEventColl, bson.D{{Key: "eventType", Value: 1}, {Key: "eventTimeStamp", Value: 1}}, false)
+	createIndex(ctx, config.BalanceSnapshotColl, bson.D{{Key: "userId", Value: 1}}, true)
+	createIndex(ctx, config.BalanceMonthEndColl, bson.D{{Key: "userId", Value: 1}, {Key: "through", Value: -1}}, true)
+	createIndex(ctx, config.UsageEventColl, bson.D{{Key: "userId", Value: 1}, {Key: "eventTimeStamp", Value: 1}, {Key: "_id", Value: 1}}, false)
+	createIndex(ctx, config.LedgerQuarantineColl, bson.D{{Key: "eventId", Value: 1}}, true)
+	createIndex(ctx, config.UsageJobColl, bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}, false)
+	createPartialIndex(ctx, config.UsageJobColl, bson.D{{Key: "dedupKey", Value: 1}}, bson.M{"dedupKey": bson.M{"$exists": true}})
 }
 
 func createIndex(ctx context.Context, collectionName string, keys bson.D, unique bool) {
@@ -62,6 +101,19 @@ func createIndex(ctx context.Context, collectionName string, keys bson.D, unique
 	}
 }
 
+// createPartialIndex creates a unique index limited to documents matching filter.
+func createPartialIndex(ctx context.Context, collectionName string, keys bson.D, filter bson.M) {
+	collection := DB.Collection(collectionName)
+	indexModel := mongo.IndexModel{
+		Keys:    keys,
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(filter),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, indexModel)
+	if err != nil {
+		log.Printf("Index creation warning on %s: %v", collectionName, err)
+	}
+}
+
 func GetCollection(name string) *mongo.Collection {
 	return DB.Collection(name)
 }
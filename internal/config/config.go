@@ -1,23 +1,62 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
+// Config is the typed service configuration. Each field is resolved, in
+// increasing order of precedence, from the defaults, the optional YAML file,
+// the environment (including .env) and finally a `<ENV>_FILE` secret file.
 type Config struct {
-	MongoURL             string
-	MongoDBName          string
-	PortkeyAPIKey        string
-	PortkeyURL           string
-	PortkeyWorkspaceSlug string
-	XAPIKey              string
+	Port                 int           `yaml:"port" env:"PORT"`
+	MongoURL             string        `yaml:"mongoUrl" env:"MONGO_URL" secret:"true"`
+	MongoDBName          string        `yaml:"mongoDbName" env:"MONGO_DB_NAME"`
+	PortkeyURL           string        `yaml:"portkeyUrl" env:"PORTKEY_URL"`
+	PortkeyAPIKey        string        `yaml:"portkeyApiKey" env:"PORTKEY_API_KEY" secret:"true"`
+	PortkeyWorkspaceSlug string        `yaml:"portkeyWorkspaceSlug" env:"PORTKEY_WORKSPACE_SLUG"`
+	PortkeyTimeout       time.Duration `yaml:"portkeyTimeout" env:"PORTKEY_TIMEOUT"`
+	XAPIKey              string        `yaml:"xApiKey" env:"X_API_KEY" secret:"true"`
+	// AdminAPIKeys lists further API keys as comma-separated "id:key"
+	// pairs. The ID is recorded as the actor in the audit log; X_API_KEY is
+	// recorded as "default".
+	AdminAPIKeys         string        `yaml:"adminApiKeys" env:"ADMIN_API_KEYS" secret:"true"`
+	UsageJobWorkers      int           `yaml:"usageJobWorkers" env:"USAGE_JOB_WORKERS"`
+	UsageJobMaxAttempts  int           `yaml:"usageJobMaxAttempts" env:"USAGE_JOB_MAX_ATTEMPTS"`
+	UsageJobPollInterval time.Duration `yaml:"usageJobPollInterval" env:"USAGE_JOB_POLL_INTERVAL"`
+	BatchConcurrency     int           `yaml:"batchConcurrency" env:"BATCH_CONCURRENCY"`
+	BatchMaxItems        int           `yaml:"batchMaxItems" env:"BATCH_MAX_ITEMS"`
+	// EntitlementMode is "flag" or "premium" for usage on models the
+	// user's package does not include.
+	EntitlementMode              string  `yaml:"entitlementMode" env:"ENTITLEMENT_MODE"`
+	EntitlementPremiumMultiplier float64 `yaml:"entitlementPremiumMultiplier" env:"ENTITLEMENT_PREMIUM_MULTIPLIER"`
+	// SchedulerInterval is how often scheduled work (e.g. B2B funding) runs.
+	SchedulerInterval time.Duration `yaml:"schedulerInterval" env:"SCHEDULER_INTERVAL"`
+	// PaymentWebhookSecret signs payment gateway webhooks. The webhook is
+	// disabled while it is empty.
+	PaymentWebhookSecret    string        `yaml:"paymentWebhookSecret" env:"PAYMENT_WEBHOOK_SECRET" secret:"true"`
+	PaymentWebhookTolerance time.Duration `yaml:"paymentWebhookTolerance" env:"PAYMENT_WEBHOOK_TOLERANCE"`
+	// AnalyticsRollupLookbackDays is how many past days of daily usage
+	// rollups are rebuilt on each run, to pick up refunds of older usage.
+	AnalyticsRollupLookbackDays int `yaml:"analyticsRollupLookbackDays" env:"ANALYTICS_ROLLUP_LOOKBACK_DAYS"`
+	// WebsearchPriceUSD is what quotes assume one web search costs.
+	WebsearchPriceUSD float64 `yaml:"websearchPriceUsd" env:"WEBSEARCH_PRICE_USD"`
+	// BalanceStreamSource is "local" to stream balance changes written by
+	// this instance, or "changestream" to follow user_balance through a
+	// MongoDB change stream and see the writes of every replica.
+	BalanceStreamSource string `yaml:"balanceStreamSource" env:"BALANCE_STREAM_SOURCE"`
 }
 
-var AppConfig Config
-
 const (
 	PaymentColl           = "payment_transactions"
 	SubsColl              = "subscription_transactions"
@@ -33,25 +72,291 @@ const (
 	B2BScheduleColl       = "b2b_package_schedule"
 	TopupPackageEventColl = "topup_package_event"
 	SubsPackageEventColl  = "subscription_package_event"
+	UsageJobColl          = "usage_jobs"
+	PackageVersionColl    = "package_master_versions"
+	OrganizationColl      = "organizations"
+	OrgMemberColl         = "organization_members"
+	OrgPoolEventColl      = "organization_pool_event"
+	UsageDailyRollupColl  = "usage_daily_rollup"
+	UsageRollupDayColl    = "usage_rollup_day"
+	BalanceSnapshotColl   = "user_balance_snapshot"
+	BalanceMonthEndColl   = "user_balance_month_end"
+	LedgerQuarantineColl  = "ledger_quarantine"
+	CreditLotColl         = "user_credit_lot"
+	JournalEntryColl      = "journal_entry"
+	AuditLogColl          = "admin_audit_log"
 
 	ThbPerUsd = 35.0
 )
 
-func LoadConfig() {
+const redacted = "********"
+
+// Default returns the configuration used before any source is applied.
+func Default() *Config {
+	return &Config{
+		Port:                 3000,
+		PortkeyTimeout:       15 * time.Second,
+		UsageJobWorkers:      4,
+		UsageJobMaxAttempts:  20,
+		UsageJobPollInterval: time.Second,
+		BatchConcurrency:     8,
+		BatchMaxItems:        100,
+
+		EntitlementMode:              "flag",
+		EntitlementPremiumMultiplier: 2.0,
+		SchedulerInterval:            time.Minute,
+		PaymentWebhookTolerance:      5 * time.Minute,
+		AnalyticsRollupLookbackDays:  2,
+		WebsearchPriceUSD:            0.01,
+		BalanceStreamSource:          "local",
+	}
+}
+
+// Load builds the configuration from all sources. path points to an optional
+// YAML file; when empty, CONFIG_FILE is consulted instead. Load does not
+// validate the result, call Validate for that.
+func Load(path string) (*Config, error) {
 	if err := godotenv.Load(); err != nil {
 		log.Println("No .env file found, using system environment variables")
 	}
 
-	AppConfig = Config{
-		MongoURL:             os.Getenv("MONGO_URL"),
-		MongoDBName:          os.Getenv("MONGO_DB_NAME"),
-		PortkeyAPIKey:        os.Getenv("PORTKEY_API_KEY"),
-		PortkeyURL:           os.Getenv("PORTKEY_URL"),
-		PortkeyWorkspaceSlug: os.Getenv("PORTKEY_WORKSPACE_SLUG"),
-		XAPIKey:              os.Getenv("X_API_KEY"),
+	cfg := Default()
+
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := cfg.loadYAML(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) loadYAML(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
 	}
+	return nil
+}
+
+// loadEnv overrides fields from their `env` tag. NAME_FILE takes precedence
+// over NAME so Docker and Kubernetes secrets can be mounted as files.
+func (c *Config) loadEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		raw, ok, err := lookupEnv(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if err := setField(v.Field(i), raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func lookupEnv(name string) (string, bool, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("read %s_FILE: %w", name, err)
+		}
+		return strings.TrimSpace(string(b)), true, nil
+	}
+	v, ok := os.LookupEnv(name)
+	return v, ok, nil
+}
+
+func setField(f reflect.Value, raw string) error {
+	if f.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported config type %s", f.Type())
+	}
+	return nil
+}
+
+// Validate reports every invalid field at once.
+func (c *Config) Validate() error {
+	var errs []error
 
-	if AppConfig.MongoURL == "" || AppConfig.MongoDBName == "" {
-		log.Fatal("Please set MONGO_URL and MONGO_DB_NAME env vars.")
+	required := []struct{ name, value string }{
+		{"MONGO_URL", c.MongoURL},
+		{"MONGO_DB_NAME", c.MongoDBName},
+		{"PORTKEY_URL", c.PortkeyURL},
+		{"PORTKEY_API_KEY", c.PortkeyAPIKey},
+		{"PORTKEY_WORKSPACE_SLUG", c.PortkeyWorkspaceSlug},
+		{"X_API_KEY", c.XAPIKey},
 	}
+	for _, r := range required {
+		if strings.TrimSpace(r.value) == "" {
+			errs = append(errs, fmt.Errorf("%s is required", r.name))
+		}
+	}
+
+	if c.MongoURL != "" {
+		if u, err := url.Parse(c.MongoURL); err != nil || (u.Scheme != "mongodb" && u.Scheme != "mongodb+srv") {
+			errs = append(errs, errors.New("MONGO_URL must be a mongodb:// or mongodb+srv:// URL"))
+		}
+	}
+	if c.PortkeyURL != "" {
+		if u, err := url.Parse(c.PortkeyURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("PORTKEY_URL must be an absolute http(s) URL"))
+		}
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT must be between 1 and 65535, got %d", c.Port))
+	}
+	if c.PortkeyTimeout <= 0 {
+		errs = append(errs, errors.New("PORTKEY_TIMEOUT must be positive"))
+	}
+	if c.UsageJobWorkers < 1 {
+		errs = append(errs, errors.New("USAGE_JOB_WORKERS must be at least 1"))
+	}
+	if c.UsageJobMaxAttempts < 1 {
+		errs = append(errs, errors.New("USAGE_JOB_MAX_ATTEMPTS must be at least 1"))
+	}
+	if c.UsageJobPollInterval <= 0 {
+		errs = append(errs, errors.New("USAGE_JOB_POLL_INTERVAL must be positive"))
+	}
+	if c.BatchConcurrency < 1 {
+		errs = append(errs, errors.New("BATCH_CONCURRENCY must be at least 1"))
+	}
+	if c.BatchMaxItems < 1 {
+		errs = append(errs, errors.New("BATCH_MAX_ITEMS must be at least 1"))
+	}
+	if c.EntitlementMode != "flag" && c.EntitlementMode != "premium" {
+		errs = append(errs, fmt.Errorf("ENTITLEMENT_MODE must be flag or premium, got %q", c.EntitlementMode))
+	}
+	if c.EntitlementPremiumMultiplier < 1 {
+		errs = append(errs, errors.New("ENTITLEMENT_PREMIUM_MULTIPLIER must be at least 1"))
+	}
+	if c.SchedulerInterval <= 0 {
+		errs = append(errs, errors.New("SCHEDULER_INTERVAL must be positive"))
+	}
+	if c.PaymentWebhookTolerance <= 0 {
+		errs = append(errs, errors.New("PAYMENT_WEBHOOK_TOLERANCE must be positive"))
+	}
+	if c.AnalyticsRollupLookbackDays < 0 {
+		errs = append(errs, errors.New("ANALYTICS_ROLLUP_LOOKBACK_DAYS must not be negative"))
+	}
+	if c.WebsearchPriceUSD < 0 {
+		errs = append(errs, errors.New("WEBSEARCH_PRICE_USD must not be negative"))
+	}
+	if c.BalanceStreamSource != "local" && c.BalanceStreamSource != "changestream" {
+		errs = append(errs, fmt.Errorf("BALANCE_STREAM_SOURCE must be local or changestream, got %q", c.BalanceStreamSource))
+	}
+	if _, err := c.APIKeys(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the configuration with secret fields masked.
+func (c *Config) Redacted() *Config {
+	out := *c
+	v := reflect.ValueOf(&out).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("secret") != "true" {
+			continue
+		}
+		if f := v.Field(i); f.Kind() == reflect.String && f.String() != "" {
+			f.SetString(redacted)
+		}
+	}
+	return &out
+}
+
+// DefaultAPIKeyID identifies X_API_KEY in the audit log.
+const DefaultAPIKeyID = "default"
+
+// APIKeys maps each accepted API key to its ID: X_API_KEY to
+// DefaultAPIKeyID and every ADMIN_API_KEYS pair to its own ID.
+func (c *Config) APIKeys() (map[string]string, error) {
+	keys := map[string]string{}
+	if c.XAPIKey != "" {
+		keys[c.XAPIKey] = DefaultAPIKeyID
+	}
+	ids := map[string]bool{DefaultAPIKeyID: true}
+	for _, pair := range strings.Split(c.AdminAPIKeys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, key, ok := strings.Cut(pair, ":")
+		id, key = strings.TrimSpace(id), strings.TrimSpace(key)
+		if !ok || id == "" || key == "" {
+			return nil, errors.New(`ADMIN_API_KEYS must be comma-separated "id:key" pairs`)
+		}
+		if ids[id] {
+			return nil, fmt.Errorf("ADMIN_API_KEYS uses the key ID %q more than once", id)
+		}
+		if _, dup := keys[key]; dup {
+			return nil, fmt.Errorf("ADMIN_API_KEYS gives key ID %q a key that is already in use", id)
+		}
+		ids[id] = true
+		keys[key] = id
+	}
+	return keys, nil
+}
+
+// Addr is the listen address for the HTTP server.
+func (c *Config) Addr() string {
+	return fmt.Sprintf(":%d", c.Port)
 }
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets every variable Load reads, restoring them after the test.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	os.Unsetenv("CONFIG_FILE")
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		for _, n := range []string{name, name + "_FILE"} {
+			t.Setenv(n, "")
+			os.Unsetenv(n)
+		}
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		env      map[string]string
+		files    map[string]string
+		wantPort int
+		wantKey  string
+	}{
+		{name: "defaults", wantPort: 3000},
+		{name: "yaml over defaults", yaml: "port: 4000\nxApiKey: from-yaml\n", wantPort: 4000, wantKey: "from-yaml"},
+		{name: "env over yaml", yaml: "port: 4000\nxApiKey: from-yaml\n", env: map[string]string{"PORT": "5000", "X_API_KEY": "from-env"}, wantPort: 5000, wantKey: "from-env"},
+		{name: "file over env", yaml: "xApiKey: from-yaml\n", env: map[string]string{"X_API_KEY": "from-env"}, files: map[string]string{"X_API_KEY": "from-file\n"}, wantPort: 3000, wantKey: "from-file"},
+		{name: "file over yaml", yaml: "port: 4000\n", files: map[string]string{"PORT": " 6000 "}, wantPort: 6000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			for k, v := range tt.files {
+				t.Setenv(k+"_FILE", writeFile(t, k, v))
+			}
+			path := ""
+			if tt.yaml != "" {
+				path = writeFile(t, "config.yaml", tt.yaml)
+			}
+
+			cfg, err := Load(path)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if cfg.Port != tt.wantPort || cfg.XAPIKey != tt.wantKey {
+				t.Errorf("port %d key %q, want %d %q", cfg.Port, cfg.XAPIKey, tt.wantPort, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.yaml", "schedulerInterval: 30s\nentitlementPremiumMultiplier: 1.5\n"))
+
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.SchedulerInterval != 30*time.Second || cfg.EntitlementPremiumMultiplier != 1.5 {
+		t.Errorf("interval %v multiplier %v", cfg.SchedulerInterval, cfg.EntitlementPremiumMultiplier)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "unknown yaml key", yaml: "prot: 4000\n", wantErr: "field prot not found"},
+		{name: "yaml type mismatch", yaml: "port: many\n", wantErr: "parse config file"},
+		{name: "bad int", env: map[string]string{"PORT": "abc"}, wantErr: "PORT"},
+		{name: "bad duration", env: map[string]string{"PORTKEY_TIMEOUT": "15"}, wantErr: "PORTKEY_TIMEOUT"},
+		{name: "bad float", env: map[string]string{"WEBSEARCH_PRICE_USD": "cheap"}, wantErr: "WEBSEARCH_PRICE_USD"},
+		{name: "missing secret file", env: map[string]string{"MONGO_URL_FILE": "/nonexistent/mongo-url"}, wantErr: "read MONGO_URL_FILE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := ""
+			if tt.yaml != "" {
+				path = writeFile(t, "config.yaml", tt.yaml)
+			}
+			_, err := Load(path)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func validConfig() *Config {
+	cfg := Default()
+	cfg.MongoURL = "mongodb://localhost:27017"
+	cfg.MongoDBName = "credit"
+	cfg.PortkeyURL = "https://api.portkey.ai"
+	cfg.PortkeyAPIKey = "pk"
+	cfg.PortkeyWorkspaceSlug = "ws"
+	cfg.XAPIKey = "key"
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{name: "srv url and admin keys", modify: func(c *Config) {
+			c.MongoURL = "mongodb+srv://cluster.example.net"
+			c.AdminAPIKeys = "ops:k1, billing:k2"
+		}},
+		{name: "missing required fields", modify: func(c *Config) {
+			c.MongoURL, c.XAPIKey = "", " "
+		}, want: []string{"MONGO_URL is required", "X_API_KEY is required"}},
+		{name: "bad urls", modify: func(c *Config) {
+			c.MongoURL, c.PortkeyURL = "postgres://db", "api.portkey.ai"
+		}, want: []string{"MONGO_URL must be", "PORTKEY_URL must be"}},
+		{name: "out of range numbers", modify: func(c *Config) {
+			c.Port, c.UsageJobWorkers, c.EntitlementPremiumMultiplier = 70000, 0, 0.5
+		}, want: []string{"PORT must be", "USAGE_JOB_WORKERS", "ENTITLEMENT_PREMIUM_MULTIPLIER"}},
+		{name: "bad durations", modify: func(c *Config) {
+			c.SchedulerInterval, c.PaymentWebhookTolerance = 0, -time.Second
+		}, want: []string{"SCHEDULER_INTERVAL", "PAYMENT_WEBHOOK_TOLERANCE"}},
+		{name: "unknown modes", modify: func(c *Config) {
+			c.EntitlementMode, c.BalanceStreamSource = "block", "redis"
+		}, want: []string{"ENTITLEMENT_MODE", "BALANCE_STREAM_SOURCE"}},
+		{name: "malformed admin keys", modify: func(c *Config) {
+			c.AdminAPIKeys = "ops"
+		}, want: []string{"ADMIN_API_KEYS"}},
+		{name: "admin key id reused", modify: func(c *Config) {
+			c.AdminAPIKeys = "default:other"
+		}, want: []string{"more than once"}},
+		{name: "admin key reused", modify: func(c *Config) {
+			c.AdminAPIKeys = "ops:key"
+		}, want: []string{"already in use"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("Validate = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate = nil, want %v", tt.want)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("Validate = %v, want it to mention %q", err, w)
+				}
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := validConfig()
+	cfg.AdminAPIKeys = "ops:k1"
+	cfg.PaymentWebhookSecret = ""
+
+	r := cfg.Redacted()
+	for name, got := range map[string]string{
+		"MongoURL":      r.MongoURL,
+		"PortkeyAPIKey": r.PortkeyAPIKey,
+		"XAPIKey":       r.XAPIKey,
+		"AdminAPIKeys":  r.AdminAPIKeys,
+	} {
+		if got != redacted {
+			t.Errorf("%s = %q, want it redacted", name, got)
+		}
+	}
+	if r.PaymentWebhookSecret != "" {
+		t.Errorf("unset secret = %q, want it left empty", r.PaymentWebhookSecret)
+	}
+	if r.MongoDBName != "credit" || r.PortkeyURL != cfg.PortkeyURL || r.Port != cfg.Port {
+		t.Errorf("non-secret fields changed: %+v", r)
+	}
+	if cfg.XAPIKey != "key" || cfg.MongoURL != "mongodb://localhost:27017" {
+		t.Error("Redacted changed the original configuration")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	cfg := validConfig()
+	cfg.AdminAPIKeys = " ops : k1 ,, billing:k2"
+	keys, err := cfg.APIKeys()
+	if err != nil {
+		t.Fatalf("APIKeys: %v", err)
+	}
+	want := map[string]string{"key": DefaultAPIKeyID, "k1": "ops", "k2": "billing"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("APIKeys = %v, want %v", keys, want)
+	}
+}
@@ -0,0 +1,54 @@
+package domain
+
+import (
+	"time"
+)
+
+const (
+	AnalyticsDay   = "day"
+	AnalyticsWeek  = "week"
+	AnalyticsMonth = "month"
+
+	AnalyticsByUser  = "user"
+	AnalyticsByAgent = "agent"
+	AnalyticsByModel = "model"
+
+	AnalyticsSourceAuto   = "auto"
+	AnalyticsSourceRaw    = "raw"
+	AnalyticsSourceRollup = "rollup"
+)
+
+// UsageAnalyticsQuery selects and groups Token Used events. Interval is
+// empty or one of day, week and month; GroupBy holds user, agent and model.
+type UsageAnalyticsQuery struct {
+	From     time.Time
+	To       time.Time
+	Interval string
+	GroupBy  []string
+	UserID   string
+	AgentID  string
+	AIModel  string
+	Source   string
+}
+
+// UsageAnalyticsRow is one group. Costs are exact Decimal128 sums rendered
+// as strings.
+type UsageAnalyticsRow struct {
+	Period           *time.Time `json:"period,omitempty" bson:"period,omitempty"`
+	UserID           string     `json:"userId,omitempty" bson:"userId,omitempty"`
+	AgentID          string     `json:"agentId,omitempty" bson:"agentId,omitempty"`
+	AIModel          string     `json:"aiModel,omitempty" bson:"aiModel,omitempty"`
+	Count            int        `json:"count" bson:"count"`
+	EggToken         int        `json:"eggToken" bson:"eggToken"`
+	ChatToken        int        `json:"chatToken" bson:"chatToken"`
+	WebsearchToken   int        `json:"websearchToken" bson:"websearchToken"`
+	RefundedToken    int        `json:"refundedToken" bson:"refundedToken"`
+	TotalCostUSD     string     `json:"totalCostUsd" bson:"-"`
+	ChatCostUSD      string     `json:"chatCostUsd" bson:"-"`
+	WebsearchCostUSD string     `json:"websearchCostUsd" bson:"-"`
+}
+
+type UsageAnalyticsResponse struct {
+	Source string              `json:"source"`
+	Items  []UsageAnalyticsRow `json:"items"`
+}
@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditEntry records one mutating admin call. Each call gets a pending
+// entry, written before it runs, and an entry with its outcome that points
+// back at the pending one. Entries form a hash chain: each carries the hash
+// of the entry before it, and its own hash covers every other field, so
+// editing, removing or reordering entries breaks the chain from that point
+// on.
+type AuditEntry struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	Seq       int64              `json:"seq" bson:"seq"`
+	Timestamp time.Time          `json:"timestamp" bson:"timestamp"`
+	// Pending marks the entry written before the call ran. It has no
+	// action, target, status or states yet.
+	Pending bool `json:"pending,omitempty" bson:"pending,omitempty"`
+	// Completes is the seq of the pending entry this outcome belongs to.
+	Completes *int64 `json:"completes,omitempty" bson:"completes,omitempty"`
+	// Actor is the ID of the API key that made the call.
+	Actor     string            `json:"actor" bson:"actor"`
+	Action    string            `json:"action" bson:"action"`
+	Method    string            `json:"method" bson:"method"`
+	Path      string            `json:"path" bson:"path"`
+	Target    map[string]string `json:"target,omitempty" bson:"target,omitempty"`
+	Status    int               `json:"status" bson:"status"`
+	RequestID string            `json:"requestId,omitempty" bson:"requestId,omitempty"`
+	Request   json.RawMessage   `json:"request,omitempty" bson:"request,omitempty"`
+	Before    json.RawMessage   `json:"before,omitempty" bson:"before,omitempty"`
+	After     json.RawMessage   `json:"after,omitempty" bson:"after,omitempty"`
+	Diff      []AuditChange     `json:"diff,omitempty" bson:"diff,omitempty"`
+	PrevHash  string            `json:"prevHash" bson:"prevHash"`
+	Hash      string            `json:"hash" bson:"hash"`
+}
+
+// AuditChange is one field that differs between an entry's before and
+// after states. Path is the dotted JSON path of the field; a value that
+// was added or removed has no Before or After.
+type AuditChange struct {
+	Path   string          `json:"path" bson:"path"`
+	Before json.RawMessage `json:"before,omitempty" bson:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+// ComputeHash is the SHA-256 of the entry's JSON with Hash left empty. The
+// JSON values must be compact and the timestamp in UTC milliseconds, as
+// stored, for the hash to match after a round trip through MongoDB.
+func (e AuditEntry) ComputeHash() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditFilter selects audit entries. Zero fields match everything; Target
+// matches entries whose route parameter TargetKey equals it.
+type AuditFilter struct {
+	Actor     string
+	Action    string
+	TargetKey string
+	Target    string
+	From      time.Time
+	To        time.Time
+	Limit     int64
+}
+
+// AuditVerification is the result of checking the hash chain. BrokenAt is
+// the sequence number of the first entry that does not follow from the one
+// before it. LastHash can be kept elsewhere to detect removal of the newest
+// entries, which the chain alone cannot show. Unfinished lists the pending
+// entries no outcome points at: calls still running, or whose outcome
+// could not be written.
+type AuditVerification struct {
+	Entries    int64     `json:"entries"`
+	Valid      bool      `json:"valid"`
+	LastHash   string    `json:"lastHash,omitempty"`
+	BrokenAt   *int64    `json:"brokenAt,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Unfinished []int64   `json:"unfinished,omitempty"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+}
@@ -0,0 +1,50 @@
+package domain
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// BalanceSnapshot is a user's replayed balance up to and including the
+// event LastEventID. Recomputes resume from it instead of replaying the
+// whole event log.
+type BalanceSnapshot struct {
+	UserID             string             `json:"userId" bson:"userId"`
+	MainToken          int                `json:"mainToken" bson:"mainToken"`
+	TopupToken         int                `json:"topupToken" bson:"topupToken"`
+	LastEventTimeStamp time.Time          `json:"lastEventTimeStamp" bson:"lastEventTimeStamp"`
+	LastEventID        primitive.ObjectID `json:"lastEventId" bson:"lastEventId"`
+	EventCount         int                `json:"eventCount" bson:"eventCount"`
+	// Lots are the active credit lots at the snapshot and the used-up ones
+	// a refund may still restore.
+	Lots []CreditLot `json:"lots,omitempty" bson:"lots,omitempty"`
+	// Accounts is what the user's main and topup journal accounts held
+	// through LastEventID, so their balance only needs the entries after it.
+	Accounts Balance `json:"accounts" bson:"accounts"`
+	// Through is set on month-end snapshots, which hold only the balance:
+	// they cover the events before the month that starts at Through.
+	Through *time.Time `json:"through,omitempty" bson:"through,omitempty"`
+	// Schema is the BalanceSnapshotSchema the snapshot was written with.
+	// Older snapshots lack state a replay now keeps and are rebuilt.
+	Schema    int       `json:"schema" bson:"schema"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// BalanceSnapshotSchema is bumped whenever replays start keeping state an
+// older snapshot lacks: 1 added credit lots, 2 the journal, whose entries
+// before a snapshot are never posted again, 3 the used-up lots and 4 the
+// journal account totals.
+const BalanceSnapshotSchema = 4
+
+// BalanceAsOf is a user's balance replayed up to and including AsOf. The
+// current balance is the stored one instead (Stored), as of its last update.
+type BalanceAsOf struct {
+	UserID       string    `json:"userId"`
+	AsOf         time.Time `json:"asOf"`
+	MainToken    int       `json:"mainToken"`
+	TopupToken   int       `json:"topupToken"`
+	TotalToken   int       `json:"totalToken"`
+	FromSnapshot bool      `json:"fromSnapshot"`
+	Stored       bool      `json:"stored,omitempty"`
+}
@@ -0,0 +1,230 @@
+package domain
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	LotActive     = "active"
+	LotConsumed   = "consumed"
+	LotExpired    = "expired"
+	LotRolledOver = "rolled_over"
+)
+
+// CreditLot is one grant of tokens (a subscription period, topup, promo
+// grant or rollover) with its own expiry. Its ID is the hex ID of the event
+// that granted it, so a replay always rebuilds the same lots.
+type CreditLot struct {
+	ID        string     `json:"lotId" bson:"_id"`
+	UserID    string     `json:"userId" bson:"userId"`
+	Bucket    string     `json:"bucket" bson:"bucket"`
+	Source    string     `json:"source" bson:"source"`
+	Amount    int        `json:"amount" bson:"amount"`
+	Remaining int        `json:"remaining" bson:"remaining"`
+	GrantedAt time.Time  `json:"grantedAt" bson:"grantedAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	Status    string     `json:"status" bson:"status"`
+	ClosedAt  *time.Time `json:"closedAt,omitempty" bson:"closedAt,omitempty"`
+}
+
+// LotBook replays events into a balance, the lots that make it up and the
+// journal entries of the events. The active lots of a bucket always add up
+// to that bucket's balance: every change Balance.Apply makes to a bucket is
+// taken from, or added to, its lots.
+type LotBook struct {
+	UserID  string
+	Balance Balance
+	// Lots holds active lots and the lots closed during this replay.
+	Lots []CreditLot
+	// Journal holds an entry for each event replayed that affects the
+	// user's own balance, for posting the entries that are missing.
+	Journal []JournalEntry
+}
+
+// Apply replays ev.
+func (l *LotBook) Apply(ev LedgerEvent) {
+	before := l.Balance
+	l.Balance = before.Apply(ev)
+	if ev.AffectsBalance() {
+		// Legacy events that do not record their change post what the
+		// replay made of them.
+		delta, ok := ev.RecordedDelta()
+		if !ok {
+			delta = Balance{Main: l.Balance.Main - before.Main, Topup: l.Balance.Topup - before.Topup}
+		}
+		l.Journal = append(l.Journal, UserJournalEntry(ev, delta))
+	}
+	l.move(ev, BucketMain, l.Balance.Main-before.Main)
+	l.move(ev, BucketTopup, l.Balance.Topup-before.Topup)
+
+	if ev.Type == LedgerRollover && ev.AffectsBalance() {
+		l.rollover(ev)
+	}
+}
+
+// ActiveLots returns a copy of the lots that still hold tokens.
+func (l *LotBook) ActiveLots() []CreditLot {
+	var out []CreditLot
+	for _, lot := range l.Lots {
+		if lot.Status == LotActive {
+			out = append(out, lot)
+		}
+	}
+	return out
+}
+
+// ResumableLots returns a copy of the lots a replay resuming after at
+// needs: the active lots and the used-up lots a later refund may still
+// restore.
+func (l *LotBook) ResumableLots(at time.Time) []CreditLot {
+	var out []CreditLot
+	for _, lot := range l.Lots {
+		if lot.Status == LotActive || lot.Status == LotConsumed && lot.ExpiresAt != nil && lot.ExpiresAt.After(at) {
+			out = append(out, lot)
+		}
+	}
+	return out
+}
+
+func (l *LotBook) move(ev LedgerEvent, bucket string, delta int) {
+	switch {
+	case delta > 0 && ev.Type == LedgerRefund:
+		l.restore(ev, bucket, delta)
+	case delta > 0:
+		l.open(ev.ID, ev, bucket, delta, ev.ExpiresAt)
+	case delta < 0:
+		l.consume(ev, bucket, -delta)
+	}
+}
+
+func (l *LotBook) open(id string, ev LedgerEvent, bucket string, amount int, expiresAt *time.Time) {
+	l.Lots = append(l.Lots, CreditLot{
+		ID:        id,
+		UserID:    l.UserID,
+		Bucket:    bucket,
+		Source:    string(ev.Type),
+		Amount:    amount,
+		Remaining: amount,
+		GrantedAt: ev.Timestamp,
+		ExpiresAt: expiresAt,
+		Status:    LotActive,
+	})
+}
+
+// consume takes amount from the bucket's lots, earliest expiry first and
+// lots that never expire last. An event that expires a lot takes from that
+// lot before any other.
+func (l *LotBook) consume(ev LedgerEvent, bucket string, amount int) {
+	status := LotConsumed
+	switch ev.Type {
+	case LedgerExpired, LedgerMainExpired, LedgerTopupExpired:
+		status = LotExpired
+	}
+
+	for _, i := range l.order(bucket, ev.LotID, false) {
+		if amount == 0 {
+			return
+		}
+		lot := &l.Lots[i]
+		take := min(lot.Remaining, amount)
+		lot.Remaining -= take
+		amount -= take
+		if lot.Remaining == 0 {
+			l.close(lot, status, ev.Timestamp)
+		}
+	}
+}
+
+// restore gives refunded tokens back to the bucket's lots that have room,
+// latest expiry first, so a refund does not expire sooner than needed.
+// Used-up lots that never expire are not reopened, so a snapshot only has
+// to keep used-up lots until they expire. Whatever does not fit opens a lot
+// of its own; a refund can restore both buckets, so that lot's ID also
+// names the bucket.
+func (l *LotBook) restore(ev LedgerEvent, bucket string, amount int) {
+	for _, i := range l.order(bucket, "", true) {
+		if amount == 0 {
+			return
+		}
+		lot := &l.Lots[i]
+		if lot.ExpiresAt != nil && !lot.ExpiresAt.After(ev.Timestamp) {
+			continue
+		}
+		put := min(lot.Amount-lot.Remaining, amount)
+		if put == 0 {
+			continue
+		}
+		lot.Remaining += put
+		amount -= put
+		lot.Status, lot.ClosedAt = LotActive, nil
+	}
+	if amount > 0 {
+		l.open(ev.ID+":"+bucket, ev, bucket, amount, ev.ExpiresAt)
+	}
+}
+
+// rollover moves what is left of the main lots into one lot that expires
+// with the new period.
+func (l *LotBook) rollover(ev LedgerEvent) {
+	carried := 0
+	for i := range l.Lots {
+		lot := &l.Lots[i]
+		if lot.Status != LotActive || lot.Bucket != BucketMain {
+			continue
+		}
+		carried += lot.Remaining
+		lot.Remaining = 0
+		l.close(lot, LotRolledOver, ev.Timestamp)
+	}
+	if carried > 0 {
+		l.open(ev.ID, ev, BucketMain, carried, ev.ExpiresAt)
+	}
+}
+
+func (l *LotBook) close(lot *CreditLot, status string, at time.Time) {
+	lot.Status = status
+	lot.ClosedAt = &at
+}
+
+// order returns the indexes of the bucket's active lots by expiry, earliest
+// first (latest first when reverse), with lots that never expire counted as
+// the latest. first, when set, is put ahead of the rest.
+func (l *LotBook) order(bucket, first string, reverse bool) []int {
+	var idx []int
+	for i, lot := range l.Lots {
+		reopen := reverse && lot.Status == LotConsumed && lot.ExpiresAt != nil && lot.Remaining < lot.Amount
+		if lot.Bucket == bucket && (lot.Status == LotActive || reopen) {
+			idx = append(idx, i)
+		}
+	}
+	slices.SortStableFunc(idx, func(a, b int) int {
+		la, lb := l.Lots[a], l.Lots[b]
+		if first != "" && (la.ID == first) != (lb.ID == first) {
+			if la.ID == first {
+				return -1
+			}
+			return 1
+		}
+		c := compareExpiry(la.ExpiresAt, lb.ExpiresAt)
+		if reverse {
+			c = -c
+		}
+		return c
+	})
+	return idx
+}
+
+// compareExpiry orders expiries with nil (never) last.
+func compareExpiry(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	default:
+		return a.Compare(*b)
+	}
+}
@@ -0,0 +1,143 @@
+package domain
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+var lotT0 = time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func day(n int) time.Time { return lotT0.AddDate(0, 0, n) }
+
+func dayPtr(n int) *time.Time {
+	t := day(n)
+	return &t
+}
+
+// lotRemaining returns each lot's remaining tokens and status by ID.
+func lotRemaining(book *LotBook) map[string]string {
+	out := map[string]string{}
+	for _, lot := range book.Lots {
+		out[lot.ID] = lot.Status + ":" + strconv.Itoa(lot.Remaining)
+	}
+	return out
+}
+
+// checkLotsMatchBalance checks that each bucket's active lots add up to it.
+func checkLotsMatchBalance(t *testing.T, book *LotBook) {
+	t.Helper()
+	sum := map[string]int{}
+	for _, lot := range book.ActiveLots() {
+		sum[lot.Bucket] += lot.Remaining
+	}
+	if sum[BucketMain] != book.Balance.Main || sum[BucketTopup] != book.Balance.Topup {
+		t.Errorf("active lots main=%d topup=%d, balance %+v", sum[BucketMain], sum[BucketTopup], book.Balance)
+	}
+}
+
+func TestLotBook(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []LedgerEvent
+		want   map[string]string
+	}{
+		{
+			name: "usage takes the earliest expiring lot first",
+			events: []LedgerEvent{
+				{ID: "s1", Type: LedgerSubscribe, Amount: 100, ExpiresAt: dayPtr(30)},
+				{ID: "s2", Type: LedgerSubscribe, Amount: 100, ExpiresAt: dayPtr(10)},
+				{ID: "u1", Type: LedgerTokenUsed, Amount: 150, Timestamp: day(1)},
+			},
+			want: map[string]string{"s1": LotActive + ":50", "s2": LotConsumed + ":0"},
+		},
+		{
+			name: "lots that never expire are used last",
+			events: []LedgerEvent{
+				{ID: "g1", Type: LedgerGrant, Amount: 100, Bucket: BucketMain},
+				{ID: "s1", Type: LedgerSubscribe, Amount: 100, ExpiresAt: dayPtr(30)},
+				{ID: "u1", Type: LedgerTokenUsed, Amount: 120, Timestamp: day(1)},
+			},
+			want: map[string]string{"g1": LotActive + ":80", "s1": LotConsumed + ":0"},
+		},
+		{
+			name: "an expiry closes its own lot first",
+			events: []LedgerEvent{
+				{ID: "t1", Type: LedgerTopup, Amount: 50, ExpiresAt: dayPtr(5)},
+				{ID: "t2", Type: LedgerTopup, Amount: 50, ExpiresAt: dayPtr(20)},
+				{ID: "x1", Type: LedgerTopupExpired, Amount: 50, LotID: "t2", Timestamp: day(20)},
+			},
+			want: map[string]string{"t1": LotActive + ":50", "t2": LotExpired + ":0"},
+		},
+		{
+			name: "refund goes back to the latest expiring lot with room",
+			events: []LedgerEvent{
+				{ID: "s1", Type: LedgerSubscribe, Amount: 100, ExpiresAt: dayPtr(10)},
+				{ID: "s2", Type: LedgerSubscribe, Amount: 100, ExpiresAt: dayPtr(30)},
+				{ID: "u1", Type: LedgerTokenUsed, Amount: 180, Timestamp: day(1)},
+				{ID: "r1", Type: LedgerRefund, Amount: 60, MainToken: intPtr(60), TopupToken: intPtr(0), Timestamp: day(2)},
+			},
+			want: map[string]string{"s1": LotConsumed + ":0", "s2": LotActive + ":80"},
+		},
+		{
+			name: "refund skips expired lots and opens its own for the rest",
+			events: []LedgerEvent{
+				{ID: "s1", Type: LedgerSubscribe, Amount: 100, ExpiresAt: dayPtr(10)},
+				{ID: "u1", Type: LedgerTokenUsed, Amount: 100, Timestamp: day(1)},
+				{ID: "r1", Type: LedgerRefund, Amount: 40, MainToken: intPtr(40), TopupToken: intPtr(0), Timestamp: day(11)},
+			},
+			want: map[string]string{"s1": LotConsumed + ":0", "r1:main": LotActive + ":40"},
+		},
+		{
+			name: "a used-up lot that never expires is not reopened",
+			events: []LedgerEvent{
+				{ID: "g1", Type: LedgerGrant, Amount: 50, Bucket: BucketMain},
+				{ID: "u1", Type: LedgerTokenUsed, Amount: 50, Timestamp: day(1)},
+				{ID: "r1", Type: LedgerRefund, Amount: 20, MainToken: intPtr(20), TopupToken: intPtr(0), Timestamp: day(2)},
+			},
+			want: map[string]string{"g1": LotConsumed + ":0", "r1:main": LotActive + ":20"},
+		},
+		{
+			name: "rollover merges what is left of main",
+			events: []LedgerEvent{
+				{ID: "s1", Type: LedgerSubscribe, Amount: 100, ExpiresAt: dayPtr(30)},
+				{ID: "g1", Type: LedgerGrant, Amount: 50, Bucket: BucketMain, ExpiresAt: dayPtr(60)},
+				{ID: "u1", Type: LedgerTokenUsed, Amount: 50, Timestamp: day(1)},
+				{ID: "ro", Type: LedgerRollover, Amount: 80, ExpiresAt: dayPtr(60), Timestamp: day(30)},
+			},
+			want: map[string]string{"s1": LotRolledOver + ":0", "g1": LotRolledOver + ":0", "ro": LotActive + ":80"},
+		},
+		{
+			name: "organization usage leaves the lots alone",
+			events: []LedgerEvent{
+				{ID: "s1", Type: LedgerSubscribe, Amount: 100},
+				{ID: "u1", Type: LedgerTokenUsed, Amount: 60, OrgID: "acme"},
+			},
+			want: map[string]string{"s1": LotActive + ":100"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			book := &LotBook{UserID: "u1"}
+			for _, ev := range tt.events {
+				ev.UserID = "u1"
+				book.Apply(ev)
+				checkLotsMatchBalance(t, book)
+			}
+			got := lotRemaining(book)
+			if len(got) != len(tt.want) {
+				t.Errorf("lots = %v, want %v", got, tt.want)
+			}
+			for id, want := range tt.want {
+				if got[id] != want {
+					t.Errorf("lot %s = %q, want %q", id, got[id], want)
+				}
+			}
+			for _, e := range book.Journal {
+				if !e.Balanced() {
+					t.Errorf("journal entry %s is not balanced", e.ID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package domain
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	DeductMainFirstThreshold = "main_first_threshold"
+	DeductTopupFirst         = "topup_first"
+	DeductEarliestExpiring   = "earliest_expiring_first"
+
+	RuleTopupFirst            = "topup_first"
+	RuleEarliestExpiringMain  = "earliest_expiring_main"
+	RuleEarliestExpiringTopup = "earliest_expiring_topup"
+	RuleEarliestExpiringLots  = "earliest_expiring_lots"
+)
+
+// DeductionPolicy selects how usage is split between the main and topup
+// buckets. A package sets Strategy and Threshold; each Token Used event
+// keeps a copy, with the bucket expiries resolved at charge time, so a
+// replay splits it exactly as the charge did. A nil policy is
+// main_first_threshold with MainDeductionThreshold.
+type DeductionPolicy struct {
+	Strategy string `json:"strategy" bson:"strategy"`
+	// Threshold is the main balance at or above which main_first_threshold
+	// draws from main first. Nil means MainDeductionThreshold.
+	Threshold      *int       `json:"threshold,omitempty" bson:"threshold,omitempty"`
+	MainExpiresAt  *time.Time `json:"mainExpiresAt,omitempty" bson:"mainExpiresAt,omitempty"`
+	TopupExpiresAt *time.Time `json:"topupExpiresAt,omitempty" bson:"topupExpiresAt,omitempty"`
+	// Runs are the user's active lots at charge time in the order
+	// earliest_expiring_first draws them across both buckets. Events
+	// charged before lots were tracked have none and compare the buckets'
+	// earliest expiries instead.
+	Runs []LotRun `json:"runs,omitempty" bson:"runs,omitempty"`
+}
+
+// LotRun is a run of neighbouring lots of one bucket in drawing order.
+type LotRun struct {
+	Bucket string `json:"bucket" bson:"bucket"`
+	Amount int    `json:"amount" bson:"amount"`
+}
+
+// LotRuns lists the active lots of both buckets in the order usage draws
+// them: earliest expiry first, lots that never expire last and main before
+// topup on ties. Neighbouring lots of the same bucket are merged.
+func LotRuns(lots []CreditLot) []LotRun {
+	var active []CreditLot
+	for _, lot := range lots {
+		if lot.Status == LotActive && lot.Remaining > 0 {
+			active = append(active, lot)
+		}
+	}
+	slices.SortStableFunc(active, func(a, b CreditLot) int {
+		if c := compareExpiry(a.ExpiresAt, b.ExpiresAt); c != 0 {
+			return c
+		}
+		if a.Bucket != b.Bucket {
+			if a.Bucket == BucketMain {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	})
+
+	var runs []LotRun
+	for _, lot := range active {
+		if n := len(runs); n > 0 && runs[n-1].Bucket == lot.Bucket {
+			runs[n-1].Amount += lot.Remaining
+			continue
+		}
+		runs = append(runs, LotRun{Bucket: lot.Bucket, Amount: lot.Remaining})
+	}
+	return runs
+}
+
+// Deduction is how much of a charge each bucket pays.
+type Deduction struct {
+	Main  int
+	Topup int
+	Rules []string
+}
+
+// DeductionStrategy splits a charge of amount tokens given the balance
+// before it. The live charge path and balance replays both use it.
+type DeductionStrategy interface {
+	Split(b Balance, amount int) Deduction
+}
+
+// Resolve returns the strategy p describes.
+func (p *DeductionPolicy) Resolve() DeductionStrategy {
+	if p == nil {
+		return MainFirstThreshold{Threshold: MainDeductionThreshold}
+	}
+	switch p.Strategy {
+	case DeductTopupFirst:
+		return TopupFirst{}
+	case DeductEarliestExpiring:
+		return EarliestExpiringFirst{MainExpiresAt: p.MainExpiresAt, TopupExpiresAt: p.TopupExpiresAt, Runs: p.Runs}
+	default:
+		threshold := MainDeductionThreshold
+		if p.Threshold != nil {
+			threshold = *p.Threshold
+		}
+		return MainFirstThreshold{Threshold: threshold}
+	}
+}
+
+// MainFirstThreshold draws from main first while main is at or above
+// Threshold, and from topup first below it.
+type MainFirstThreshold struct {
+	Threshold int
+}
+
+func (s MainFirstThreshold) Split(b Balance, amount int) Deduction {
+	if b.Main >= s.Threshold {
+		return splitFirst(b, amount, true, RuleThresholdMain)
+	}
+	return splitFirst(b, amount, false, RuleThresholdTopup)
+}
+
+// TopupFirst always draws from topup first.
+type TopupFirst struct{}
+
+func (TopupFirst) Split(b Balance, amount int) Deduction {
+	return splitFirst(b, amount, false, RuleTopupFirst)
+}
+
+// EarliestExpiringFirst draws lot by lot across both buckets, earliest
+// expiry first, following Runs. Without Runs it draws first from the bucket
+// whose earliest lot expires sooner. A bucket without an expiry is used
+// last; ties go to main.
+type EarliestExpiringFirst struct {
+	MainExpiresAt  *time.Time
+	TopupExpiresAt *time.Time
+	Runs           []LotRun
+}
+
+func (s EarliestExpiringFirst) Split(b Balance, amount int) Deduction {
+	if len(s.Runs) > 0 {
+		return splitRuns(s.Runs, b, amount)
+	}
+	topupSooner := s.TopupExpiresAt != nil &&
+		(s.MainExpiresAt == nil || s.TopupExpiresAt.Before(*s.MainExpiresAt))
+	if topupSooner {
+		return splitFirst(b, amount, false, RuleEarliestExpiringTopup)
+	}
+	return splitFirst(b, amount, true, RuleEarliestExpiringMain)
+}
+
+// splitRuns draws amount from the runs in order. The balance may have moved
+// since the runs were taken, as in a batch that shares them: tokens a bucket
+// has lost since come off the front of its runs, since each bucket is drawn
+// in expiry order, and tokens it has gained are drawn after the runs, main
+// first.
+func splitRuns(runs []LotRun, b Balance, amount int) Deduction {
+	left := map[string]int{BucketMain: max(b.Main, 0), BucketTopup: max(b.Topup, 0)}
+	gone := map[string]int{BucketMain: -left[BucketMain], BucketTopup: -left[BucketTopup]}
+	for _, r := range runs {
+		gone[r.Bucket] += r.Amount
+	}
+
+	d := Deduction{Rules: []string{RuleEarliestExpiringLots}}
+	for _, r := range runs {
+		n := r.Amount
+		if g := min(max(gone[r.Bucket], 0), n); g > 0 {
+			n -= g
+			gone[r.Bucket] -= g
+		}
+		n = min(n, left[r.Bucket], amount)
+		if r.Bucket == BucketMain {
+			d.Main += n
+		} else {
+			d.Topup += n
+		}
+		left[r.Bucket] -= n
+		amount -= n
+	}
+	if amount > 0 {
+		rest := splitFirst(Balance{Main: left[BucketMain], Topup: left[BucketTopup]}, amount, true, RuleEarliestExpiringLots)
+		d.Main += rest.Main
+		d.Topup += rest.Topup
+		d.Rules = append(d.Rules, rest.Rules[1:]...)
+	}
+	return d
+}
+
+// splitFirst takes as much of amount as the first bucket holds and the rest
+// from the other one.
+func splitFirst(b Balance, amount int, mainFirst bool, rule string) Deduction {
+	first, overflow := b.Topup, RuleOverflowToMain
+	if mainFirst {
+		first, overflow = b.Main, RuleOverflowToTopup
+	}
+
+	fromFirst := min(first, amount)
+	d := Deduction{Rules: []string{rule}}
+	if fromFirst < amount {
+		d.Rules = append(d.Rules, overflow)
+	}
+	if mainFirst {
+		d.Main, d.Topup = fromFirst, amount-fromFirst
+	} else {
+		d.Main, d.Topup = amount-fromFirst, fromFirst
+	}
+	return d
+}
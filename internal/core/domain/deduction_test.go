@@ -0,0 +1,205 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitFirst(t *testing.T) {
+	tests := []struct {
+		name      string
+		balance   Balance
+		amount    int
+		mainFirst bool
+		want      Deduction
+	}{
+		{
+			name:    "main first covers the charge",
+			balance: Balance{Main: 500, Topup: 200}, amount: 300, mainFirst: true,
+			want: Deduction{Main: 300, Rules: []string{"r"}},
+		},
+		{
+			name:    "main first overflows to topup",
+			balance: Balance{Main: 100, Topup: 200}, amount: 250, mainFirst: true,
+			want: Deduction{Main: 100, Topup: 150, Rules: []string{"r", RuleOverflowToTopup}},
+		},
+		{
+			name:    "topup first covers the charge",
+			balance: Balance{Main: 500, Topup: 200}, amount: 200, mainFirst: false,
+			want: Deduction{Topup: 200, Rules: []string{"r"}},
+		},
+		{
+			name:    "topup first overflows to main",
+			balance: Balance{Main: 500, Topup: 50}, amount: 80, mainFirst: false,
+			want: Deduction{Main: 30, Topup: 50, Rules: []string{"r", RuleOverflowToMain}},
+		},
+		{
+			name:    "charge beyond both buckets lands on the second",
+			balance: Balance{Main: 10, Topup: 20}, amount: 100, mainFirst: true,
+			want: Deduction{Main: 10, Topup: 90, Rules: []string{"r", RuleOverflowToTopup}},
+		},
+		{
+			name:    "empty first bucket",
+			balance: Balance{Topup: 20}, amount: 5, mainFirst: true,
+			want: Deduction{Topup: 5, Rules: []string{"r", RuleOverflowToTopup}},
+		},
+		{
+			name:    "zero charge",
+			balance: Balance{Main: 10, Topup: 20}, amount: 0, mainFirst: true,
+			want: Deduction{Rules: []string{"r"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitFirst(tt.balance, tt.amount, tt.mainFirst, "r")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitFirst(%+v, %d, %v) = %+v, want %+v", tt.balance, tt.amount, tt.mainFirst, got, tt.want)
+			}
+			if got.Main+got.Topup != tt.amount {
+				t.Errorf("split %d+%d does not add up to %d", got.Main, got.Topup, tt.amount)
+			}
+		})
+	}
+}
+
+func TestDeductionStrategies(t *testing.T) {
+	early := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.AddDate(0, 1, 0)
+	threshold := 300
+	b := Balance{Main: 200, Topup: 200}
+
+	tests := []struct {
+		name   string
+		policy *DeductionPolicy
+		want   Deduction
+	}{
+		{
+			name:   "nil policy uses the default threshold, main at or above it",
+			policy: nil,
+			want:   Deduction{Main: 150, Rules: []string{RuleThresholdMain}},
+		},
+		{
+			name:   "main below a custom threshold draws topup first",
+			policy: &DeductionPolicy{Strategy: DeductMainFirstThreshold, Threshold: &threshold},
+			want:   Deduction{Topup: 150, Rules: []string{RuleThresholdTopup}},
+		},
+		{
+			name:   "unknown strategy falls back to the threshold",
+			policy: &DeductionPolicy{Strategy: "bogus"},
+			want:   Deduction{Main: 150, Rules: []string{RuleThresholdMain}},
+		},
+		{
+			name:   "topup first",
+			policy: &DeductionPolicy{Strategy: DeductTopupFirst},
+			want:   Deduction{Topup: 150, Rules: []string{RuleTopupFirst}},
+		},
+		{
+			name:   "topup expires sooner",
+			policy: &DeductionPolicy{Strategy: DeductEarliestExpiring, MainExpiresAt: &late, TopupExpiresAt: &early},
+			want:   Deduction{Topup: 150, Rules: []string{RuleEarliestExpiringTopup}},
+		},
+		{
+			name:   "main expires sooner",
+			policy: &DeductionPolicy{Strategy: DeductEarliestExpiring, MainExpiresAt: &early, TopupExpiresAt: &late},
+			want:   Deduction{Main: 150, Rules: []string{RuleEarliestExpiringMain}},
+		},
+		{
+			name:   "same expiry goes to main",
+			policy: &DeductionPolicy{Strategy: DeductEarliestExpiring, MainExpiresAt: &early, TopupExpiresAt: &early},
+			want:   Deduction{Main: 150, Rules: []string{RuleEarliestExpiringMain}},
+		},
+		{
+			name:   "main that never expires is used last",
+			policy: &DeductionPolicy{Strategy: DeductEarliestExpiring, TopupExpiresAt: &late},
+			want:   Deduction{Topup: 150, Rules: []string{RuleEarliestExpiringTopup}},
+		},
+		{
+			name:   "no expiries go to main",
+			policy: &DeductionPolicy{Strategy: DeductEarliestExpiring},
+			want:   Deduction{Main: 150, Rules: []string{RuleEarliestExpiringMain}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.Resolve().Split(b, 150)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Split = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLotRuns(t *testing.T) {
+	lots := []CreditLot{
+		{ID: "m2", Bucket: BucketMain, Remaining: 100, ExpiresAt: dayPtr(20), Status: LotActive},
+		{ID: "t1", Bucket: BucketTopup, Remaining: 30, ExpiresAt: dayPtr(10), Status: LotActive},
+		{ID: "m1", Bucket: BucketMain, Remaining: 50, ExpiresAt: dayPtr(5), Status: LotActive},
+		{ID: "m3", Bucket: BucketMain, Remaining: 40, ExpiresAt: dayPtr(25), Status: LotActive},
+		{ID: "t2", Bucket: BucketTopup, Remaining: 20, ExpiresAt: dayPtr(25), Status: LotActive},
+		{ID: "t3", Bucket: BucketTopup, Remaining: 60, Status: LotActive},
+		{ID: "t4", Bucket: BucketTopup, Remaining: 90, ExpiresAt: dayPtr(1), Status: LotExpired},
+		{ID: "m4", Bucket: BucketMain, Remaining: 0, ExpiresAt: dayPtr(2), Status: LotActive},
+	}
+	want := []LotRun{
+		{Bucket: BucketMain, Amount: 50},
+		{Bucket: BucketTopup, Amount: 30},
+		{Bucket: BucketMain, Amount: 140},
+		{Bucket: BucketTopup, Amount: 80},
+	}
+	if got := LotRuns(lots); !reflect.DeepEqual(got, want) {
+		t.Errorf("LotRuns = %+v, want %+v", got, want)
+	}
+}
+
+func TestSplitRuns(t *testing.T) {
+	runs := []LotRun{
+		{Bucket: BucketMain, Amount: 50},
+		{Bucket: BucketTopup, Amount: 30},
+		{Bucket: BucketMain, Amount: 100},
+	}
+	tests := []struct {
+		name    string
+		balance Balance
+		amount  int
+		want    Deduction
+	}{
+		{
+			name:    "draws lot by lot across the buckets",
+			balance: Balance{Main: 150, Topup: 30}, amount: 100,
+			want: Deduction{Main: 70, Topup: 30, Rules: []string{RuleEarliestExpiringLots}},
+		},
+		{
+			name:    "stays in the earliest lot",
+			balance: Balance{Main: 150, Topup: 30}, amount: 40,
+			want: Deduction{Main: 40, Rules: []string{RuleEarliestExpiringLots}},
+		},
+		{
+			name:    "tokens a bucket has lost come off its earliest lots",
+			balance: Balance{Main: 110, Topup: 30}, amount: 40,
+			want: Deduction{Main: 10, Topup: 30, Rules: []string{RuleEarliestExpiringLots}},
+		},
+		{
+			name:    "tokens a bucket has gained are drawn after the runs",
+			balance: Balance{Main: 150, Topup: 50}, amount: 190,
+			want: Deduction{Main: 150, Topup: 40, Rules: []string{RuleEarliestExpiringLots, RuleOverflowToTopup}},
+		},
+		{
+			name:    "charge beyond both buckets lands on topup",
+			balance: Balance{Main: 150, Topup: 30}, amount: 200,
+			want: Deduction{Main: 150, Topup: 50, Rules: []string{RuleEarliestExpiringLots, RuleOverflowToTopup}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &DeductionPolicy{Strategy: DeductEarliestExpiring, MainExpiresAt: dayPtr(5), TopupExpiresAt: dayPtr(10), Runs: runs}
+			got := policy.Resolve().Split(tt.balance, tt.amount)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Split(%+v, %d) = %+v, want %+v", tt.balance, tt.amount, got, tt.want)
+			}
+			if got.Main+got.Topup != tt.amount {
+				t.Errorf("split %d+%d does not add up to %d", got.Main, got.Topup, tt.amount)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package domain
+
+const (
+	FlagModelNotEntitled = "model_not_entitled"
+
+	EntitlementFlag    = "flag"
+	EntitlementPremium = "premium"
+)
+
+// PackageBestModels lists the models a package may use, keyed by canonical
+// model ID. A package without an entry may use every model.
+type PackageBestModels struct {
+	PackageID string   `json:"packageId" bson:"packageId"`
+	ModelIDs  []string `json:"modelIds" bson:"modelIds"`
+}
+
+type Entitlements struct {
+	UserID    string `json:"userId"`
+	PackageID string `json:"packageId"`
+	// OrgID is set when the package is the user's organization's.
+	OrgID string `json:"orgId,omitempty"`
+	// Restricted is false when the package allows every model.
+	Restricted bool     `json:"restricted"`
+	ModelIDs   []string `json:"modelIds"`
+}
+
+type EntitlementCheckIn struct {
+	UserID  string `json:"userId"`
+	AIModel string `json:"aiModel"`
+}
+
+type EntitlementCheck struct {
+	UserID    string `json:"userId"`
+	PackageID string `json:"packageId"`
+	OrgID     string `json:"orgId,omitempty"`
+	AIModel   string `json:"aiModel"`
+	ModelID   string `json:"modelId,omitempty"`
+	Allowed   bool   `json:"allowed"`
+	// Action is what a charge on this model would do: allow, flag or premium.
+	Action     string  `json:"action"`
+	Multiplier float64 `json:"multiplier"`
+}
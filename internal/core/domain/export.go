@@ -0,0 +1,20 @@
+package domain
+
+import (
+	"time"
+)
+
+const (
+	ExportCSV     = "csv"
+	ExportNDJSON  = "ndjson"
+	ExportParquet = "parquet"
+)
+
+// UsageExportFilter selects the usage events to export. Zero values leave
+// that dimension unfiltered; From is inclusive and To exclusive.
+type UsageExportFilter struct {
+	From    time.Time
+	To      time.Time
+	UserIDs []string
+	AgentID string
+}
@@ -0,0 +1,152 @@
+package domain
+
+import (
+	"time"
+)
+
+// Ledger accounts, in egg tokens. User buckets and organization pools are
+// what the service owes and normally carry a credit balance; the others
+// are where those tokens came from or went.
+const (
+	// AccountSales is debited for tokens sold: subscriptions, topups and
+	// organization funding.
+	AccountSales = "sales"
+	// AccountPromo is debited for tokens given away by admin grants and
+	// credited when adjustments take tokens back.
+	AccountPromo = "promo_liability"
+	// AccountRevenue is credited for tokens spent on usage and debited for
+	// refunds.
+	AccountRevenue = "revenue"
+	// AccountBreakage is credited for tokens that expired unused.
+	AccountBreakage = "expired_breakage"
+)
+
+// UserAccount is the account of a user's main or topup bucket.
+func UserAccount(userID, bucket string) string {
+	return "user:" + userID + ":" + bucket
+}
+
+// OrgPoolAccount is the account of an organization's shared pool.
+func OrgPoolAccount(orgID string) string {
+	return "org:" + orgID + ":pool"
+}
+
+type JournalLine struct {
+	Account string `json:"account" bson:"account"`
+	Debit   int    `json:"debit,omitempty" bson:"debit"`
+	Credit  int    `json:"credit,omitempty" bson:"credit"`
+}
+
+// JournalEntry is the double-entry posting of one event. User events are
+// keyed "evt:<eventId>" and organization pool events "org:<eventId>", so
+// posting an event again replaces its entry.
+type JournalEntry struct {
+	ID        string        `json:"entryId" bson:"_id"`
+	UserID    string        `json:"userId,omitempty" bson:"userId,omitempty"`
+	OrgID     string        `json:"orgId,omitempty" bson:"orgId,omitempty"`
+	EventType string        `json:"eventType" bson:"eventType"`
+	EventAt   time.Time     `json:"eventAt" bson:"eventAt"`
+	Lines     []JournalLine `json:"lines" bson:"lines"`
+	PostedAt  time.Time     `json:"postedAt" bson:"postedAt"`
+}
+
+// Balanced reports whether the entry's debits equal its credits.
+func (e JournalEntry) Balanced() bool {
+	sum := 0
+	for _, l := range e.Lines {
+		sum += l.Debit - l.Credit
+	}
+	return sum == 0
+}
+
+// UserJournalEntry posts ev as the change delta it made to the user's
+// buckets, normally the change the event records (LedgerEvent.RecordedDelta).
+// Posting what the event records rather than what a replay makes of it
+// keeps the journal an independent check on the replayed balance.
+func UserJournalEntry(ev LedgerEvent, delta Balance) JournalEntry {
+	e := JournalEntry{
+		ID:        "evt:" + ev.ID,
+		UserID:    ev.UserID,
+		EventType: string(ev.Type),
+		EventAt:   ev.Timestamp,
+	}
+
+	var other string
+	switch ev.Type {
+	case LedgerSubscribe, LedgerTopup:
+		other = AccountSales
+	case LedgerGrant, LedgerAdjustment:
+		other = AccountPromo
+	case LedgerTokenUsed, LedgerRefund:
+		other = AccountRevenue
+	default:
+		other = AccountBreakage
+	}
+
+	net := 0
+	for _, b := range []struct {
+		bucket string
+		delta  int
+	}{{BucketMain, delta.Main}, {BucketTopup, delta.Topup}} {
+		switch {
+		case b.delta > 0:
+			e.Lines = append(e.Lines, JournalLine{Account: UserAccount(ev.UserID, b.bucket), Credit: b.delta})
+		case b.delta < 0:
+			e.Lines = append(e.Lines, JournalLine{Account: UserAccount(ev.UserID, b.bucket), Debit: -b.delta})
+		}
+		net += b.delta
+	}
+	switch {
+	case net > 0:
+		e.Lines = append(e.Lines, JournalLine{Account: other, Debit: net})
+	case net < 0:
+		e.Lines = append(e.Lines, JournalLine{Account: other, Credit: -net})
+	}
+	return e
+}
+
+// OrgJournalEntry posts a movement of an organization's pool.
+func OrgJournalEntry(ev OrgPoolEvent) JournalEntry {
+	e := JournalEntry{
+		ID:        "org:" + ev.ID.Hex(),
+		OrgID:     ev.OrgID,
+		EventType: ev.EventType,
+		EventAt:   ev.EventTimeStamp,
+	}
+	if ev.UserID != nil {
+		e.UserID = *ev.UserID
+	}
+
+	other := AccountRevenue
+	if ev.EventType == OrgEventFund {
+		other = AccountSales
+	}
+	pool := OrgPoolAccount(ev.OrgID)
+	switch {
+	case ev.EggToken > 0:
+		e.Lines = []JournalLine{{Account: other, Debit: ev.EggToken}, {Account: pool, Credit: ev.EggToken}}
+	case ev.EggToken < 0:
+		e.Lines = []JournalLine{{Account: pool, Debit: -ev.EggToken}, {Account: other, Credit: -ev.EggToken}}
+	}
+	return e
+}
+
+// AccountBalance is an account's totals in a trial balance. Balance is
+// credits minus debits, so what is owed to users is positive.
+type AccountBalance struct {
+	Account string `json:"account" bson:"_id"`
+	Debit   int    `json:"debit" bson:"debit"`
+	Credit  int    `json:"credit" bson:"credit"`
+	Balance int    `json:"balance" bson:"balance"`
+}
+
+// TrialBalance lists every account's totals. The journal is consistent when
+// total debits equal total credits and no single entry is unbalanced.
+type TrialBalance struct {
+	Accounts          []AccountBalance `json:"accounts"`
+	TotalDebit        int              `json:"totalDebit"`
+	TotalCredit       int              `json:"totalCredit"`
+	UnbalancedEntries []string         `json:"unbalancedEntries"`
+	Balanced          bool             `json:"balanced"`
+	GeneratedAt       time.Time        `json:"generatedAt"`
+}
@@ -0,0 +1,101 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUserJournalEntry(t *testing.T) {
+	main, topup := UserAccount("u1", BucketMain), UserAccount("u1", BucketTopup)
+
+	tests := []struct {
+		name  string
+		ev    LedgerEvent
+		delta Balance
+		want  []JournalLine
+	}{
+		{
+			name:  "subscription is sold",
+			ev:    LedgerEvent{Type: LedgerSubscribe, Amount: 100},
+			delta: Balance{Main: 100},
+			want:  []JournalLine{{Account: main, Credit: 100}, {Account: AccountSales, Debit: 100}},
+		},
+		{
+			name:  "usage from both buckets is revenue",
+			ev:    LedgerEvent{Type: LedgerTokenUsed, Amount: 70},
+			delta: Balance{Main: -50, Topup: -20},
+			want:  []JournalLine{{Account: main, Debit: 50}, {Account: topup, Debit: 20}, {Account: AccountRevenue, Credit: 70}},
+		},
+		{
+			name:  "clamped usage posts only what was taken",
+			ev:    LedgerEvent{Type: LedgerTokenUsed, Amount: 500},
+			delta: Balance{Main: -40},
+			want:  []JournalLine{{Account: main, Debit: 40}, {Account: AccountRevenue, Credit: 40}},
+		},
+		{
+			name:  "refund debits revenue",
+			ev:    LedgerEvent{Type: LedgerRefund, Amount: 30},
+			delta: Balance{Main: 10, Topup: 20},
+			want:  []JournalLine{{Account: main, Credit: 10}, {Account: topup, Credit: 20}, {Account: AccountRevenue, Debit: 30}},
+		},
+		{
+			name:  "expiry is breakage",
+			ev:    LedgerEvent{Type: LedgerTopupExpired, Amount: 30},
+			delta: Balance{Topup: -30},
+			want:  []JournalLine{{Account: topup, Debit: 30}, {Account: AccountBreakage, Credit: 30}},
+		},
+		{
+			name:  "negative adjustment credits promo",
+			ev:    LedgerEvent{Type: LedgerAdjustment, Amount: 15, SignedAmount: -15},
+			delta: Balance{Main: -15},
+			want:  []JournalLine{{Account: main, Debit: 15}, {Account: AccountPromo, Credit: 15}},
+		},
+		{
+			name: "no change posts no lines",
+			ev:   LedgerEvent{Type: LedgerTokenUsed, Amount: 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ev.ID, tt.ev.UserID = "e1", "u1"
+			got := UserJournalEntry(tt.ev, tt.delta)
+			if got.ID != "evt:e1" || got.UserID != "u1" || got.EventType != string(tt.ev.Type) {
+				t.Errorf("entry header = %q %q %q", got.ID, got.UserID, got.EventType)
+			}
+			if !reflect.DeepEqual(got.Lines, tt.want) {
+				t.Errorf("lines = %+v, want %+v", got.Lines, tt.want)
+			}
+			if !got.Balanced() {
+				t.Errorf("entry is not balanced: %+v", got.Lines)
+			}
+		})
+	}
+}
+
+func TestRecordedDelta(t *testing.T) {
+	tests := []struct {
+		name   string
+		ev     LedgerEvent
+		want   Balance
+		wantOK bool
+	}{
+		{name: "subscribe", ev: LedgerEvent{Type: LedgerSubscribe, Amount: 100}, want: Balance{Main: 100}, wantOK: true},
+		{name: "topup", ev: LedgerEvent{Type: LedgerTopup, Amount: 40}, want: Balance{Topup: 40}, wantOK: true},
+		{name: "split usage", ev: LedgerEvent{Type: LedgerTokenUsed, Amount: 70, MainToken: intPtr(50), TopupToken: intPtr(20)}, want: Balance{Main: -50, Topup: -20}, wantOK: true},
+		{name: "usage without a split", ev: LedgerEvent{Type: LedgerTokenUsed, Amount: 70}},
+		{name: "legacy expiry", ev: LedgerEvent{Type: LedgerExpired, Amount: 10}},
+		{name: "topup expiry", ev: LedgerEvent{Type: LedgerTopupExpired, Amount: 30}, want: Balance{Topup: -30}, wantOK: true},
+		{name: "rollover records no change", ev: LedgerEvent{Type: LedgerRollover, Amount: 80}, wantOK: true},
+		{name: "legacy refund", ev: LedgerEvent{Type: LedgerRefund, Amount: 25}, want: Balance{Main: 25}, wantOK: true},
+		{name: "split refund", ev: LedgerEvent{Type: LedgerRefund, Amount: 25, MainToken: intPtr(15), TopupToken: intPtr(-10)}, want: Balance{Main: 15, Topup: 10}, wantOK: true},
+		{name: "organization usage", ev: LedgerEvent{Type: LedgerTokenUsed, Amount: 60, OrgID: "acme"}, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.ev.RecordedDelta()
+			if ok != tt.wantOK || ok && got != tt.want {
+				t.Errorf("RecordedDelta = %+v %v, want %+v %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
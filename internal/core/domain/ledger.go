@@ -0,0 +1,290 @@
+package domain
+
+import (
+	"time"
+)
+
+// LedgerEventType is the type of a user_usage_event document.
+type LedgerEventType string
+
+const (
+	LedgerSubscribe    LedgerEventType = "Subscribe"
+	LedgerTopup        LedgerEventType = "Topup"
+	LedgerTokenUsed    LedgerEventType = "Token Used"
+	LedgerExpired      LedgerEventType = "Expired"
+	LedgerMainExpired  LedgerEventType = "MainExpired"
+	LedgerTopupExpired LedgerEventType = "TopupExpired"
+	LedgerRefund       LedgerEventType = "Refund"
+	LedgerGrant        LedgerEventType = "Grant"
+	LedgerAdjustment   LedgerEventType = "Adjustment"
+	LedgerRollover     LedgerEventType = "Rollover"
+)
+
+var ledgerEventTypes = map[LedgerEventType]bool{
+	LedgerSubscribe: true, LedgerTopup: true, LedgerTokenUsed: true, LedgerExpired: true,
+	LedgerMainExpired: true, LedgerTopupExpired: true, LedgerRefund: true, LedgerGrant: true,
+	LedgerAdjustment: true, LedgerRollover: true,
+}
+
+// Valid reports whether t is a known event type.
+func (t LedgerEventType) Valid() bool {
+	return ledgerEventTypes[t]
+}
+
+// MainDeductionThreshold is the main balance below which usage is taken
+// from topup first when a package sets no deduction policy.
+const MainDeductionThreshold = 100
+
+// LedgerEvent is the part of a usage event that affects balances. Amount is
+// the unsigned eggToken; SignedAmount keeps the stored sign, which only
+// adjustments use. MainToken and TopupToken are the per-bucket amounts a
+// refund restores, when recorded.
+type LedgerEvent struct {
+	ID           string
+	Timestamp    time.Time
+	UserID       string
+	OrgID        string
+	Type         LedgerEventType
+	Amount       int
+	SignedAmount int
+	MainToken    *int
+	TopupToken   *int
+	Bucket       string
+	Deduction    *DeductionPolicy
+	// ExpiresAt is when the tokens a credit event grants expire, and LotID
+	// the lot an expiry event closes.
+	ExpiresAt *time.Time
+	LotID     string
+}
+
+// AffectsBalance reports whether the event changes the user's own balance.
+// Organization members' usage is charged to the organization pool.
+func (e LedgerEvent) AffectsBalance() bool {
+	return e.OrgID == ""
+}
+
+// Balance is a user's main and topup token balance.
+type Balance struct {
+	Main  int `json:"main" bson:"main"`
+	Topup int `json:"topup" bson:"topup"`
+}
+
+func (b Balance) Total() int {
+	return b.Main + b.Topup
+}
+
+// Balance rules name the steps Trace reports for an event.
+const (
+	RuleCreditMain        = "credit_main"
+	RuleCreditTopup       = "credit_topup"
+	RuleThresholdMain     = "threshold_main_first"
+	RuleThresholdTopup    = "threshold_topup_first"
+	RuleOverflowToTopup   = "overflow_to_topup"
+	RuleOverflowToMain    = "overflow_to_main"
+	RuleClampAtZero       = "clamp_at_zero"
+	RuleExpireMain        = "expire_main"
+	RuleExpireTopup       = "expire_topup"
+	RuleRolloverCap       = "rollover_cap"
+	RuleRefundSplit       = "refund_split"
+	RuleRefundMain        = "refund_main"
+	RuleAdjustMain        = "adjust_main"
+	RuleAdjustTopup       = "adjust_topup"
+	RuleOrgPoolSkipped    = "org_pool_skipped"
+	RuleQuarantineSkipped = "quarantined"
+)
+
+// Apply returns the balance after ev. Neither bucket goes below zero.
+func (b Balance) Apply(ev LedgerEvent) Balance {
+	b, _ = b.Trace(ev)
+	return b
+}
+
+// Trace is Apply that also reports which rules decided the outcome, for
+// explaining a balance.
+func (b Balance) Trace(ev LedgerEvent) (Balance, []string) {
+	if !ev.AffectsBalance() {
+		return b, []string{RuleOrgPoolSkipped}
+	}
+	amount := ev.Amount
+	var rules []string
+
+	switch ev.Type {
+	case LedgerSubscribe:
+		b.Main += amount
+		rules = append(rules, RuleCreditMain)
+	case LedgerTopup:
+		b.Topup += amount
+		rules = append(rules, RuleCreditTopup)
+	case LedgerTokenUsed:
+		d := ev.Deduction.Resolve().Split(b, amount)
+		rules = append(rules, d.Rules...)
+		b = b.take(d, &rules)
+	case LedgerExpired:
+		d := splitFirst(b, amount, true, RuleExpireMain)
+		rules = append(rules, d.Rules...)
+		b = b.take(d, &rules)
+	case LedgerMainExpired:
+		rules = append(rules, RuleExpireMain)
+		b.Main = clamp(b.Main-amount, &rules)
+	case LedgerRollover:
+		// A renewal's MainExpired removes the forfeited part; the
+		// Rollover records what was carried and caps main at it.
+		rules = append(rules, RuleRolloverCap)
+		b.Main = min(b.Main, amount)
+	case LedgerTopupExpired:
+		rules = append(rules, RuleExpireTopup)
+		b.Topup = clamp(b.Topup-amount, &rules)
+	case LedgerRefund:
+		// Refunds carry the per-bucket amounts they restore.
+		if ev.MainToken == nil && ev.TopupToken == nil {
+			b.Main += amount
+			rules = append(rules, RuleRefundMain)
+			break
+		}
+		b.Main += absInt(ev.MainToken)
+		b.Topup += absInt(ev.TopupToken)
+		rules = append(rules, RuleRefundSplit)
+	case LedgerGrant, LedgerAdjustment:
+		// Admin events target one bucket; adjustments keep their sign.
+		delta := amount
+		if ev.Type == LedgerAdjustment {
+			delta = ev.SignedAmount
+		}
+		if ev.Bucket == BucketTopup {
+			rules = append(rules, RuleAdjustTopup)
+			b.Topup = clamp(b.Topup+delta, &rules)
+		} else {
+			rules = append(rules, RuleAdjustMain)
+			b.Main = clamp(b.Main+delta, &rules)
+		}
+	}
+	return b, rules
+}
+
+// RecordedDelta returns the change ev records to each bucket, independent
+// of the balance it meets. ok is false for legacy events whose change
+// depends on that balance: usage without its split and Expired events.
+func (e LedgerEvent) RecordedDelta() (d Balance, ok bool) {
+	if !e.AffectsBalance() {
+		return d, true
+	}
+	switch e.Type {
+	case LedgerSubscribe:
+		d.Main = e.Amount
+	case LedgerTopup:
+		d.Topup = e.Amount
+	case LedgerTokenUsed:
+		if e.MainToken == nil || e.TopupToken == nil {
+			return d, false
+		}
+		d.Main, d.Topup = -absInt(e.MainToken), -absInt(e.TopupToken)
+	case LedgerExpired:
+		return d, false
+	case LedgerMainExpired:
+		d.Main = -e.Amount
+	case LedgerTopupExpired:
+		d.Topup = -e.Amount
+	case LedgerRollover:
+		// The renewal's MainExpired already removed the forfeited part.
+	case LedgerRefund:
+		if e.MainToken == nil && e.TopupToken == nil {
+			d.Main = e.Amount
+			break
+		}
+		d.Main, d.Topup = absInt(e.MainToken), absInt(e.TopupToken)
+	case LedgerGrant, LedgerAdjustment:
+		delta := e.Amount
+		if e.Type == LedgerAdjustment {
+			delta = e.SignedAmount
+		}
+		if e.Bucket == BucketTopup {
+			d.Topup = delta
+		} else {
+			d.Main = delta
+		}
+	}
+	return d, true
+}
+
+// Add returns the sum of two balances.
+func (b Balance) Add(o Balance) Balance {
+	return Balance{Main: b.Main + o.Main, Topup: b.Topup + o.Topup}
+}
+
+// RollupLedger replays events, in order, on top of start.
+func RollupLedger(start Balance, events []LedgerEvent) Balance {
+	b := start
+	for _, ev := range events {
+		b = b.Apply(ev)
+	}
+	return b
+}
+
+// take subtracts a deduction, flooring only the buckets it charged.
+func (b Balance) take(d Deduction, rules *[]string) Balance {
+	if d.Main != 0 {
+		b.Main = clamp(b.Main-d.Main, rules)
+	}
+	if d.Topup != 0 {
+		b.Topup = clamp(b.Topup-d.Topup, rules)
+	}
+	return b
+}
+
+// clamp floors n at zero, noting when it had to.
+func clamp(n int, rules *[]string) int {
+	if n < 0 {
+		*rules = append(*rules, RuleClampAtZero)
+		return 0
+	}
+	return n
+}
+
+func absInt(p *int) int {
+	if p == nil {
+		return 0
+	}
+	if *p < 0 {
+		return -*p
+	}
+	return *p
+}
+
+// QuarantinedEvent is a usage event that could not be decoded and is left
+// out of balance replays until it is fixed.
+type QuarantinedEvent struct {
+	EventID    string    `json:"eventId" bson:"eventId"`
+	UserID     string    `json:"userId" bson:"userId"`
+	EventType  string    `json:"eventType,omitempty" bson:"eventType,omitempty"`
+	Error      string    `json:"error" bson:"error"`
+	DetectedAt time.Time `json:"detectedAt" bson:"detectedAt"`
+}
+
+// BalanceExplanation is a step-by-step replay of a user's balance.
+type BalanceExplanation struct {
+	UserID  string        `json:"userId"`
+	Opening Balance       `json:"opening"`
+	Steps   []BalanceStep `json:"steps"`
+	Closing Balance       `json:"closing"`
+	// Stored is the balance currently in user_balance; Matches reports
+	// whether it equals a full replay.
+	Stored  *Balance `json:"stored,omitempty"`
+	Matches *bool    `json:"matches,omitempty"`
+	// Journal is what the user's journal accounts hold; JournalMatches
+	// reports whether it equals a full replay.
+	Journal        *Balance `json:"journal,omitempty"`
+	JournalMatches *bool    `json:"journalMatches,omitempty"`
+}
+
+// BalanceStep is one event and its effect on the balance.
+type BalanceStep struct {
+	EventID        string    `json:"eventId"`
+	EventTimeStamp time.Time `json:"eventTimeStamp"`
+	EventType      string    `json:"eventType"`
+	EggToken       int       `json:"eggToken"`
+	TraceID        string    `json:"traceId,omitempty"`
+	Before         Balance   `json:"before"`
+	After          Balance   `json:"after"`
+	Rules          []string  `json:"rules"`
+	Error          string    `json:"error,omitempty"`
+}
@@ -0,0 +1,123 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func intPtr(n int) *int { return &n }
+
+func TestBalanceTrace(t *testing.T) {
+	tests := []struct {
+		name      string
+		start     Balance
+		ev        LedgerEvent
+		want      Balance
+		wantRules []string
+	}{
+		{
+			name:  "subscribe credits main",
+			start: Balance{Main: 10, Topup: 5},
+			ev:    LedgerEvent{Type: LedgerSubscribe, Amount: 100},
+			want:  Balance{Main: 110, Topup: 5}, wantRules: []string{RuleCreditMain},
+		},
+		{
+			name:  "topup credits topup",
+			start: Balance{Main: 10, Topup: 5},
+			ev:    LedgerEvent{Type: LedgerTopup, Amount: 100},
+			want:  Balance{Main: 10, Topup: 105}, wantRules: []string{RuleCreditTopup},
+		},
+		{
+			name:  "usage above the threshold draws main first",
+			start: Balance{Main: 150, Topup: 50},
+			ev:    LedgerEvent{Type: LedgerTokenUsed, Amount: 170},
+			want:  Balance{Main: 0, Topup: 30}, wantRules: []string{RuleThresholdMain, RuleOverflowToTopup},
+		},
+		{
+			name:  "usage below the threshold draws topup first",
+			start: Balance{Main: 50, Topup: 20},
+			ev:    LedgerEvent{Type: LedgerTokenUsed, Amount: 30},
+			want:  Balance{Main: 40, Topup: 0}, wantRules: []string{RuleThresholdTopup, RuleOverflowToMain},
+		},
+		{
+			name:  "usage beyond the balance clamps",
+			start: Balance{Main: 150, Topup: 10},
+			ev:    LedgerEvent{Type: LedgerTokenUsed, Amount: 200},
+			want:  Balance{}, wantRules: []string{RuleThresholdMain, RuleOverflowToTopup, RuleClampAtZero},
+		},
+		{
+			name:  "organization usage is skipped",
+			start: Balance{Main: 150},
+			ev:    LedgerEvent{Type: LedgerTokenUsed, Amount: 100, OrgID: "acme"},
+			want:  Balance{Main: 150}, wantRules: []string{RuleOrgPoolSkipped},
+		},
+		{
+			name:  "legacy expiry takes main first",
+			start: Balance{Main: 30, Topup: 30},
+			ev:    LedgerEvent{Type: LedgerExpired, Amount: 40},
+			want:  Balance{Main: 0, Topup: 20}, wantRules: []string{RuleExpireMain, RuleOverflowToTopup},
+		},
+		{
+			name:  "main expiry clamps",
+			start: Balance{Main: 30, Topup: 30},
+			ev:    LedgerEvent{Type: LedgerMainExpired, Amount: 40},
+			want:  Balance{Main: 0, Topup: 30}, wantRules: []string{RuleExpireMain, RuleClampAtZero},
+		},
+		{
+			name:  "topup expiry",
+			start: Balance{Main: 30, Topup: 30},
+			ev:    LedgerEvent{Type: LedgerTopupExpired, Amount: 10},
+			want:  Balance{Main: 30, Topup: 20}, wantRules: []string{RuleExpireTopup},
+		},
+		{
+			name:  "rollover caps main",
+			start: Balance{Main: 300, Topup: 30},
+			ev:    LedgerEvent{Type: LedgerRollover, Amount: 100},
+			want:  Balance{Main: 100, Topup: 30}, wantRules: []string{RuleRolloverCap},
+		},
+		{
+			name:  "rollover never raises main",
+			start: Balance{Main: 50},
+			ev:    LedgerEvent{Type: LedgerRollover, Amount: 100},
+			want:  Balance{Main: 50}, wantRules: []string{RuleRolloverCap},
+		},
+		{
+			name:  "legacy refund goes to main",
+			start: Balance{Main: 10, Topup: 10},
+			ev:    LedgerEvent{Type: LedgerRefund, Amount: 25},
+			want:  Balance{Main: 35, Topup: 10}, wantRules: []string{RuleRefundMain},
+		},
+		{
+			name:  "refund restores both buckets",
+			start: Balance{Main: 10, Topup: 10},
+			ev:    LedgerEvent{Type: LedgerRefund, Amount: 25, MainToken: intPtr(15), TopupToken: intPtr(-10)},
+			want:  Balance{Main: 25, Topup: 20}, wantRules: []string{RuleRefundSplit},
+		},
+		{
+			name:  "grant to topup",
+			start: Balance{Main: 10},
+			ev:    LedgerEvent{Type: LedgerGrant, Amount: 40, SignedAmount: 40, Bucket: BucketTopup},
+			want:  Balance{Main: 10, Topup: 40}, wantRules: []string{RuleAdjustTopup},
+		},
+		{
+			name:  "negative adjustment keeps its sign and clamps",
+			start: Balance{Main: 10},
+			ev:    LedgerEvent{Type: LedgerAdjustment, Amount: 40, SignedAmount: -40, Bucket: BucketMain},
+			want:  Balance{}, wantRules: []string{RuleAdjustMain, RuleClampAtZero},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rules := tt.start.Trace(tt.ev)
+			if got != tt.want {
+				t.Errorf("balance = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(rules, tt.wantRules) {
+				t.Errorf("rules = %v, want %v", rules, tt.wantRules)
+			}
+			if applied := tt.start.Apply(tt.ev); applied != got {
+				t.Errorf("Apply = %+v, Trace = %+v", applied, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package domain
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	OrgEventFund   = "Fund"
+	OrgEventUsage  = "Usage"
+	OrgEventRefund = "Refund"
+
+	IntervalDaily   = "daily"
+	IntervalWeekly  = "weekly"
+	IntervalMonthly = "monthly"
+)
+
+// Organization is a B2B customer whose members draw from a shared pool.
+type Organization struct {
+	OrgID       string `json:"orgId" bson:"orgId"`
+	Name        string `json:"name" bson:"name"`
+	PackageID   string `json:"packageId,omitempty" bson:"packageId,omitempty"`
+	PoolBalance int    `json:"poolBalance" bson:"poolBalance"`
+	Status      string `json:"status" bson:"status"`
+	// FundedThrough holds, per schedule ID, the last period credited to
+	// the pool, so a retried funding is not credited twice.
+	FundedThrough map[string]time.Time `json:"-" bson:"fundedThrough,omitempty"`
+	CreatedAt     time.Time            `json:"createdAt" bson:"createdAt"`
+	UpdatedAt     time.Time            `json:"updatedAt" bson:"updatedAt"`
+}
+
+// OrgMember links a user to an organization. PeriodConsumed resets each
+// time the pool is funded and is what Cap is checked against.
+type OrgMember struct {
+	OrgID          string    `json:"orgId" bson:"orgId"`
+	UserID         string    `json:"userId" bson:"userId"`
+	Cap            *int      `json:"cap,omitempty" bson:"cap,omitempty"`
+	PeriodConsumed int       `json:"periodConsumed" bson:"periodConsumed"`
+	TotalConsumed  int       `json:"totalConsumed" bson:"totalConsumed"`
+	CreatedAt      time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// B2BSchedule funds an organization's pool every interval.
+type B2BSchedule struct {
+	ID        primitive.ObjectID `json:"scheduleId" bson:"_id,omitempty"`
+	OrgID     string             `json:"orgId" bson:"orgId"`
+	PackageID string             `json:"packageId" bson:"packageId"`
+	EggToken  int                `json:"eggToken" bson:"eggToken"`
+	Interval  string             `json:"interval" bson:"interval"`
+	NextRunAt time.Time          `json:"nextRunAt" bson:"nextRunAt"`
+	Status    string             `json:"status" bson:"status"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+// OrgPoolEvent records every movement of an organization's pool.
+type OrgPoolEvent struct {
+	ID             primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	OrgID          string              `json:"orgId" bson:"orgId"`
+	EventType      string              `json:"eventType" bson:"eventType"`
+	EggToken       int                 `json:"eggToken" bson:"eggToken"`
+	UserID         *string             `json:"userId,omitempty" bson:"userId,omitempty"`
+	TraceID        *string             `json:"traceId,omitempty" bson:"traceId,omitempty"`
+	ScheduleID     *primitive.ObjectID `json:"scheduleId,omitempty" bson:"scheduleId,omitempty"`
+	PeriodStart    *time.Time          `json:"periodStart,omitempty" bson:"periodStart,omitempty"`
+	EventTimeStamp time.Time           `json:"eventTimeStamp" bson:"eventTimeStamp"`
+	// AppliedAt is set on a Fund event once the pool has been credited.
+	AppliedAt *time.Time `json:"appliedAt,omitempty" bson:"appliedAt,omitempty"`
+}
+
+type OrganizationIn struct {
+	OrgID string `json:"orgId"`
+	Name  string `json:"name"`
+}
+
+// OrgMemberIn sets a member's cap; a nil Cap removes it.
+type OrgMemberIn struct {
+	Cap *int `json:"cap"`
+}
+
+type B2BScheduleIn struct {
+	PackageID string     `json:"packageId"`
+	EggToken  int        `json:"eggToken,omitempty"`
+	Interval  string     `json:"interval"`
+	StartAt   *time.Time `json:"startAt,omitempty"`
+}
+
+type OrganizationDetail struct {
+	Organization
+	Members []OrgMember `json:"members"`
+}
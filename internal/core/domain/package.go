@@ -0,0 +1,133 @@
+package domain
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// PackageMaster is a package in the package_master_v3 catalog. Version is
+// bumped on every change and each version is kept in package_master_versions,
+// so usage events can be traced back to the terms they were charged under.
+type PackageMaster struct {
+	PackageID string  `json:"packageId" bson:"packageId"`
+	Name      string  `json:"name" bson:"name"`
+	Price     float64 `json:"price" bson:"price"`
+	Currency  string  `json:"currency" bson:"currency"`
+	EggToken  int     `json:"eggToken" bson:"eggToken"`
+	// ConversionRatio is the THB price of one egg token. Legacy documents
+	// that store it as anything but a number decode as 0, which prices at 1.
+	ConversionRatio float64 `json:"conversionRatio" bson:"conversionRatio"`
+	ValidityDays    int     `json:"validityDays" bson:"validityDays"`
+	Tier            string  `json:"tier" bson:"tier"`
+	// Rollover decides how much unused main balance carries into the next
+	// period on renewal. Nil means none.
+	Rollover *RolloverPolicy `json:"rollover,omitempty" bson:"rollover,omitempty"`
+	// Deduction decides which bucket usage is charged to. Nil means
+	// main_first_threshold at MainDeductionThreshold.
+	Deduction *DeductionPolicy `json:"deduction,omitempty" bson:"deduction,omitempty"`
+	// Active is true for legacy documents without the field.
+	Active    bool      `json:"active" bson:"active"`
+	Version   int       `json:"version" bson:"version"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// UnmarshalBSON decodes a package tolerantly: legacy catalog documents may
+// store conversionRatio as a string or leave out active.
+func (p *PackageMaster) UnmarshalBSON(data []byte) error {
+	type plain PackageMaster
+	var doc struct {
+		Package         plain         `bson:",inline"`
+		ConversionRatio bson.RawValue `bson:"conversionRatio"`
+	}
+	doc.Package.Active = true
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	ratio, err := conversionRatio(doc.ConversionRatio)
+	if err != nil {
+		return err
+	}
+	*p = PackageMaster(doc.Package)
+	p.ConversionRatio = ratio
+	return nil
+}
+
+// conversionRatio reads a stored conversion ratio of any numeric type. Other
+// types, including strings, read as 0.
+func conversionRatio(v bson.RawValue) (float64, error) {
+	switch v.Type {
+	case bsontype.Double:
+		return v.Double(), nil
+	case bsontype.Int32:
+		return float64(v.Int32()), nil
+	case bsontype.Int64:
+		return float64(v.Int64()), nil
+	case bsontype.Decimal128:
+		f, err := strconv.ParseFloat(v.Decimal128().String(), 64)
+		if err != nil {
+			return 0, fmt.Errorf("conversionRatio: %w", err)
+		}
+		return f, nil
+	default:
+		return 0, nil
+	}
+}
+
+const (
+	RolloverNone    = "none"
+	RolloverFull    = "full"
+	RolloverCap     = "cap"
+	RolloverPercent = "percent"
+)
+
+// RolloverPolicy carries nothing, everything, at most Cap tokens, or Percent
+// percent of the unused main balance into the next period.
+type RolloverPolicy struct {
+	Mode    string  `json:"mode" bson:"mode"`
+	Cap     int     `json:"cap,omitempty" bson:"cap,omitempty"`
+	Percent float64 `json:"percent,omitempty" bson:"percent,omitempty"`
+}
+
+// PackageVersion is an immutable snapshot of a package's terms.
+type PackageVersion struct {
+	PackageMaster `bson:",inline"`
+	ChangedAt     time.Time `json:"changedAt" bson:"changedAt"`
+}
+
+// UnmarshalBSON decodes the inlined terms with PackageMaster's tolerant
+// decoder, which the driver skips for inline fields.
+func (v *PackageVersion) UnmarshalBSON(data []byte) error {
+	var changed struct {
+		ChangedAt time.Time `bson:"changedAt"`
+	}
+	if err := bson.Unmarshal(data, &changed); err != nil {
+		return err
+	}
+	if err := v.PackageMaster.UnmarshalBSON(data); err != nil {
+		return err
+	}
+	v.ChangedAt = changed.ChangedAt
+	return nil
+}
+
+// PackageIn is the body for creating or replacing a package. On update,
+// Version must match the current version when set.
+type PackageIn struct {
+	PackageID       string           `json:"packageId"`
+	Name            string           `json:"name"`
+	Price           float64          `json:"price"`
+	Currency        string           `json:"currency"`
+	EggToken        int              `json:"eggToken"`
+	ConversionRatio float64          `json:"conversionRatio"`
+	ValidityDays    int              `json:"validityDays"`
+	Tier            string           `json:"tier"`
+	Rollover        *RolloverPolicy  `json:"rollover,omitempty"`
+	Deduction       *DeductionPolicy `json:"deduction,omitempty"`
+	Active          *bool            `json:"active,omitempty"`
+	Version         *int             `json:"version,omitempty"`
+}
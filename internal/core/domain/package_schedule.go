@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ScheduleUpgrade   = "upgrade"
+	ScheduleDowngrade = "downgrade"
+	ScheduleCancel    = "cancel"
+
+	SchedulePending   = "pending"
+	ScheduleApplying  = "applying"
+	ScheduleApplied   = "applied"
+	ScheduleCancelled = "cancelled"
+)
+
+// PackageSchedule is a plan change in user_package_schedule that takes
+// effect when the user's current main package period ends. An upgrade is
+// paid for up front with a subscription payment for the target package,
+// which it reserves.
+type PackageSchedule struct {
+	ID              primitive.ObjectID `json:"scheduleId" bson:"_id,omitempty"`
+	UserID          string             `json:"userId" bson:"userId"`
+	Action          string             `json:"action" bson:"action"`
+	FromPackageID   string             `json:"fromPackageId" bson:"fromPackageId"`
+	TargetPackageID string             `json:"targetPackageId,omitempty" bson:"targetPackageId,omitempty"`
+	PaymentID       string             `json:"paymentId,omitempty" bson:"paymentId,omitempty"`
+	EffectiveAt     time.Time          `json:"effectiveAt" bson:"effectiveAt"`
+	Status          string             `json:"status" bson:"status"`
+	LastError       string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	// ClaimedUntil is the lease of the worker applying the schedule, or
+	// when a schedule that failed may be tried again.
+	ClaimedUntil *time.Time `json:"-" bson:"claimedUntil,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt" bson:"createdAt"`
+	UpdatedAt    time.Time  `json:"updatedAt" bson:"updatedAt"`
+	AppliedAt    *time.Time `json:"appliedAt,omitempty" bson:"appliedAt,omitempty"`
+}
+
+type PackageScheduleIn struct {
+	Action          string `json:"action"`
+	TargetPackageID string `json:"targetPackageId,omitempty"`
+	// PaymentID is the pending or succeeded, not yet granted subscription
+	// payment for the target package that pays for an upgrade.
+	PaymentID string `json:"paymentId,omitempty"`
+}
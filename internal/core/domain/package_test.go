@@ -0,0 +1,69 @@
+package domain
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPackageMasterUnmarshalBSON(t *testing.T) {
+	ratio, _ := primitive.ParseDecimal128("0.25")
+	tests := []struct {
+		name       string
+		doc        bson.M
+		wantRatio  float64
+		wantActive bool
+	}{
+		{name: "double", doc: bson.M{"conversionRatio": 0.5, "active": true}, wantRatio: 0.5, wantActive: true},
+		{name: "int32", doc: bson.M{"conversionRatio": int32(2)}, wantRatio: 2, wantActive: true},
+		{name: "int64", doc: bson.M{"conversionRatio": int64(3)}, wantRatio: 3, wantActive: true},
+		{name: "decimal", doc: bson.M{"conversionRatio": ratio}, wantRatio: 0.25, wantActive: true},
+		{name: "legacy string reads as 0", doc: bson.M{"conversionRatio": "1.5"}, wantRatio: 0, wantActive: true},
+		{name: "missing ratio", doc: bson.M{}, wantRatio: 0, wantActive: true},
+		{name: "inactive", doc: bson.M{"conversionRatio": 1.0, "active": false}, wantRatio: 1, wantActive: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.doc["packageId"] = "p1"
+			tt.doc["version"] = 4
+			data, err := bson.Marshal(tt.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pkg PackageMaster
+			if err := bson.Unmarshal(data, &pkg); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if pkg.ConversionRatio != tt.wantRatio || pkg.Active != tt.wantActive {
+				t.Errorf("ratio=%v active=%v, want ratio=%v active=%v", pkg.ConversionRatio, pkg.Active, tt.wantRatio, tt.wantActive)
+			}
+			if pkg.PackageID != "p1" || pkg.Version != 4 {
+				t.Errorf("packageId=%q version=%d, want p1 and 4", pkg.PackageID, pkg.Version)
+			}
+
+			var ver PackageVersion
+			if err := bson.Unmarshal(data, &ver); err != nil {
+				t.Fatalf("Unmarshal version: %v", err)
+			}
+			if ver.ConversionRatio != tt.wantRatio || ver.Active != tt.wantActive || ver.PackageID != "p1" {
+				t.Errorf("version %+v, want ratio=%v active=%v", ver.PackageMaster, tt.wantRatio, tt.wantActive)
+			}
+		})
+	}
+}
+
+func TestPackageMasterRoundTrip(t *testing.T) {
+	in := PackageMaster{PackageID: "p1", ConversionRatio: 0.75, Active: false, Version: 2}
+	data, err := bson.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out PackageMaster
+	if err := bson.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+}
@@ -0,0 +1,84 @@
+package domain
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	PaymentSucceeded = "payment.succeeded"
+	PaymentFailed    = "payment.failed"
+	PaymentRefunded  = "payment.refunded"
+
+	PaymentKindSubscription = "subscription"
+	PaymentKindTopup        = "topup"
+
+	PaymentStatusPending   = "pending"
+	PaymentStatusSucceeded = "succeeded"
+	PaymentStatusFailed    = "failed"
+	PaymentStatusRefunded  = "refunded"
+)
+
+// PaymentWebhookEvent is a payment gateway notification, modeled on Stripe
+// and Omise events. ID identifies the delivery; the same payment may appear
+// in several events as its status changes.
+type PaymentWebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      PaymentData `json:"data"`
+}
+
+type PaymentData struct {
+	PaymentID string  `json:"paymentId"`
+	UserID    string  `json:"userId"`
+	Kind      string  `json:"kind"`
+	PackageID string  `json:"packageId"`
+	Amount    float64 `json:"amount"`
+	Currency  string  `json:"currency"`
+}
+
+// PaymentTransaction is a payment in payment_transactions. Granted and
+// Revoked record whether its credits have been applied and taken back. A
+// payment reserved by a scheduled upgrade (ScheduleID) is granted when the
+// upgrade applies rather than when it succeeds. A recurring payment for a
+// subscription the user already has pays for the period starting at
+// RenewalPeriod and is granted by that renewal.
+type PaymentTransaction struct {
+	PaymentID      string              `json:"paymentId" bson:"paymentId"`
+	UserID         string              `json:"userId" bson:"userId"`
+	Kind           string              `json:"kind" bson:"kind"`
+	PackageID      string              `json:"packageId" bson:"packageId"`
+	Amount         float64             `json:"amount" bson:"amount"`
+	Currency       string              `json:"currency" bson:"currency"`
+	Status         string              `json:"status" bson:"status"`
+	EggToken       int                 `json:"eggToken,omitempty" bson:"eggToken,omitempty"`
+	SubscriptionID string              `json:"subscriptionId,omitempty" bson:"subscriptionId,omitempty"`
+	EventIDs       []string            `json:"eventIds" bson:"eventIds"`
+	GrantedAt      *time.Time          `json:"grantedAt,omitempty" bson:"grantedAt,omitempty"`
+	RevokedAt      *time.Time          `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+	ScheduleID     *primitive.ObjectID `json:"scheduleId,omitempty" bson:"scheduleId,omitempty"`
+	RenewalPeriod  *time.Time          `json:"renewalPeriod,omitempty" bson:"renewalPeriod,omitempty"`
+	CreatedAt      time.Time           `json:"createdAt" bson:"createdAt"`
+	UpdatedAt      time.Time           `json:"updatedAt" bson:"updatedAt"`
+}
+
+// SubscriptionTransaction is a subscription started by a payment, kept in
+// subscription_transactions.
+type SubscriptionTransaction struct {
+	SubscriptionID string    `json:"subscriptionId" bson:"subscriptionId"`
+	PaymentID      string    `json:"paymentId" bson:"paymentId"`
+	UserID         string    `json:"userId" bson:"userId"`
+	PackageID      string    `json:"packageId" bson:"packageId"`
+	Status         string    `json:"status" bson:"status"`
+	StartDate      time.Time `json:"startDate" bson:"startDate"`
+	EndDate        time.Time `json:"endDate" bson:"endDate"`
+	CreatedAt      time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+type PaymentWebhookResponse struct {
+	Duplicate bool               `json:"duplicate"`
+	Payment   PaymentTransaction `json:"payment"`
+}
@@ -0,0 +1,62 @@
+package domain
+
+import (
+	"time"
+)
+
+// Flags raised on usage events when the charge needs a second look.
+const (
+	FlagUnknownModel  = "unknown_model"
+	FlagModelDisabled = "model_disabled"
+)
+
+type Provider struct {
+	ProviderID  string    `json:"providerId" bson:"providerId"`
+	DisplayName string    `json:"displayName" bson:"displayName"`
+	Enabled     bool      `json:"enabled" bson:"enabled"`
+	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// ProviderModel is the canonical record for an AI model. Aliases hold the
+// raw ai_model strings Portkey reports for it, stored lower-case.
+type ProviderModel struct {
+	ModelID     string   `json:"modelId" bson:"modelId"`
+	ProviderID  string   `json:"providerId" bson:"providerId"`
+	DisplayName string   `json:"displayName" bson:"displayName"`
+	Aliases     []string `json:"aliases" bson:"aliases"`
+	// Prices are in USD per token.
+	InputPricePerToken  float64   `json:"inputPricePerToken" bson:"inputPricePerToken"`
+	OutputPricePerToken float64   `json:"outputPricePerToken" bson:"outputPricePerToken"`
+	ContextWindow       int       `json:"contextWindow" bson:"contextWindow"`
+	Enabled             bool      `json:"enabled" bson:"enabled"`
+	CreatedAt           time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt           time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+type ProviderIn struct {
+	ProviderID  string `json:"providerId"`
+	DisplayName string `json:"displayName"`
+	Enabled     *bool  `json:"enabled,omitempty"`
+}
+
+type ProviderModelIn struct {
+	ModelID             string   `json:"modelId"`
+	ProviderID          string   `json:"providerId"`
+	DisplayName         string   `json:"displayName"`
+	Aliases             []string `json:"aliases"`
+	InputPricePerToken  float64  `json:"inputPricePerToken"`
+	OutputPricePerToken float64  `json:"outputPricePerToken"`
+	ContextWindow       int      `json:"contextWindow"`
+	Enabled             *bool    `json:"enabled,omitempty"`
+}
+
+// UnknownModelUsage summarises charges for an ai_model the registry could
+// not resolve.
+type UnknownModelUsage struct {
+	AIModel   string    `json:"aiModel" bson:"_id"`
+	Events    int       `json:"events" bson:"events"`
+	EggToken  int       `json:"eggToken" bson:"eggToken"`
+	FirstSeen time.Time `json:"firstSeen" bson:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen" bson:"lastSeen"`
+}
@@ -0,0 +1,34 @@
+package domain
+
+// QuoteIn is the body of POST /api/v1/quote: an estimate of a run the
+// caller has not started yet.
+type QuoteIn struct {
+	UserID           string `json:"userId"`
+	Model            string `json:"model"`
+	PromptTokens     int    `json:"promptTokens"`
+	CompletionTokens int    `json:"completionTokens"`
+	WebsearchCount   int    `json:"websearchCount,omitempty"`
+}
+
+// Quote prices a QuoteIn the way the usage would be charged. Token amounts
+// are positive. Available is what the charge would draw on: the user's
+// remaining balance, or for organization members the pool, limited by the
+// member's cap.
+type Quote struct {
+	UserID            string   `json:"userId"`
+	PackageID         string   `json:"packageId"`
+	OrgID             string   `json:"orgId,omitempty"`
+	Model             string   `json:"model"`
+	ModelID           string   `json:"modelId,omitempty"`
+	TotalCostUsd      string   `json:"totalCostUsd"`
+	ChatCostUsd       string   `json:"chatCostUsd"`
+	WebsearchCostUsd  string   `json:"websearchCostUsd"`
+	ChatToken         int      `json:"chatToken"`
+	WebsearchToken    int      `json:"websearchToken"`
+	EggToken          int      `json:"eggToken"`
+	PremiumMultiplier float64  `json:"premiumMultiplier,omitempty"`
+	Flags             []string `json:"flags,omitempty"`
+	Available         int      `json:"available"`
+	Affordable        bool     `json:"affordable"`
+	Shortfall         int      `json:"shortfall,omitempty"`
+}
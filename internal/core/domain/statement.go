@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"time"
+)
+
+// Statement is a user's monthly account statement. Every amount is the
+// change the events made to the balance, as replayed by RollupBalances, so
+// Opening plus the section totals equals Closing.
+type Statement struct {
+	UserID        string           `json:"userId"`
+	Month         string           `json:"month"`
+	PeriodStart   time.Time        `json:"periodStart"`
+	PeriodEnd     time.Time        `json:"periodEnd"`
+	Opening       StatementBalance `json:"opening"`
+	Subscriptions []StatementLine  `json:"subscriptions"`
+	Topups        []StatementLine  `json:"topups"`
+	Usage         []StatementUsage `json:"usage"`
+	Refunds       StatementAmount  `json:"refunds"`
+	Adjustments   StatementAmount  `json:"adjustments"`
+	Expiries      []StatementLine  `json:"expiries"`
+	Closing       StatementBalance `json:"closing"`
+	GeneratedAt   time.Time        `json:"generatedAt"`
+}
+
+type StatementBalance struct {
+	MainToken  int     `json:"mainToken"`
+	TopupToken int     `json:"topupToken"`
+	EggToken   int     `json:"eggToken"`
+	Thb        float64 `json:"thb"`
+}
+
+// StatementAmount is a signed token change and its THB value.
+type StatementAmount struct {
+	Count    int     `json:"count"`
+	EggToken int     `json:"eggToken"`
+	Thb      float64 `json:"thb"`
+}
+
+type StatementLine struct {
+	Date      time.Time `json:"date"`
+	EventType string    `json:"eventType"`
+	PackageID string    `json:"packageId,omitempty"`
+	StatementAmount
+}
+
+// StatementUsage is the month's usage for one model and agent.
+type StatementUsage struct {
+	AIModel string `json:"aiModel"`
+	AgentID string `json:"agentId,omitempty"`
+	StatementAmount
+}
@@ -7,44 +7,117 @@ import (
 )
 
 type UsageEventOut struct {
-	EventTimeStamp   time.Time             `json:"eventTimeStamp" bson:"eventTimeStamp"`
-	UserID           string                `json:"userId" bson:"userId"`
-	EventType        string                `json:"eventType" bson:"eventType"`
-	SubscriptionID   *string               `json:"subscriptionId,omitempty" bson:"subscriptionId,omitempty"`
-	PackageID        *string               `json:"packageId,omitempty" bson:"packageId,omitempty"`
-	EggToken         int                   `json:"eggToken" bson:"eggToken"`
-	ChatToken        *int                  `json:"chatToken,omitempty" bson:"chatToken,omitempty"`
-	WebsearchToken   *int                  `json:"websearchToken,omitempty" bson:"websearchToken,omitempty"`
-	TotalCostUSD     *primitive.Decimal128 `json:"totalCostUsd,omitempty" bson:"totalCostUsd,omitempty"`
-	ChatCostUSD      *primitive.Decimal128 `json:"chatCostUsd,omitempty" bson:"chatCostUsd,omitempty"`
-	WebsearchCostUSD *primitive.Decimal128 `json:"websearchCostUsd,omitempty" bson:"websearchCostUsd,omitempty"`
-	TraceID          *string               `json:"traceId,omitempty" bson:"traceId,omitempty"`
-	AIModel          *string               `json:"aiModel,omitempty" bson:"aiModel,omitempty"`
-	AgentID          *string               `json:"agentId,omitempty" bson:"agentId,omitempty"`
+	ID                primitive.ObjectID    `json:"id,omitempty" bson:"_id,omitempty"`
+	EventTimeStamp    time.Time             `json:"eventTimeStamp" bson:"eventTimeStamp"`
+	UserID            string                `json:"userId" bson:"userId"`
+	OrgID             *string               `json:"orgId,omitempty" bson:"orgId,omitempty"`
+	EventType         string                `json:"eventType" bson:"eventType"`
+	SubscriptionID    *string               `json:"subscriptionId,omitempty" bson:"subscriptionId,omitempty"`
+	PackageID         *string               `json:"packageId,omitempty" bson:"packageId,omitempty"`
+	PackageVersion    *int                  `json:"packageVersion,omitempty" bson:"packageVersion,omitempty"`
+	EggToken          int                   `json:"eggToken" bson:"eggToken"`
+	MainToken         *int                  `json:"mainToken,omitempty" bson:"mainToken,omitempty"`
+	TopupToken        *int                  `json:"topupToken,omitempty" bson:"topupToken,omitempty"`
+	Deduction         *DeductionPolicy      `json:"deduction,omitempty" bson:"deduction,omitempty"`
+	ChatToken         *int                  `json:"chatToken,omitempty" bson:"chatToken,omitempty"`
+	WebsearchToken    *int                  `json:"websearchToken,omitempty" bson:"websearchToken,omitempty"`
+	TotalCostUSD      *primitive.Decimal128 `json:"totalCostUsd,omitempty" bson:"totalCostUsd,omitempty"`
+	ChatCostUSD       *primitive.Decimal128 `json:"chatCostUsd,omitempty" bson:"chatCostUsd,omitempty"`
+	WebsearchCostUSD  *primitive.Decimal128 `json:"websearchCostUsd,omitempty" bson:"websearchCostUsd,omitempty"`
+	TraceID           *string               `json:"traceId,omitempty" bson:"traceId,omitempty"`
+	AIModel           *string               `json:"aiModel,omitempty" bson:"aiModel,omitempty"`
+	ModelID           *string               `json:"modelId,omitempty" bson:"modelId,omitempty"`
+	Flags             []string              `json:"flags,omitempty" bson:"flags,omitempty"`
+	PremiumMultiplier *float64              `json:"premiumMultiplier,omitempty" bson:"premiumMultiplier,omitempty"`
+	AgentID           *string               `json:"agentId,omitempty" bson:"agentId,omitempty"`
+	RefundedToken     int                   `json:"refundedToken,omitempty" bson:"refundedToken,omitempty"`
+	RefundOf          *primitive.ObjectID   `json:"refundOf,omitempty" bson:"refundOf,omitempty"`
+	Reason            *string               `json:"reason,omitempty" bson:"reason,omitempty"`
+	Bucket            *string               `json:"bucket,omitempty" bson:"bucket,omitempty"`
+	Actor             *string               `json:"actor,omitempty" bson:"actor,omitempty"`
+	ScheduleID        *primitive.ObjectID   `json:"scheduleId,omitempty" bson:"scheduleId,omitempty"`
+	RenewalPeriod     *time.Time            `json:"renewalPeriod,omitempty" bson:"renewalPeriod,omitempty"`
+	PaymentID         *string               `json:"paymentId,omitempty" bson:"paymentId,omitempty"`
+	ExpiresAt         *time.Time            `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	LotID             *string               `json:"lotId,omitempty" bson:"lotId,omitempty"`
 }
 
+const (
+	BucketMain  = "main"
+	BucketTopup = "topup"
+)
+
 type TokenUsedIn struct {
-	UserID        string   `json:"userId"`
-	TraceID       string   `json:"traceId"`
-	AgentID       *string  `json:"agentId,omitempty"`
-	WebsearchCost *float64 `json:"websearchCost,omitempty"`
+	UserID        string   `json:"userId" bson:"userId"`
+	TraceID       string   `json:"traceId" bson:"traceId"`
+	AgentID       *string  `json:"agentId,omitempty" bson:"agentId,omitempty"`
+	WebsearchCost *float64 `json:"websearchCost,omitempty" bson:"websearchCost,omitempty"`
+}
+
+// RefundIn is the body of POST /api/v1/usage/:traceId/refund. A nil Amount
+// refunds everything not yet refunded.
+type RefundIn struct {
+	Amount *int   `json:"amount,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// AdjustmentIn is an admin Grant or Adjustment. Grants must be positive;
+// adjustments may be negative to remove tokens. A grant with ExpiresAt is a
+// promo whose unused tokens expire then.
+type AdjustmentIn struct {
+	Type      string     `json:"type"`
+	Bucket    string     `json:"bucket"`
+	Amount    int        `json:"amount"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type AdjustmentResponse struct {
+	Event   UsageEventOut `json:"event"`
+	Balance UserBalance   `json:"balance"`
+}
+
+// TokenUsedBatchIn is the body of POST /api/v1/token_used/batch.
+type TokenUsedBatchIn struct {
+	Items []TokenUsedIn `json:"items"`
+}
+
+// TokenUsedBatchItem is the outcome of one batch item, in request order.
+type TokenUsedBatchItem struct {
+	TraceID           string   `json:"traceId"`
+	UserID            string   `json:"userId"`
+	TransactionStatus string   `json:"transactionStatus"`
+	TotalCostUsd      string   `json:"totalCostUsd,omitempty"`
+	TotalToken        int      `json:"totalToken,omitempty"`
+	Flags             []string `json:"flags,omitempty"`
+	StatusCode        int      `json:"statusCode"`
+	Detail            string   `json:"detail,omitempty"`
+}
+
+type TokenUsedBatchResponse struct {
+	Succeeded  int                  `json:"succeeded"`
+	Duplicates int                  `json:"duplicates"`
+	Failed     int                  `json:"failed"`
+	Results    []TokenUsedBatchItem `json:"results"`
 }
 
 type TokenUsedResponse struct {
-	TraceID           string `json:"traceId"`
-	TotalCostUsd      string `json:"totalCostUsd"`
-	TotalToken        int    `json:"totalToken"`
-	TransactionStatus string `json:"transactionStatus"`
+	TraceID           string   `json:"traceId" bson:"traceId"`
+	TotalCostUsd      string   `json:"totalCostUsd" bson:"totalCostUsd"`
+	TotalToken        int      `json:"totalToken" bson:"totalToken"`
+	TransactionStatus string   `json:"transactionStatus" bson:"transactionStatus"`
+	ModelID           string   `json:"modelId,omitempty" bson:"modelId,omitempty"`
+	Flags             []string `json:"flags,omitempty" bson:"flags,omitempty"`
 }
 
 type UserBalance struct {
-	UserID                string    `bson:"userId"`
-	TotalToken            int       `bson:"totalToken"`
-	MainTokenBalance      int       `bson:"mainTokenBalance"`
-	TopupTokenBalance     int       `bson:"topupTokenBalance"`
-	RemainingTokenBalance int       `bson:"remainingTokenBalance"`
-	UpdatedAt             time.Time `bson:"updatedAt"`
-	CreatedAt             time.Time `bson:"createdAt"`
+	UserID                string    `json:"userId" bson:"userId"`
+	TotalToken            int       `json:"totalToken" bson:"totalToken"`
+	MainTokenBalance      int       `json:"mainTokenBalance" bson:"mainTokenBalance"`
+	TopupTokenBalance     int       `json:"topupTokenBalance" bson:"topupTokenBalance"`
+	RemainingTokenBalance int       `json:"remainingTokenBalance" bson:"remainingTokenBalance"`
+	UpdatedAt             time.Time `json:"updatedAt" bson:"updatedAt"`
+	CreatedAt             time.Time `json:"createdAt" bson:"createdAt"`
 }
 
 type UserMainPackage struct {
@@ -54,8 +127,21 @@ type UserMainPackage struct {
 	Status         string    `bson:"status"`
 	StartDate      time.Time `bson:"startDate"`
 	EndDate        time.Time `bson:"endDate"`
-	CreatedAt      time.Time `bson:"createdAt"`
-	UpdatedAt      time.Time `bson:"updatedAt"`
+	// Renewal is the rollover decided for the period starting at EndDate.
+	// It is saved before the period's first event, so a retried renewal
+	// posts the same amounts instead of working them out again from a
+	// balance it has already changed.
+	Renewal   *RenewalPlan `bson:"renewal,omitempty"`
+	CreatedAt time.Time    `bson:"createdAt"`
+	UpdatedAt time.Time    `bson:"updatedAt"`
+}
+
+// RenewalPlan splits the unused main balance at a renewal into the part
+// carried into the period starting at Period and the part forfeited.
+type RenewalPlan struct {
+	Period    time.Time `bson:"period"`
+	Carried   int       `bson:"carried"`
+	Forfeited int       `bson:"forfeited"`
 }
 
 type UserTopupPackage struct {
@@ -67,9 +153,3 @@ type UserTopupPackage struct {
 	CreatedAt       time.Time `bson:"createdAt"`
 	UpdatedAt       time.Time `bson:"updatedAt"`
 }
-
-type PackageMaster struct {
-	PackageID       string      `bson:"packageId"`
-	EggToken        int         `bson:"eggToken"`
-	ConversionRatio interface{} `bson:"conversionRatio"`
-}
@@ -0,0 +1,38 @@
+package domain
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// UsageJob is a token_used request queued for asynchronous settlement.
+type UsageJob struct {
+	ID            primitive.ObjectID `json:"jobId" bson:"_id,omitempty"`
+	Status        string             `json:"status" bson:"status"`
+	Request       TokenUsedIn        `json:"request" bson:"request"`
+	Attempts      int                `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time          `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	LockedUntil   *time.Time         `json:"-" bson:"lockedUntil,omitempty"`
+	LastError     string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	Result        *TokenUsedResponse `json:"result,omitempty" bson:"result,omitempty"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt     time.Time          `json:"updatedAt" bson:"updatedAt"`
+	CompletedAt   *time.Time         `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+	// DedupKey is the request's traceId while the job has not failed, so
+	// the trace is queued once.
+	DedupKey string `json:"-" bson:"dedupKey,omitempty"`
+}
+
+type UsageJobAccepted struct {
+	JobID     string `json:"jobId"`
+	Status    string `json:"status"`
+	StatusURL string `json:"statusUrl"`
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidAdjustment = errors.New("Invalid adjustment")
+
+// CreateAdjustment appends an admin Grant or Adjustment event and recomputes
+// the user's balance from the event log, so the change survives recomputes.
+// actor is the ID of the API key that made the change.
+func CreateAdjustment(ctx context.Context, userID string, in domain.AdjustmentIn, actor string) (*domain.UsageEventOut, *domain.UserBalance, error) {
+	if err := validateAdjustment(in); err != nil {
+		return nil, nil, err
+	}
+
+	reason := strings.TrimSpace(in.Reason)
+	bucket := in.Bucket
+
+	doc := domain.UsageEventOut{
+		ID:             primitive.NewObjectID(),
+		EventTimeStamp: time.Now(),
+		UserID:         userID,
+		EventType:      in.Type,
+		EggToken:       in.Amount,
+		Bucket:         &bucket,
+		Reason:         &reason,
+		Actor:          &actor,
+		ExpiresAt:      in.ExpiresAt,
+	}
+	if _, err := mongodb.GetCollection(config.UsageEventColl).InsertOne(ctx, doc); err != nil {
+		return nil, nil, err
+	}
+	postEvents(ctx, &doc)
+
+	bal, err := RecomputeAndUpsertUserBalance(ctx, userID)
+	if err != nil {
+		return &doc, nil, err
+	}
+	return &doc, bal, nil
+}
+
+func validateAdjustment(in domain.AdjustmentIn) error {
+	switch in.Type {
+	case EvtGrant:
+		if in.Amount <= 0 {
+			return errors.Join(ErrInvalidAdjustment, errors.New("grant amount must be positive"))
+		}
+	case EvtAdjustment:
+		if in.Amount == 0 {
+			return errors.Join(ErrInvalidAdjustment, errors.New("adjustment amount must not be zero"))
+		}
+	default:
+		return errors.Join(ErrInvalidAdjustment, errors.New("type must be Grant or Adjustment"))
+	}
+
+	if in.Bucket != domain.BucketMain && in.Bucket != domain.BucketTopup {
+		return errors.Join(ErrInvalidAdjustment, errors.New("bucket must be main or topup"))
+	}
+	if in.ExpiresAt != nil {
+		if in.Type != EvtGrant {
+			return errors.Join(ErrInvalidAdjustment, errors.New("expiresAt only applies to grants"))
+		}
+		if !in.ExpiresAt.After(time.Now()) {
+			return errors.Join(ErrInvalidAdjustment, errors.New("expiresAt must be in the future"))
+		}
+	}
+	if strings.TrimSpace(in.Reason) == "" {
+		return errors.Join(ErrInvalidAdjustment, errors.New("reason is required"))
+	}
+	return nil
+}
+
+// ListAdjustments returns a user's Grant and Adjustment events, newest first.
+func ListAdjustments(ctx context.Context, userID string) ([]domain.UsageEventOut, error) {
+	filter := bson.M{"userId": userID, "eventType": bson.M{"$in": bson.A{EvtGrant, EvtAdjustment}}}
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Find(ctx, filter, options.Find().SetSort(bson.M{"eventTimeStamp": -1}))
+	if err != nil {
+		return nil, err
+	}
+	events := []domain.UsageEventOut{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+)
+
+func TestValidateAdjustment(t *testing.T) {
+	future := time.Now().Add(24 * time.Hour)
+	past := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name string
+		in   domain.AdjustmentIn
+		ok   bool
+	}{
+		{name: "grant without an actor in the body", in: domain.AdjustmentIn{Type: EvtGrant, Bucket: domain.BucketMain, Amount: 500, Reason: "Outage goodwill"}, ok: true},
+		{name: "negative adjustment", in: domain.AdjustmentIn{Type: EvtAdjustment, Bucket: domain.BucketTopup, Amount: -20, Reason: "Correction"}, ok: true},
+		{name: "promo grant", in: domain.AdjustmentIn{Type: EvtGrant, Bucket: domain.BucketMain, Amount: 50, Reason: "Promo", ExpiresAt: &future}, ok: true},
+		{name: "grant must be positive", in: domain.AdjustmentIn{Type: EvtGrant, Bucket: domain.BucketMain, Amount: -5, Reason: "x"}},
+		{name: "zero adjustment", in: domain.AdjustmentIn{Type: EvtAdjustment, Bucket: domain.BucketMain, Reason: "x"}},
+		{name: "unknown type", in: domain.AdjustmentIn{Type: "Refund", Bucket: domain.BucketMain, Amount: 5, Reason: "x"}},
+		{name: "unknown bucket", in: domain.AdjustmentIn{Type: EvtGrant, Bucket: "org", Amount: 5, Reason: "x"}},
+		{name: "expiry on an adjustment", in: domain.AdjustmentIn{Type: EvtAdjustment, Bucket: domain.BucketMain, Amount: 5, Reason: "x", ExpiresAt: &future}},
+		{name: "expiry in the past", in: domain.AdjustmentIn{Type: EvtGrant, Bucket: domain.BucketMain, Amount: 5, Reason: "x", ExpiresAt: &past}},
+		{name: "blank reason", in: domain.AdjustmentIn{Type: EvtGrant, Bucket: domain.BucketMain, Amount: 5, Reason: "  "}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAdjustment(tt.in)
+			if tt.ok && err != nil {
+				t.Errorf("validateAdjustment = %v, want nil", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidAdjustment) {
+				t.Errorf("validateAdjustment = %v, want ErrInvalidAdjustment", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidAnalytics = errors.New("Invalid analytics query")
+
+// UsageAnalytics aggregates Token Used events. With the auto source, a
+// bounded range on UTC day boundaries whose every day has a complete rollup
+// is answered from the daily rollups and anything else from the raw events.
+func UsageAnalytics(ctx context.Context, q domain.UsageAnalyticsQuery) (*domain.UsageAnalyticsResponse, error) {
+	if err := validateAnalytics(q); err != nil {
+		return nil, err
+	}
+
+	source := q.Source
+	if source == "" || source == domain.AnalyticsSourceAuto {
+		covered, err := rollupsCover(ctx, q.From, q.To)
+		if err != nil {
+			return nil, err
+		}
+		source = domain.AnalyticsSourceRaw
+		if covered {
+			source = domain.AnalyticsSourceRollup
+		}
+	}
+
+	var coll *mongo.Collection
+	var pipeline mongo.Pipeline
+	if source == domain.AnalyticsSourceRollup {
+		coll = mongodb.GetCollection(config.UsageDailyRollupColl)
+		pipeline = rollupAnalyticsPipeline(q)
+	} else {
+		coll = mongodb.GetCollection(config.UsageEventColl)
+		pipeline = rawAnalyticsPipeline(q)
+	}
+
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []analyticsResult
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	items := make([]domain.UsageAnalyticsRow, 0, len(results))
+	for _, r := range results {
+		row := r.UsageAnalyticsRow
+		row.TotalCostUSD = r.TotalCostUSD.String()
+		row.ChatCostUSD = r.ChatCostUSD.String()
+		row.WebsearchCostUSD = r.WebsearchCostUSD.String()
+		items = append(items, row)
+	}
+	return &domain.UsageAnalyticsResponse{Source: source, Items: items}, nil
+}
+
+type analyticsResult struct {
+	domain.UsageAnalyticsRow `bson:",inline"`
+	TotalCostUSD             primitive.Decimal128 `bson:"totalCostUsd"`
+	ChatCostUSD              primitive.Decimal128 `bson:"chatCostUsd"`
+	WebsearchCostUSD         primitive.Decimal128 `bson:"websearchCostUsd"`
+}
+
+func validateAnalytics(q domain.UsageAnalyticsQuery) error {
+	var errs []error
+	switch q.Interval {
+	case "", domain.AnalyticsDay, domain.AnalyticsWeek, domain.AnalyticsMonth:
+	default:
+		errs = append(errs, fmt.Errorf("interval must be day, week or month, got %q", q.Interval))
+	}
+	for _, g := range q.GroupBy {
+		if g != domain.AnalyticsByUser && g != domain.AnalyticsByAgent && g != domain.AnalyticsByModel {
+			errs = append(errs, fmt.Errorf("groupBy must be user, agent or model, got %q", g))
+		}
+	}
+	switch q.Source {
+	case "", domain.AnalyticsSourceAuto, domain.AnalyticsSourceRaw, domain.AnalyticsSourceRollup:
+	default:
+		errs = append(errs, fmt.Errorf("source must be auto, raw or rollup, got %q", q.Source))
+	}
+	if q.Source == domain.AnalyticsSourceRollup && !(dayAligned(q.From) && dayAligned(q.To)) {
+		errs = append(errs, errors.New("rollup queries need from and to on UTC day boundaries"))
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.To.After(q.From) {
+		errs = append(errs, errors.New("to must be after from"))
+	}
+	if len(errs) > 0 {
+		return errors.Join(append([]error{ErrInvalidAnalytics}, errs...)...)
+	}
+	return nil
+}
+
+func dayAligned(t time.Time) bool {
+	return t.IsZero() || t.Equal(t.UTC().Truncate(24*time.Hour))
+}
+
+// rollupsCover reports whether every UTC day in [from, to) has a complete
+// rollup: one refreshed after the day ended. Open ranges are never covered,
+// since the rollups only reach back as far as they were built.
+func rollupsCover(ctx context.Context, from, to time.Time) (bool, error) {
+	if from.IsZero() || to.IsZero() || !dayAligned(from) || !dayAligned(to) {
+		return false, nil
+	}
+	n, err := mongodb.GetCollection(config.UsageRollupDayColl).CountDocuments(ctx, bson.M{
+		"_id":      bson.M{"$gte": from, "$lt": to},
+		"complete": true,
+	})
+	if err != nil {
+		return false, err
+	}
+	return n == int64(len(rollupDays(from, to))), nil
+}
+
+// rollupDays lists the UTC days in [start, end).
+func rollupDays(start, end time.Time) []time.Time {
+	var days []time.Time
+	for d := start.UTC(); d.Before(end); d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+	return days
+}
+
+// rollupDayComplete reports whether a rollup of day refreshed at
+// refreshedAt saw all of its events.
+func rollupDayComplete(day, refreshedAt time.Time) bool {
+	return !refreshedAt.Before(day.AddDate(0, 0, 1))
+}
+
+// markRollupDays records that the days in [start, end) were rolled up at
+// refreshedAt.
+func markRollupDays(ctx context.Context, start, end, refreshedAt time.Time) error {
+	var models []mongo.WriteModel
+	for _, day := range rollupDays(start, end) {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": day}).
+			SetUpdate(bson.M{"$set": bson.M{"refreshedAt": refreshedAt, "complete": rollupDayComplete(day, refreshedAt)}}).
+			SetUpsert(true))
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	_, err := mongodb.GetCollection(config.UsageRollupDayColl).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func timeRange(field string, from, to time.Time) bson.M {
+	r := bson.M{}
+	if !from.IsZero() {
+		r["$gte"] = from
+	}
+	if !to.IsZero() {
+		r["$lt"] = to
+	}
+	if len(r) == 0 {
+		return bson.M{}
+	}
+	return bson.M{field: r}
+}
+
+// analyticsGroup builds the $group stage. dateField is truncated to the
+// interval; the other keys are included only when grouped by.
+func analyticsGroup(q domain.UsageAnalyticsQuery, dateField string, keys map[string]any, sums bson.M) bson.D {
+	id := bson.M{}
+	if q.Interval != "" {
+		trunc := bson.M{"date": dateField, "unit": q.Interval}
+		if q.Interval == domain.AnalyticsWeek {
+			trunc["startOfWeek"] = "monday"
+		}
+		id["period"] = bson.M{"$dateTrunc": trunc}
+	}
+	for _, g := range q.GroupBy {
+		switch g {
+		case domain.AnalyticsByUser:
+			id["userId"] = keys["userId"]
+		case domain.AnalyticsByAgent:
+			id["agentId"] = keys["agentId"]
+		case domain.AnalyticsByModel:
+			id["aiModel"] = keys["aiModel"]
+		}
+	}
+	sums["_id"] = id
+	return bson.D{{Key: "$group", Value: sums}}
+}
+
+// analyticsOutput flattens the group key into the row and orders the rows.
+func analyticsOutput() []bson.D {
+	return []bson.D{
+		{{Key: "$addFields", Value: bson.M{
+			"period":  "$_id.period",
+			"userId":  "$_id.userId",
+			"agentId": "$_id.agentId",
+			"aiModel": "$_id.aiModel",
+		}}},
+		{{Key: "$project", Value: bson.M{"_id": 0}}},
+		{{Key: "$sort", Value: bson.D{
+			{Key: "period", Value: 1}, {Key: "userId", Value: 1}, {Key: "agentId", Value: 1}, {Key: "aiModel", Value: 1},
+		}}},
+	}
+}
+
+func decimalSum(field string) bson.M {
+	return bson.M{"$sum": bson.M{"$toDecimal": bson.M{"$ifNull": bson.A{field, 0}}}}
+}
+
+// tokenValue reads a token count as a number. Legacy events may hold it as
+// a numeric string; values that are not numbers count as 0 rather than
+// failing the whole aggregation.
+func tokenValue(field string) bson.M {
+	return bson.M{"$convert": bson.M{
+		"input": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$type": field}, "string"}},
+			bson.M{"$trim": bson.M{"input": field}},
+			field,
+		}},
+		"to":      "long",
+		"onError": 0,
+		"onNull":  0,
+	}}
+}
+
+// usageSums totals raw Token Used events; usage events store negative
+// token amounts.
+func usageSums() bson.M {
+	return bson.M{
+		"count":            bson.M{"$sum": 1},
+		"eggToken":         bson.M{"$sum": bson.M{"$abs": tokenValue("$eggToken")}},
+		"chatToken":        bson.M{"$sum": bson.M{"$abs": tokenValue("$chatToken")}},
+		"websearchToken":   bson.M{"$sum": bson.M{"$abs": tokenValue("$websearchToken")}},
+		"refundedToken":    bson.M{"$sum": tokenValue("$refundedToken")},
+		"totalCostUsd":     decimalSum("$totalCostUsd"),
+		"chatCostUsd":      decimalSum("$chatCostUsd"),
+		"websearchCostUsd": decimalSum("$websearchCostUsd"),
+	}
+}
+
+var rawUsageKeys = map[string]any{
+	"userId":  "$userId",
+	"agentId": bson.M{"$ifNull": bson.A{"$agentId", ""}},
+	"aiModel": bson.M{"$ifNull": bson.A{"$modelId", bson.M{"$ifNull": bson.A{"$aiModel", "unknown"}}}},
+}
+
+func rawAnalyticsPipeline(q domain.UsageAnalyticsQuery) mongo.Pipeline {
+	match := timeRange("eventTimeStamp", q.From, q.To)
+	match["eventType"] = EvtTokenUsed
+	if q.UserID != "" {
+		match["userId"] = q.UserID
+	}
+	if q.AgentID != "" {
+		match["agentId"] = q.AgentID
+	}
+	if q.AIModel != "" {
+		match["$or"] = bson.A{
+			bson.M{"modelId": q.AIModel},
+			bson.M{"modelId": bson.M{"$exists": false}, "aiModel": q.AIModel},
+		}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		analyticsGroup(q, "$eventTimeStamp", rawUsageKeys, usageSums()),
+	}
+	return append(pipeline, analyticsOutput()...)
+}
+
+func rollupAnalyticsPipeline(q domain.UsageAnalyticsQuery) mongo.Pipeline {
+	match := timeRange("day", q.From, q.To)
+	if q.UserID != "" {
+		match["userId"] = q.UserID
+	}
+	if q.AgentID != "" {
+		match["agentId"] = q.AgentID
+	}
+	if q.AIModel != "" {
+		match["aiModel"] = q.AIModel
+	}
+
+	sums := bson.M{}
+	for _, f := range []string{"count", "eggToken", "chatToken", "websearchToken", "refundedToken", "totalCostUsd", "chatCostUsd", "websearchCostUsd"} {
+		sums[f] = bson.M{"$sum": "$" + f}
+	}
+	keys := map[string]any{"userId": "$userId", "agentId": "$agentId", "aiModel": "$aiModel"}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		analyticsGroup(q, "$day", keys, sums),
+	}
+	return append(pipeline, analyticsOutput()...)
+}
+
+// RefreshUsageRollups rebuilds the daily rollups for every UTC day touched
+// by [from, to]. Rows are replaced in place, so readers never see a day
+// disappear, and groups that no longer have events are removed afterwards.
+// Each day is then recorded in usage_rollup_day, complete once it has been
+// rolled up after it ended.
+func RefreshUsageRollups(ctx context.Context, from, to time.Time) error {
+	start := from.UTC().Truncate(24 * time.Hour)
+	end := to.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	refreshedAt := time.Now()
+
+	q := domain.UsageAnalyticsQuery{
+		From:     start,
+		To:       end,
+		Interval: domain.AnalyticsDay,
+		GroupBy:  []string{domain.AnalyticsByUser, domain.AnalyticsByAgent, domain.AnalyticsByModel},
+	}
+	match := timeRange("eventTimeStamp", start, end)
+	match["eventType"] = EvtTokenUsed
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		analyticsGroup(q, "$eventTimeStamp", rawUsageKeys, usageSums()),
+		{{Key: "$addFields", Value: bson.M{
+			"day":         "$_id.period",
+			"userId":      "$_id.userId",
+			"agentId":     "$_id.agentId",
+			"aiModel":     "$_id.aiModel",
+			"refreshedAt": refreshedAt,
+		}}},
+		{{Key: "$project", Value: bson.M{"_id": 0}}},
+		{{Key: "$merge", Value: bson.M{
+			"into":           config.UsageDailyRollupColl,
+			"on":             bson.A{"day", "userId", "agentId", "aiModel"},
+			"whenMatched":    "replace",
+			"whenNotMatched": "insert",
+		}}},
+	}
+
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	if err := cursor.Close(ctx); err != nil {
+		return err
+	}
+
+	stale := timeRange("day", start, end)
+	stale["refreshedAt"] = bson.M{"$lt": refreshedAt}
+	if _, err := mongodb.GetCollection(config.UsageDailyRollupColl).DeleteMany(ctx, stale); err != nil {
+		return err
+	}
+	return markRollupDays(ctx, start, end, refreshedAt)
+}
+
+// RecentUsageRollups returns a periodic task that refreshes today's rollups
+// and those of the previous lookbackDays days.
+func RecentUsageRollups(lookbackDays int) func(context.Context) error {
+	return func(ctx context.Context) error {
+		now := time.Now()
+		return RefreshUsageRollups(ctx, now.AddDate(0, 0, -lookbackDays), now)
+	}
+}
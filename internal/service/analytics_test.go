@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestRollupDays(t *testing.T) {
+	d := func(day int) time.Time { return time.Date(2026, 9, day, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name       string
+		start, end time.Time
+		want       int
+	}{
+		{name: "one day", start: d(1), end: d(2), want: 1},
+		{name: "month", start: d(1), end: d(1).AddDate(0, 1, 0), want: 30},
+		{name: "empty range", start: d(3), end: d(3), want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			days := rollupDays(tt.start, tt.end)
+			if len(days) != tt.want {
+				t.Fatalf("%d days, want %d", len(days), tt.want)
+			}
+			for i, day := range days {
+				if !day.Equal(tt.start.AddDate(0, 0, i)) || !dayAligned(day) {
+					t.Errorf("day %d = %v", i, day)
+				}
+			}
+		})
+	}
+}
+
+func TestRollupDayComplete(t *testing.T) {
+	day := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		refreshedAt time.Time
+		want        bool
+	}{
+		{name: "refreshed during the day", refreshedAt: day.Add(23 * time.Hour), want: false},
+		{name: "refreshed as the day ends", refreshedAt: day.AddDate(0, 0, 1), want: true},
+		{name: "refreshed later", refreshedAt: day.AddDate(0, 0, 3), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rollupDayComplete(day, tt.refreshedAt); got != tt.want {
+				t.Errorf("complete = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollupsCoverNeedsWholeDays(t *testing.T) {
+	day := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	// None of these ranges can be served from rollups, so no rollup days
+	// are looked up.
+	tests := []struct {
+		name     string
+		from, to time.Time
+	}{
+		{name: "open start", to: day},
+		{name: "open end", from: day},
+		{name: "unbounded"},
+		{name: "start mid-day", from: day.Add(time.Hour), to: day.AddDate(0, 0, 2)},
+		{name: "end mid-day", from: day, to: day.Add(30 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			covered, err := rollupsCover(context.Background(), tt.from, tt.to)
+			if err != nil || covered {
+				t.Errorf("rollupsCover = %v, %v, want false", covered, err)
+			}
+		})
+	}
+}
+
+func TestValidateAnalytics(t *testing.T) {
+	day := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		q    domain.UsageAnalyticsQuery
+		ok   bool
+	}{
+		{name: "empty query", ok: true},
+		{name: "weekly by user and model", q: domain.UsageAnalyticsQuery{Interval: domain.AnalyticsWeek, GroupBy: []string{domain.AnalyticsByUser, domain.AnalyticsByModel}}, ok: true},
+		{name: "rollup on day boundaries", q: domain.UsageAnalyticsQuery{From: day, To: day.AddDate(0, 1, 0), Source: domain.AnalyticsSourceRollup}, ok: true},
+		{name: "unknown interval", q: domain.UsageAnalyticsQuery{Interval: "hour"}},
+		{name: "unknown group", q: domain.UsageAnalyticsQuery{GroupBy: []string{"org"}}},
+		{name: "unknown source", q: domain.UsageAnalyticsQuery{Source: "cache"}},
+		{name: "rollup mid-day", q: domain.UsageAnalyticsQuery{From: day.Add(time.Hour), To: day.AddDate(0, 0, 1), Source: domain.AnalyticsSourceRollup}},
+		{name: "to before from", q: domain.UsageAnalyticsQuery{From: day, To: day.Add(-time.Hour)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAnalytics(tt.q)
+			if tt.ok && err != nil {
+				t.Errorf("validateAnalytics = %v, want nil", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidAnalytics) {
+				t.Errorf("validateAnalytics = %v, want ErrInvalidAnalytics", err)
+			}
+		})
+	}
+}
+
+// pipelineStage returns the value of the first stage named op.
+func pipelineStage(t *testing.T, p mongo.Pipeline, op string) bson.M {
+	t.Helper()
+	for _, stage := range p {
+		if stage[0].Key == op {
+			return stage[0].Value.(bson.M)
+		}
+	}
+	t.Fatalf("pipeline has no %s stage", op)
+	return nil
+}
+
+func TestRawAnalyticsPipeline(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	p := rawAnalyticsPipeline(domain.UsageAnalyticsQuery{
+		From: from, To: to, Interval: domain.AnalyticsWeek,
+		GroupBy: []string{domain.AnalyticsByModel}, UserID: "u1", AIModel: "gpt-4o",
+	})
+
+	match := pipelineStage(t, p, "$match")
+	if match["eventType"] != EvtTokenUsed || match["userId"] != "u1" {
+		t.Errorf("match = %v", match)
+	}
+	if r := match["eventTimeStamp"].(bson.M); r["$gte"] != from || r["$lt"] != to {
+		t.Errorf("time range = %v", r)
+	}
+	if _, ok := match["$or"]; !ok {
+		t.Error("model filter must match modelId, or aiModel on events without one")
+	}
+
+	id := pipelineStage(t, p, "$group")["_id"].(bson.M)
+	trunc := id["period"].(bson.M)["$dateTrunc"].(bson.M)
+	if trunc["unit"] != domain.AnalyticsWeek || trunc["startOfWeek"] != "monday" || trunc["date"] != "$eventTimeStamp" {
+		t.Errorf("period = %v", trunc)
+	}
+	if _, ok := id["aiModel"]; !ok {
+		t.Error("group key has no aiModel")
+	}
+	if _, ok := id["userId"]; ok {
+		t.Error("group key has userId without groupBy=user")
+	}
+}
+
+func TestRollupAnalyticsPipeline(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	p := rollupAnalyticsPipeline(domain.UsageAnalyticsQuery{
+		From: from, To: from.AddDate(0, 0, 7),
+		GroupBy: []string{domain.AnalyticsByAgent}, AIModel: "gpt-4o",
+	})
+
+	match := pipelineStage(t, p, "$match")
+	if match["aiModel"] != "gpt-4o" {
+		t.Errorf("match = %v", match)
+	}
+	if _, ok := match["day"]; !ok {
+		t.Error("rollups are matched on day")
+	}
+
+	group := pipelineStage(t, p, "$group")
+	id := group["_id"].(bson.M)
+	if _, ok := id["period"]; ok {
+		t.Error("group key has a period without an interval")
+	}
+	if id["agentId"] != "$agentId" {
+		t.Errorf("group key = %v", id)
+	}
+	if group["totalCostUsd"] == nil || group["refundedToken"] == nil {
+		t.Errorf("group sums = %v", group)
+	}
+}
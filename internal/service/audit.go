@@ -0,0 +1,266 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BeginAudit appends the pending entry for a call before it runs and
+// returns its seq. A call whose pending entry cannot be written must not
+// run.
+func BeginAudit(ctx context.Context, e domain.AuditEntry) (int64, error) {
+	e.Pending, e.Completes = true, nil
+	e.Action, e.Target, e.Status = "", nil, 0
+	e.Before, e.After = nil, nil
+	return appendAudit(ctx, e)
+}
+
+// FinishAudit appends the outcome of the call whose pending entry is seq.
+// The request body is already on the pending entry.
+func FinishAudit(ctx context.Context, seq int64, e domain.AuditEntry) error {
+	e.Pending, e.Completes = false, &seq
+	e.Request = nil
+	_, err := appendAudit(ctx, e)
+	return err
+}
+
+// appendAudit appends e to the audit log, chained to the newest entry, and
+// returns its seq. The unique index on seq lets concurrent appends race
+// safely: the loser reads the new head and tries again, for as long as ctx
+// allows.
+func appendAudit(ctx context.Context, e domain.AuditEntry) (int64, error) {
+	e.ID = primitive.NewObjectID()
+	e.Timestamp = time.Now().UTC().Truncate(time.Millisecond)
+	e.Request = compactJSON(e.Request)
+	e.Before = compactJSON(e.Before)
+	e.After = compactJSON(e.After)
+	e.Diff = AuditDiff(e.Before, e.After)
+
+	coll := mongodb.GetCollection(config.AuditLogColl)
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, fmt.Errorf("append audit entry: %w", err)
+		}
+		var head domain.AuditEntry
+		err := coll.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"seq": -1})).Decode(&head)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, err
+		}
+		e.Seq = head.Seq + 1
+		e.PrevHash = head.Hash
+		e.Hash = e.ComputeHash()
+
+		_, err = coll.InsertOne(ctx, e)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return e.Seq, nil
+	}
+}
+
+// compactJSON returns b without insignificant whitespace. A body that is
+// not JSON is kept as a JSON string.
+func compactJSON(b []byte) json.RawMessage {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		s, _ := json.Marshal(string(b))
+		return s
+	}
+	return buf.Bytes()
+}
+
+// AuditDiff lists the fields that differ between two JSON documents, by
+// dotted path. Objects are compared field by field and anything else,
+// arrays included, as a whole.
+func AuditDiff(before, after json.RawMessage) []domain.AuditChange {
+	if before == nil && after == nil {
+		return nil
+	}
+	b, a := map[string]json.RawMessage{}, map[string]json.RawMessage{}
+	flattenJSON("", before, b)
+	flattenJSON("", after, a)
+
+	paths := make([]string, 0, len(b)+len(a))
+	for p := range b {
+		paths = append(paths, p)
+	}
+	for p := range a {
+		if _, ok := b[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var changes []domain.AuditChange
+	for _, p := range paths {
+		if !bytes.Equal(b[p], a[p]) {
+			changes = append(changes, domain.AuditChange{Path: p, Before: b[p], After: a[p]})
+		}
+	}
+	return changes
+}
+
+func flattenJSON(prefix string, raw json.RawMessage, out map[string]json.RawMessage) {
+	if raw == nil {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return
+	}
+	flattenValue(prefix, v, out)
+}
+
+func flattenValue(prefix string, v any, out map[string]json.RawMessage) {
+	if obj, ok := v.(map[string]any); ok && len(obj) > 0 {
+		for k, child := range obj {
+			path := k
+			if prefix != "" {
+				path = prefix + "." + k
+			}
+			flattenValue(path, child, out)
+		}
+		return
+	}
+	b, _ := json.Marshal(v)
+	out[prefix] = b
+}
+
+// ListAuditEntries returns the entries matching f, newest first.
+func ListAuditEntries(ctx context.Context, f domain.AuditFilter) ([]domain.AuditEntry, error) {
+	filter := bson.M{}
+	if f.Actor != "" {
+		filter["actor"] = f.Actor
+	}
+	if f.Action != "" {
+		filter["action"] = f.Action
+	}
+	if f.TargetKey != "" {
+		filter["target."+f.TargetKey] = f.Target
+	}
+	ts := bson.M{}
+	if !f.From.IsZero() {
+		ts["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		ts["$lt"] = f.To
+	}
+	if len(ts) > 0 {
+		filter["timestamp"] = ts
+	}
+
+	opts := options.Find().SetSort(bson.M{"seq": -1})
+	if f.Limit > 0 {
+		opts.SetLimit(f.Limit)
+	}
+	cursor, err := mongodb.GetCollection(config.AuditLogColl).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	entries := []domain.AuditEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// VerifyAuditChain walks the audit log in order and checks that sequence
+// numbers have no gaps and that every entry's hashes match.
+func VerifyAuditChain(ctx context.Context) (*domain.AuditVerification, error) {
+	cursor, err := mongodb.GetCollection(config.AuditLogColl).Find(ctx, bson.M{},
+		options.Find().SetSort(bson.M{"seq": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	chain := newAuditChain()
+	for cursor.Next(ctx) {
+		var e domain.AuditEntry
+		if err := cursor.Decode(&e); err != nil {
+			return nil, fmt.Errorf("decode audit entry: %w", err)
+		}
+		if !chain.add(e) {
+			break
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return chain.finish(), nil
+}
+
+// auditChain checks audit entries fed to it in seq order.
+type auditChain struct {
+	v          *domain.AuditVerification
+	prevHash   string
+	unfinished map[int64]bool
+}
+
+func newAuditChain() *auditChain {
+	return &auditChain{v: &domain.AuditVerification{Valid: true}, unfinished: map[int64]bool{}}
+}
+
+// add checks e against the entries before it. It returns false once the
+// chain is broken.
+func (a *auditChain) add(e domain.AuditEntry) bool {
+	a.v.Entries++
+
+	reason := ""
+	switch {
+	case e.Seq != a.v.Entries:
+		reason = fmt.Sprintf("expected seq %d", a.v.Entries)
+	case e.PrevHash != a.prevHash:
+		reason = "prevHash does not match the previous entry"
+	case e.ComputeHash() != e.Hash:
+		reason = "hash does not match the entry"
+	}
+	if reason != "" {
+		seq := e.Seq
+		a.v.Valid, a.v.BrokenAt, a.v.Reason = false, &seq, reason
+		return false
+	}
+	a.prevHash = e.Hash
+	if e.Pending {
+		a.unfinished[e.Seq] = true
+	}
+	if e.Completes != nil {
+		delete(a.unfinished, *e.Completes)
+	}
+	return true
+}
+
+func (a *auditChain) finish() *domain.AuditVerification {
+	if a.v.Valid {
+		a.v.LastHash = a.prevHash
+	}
+	for seq := range a.unfinished {
+		a.v.Unfinished = append(a.v.Unfinished, seq)
+	}
+	sort.Slice(a.v.Unfinished, func(i, j int) bool { return a.v.Unfinished[i] < a.v.Unfinished[j] })
+	a.v.VerifiedAt = time.Now()
+	return a.v
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+)
+
+// chained links entries into a hash chain in order, numbering them from 1.
+func chained(entries ...domain.AuditEntry) []domain.AuditEntry {
+	prev := ""
+	for i := range entries {
+		entries[i].Seq = int64(i + 1)
+		entries[i].PrevHash = prev
+		entries[i].Hash = entries[i].ComputeHash()
+		prev = entries[i].Hash
+	}
+	return entries
+}
+
+func completes(seq int64) *int64 { return &seq }
+
+func TestAuditChain(t *testing.T) {
+	tests := []struct {
+		name       string
+		entries    func() []domain.AuditEntry
+		valid      bool
+		brokenAt   int64
+		unfinished []int64
+	}{
+		{
+			name: "every pending entry has an outcome",
+			entries: func() []domain.AuditEntry {
+				return chained(
+					domain.AuditEntry{Pending: true, Path: "/a"},
+					domain.AuditEntry{Pending: true, Path: "/b"},
+					domain.AuditEntry{Completes: completes(2), Action: "b", Status: 200},
+					domain.AuditEntry{Completes: completes(1), Action: "a", Status: 400},
+				)
+			},
+			valid: true,
+		},
+		{
+			name: "pending entry without an outcome",
+			entries: func() []domain.AuditEntry {
+				return chained(
+					domain.AuditEntry{Pending: true, Path: "/a"},
+					domain.AuditEntry{Pending: true, Path: "/b"},
+					domain.AuditEntry{Completes: completes(1), Action: "a", Status: 200},
+				)
+			},
+			valid:      true,
+			unfinished: []int64{2},
+		},
+		{
+			name: "entries written before pending entries",
+			entries: func() []domain.AuditEntry {
+				return chained(
+					domain.AuditEntry{Action: "a", Status: 200},
+					domain.AuditEntry{Action: "b", Status: 200},
+				)
+			},
+			valid: true,
+		},
+		{
+			name: "edited outcome",
+			entries: func() []domain.AuditEntry {
+				entries := chained(
+					domain.AuditEntry{Pending: true, Path: "/a"},
+					domain.AuditEntry{Completes: completes(1), Action: "a", Status: 500},
+				)
+				entries[1].Status = 200
+				return entries
+			},
+			brokenAt: 2,
+		},
+		{
+			name: "removed entry",
+			entries: func() []domain.AuditEntry {
+				entries := chained(
+					domain.AuditEntry{Pending: true, Path: "/a"},
+					domain.AuditEntry{Completes: completes(1), Action: "a", Status: 200},
+					domain.AuditEntry{Pending: true, Path: "/b"},
+				)
+				return append(entries[:1], entries[2])
+			},
+			brokenAt: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := newAuditChain()
+			for _, e := range tt.entries() {
+				if !chain.add(e) {
+					break
+				}
+			}
+			v := chain.finish()
+			if v.Valid != tt.valid {
+				t.Fatalf("valid = %v (%s), want %v", v.Valid, v.Reason, tt.valid)
+			}
+			if !tt.valid && (v.BrokenAt == nil || *v.BrokenAt != tt.brokenAt) {
+				t.Errorf("brokenAt = %v, want %d", v.BrokenAt, tt.brokenAt)
+			}
+			if tt.valid && !reflect.DeepEqual(v.Unfinished, tt.unfinished) {
+				t.Errorf("unfinished = %v, want %v", v.Unfinished, tt.unfinished)
+			}
+		})
+	}
+}
+
+func TestAuditEntryJSONOmitsUnsetPhase(t *testing.T) {
+	// Entries written before pending entries existed must keep their hash,
+	// so the new fields stay out of the hashed JSON when unset.
+	b, err := json.Marshal(domain.AuditEntry{Seq: 3, Actor: "ops", Action: "package.update", Status: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"pending", "completes"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("JSON of a legacy entry has %q: %s", key, b)
+		}
+	}
+}
@@ -2,13 +2,12 @@ package service
 
 import (
 	"context"
-	"math"
+	"errors"
 	"strconv"
-	"strings"
 	"time"
 
-	"munggonegg/credit-service-go/internal/config"
 	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
 	"munggonegg/credit-service-go/internal/core/domain"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -17,98 +16,63 @@ import (
 )
 
 const (
-	EvtSubscribe    = "Subscribe"
-	EvtTopup        = "Topup"
-	EvtTokenUsed    = "Token Used"
-	EvtExpired      = "Expired"
-	EvtMainExpired  = "MainExpired"
-	EvtTopupExpired = "TopupExpired"
-
-	MainDeductionThreshold = 100
+	EvtSubscribe    = string(domain.LedgerSubscribe)
+	EvtTopup        = string(domain.LedgerTopup)
+	EvtTokenUsed    = string(domain.LedgerTokenUsed)
+	EvtExpired      = string(domain.LedgerExpired)
+	EvtMainExpired  = string(domain.LedgerMainExpired)
+	EvtTopupExpired = string(domain.LedgerTopupExpired)
+	EvtRefund       = string(domain.LedgerRefund)
+	EvtGrant        = string(domain.LedgerGrant)
+	EvtAdjustment   = string(domain.LedgerAdjustment)
+	EvtRollover     = string(domain.LedgerRollover)
+
+	MainDeductionThreshold = domain.MainDeductionThreshold
 )
 
+// RollupBalances replays raw usage events and returns the main, topup and
+// total balance. Events that fail to decode are skipped; replays that can
+// record them use replayUserBalance, which quarantines them.
 func RollupBalances(events []bson.M) (int, int, int) {
-	main := 0
-	topup := 0
-
-	for _, ev := range events {
-		eventType, ok := ev["eventType"].(string)
-		if !ok {
-			continue
-		}
-		eventType = strings.TrimSpace(eventType)
-
-		var amount int
-		switch v := ev["eggToken"].(type) {
-		case int32:
-			amount = int(math.Abs(float64(v)))
-		case int64:
-			amount = int(math.Abs(float64(v)))
-		case float64:
-			amount = int(math.Abs(v))
-		case string:
-			if val, err := strconv.Atoi(v); err == nil {
-				amount = int(math.Abs(float64(val)))
-			}
-		default:
-			continue
-		}
-
-		switch eventType {
-		case EvtSubscribe:
-			main += amount
-		case EvtTopup:
-			topup += amount
-		case EvtTokenUsed:
-			if main >= MainDeductionThreshold {
-				if amount <= main {
-					main -= amount
-				} else {
-					remainder := amount - main
-					main = 0
-					topup = int(math.Max(0, float64(topup-remainder)))
-				}
-			} else {
-				if amount <= topup {
-					topup -= amount
-				} else {
-					remainder := amount - topup
-					topup = 0
-					main = int(math.Max(0, float64(main-remainder)))
-				}
-			}
-		case EvtExpired:
-			if amount <= main {
-				main -= amount
-			} else {
-				remainder := amount - main
-				main = 0
-				topup = int(math.Max(0, float64(topup-remainder)))
-			}
-		case EvtMainExpired:
-			main = int(math.Max(0, float64(main-amount)))
-		case EvtTopupExpired:
-			topup = int(math.Max(0, float64(topup-amount)))
+	var b domain.Balance
+	for _, raw := range events {
+		if ev, err := DecodeLedgerEvent(raw); err == nil {
+			b = b.Apply(ev)
 		}
 	}
+	return b.Main, b.Topup, b.Total()
+}
 
-	return main, topup, main + topup
+// GetUserBalance returns the user's stored balance, or nil when none has
+// been computed yet.
+func GetUserBalance(ctx context.Context, userID string) (*domain.UserBalance, error) {
+	var bal domain.UserBalance
+	err := mongodb.GetCollection(config.UserBalanceColl).FindOne(ctx, bson.M{"userId": userID}).Decode(&bal)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bal, nil
 }
 
 func RecomputeAndUpsertUserBalance(ctx context.Context, userID string) (*domain.UserBalance, error) {
-	uueColl := mongodb.GetCollection(config.UsageEventColl)
 	umpColl := mongodb.GetCollection(config.UserMainPackageColl)
 	utpColl := mongodb.GetCollection(config.UserTopupPackageColl)
 	pkgColl := mongodb.GetCollection(config.PackageMasterV3Coll)
 	balColl := mongodb.GetCollection(config.UserBalanceColl)
 
-	// Fetch events
-	cursor, err := uueColl.Find(ctx, bson.M{"userId": userID}, options.Find().SetSort(bson.M{"eventTimeStamp": 1}))
-	if err != nil {
+	// Replay events since the latest snapshot; this brings the user's
+	// credit lots up to date and posts any missing journal entries, so
+	// the journal accounts hold every event recorded so far
+	if _, err := replayUserBalance(ctx, userID); err != nil {
 		return nil, err
 	}
-	var events []bson.M
-	if err = cursor.All(ctx, &events); err != nil {
+
+	// The stored balance is what the journal accounts hold
+	accounts, err := JournalBalance(ctx, userID)
+	if err != nil {
 		return nil, err
 	}
 
@@ -121,7 +85,7 @@ func RecomputeAndUpsertUserBalance(ctx context.Context, userID string) (*domain.
 	_ = utpColl.FindOne(ctx, bson.M{"userId": userID, "status": "A"}).Decode(&topupDoc)
 
 	// Calculate balances
-	mainBal, topupBal, remainingBal := RollupBalances(events)
+	mainBal, topupBal, remainingBal := accounts.Main, accounts.Topup, accounts.Total()
 
 	// Get main package egg token
 	mainEgg := 0
@@ -164,10 +128,24 @@ func RecomputeAndUpsertUserBalance(ctx context.Context, userID string) (*domain.
 	if err != nil {
 		return nil, err
 	}
+	publishBalance(ctx, userID, &updatedDoc)
 
 	return &updatedDoc, nil
 }
 
+// loadUserEvents returns all of a user's usage events in replay order.
+func loadUserEvents(ctx context.Context, userID string) ([]bson.M, error) {
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Find(ctx, bson.M{"userId": userID}, options.Find().SetSort(replayOrder))
+	if err != nil {
+		return nil, err
+	}
+	var events []bson.M
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
 func RecomputeTotalTopupToken(ctx context.Context, userID string) (int, error) {
 	tpeColl := mongodb.GetCollection(config.TopupPackageEventColl)
 	pkgCollName := config.PackageMasterV3Coll
@@ -212,6 +190,13 @@ func RecomputeTotalTopupToken(ctx context.Context, userID string) (int, error) {
 	return 0, nil
 }
 
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
 func toInt(v interface{}) int {
 	switch val := v.(type) {
 	case int:
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CurrentBalance returns the user's stored balance without replaying
+// anything; a user without one has a zero balance.
+func CurrentBalance(ctx context.Context, userID string) (*domain.BalanceAsOf, error) {
+	bal, err := GetUserBalance(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	out := &domain.BalanceAsOf{UserID: userID, AsOf: time.Now(), Stored: true}
+	if bal != nil {
+		out.AsOf = bal.UpdatedAt
+		out.MainToken, out.TopupToken = bal.MainTokenBalance, bal.TopupTokenBalance
+		out.TotalToken = bal.MainTokenBalance + bal.TopupTokenBalance
+	}
+	return out, nil
+}
+
+// BalanceAsOf replays the user's events up to and including asOf. It starts
+// from the latest of the user's snapshot and month-end snapshots that is not
+// newer than asOf, so a replay never covers more than the events since the
+// previous month end. Month ends the replay passes that have settled are
+// saved as month-end snapshots. Malformed events are left out without being
+// quarantined; the replay only reads.
+func BalanceAsOf(ctx context.Context, userID string, asOf time.Time) (*domain.BalanceAsOf, error) {
+	snap, err := asOfSnapshot(ctx, userID, asOf)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"userId": userID, "eventTimeStamp": bson.M{"$lte": asOf}}
+	if snap != nil {
+		filter["$or"] = afterSnapshot(snap)
+	}
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Find(ctx, filter, options.Find().SetSort(replayOrder))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	r := newAsOfReplay(userID, snap, time.Now().Add(-balanceSnapshotMargin))
+	for cursor.Next(ctx) {
+		var raw bson.M
+		if err := cursor.Decode(&raw); err != nil {
+			return nil, err
+		}
+		ev, err := DecodeLedgerEvent(raw)
+		id, _ := raw["_id"].(primitive.ObjectID)
+		r.add(eventTime(raw), id, ev, err == nil)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	r.finish(asOf)
+	saveMonthEndSnapshots(ctx, r.monthEnds)
+
+	return &domain.BalanceAsOf{
+		UserID:       userID,
+		AsOf:         asOf,
+		MainToken:    r.state.MainToken,
+		TopupToken:   r.state.TopupToken,
+		TotalToken:   r.state.MainToken + r.state.TopupToken,
+		FromSnapshot: snap != nil,
+	}, nil
+}
+
+// asOfSnapshot returns the latest snapshot an as-of replay to asOf may start
+// from: the user's snapshot when it is not newer than asOf, or the latest
+// month-end snapshot before asOf, whichever covers more events.
+func asOfSnapshot(ctx context.Context, userID string, asOf time.Time) (*domain.BalanceSnapshot, error) {
+	snap, err := latestBalanceSnapshot(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if snap != nil && snap.LastEventTimeStamp.After(asOf) {
+		snap = nil
+	}
+
+	var monthEnd domain.BalanceSnapshot
+	err = mongodb.GetCollection(config.BalanceMonthEndColl).FindOne(ctx,
+		bson.M{"userId": userID, "through": bson.M{"$lte": asOf}},
+		options.FindOne().SetSort(bson.D{{Key: "through", Value: -1}}),
+	).Decode(&monthEnd)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return snap, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if snap == nil || monthEnd.EventCount > snap.EventCount {
+		return &monthEnd, nil
+	}
+	return snap, nil
+}
+
+// asOfReplay replays events on top of a snapshot and keeps the balance at
+// each month end it passes, up to settled.
+type asOfReplay struct {
+	state     domain.BalanceSnapshot
+	next      time.Time
+	settled   time.Time
+	monthEnds []domain.BalanceSnapshot
+}
+
+func newAsOfReplay(userID string, from *domain.BalanceSnapshot, settled time.Time) *asOfReplay {
+	r := &asOfReplay{settled: settled}
+	if from == nil {
+		r.state.UserID = userID
+		return r
+	}
+	r.state = domain.BalanceSnapshot{
+		UserID:             userID,
+		MainToken:          from.MainToken,
+		TopupToken:         from.TopupToken,
+		LastEventTimeStamp: from.LastEventTimeStamp,
+		LastEventID:        from.LastEventID,
+		EventCount:         from.EventCount,
+	}
+	r.next = nextMonthStart(from.LastEventTimeStamp)
+	if from.Through != nil && !r.next.After(*from.Through) {
+		r.next = from.Through.AddDate(0, 1, 0)
+	}
+	return r
+}
+
+// add replays one event; ok is false for malformed events, which are
+// counted but leave the balance alone.
+func (r *asOfReplay) add(ts time.Time, id primitive.ObjectID, ev domain.LedgerEvent, ok bool) {
+	if r.next.IsZero() {
+		r.next = nextMonthStart(ts)
+	}
+	r.passMonthEnds(ts)
+	if ok {
+		b := domain.Balance{Main: r.state.MainToken, Topup: r.state.TopupToken}.Apply(ev)
+		r.state.MainToken, r.state.TopupToken = b.Main, b.Topup
+	}
+	r.state.LastEventTimeStamp, r.state.LastEventID = ts, id
+	r.state.EventCount++
+}
+
+// finish takes the month ends up to asOf, which every replayed event
+// preceded.
+func (r *asOfReplay) finish(asOf time.Time) {
+	if !r.next.IsZero() {
+		r.passMonthEnds(asOf)
+	}
+}
+
+// passMonthEnds keeps the balance at each settled month end up to t, before
+// an event at t is replayed.
+func (r *asOfReplay) passMonthEnds(t time.Time) {
+	for !r.next.After(t) && !r.next.After(r.settled) {
+		snap := r.state
+		through := r.next
+		snap.Through = &through
+		r.monthEnds = append(r.monthEnds, snap)
+		r.next = r.next.AddDate(0, 1, 0)
+	}
+}
+
+// nextMonthStart is the first UTC month start after t.
+func nextMonthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, 0)
+}
+
+// saveMonthEndSnapshots saves snapshots taken at month ends. They only
+// speed up as-of replays, so a failure is logged.
+func saveMonthEndSnapshots(ctx context.Context, snaps []domain.BalanceSnapshot) {
+	if len(snaps) == 0 {
+		return
+	}
+	now := time.Now()
+	models := make([]mongo.WriteModel, len(snaps))
+	for i, s := range snaps {
+		s.CreatedAt = now
+		models[i] = mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"userId": s.UserID, "through": s.Through}).
+			SetReplacement(s).
+			SetUpsert(true)
+	}
+	_, err := mongodb.GetCollection(config.BalanceMonthEndColl).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		log.Printf("Saving month-end balance snapshots for user %s failed: %v", snaps[0].UserID, err)
+	}
+}
+
+// WriteBalanceReport writes every user's balance as of asOf to w, as csv or
+// ndjson, one user at a time. Users are those with any event up to asOf.
+// It returns how many users were written.
+func WriteBalanceReport(ctx context.Context, asOf time.Time, format string, w io.Writer) (int, error) {
+	if format != domain.ExportCSV && format != domain.ExportNDJSON {
+		return 0, fmt.Errorf("%w: format must be csv or ndjson, got %q", ErrInvalidExport, format)
+	}
+
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"eventTimeStamp": bson.M{"$lte": asOf}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$userId"}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	cw := csv.NewWriter(w)
+	enc := json.NewEncoder(w)
+	if format == domain.ExportCSV {
+		if err := cw.Write([]string{"userId", "asOf", "mainToken", "topupToken", "totalToken"}); err != nil {
+			return 0, err
+		}
+	}
+
+	n := 0
+	for cursor.Next(ctx) {
+		var group struct {
+			UserID string `bson:"_id"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return n, err
+		}
+		bal, err := BalanceAsOf(ctx, group.UserID, asOf)
+		if err != nil {
+			return n, fmt.Errorf("user %s: %w", group.UserID, err)
+		}
+
+		if format == domain.ExportCSV {
+			err = cw.Write([]string{
+				bal.UserID, bal.AsOf.UTC().Format(time.RFC3339),
+				strconv.Itoa(bal.MainToken), strconv.Itoa(bal.TopupToken), strconv.Itoa(bal.TotalToken),
+			})
+		} else {
+			err = enc.Encode(bal)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+		if n%exportChunkSize == 0 {
+			cw.Flush()
+			if err := flushWriter(w); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return n, err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return n, err
+	}
+	return n, flushWriter(w)
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// replayAsOf replays docs up to asOf the way BalanceAsOf does, starting
+// after snap.
+func replayAsOf(snap *domain.BalanceSnapshot, asOf, settled time.Time, docs []bson.M) *asOfReplay {
+	sorted := slices.Clone(docs)
+	slices.SortStableFunc(sorted, compareReplayOrder)
+
+	r := newAsOfReplay("u1", snap, settled)
+	for _, raw := range sorted {
+		if eventTime(raw).After(asOf) || snap != nil && !afterSnapshotDoc(snap, raw) {
+			continue
+		}
+		ev, err := DecodeLedgerEvent(raw)
+		r.add(eventTime(raw), raw["_id"].(primitive.ObjectID), ev, err == nil)
+	}
+	r.finish(asOf)
+	return r
+}
+
+func TestAsOfReplayMonthEnds(t *testing.T) {
+	const day = 60 * 24
+	docs := []bson.M{
+		usageDoc(1, 0, "Subscribe", int32(1000), nil),
+		usageDoc(2, 10*day, "Token Used", int32(-100), nil),
+		usageDoc(3, 20*day, "Topup", int32(300), nil),
+		// 1 April falls on day 31; this event is the first of April.
+		usageDoc(4, 31*day, "Token Used", int32(-50), nil),
+		usageDoc(5, 40*day, "Token Used", "garbage", nil),
+		usageDoc(6, 70*day, "Grant", int32(70), bson.M{"bucket": "topup"}),
+	}
+	april, may, june := at(31*day), at(61*day), at(92*day)
+	asOf := at(100 * day)
+
+	full := replayAsOf(nil, asOf, asOf, docs)
+	want := map[time.Time]int{april: 1200, may: 1150, june: 1220}
+	if len(full.monthEnds) != len(want) {
+		t.Fatalf("%d month-end snapshots, want %d", len(full.monthEnds), len(want))
+	}
+	for _, s := range full.monthEnds {
+		through := *s.Through
+		if got := s.MainToken + s.TopupToken; got != want[through] {
+			t.Errorf("balance through %v = %d, want %d", through, got, want[through])
+		}
+		if !s.LastEventTimeStamp.Before(through) {
+			t.Errorf("snapshot through %v ends at %v", through, s.LastEventTimeStamp)
+		}
+
+		// Resuming from a month-end snapshot matches the full replay.
+		resumed := replayAsOf(stored(t, &s), asOf, asOf, docs)
+		if resumed.state.MainToken != full.state.MainToken || resumed.state.TopupToken != full.state.TopupToken || resumed.state.EventCount != full.state.EventCount {
+			t.Errorf("resumed from %v: %+v, full replay %+v", through, resumed.state, full.state)
+		}
+		for _, later := range resumed.monthEnds {
+			if !later.Through.After(through) {
+				t.Errorf("resumed from %v took the month end %v again", through, later.Through)
+			}
+		}
+	}
+
+	// Month ends that have not settled are not kept.
+	if r := replayAsOf(nil, asOf, may, docs); len(r.monthEnds) != 2 {
+		t.Errorf("%d month-end snapshots before May settled, want 2", len(r.monthEnds))
+	}
+}
+
+func TestNextMonthStart(t *testing.T) {
+	tests := []struct {
+		in, want time.Time
+	}{
+		{time.Date(2026, 3, 15, 8, 0, 0, 0, time.UTC), time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 12, 31, 23, 59, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 4, 1, 1, 0, 0, 0, time.FixedZone("ICT", 7*3600)), time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := nextMonthStart(tt.in); !got.Equal(tt.want) {
+			t.Errorf("nextMonthStart(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ExplainBalance replays every event of the user and records each one's
+// effect and the rules that applied. Only events in [from, to) are listed
+// (zero bounds are open), but the replay always starts from the first
+// event so the balances are exact. When the whole history is replayed the
+// result is compared with the stored balance.
+func ExplainBalance(ctx context.Context, userID string, from, to time.Time) (*domain.BalanceExplanation, error) {
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Find(ctx, bson.M{"userId": userID}, options.Find().SetSort(replayOrder))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	e := newBalanceExplainer(userID, from, to)
+	for cursor.Next(ctx) {
+		var raw bson.M
+		if err := cursor.Decode(&raw); err != nil {
+			return nil, err
+		}
+		if !e.add(raw) {
+			break
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	out := e.finish()
+
+	if to.IsZero() {
+		var stored domain.UserBalance
+		err := mongodb.GetCollection(config.UserBalanceColl).FindOne(ctx, bson.M{"userId": userID}).Decode(&stored)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+		if err == nil {
+			s := domain.Balance{Main: stored.MainTokenBalance, Topup: stored.TopupTokenBalance}
+			matches := s == out.Closing
+			out.Stored, out.Matches = &s, &matches
+		}
+
+		journal, err := JournalBalance(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		journalMatches := journal == out.Closing
+		out.Journal, out.JournalMatches = &journal, &journalMatches
+	}
+	return out, nil
+}
+
+// balanceExplainer replays events in replay order and lists the steps of
+// those in [from, to).
+type balanceExplainer struct {
+	out      *domain.BalanceExplanation
+	b        domain.Balance
+	from, to time.Time
+	opened   bool
+}
+
+func newBalanceExplainer(userID string, from, to time.Time) *balanceExplainer {
+	return &balanceExplainer{
+		out:    &domain.BalanceExplanation{UserID: userID, Steps: []domain.BalanceStep{}},
+		from:   from,
+		to:     to,
+		opened: from.IsZero(),
+	}
+}
+
+// add replays one event and reports whether later events may still be
+// listed; it returns false once raw is at or after to. An event that does
+// not decode is listed as skipped and leaves the balance as it was.
+func (e *balanceExplainer) add(raw bson.M) bool {
+	at := eventTime(raw)
+	if !e.to.IsZero() && !at.Before(e.to) {
+		return false
+	}
+	if !e.opened && !at.Before(e.from) {
+		e.out.Opening = e.b
+		e.opened = true
+	}
+
+	before := e.b
+	ev, decodeErr := DecodeLedgerEvent(raw)
+	var rules []string
+	if decodeErr == nil {
+		e.b, rules = e.b.Trace(ev)
+	} else {
+		rules = []string{domain.RuleQuarantineSkipped}
+	}
+	if !e.opened {
+		return true
+	}
+
+	step := domain.BalanceStep{
+		EventID:        ev.ID,
+		EventTimeStamp: at,
+		EventType:      string(ev.Type),
+		EggToken:       ev.SignedAmount,
+		Before:         before,
+		After:          e.b,
+		Rules:          rules,
+	}
+	step.TraceID, _ = raw["traceId"].(string)
+	if decodeErr != nil {
+		step.EventType, _ = raw["eventType"].(string)
+		step.Error = decodeErr.Error()
+	}
+	e.out.Steps = append(e.out.Steps, step)
+	return true
+}
+
+// finish sets the opening and closing balances and returns the
+// explanation.
+func (e *balanceExplainer) finish() *domain.BalanceExplanation {
+	if !e.opened {
+		e.out.Opening = e.b
+	}
+	e.out.Closing = e.b
+	return e.out
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBalanceExplainer(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 9, d, 0, 0, 0, 0, time.UTC) }
+	event := func(d int, eventType string, egg int) bson.M {
+		return bson.M{
+			"_id":            primitive.NewObjectIDFromTimestamp(day(d)),
+			"userId":         "u1",
+			"eventType":      eventType,
+			"eventTimeStamp": primitive.NewDateTimeFromTime(day(d)),
+			"eggToken":       int32(egg),
+		}
+	}
+	used := event(3, "Token Used", 30)
+	used["traceId"] = "trace-1"
+	events := []bson.M{
+		event(1, "Subscribe", 100),
+		event(2, "Topup", 50),
+		used,
+		event(4, "Bonus", 999),
+		event(5, "Token Used", 10),
+	}
+
+	tests := []struct {
+		name         string
+		from, to     time.Time
+		wantTypes    []string
+		wantOpening  int
+		wantClosing  int
+		wantConsumed int
+	}{
+		{name: "whole history", wantTypes: []string{"Subscribe", "Topup", "Token Used", "Bonus", "Token Used"}, wantClosing: 110, wantConsumed: 5},
+		{name: "window", from: day(2), to: day(5), wantTypes: []string{"Topup", "Token Used", "Bonus"}, wantOpening: 100, wantClosing: 120, wantConsumed: 4},
+		{name: "after every event", from: day(10), wantTypes: []string{}, wantOpening: 110, wantClosing: 110, wantConsumed: 5},
+		{name: "before every event", to: day(1), wantTypes: []string{}, wantConsumed: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newBalanceExplainer("u1", tt.from, tt.to)
+			consumed := 0
+			for _, raw := range events {
+				if !e.add(raw) {
+					break
+				}
+				consumed++
+			}
+			out := e.finish()
+
+			if consumed != tt.wantConsumed {
+				t.Errorf("replayed %d events, want %d", consumed, tt.wantConsumed)
+			}
+			if len(out.Steps) != len(tt.wantTypes) {
+				t.Fatalf("%d steps, want %v", len(out.Steps), tt.wantTypes)
+			}
+			for i, step := range out.Steps {
+				if step.EventType != tt.wantTypes[i] {
+					t.Errorf("step %d is %s, want %s", i, step.EventType, tt.wantTypes[i])
+				}
+				if i > 0 && step.Before != out.Steps[i-1].After {
+					t.Errorf("step %d starts at %+v, want %+v", i, step.Before, out.Steps[i-1].After)
+				}
+			}
+			if len(out.Steps) > 0 && out.Steps[0].Before != out.Opening {
+				t.Errorf("first step starts at %+v, want the opening %+v", out.Steps[0].Before, out.Opening)
+			}
+			if got := out.Opening.Total(); got != tt.wantOpening {
+				t.Errorf("opening = %d, want %d", got, tt.wantOpening)
+			}
+			if got := out.Closing.Total(); got != tt.wantClosing {
+				t.Errorf("closing = %d, want %d", got, tt.wantClosing)
+			}
+		})
+	}
+}
+
+func TestBalanceExplainerSteps(t *testing.T) {
+	at := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	e := newBalanceExplainer("u1", time.Time{}, time.Time{})
+	e.add(bson.M{"_id": primitive.NewObjectIDFromTimestamp(at), "userId": "u1", "eventType": "Topup", "eventTimeStamp": primitive.NewDateTimeFromTime(at), "eggToken": int32(50)})
+	e.add(bson.M{"userId": "u1", "eventType": "Token Used", "eventTimeStamp": primitive.NewDateTimeFromTime(at.Add(time.Hour)), "eggToken": int32(20), "traceId": "trace-1"})
+	e.add(bson.M{"userId": "u1", "eventType": "Bonus", "eventTimeStamp": primitive.NewDateTimeFromTime(at.Add(2 * time.Hour)), "eggToken": int32(5)})
+	out := e.finish()
+
+	topup, used, bad := out.Steps[0], out.Steps[1], out.Steps[2]
+	if topup.EggToken != 50 || topup.After != (domain.Balance{Topup: 50}) || !slices.Contains(topup.Rules, domain.RuleCreditTopup) {
+		t.Errorf("topup step = %+v", topup)
+	}
+	if used.EggToken != 20 || used.TraceID != "trace-1" || used.After.Total() != 30 || !used.EventTimeStamp.Equal(at.Add(time.Hour)) {
+		t.Errorf("usage step = %+v", used)
+	}
+	if bad.Error == "" || bad.After != bad.Before || !slices.Contains(bad.Rules, domain.RuleQuarantineSkipped) {
+		t.Errorf("undecodable step = %+v, want it skipped with its error", bad)
+	}
+}
@@ -0,0 +1,288 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// balanceSnapshotEvery is how many events a recompute may replay past
+	// the latest snapshot before it writes a new one.
+	balanceSnapshotEvery = 1000
+	// balanceSnapshotMargin keeps the newest events out of snapshots. An
+	// event's timestamp is taken shortly before it is inserted, and failed
+	// settlements delete their events, so only events older than this are
+	// considered settled in replay order.
+	balanceSnapshotMargin = time.Minute
+)
+
+var ErrSnapshotMismatch = errors.New("Balance snapshot does not match a full replay")
+
+// replayUserBalance returns the user's balance, replaying only the events
+// after their latest snapshot.
+func replayUserBalance(ctx context.Context, userID string) (domain.Balance, error) {
+	book, err := replayUserLedger(ctx, userID)
+	return book.Balance, err
+}
+
+// replayUserLedger returns the user's balance and credit lots, replaying
+// only the events after their latest snapshot, saves the lots it touched
+// and posts the journal entries that are missing. Events are streamed
+// rather than loaded at once. When the replay runs long, the state at the
+// margin is saved as the next snapshot. A snapshot from an older schema is replaced by one from a
+// full replay.
+func replayUserLedger(ctx context.Context, userID string) (*domain.LotBook, error) {
+	stored, err := latestBalanceSnapshot(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	snap, migrate := resumableSnapshot(stored)
+	book, next, err := replayFrom(ctx, userID, snap, time.Now().Add(-balanceSnapshotMargin))
+	if err != nil {
+		return nil, err
+	}
+	if err := saveCreditLots(ctx, book.Lots); err != nil {
+		return nil, err
+	}
+	if err := insertJournalEntries(ctx, book.Journal); err != nil {
+		return nil, err
+	}
+	if next != nil && (migrate || next.EventCount-snapshotCount(snap) >= balanceSnapshotEvery) {
+		err := snapshotAccounts(ctx, snap, next)
+		if err == nil {
+			err = saveBalanceSnapshot(ctx, next, migrate)
+		}
+		if err != nil {
+			log.Printf("Balance snapshot for user %s failed: %v", userID, err)
+		}
+	}
+	return book, nil
+}
+
+// snapshotAccounts sets the journal account totals of next, carrying them
+// forward from prev (a full sum when nil).
+func snapshotAccounts(ctx context.Context, prev, next *domain.BalanceSnapshot) error {
+	tail, err := userAccountBalances(ctx, next.UserID, prev, next)
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		tail = prev.Accounts.Add(tail)
+	}
+	next.Accounts = tail
+	return nil
+}
+
+// resumableSnapshot returns the snapshot a replay may resume from. A
+// snapshot from an older schema is not used; migrate reports that it must
+// be replaced.
+func resumableSnapshot(snap *domain.BalanceSnapshot) (resume *domain.BalanceSnapshot, migrate bool) {
+	if snap != nil && snap.Schema < domain.BalanceSnapshotSchema {
+		return nil, true
+	}
+	return snap, false
+}
+
+// replayFrom replays the events after snap (all events when nil). It also
+// returns the state after the last event older than cutoff, as a candidate
+// snapshot, or nil when no such event followed snap.
+func replayFrom(ctx context.Context, userID string, snap *domain.BalanceSnapshot, cutoff time.Time) (*domain.LotBook, *domain.BalanceSnapshot, error) {
+	r := newSnapshotReplay(userID, snap, cutoff)
+	filter := bson.M{"userId": userID}
+	if snap != nil {
+		filter["$or"] = afterSnapshot(snap)
+	}
+
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Find(ctx, filter, options.Find().SetSort(replayOrder))
+	if err != nil {
+		return r.book, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var raw bson.M
+		if err := cursor.Decode(&raw); err != nil {
+			return r.book, nil, err
+		}
+		ev, ok := decodeOrQuarantine(ctx, raw)
+		r.add(raw, ev, ok)
+	}
+	r.finish()
+	return r.book, r.next, cursor.Err()
+}
+
+// snapshotReplay replays events, in replayOrder, on top of a snapshot and
+// keeps the candidate for the next one.
+type snapshotReplay struct {
+	book   *domain.LotBook
+	next   *domain.BalanceSnapshot
+	count  int
+	cutoff time.Time
+}
+
+func newSnapshotReplay(userID string, snap *domain.BalanceSnapshot, cutoff time.Time) *snapshotReplay {
+	book := &domain.LotBook{UserID: userID}
+	if snap != nil {
+		book.Balance = domain.Balance{Main: snap.MainToken, Topup: snap.TopupToken}
+		book.Lots = append(book.Lots, snap.Lots...)
+	}
+	return &snapshotReplay{book: book, count: snapshotCount(snap), cutoff: cutoff}
+}
+
+// add replays the stored event raw, decoded as ev; ok is false for an
+// event that is skipped but still counted.
+func (r *snapshotReplay) add(raw bson.M, ev domain.LedgerEvent, ok bool) {
+	// Events come in time order, so the candidate snapshot is final once
+	// an event at or past the cutoff shows up.
+	at := eventTime(raw)
+	if r.next != nil && r.next.Lots == nil && !at.Before(r.cutoff) {
+		freezeLots(r.next, r.book)
+	}
+
+	if ok {
+		r.book.Apply(ev)
+	}
+	r.count++
+
+	if !at.Before(r.cutoff) {
+		return
+	}
+	id, _ := raw["_id"].(primitive.ObjectID)
+	r.next = &domain.BalanceSnapshot{
+		UserID:             r.book.UserID,
+		MainToken:          r.book.Balance.Main,
+		TopupToken:         r.book.Balance.Topup,
+		LastEventTimeStamp: at,
+		LastEventID:        id,
+		EventCount:         r.count,
+	}
+}
+
+func (r *snapshotReplay) finish() {
+	if r.next != nil && r.next.Lots == nil {
+		freezeLots(r.next, r.book)
+	}
+}
+
+// freezeLots records the book's lots on a candidate snapshot.
+func freezeLots(snap *domain.BalanceSnapshot, book *domain.LotBook) {
+	snap.Lots = book.ResumableLots(snap.LastEventTimeStamp)
+	if snap.Lots == nil {
+		snap.Lots = []domain.CreditLot{}
+	}
+	snap.Schema = domain.BalanceSnapshotSchema
+}
+
+// afterSnapshot matches the events replayed after snap.
+func afterSnapshot(snap *domain.BalanceSnapshot) bson.A {
+	return bson.A{
+		bson.M{"eventTimeStamp": bson.M{"$gt": snap.LastEventTimeStamp}},
+		bson.M{"eventTimeStamp": snap.LastEventTimeStamp, "_id": bson.M{"$gt": snap.LastEventID}},
+	}
+}
+
+// replayOrder is the order events are replayed in. _id breaks timestamp
+// ties so a snapshot boundary is exact.
+var replayOrder = bson.D{{Key: "eventTimeStamp", Value: 1}, {Key: "_id", Value: 1}}
+
+func snapshotCount(snap *domain.BalanceSnapshot) int {
+	if snap == nil {
+		return 0
+	}
+	return snap.EventCount
+}
+
+func latestBalanceSnapshot(ctx context.Context, userID string) (*domain.BalanceSnapshot, error) {
+	var snap domain.BalanceSnapshot
+	err := mongodb.GetCollection(config.BalanceSnapshotColl).FindOne(ctx, bson.M{"userId": userID}).Decode(&snap)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// saveBalanceSnapshot replaces the user's snapshot unless a newer one was
+// saved in the meantime. A snapshot from an older schema is replaced
+// regardless.
+func saveBalanceSnapshot(ctx context.Context, snap *domain.BalanceSnapshot, migrate bool) error {
+	snap.CreatedAt = time.Now()
+	filter := bson.M{"userId": snap.UserID, "eventCount": bson.M{"$lt": snap.EventCount}}
+	if migrate {
+		filter = bson.M{"userId": snap.UserID, "schema": bson.M{"$not": bson.M{"$gte": domain.BalanceSnapshotSchema}}}
+	}
+	_, err := mongodb.GetCollection(config.BalanceSnapshotColl).ReplaceOne(ctx,
+		filter,
+		snap,
+		options.Replace().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// SnapshotUserBalance replays the user's full event log, saves its lots,
+// posts its missing journal entries and saves a fresh snapshot, replacing
+// any existing one.
+func SnapshotUserBalance(ctx context.Context, userID string) (*domain.BalanceSnapshot, error) {
+	book, next, err := replayFrom(ctx, userID, nil, time.Now().Add(-balanceSnapshotMargin))
+	if err != nil || next == nil {
+		return next, err
+	}
+	// Events before the snapshot are not replayed again, so post them now.
+	if err := saveCreditLots(ctx, book.Lots); err != nil {
+		return nil, err
+	}
+	if err := insertJournalEntries(ctx, book.Journal); err != nil {
+		return nil, err
+	}
+	if err := snapshotAccounts(ctx, nil, next); err != nil {
+		return nil, err
+	}
+	next.CreatedAt = time.Now()
+	_, err = mongodb.GetCollection(config.BalanceSnapshotColl).ReplaceOne(ctx,
+		bson.M{"userId": userID}, next, options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// VerifyUserBalance checks that resuming from the user's snapshot gives the
+// same balance as replaying every event.
+func VerifyUserBalance(ctx context.Context, userID string) error {
+	snap, err := latestBalanceSnapshot(ctx, userID)
+	if err != nil || snap == nil {
+		return err
+	}
+	cutoff := time.Now()
+	resumed, _, err := replayFrom(ctx, userID, snap, cutoff)
+	if err != nil {
+		return err
+	}
+	full, _, err := replayFrom(ctx, userID, nil, cutoff)
+	if err != nil {
+		return err
+	}
+	if resumed.Balance != full.Balance {
+		return fmt.Errorf("%w: user %s snapshot replay main=%d topup=%d, full replay main=%d topup=%d",
+			ErrSnapshotMismatch, userID, resumed.Balance.Main, resumed.Balance.Topup, full.Balance.Main, full.Balance.Topup)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var replayT0 = time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// at returns replayT0 plus n minutes.
+func at(n int) time.Time { return replayT0.Add(time.Duration(n) * time.Minute) }
+
+// oid returns an ObjectID that sorts by n.
+func oid(n byte) primitive.ObjectID {
+	var id primitive.ObjectID
+	id[len(id)-1] = n
+	return id
+}
+
+func usageDoc(id byte, minute int, eventType string, egg any, extra bson.M) bson.M {
+	raw := bson.M{
+		"_id":            oid(id),
+		"userId":         "u1",
+		"eventType":      eventType,
+		"eventTimeStamp": primitive.NewDateTimeFromTime(at(minute)),
+		"eggToken":       egg,
+	}
+	for k, v := range extra {
+		raw[k] = v
+	}
+	return raw
+}
+
+// replayDocs replays docs the way replayFrom replays the stored events: the
+// ones after snap, in replayOrder.
+func replayDocs(snap *domain.BalanceSnapshot, cutoff time.Time, docs []bson.M) (*domain.LotBook, *domain.BalanceSnapshot) {
+	sorted := slices.Clone(docs)
+	slices.SortStableFunc(sorted, compareReplayOrder)
+
+	r := newSnapshotReplay("u1", snap, cutoff)
+	for _, raw := range sorted {
+		if snap != nil && !afterSnapshotDoc(snap, raw) {
+			continue
+		}
+		ev, err := DecodeLedgerEvent(raw)
+		r.add(raw, ev, err == nil)
+	}
+	r.finish()
+	return r.book, r.next
+}
+
+func compareReplayOrder(a, b bson.M) int {
+	if c := eventTime(a).Compare(eventTime(b)); c != 0 {
+		return c
+	}
+	ida, idb := a["_id"].(primitive.ObjectID), b["_id"].(primitive.ObjectID)
+	return bytes.Compare(ida[:], idb[:])
+}
+
+// afterSnapshotDoc is afterSnapshot as a predicate.
+func afterSnapshotDoc(snap *domain.BalanceSnapshot, raw bson.M) bool {
+	ts := eventTime(raw)
+	id := raw["_id"].(primitive.ObjectID)
+	return ts.After(snap.LastEventTimeStamp) ||
+		ts.Equal(snap.LastEventTimeStamp) && bytes.Compare(id[:], snap.LastEventID[:]) > 0
+}
+
+// stored returns snap as it reads back from MongoDB.
+func stored(t *testing.T, snap *domain.BalanceSnapshot) *domain.BalanceSnapshot {
+	t.Helper()
+	if snap == nil {
+		return nil
+	}
+	data, err := bson.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out domain.BalanceSnapshot
+	if err := bson.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return &out
+}
+
+// lotKeys describes the active lots independently of time zones.
+func lotKeys(book *domain.LotBook) []string {
+	var keys []string
+	for _, l := range book.ActiveLots() {
+		expires := "never"
+		if l.ExpiresAt != nil {
+			expires = l.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+		keys = append(keys, fmt.Sprintf("%s %s %d/%d %s", l.ID, l.Bucket, l.Remaining, l.Amount, expires))
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func checkSameReplay(t *testing.T, got, want *domain.LotBook) {
+	t.Helper()
+	if got.Balance != want.Balance {
+		t.Errorf("balance = %+v, full replay %+v", got.Balance, want.Balance)
+	}
+	if g, w := lotKeys(got), lotKeys(want); !slices.Equal(g, w) {
+		t.Errorf("lots = %v, full replay %v", g, w)
+	}
+}
+
+func replayFixture() []bson.M {
+	topupLot := oid(2).Hex()
+	return []bson.M{
+		usageDoc(1, 0, "Subscribe", int32(1000), bson.M{"expiresAt": primitive.NewDateTimeFromTime(at(60 * 24 * 30))}),
+		usageDoc(2, 1, "Topup", int32(300), bson.M{"expiresAt": primitive.NewDateTimeFromTime(at(60 * 24 * 10))}),
+		// Three charges share a timestamp; _id decides their order.
+		usageDoc(5, 2, "Token Used", int32(150), nil),
+		usageDoc(3, 2, "Token Used", int32(200), nil),
+		usageDoc(4, 2, "Token Used", int32(950), nil),
+		usageDoc(6, 3, "Token Used", "garbage", nil),
+		usageDoc(7, 4, "Refund", int32(100), bson.M{"mainToken": int32(60), "topupToken": int32(40)}),
+		usageDoc(8, 5, "TopupExpired", int32(10), bson.M{"lotId": topupLot}),
+		usageDoc(9, 5, "Grant", int32(70), bson.M{"bucket": "topup"}),
+		usageDoc(10, 6, "Token Used", int32(120), bson.M{"deduction": bson.M{"strategy": domain.DeductTopupFirst}}),
+	}
+}
+
+// TestReplayFromEveryBoundary resumes from a snapshot taken after each
+// prefix of the log and checks the result against a full replay.
+func TestReplayFromEveryBoundary(t *testing.T) {
+	docs := replayFixture()
+	slices.SortStableFunc(docs, compareReplayOrder)
+	never := at(1 << 20)
+	full, fullNext := replayDocs(nil, never, docs)
+
+	for k := 1; k <= len(docs); k++ {
+		t.Run(fmt.Sprintf("after %d events", k), func(t *testing.T) {
+			_, snap := replayDocs(nil, never, docs[:k])
+			snap = stored(t, snap)
+			if snap.LastEventID != docs[k-1]["_id"] || snap.EventCount != k {
+				t.Fatalf("snapshot ends at %s after %d events, want %s after %d", snap.LastEventID.Hex(), snap.EventCount, docs[k-1]["_id"], k)
+			}
+			resumed, next := replayDocs(snap, never, docs)
+			checkSameReplay(t, resumed, full)
+			if next == nil && k < len(docs) || next != nil && next.EventCount != fullNext.EventCount {
+				t.Errorf("next snapshot = %+v, full replay %+v", next, fullNext)
+			}
+		})
+	}
+}
+
+// TestReplayFromTimestampTies checks events that share the snapshot's
+// timestamp: later _ids are replayed after it, earlier ones are taken as
+// already covered.
+func TestReplayFromTimestampTies(t *testing.T) {
+	docs := replayFixture()
+	never := at(1 << 20)
+	_, snap := replayDocs(nil, never, docs)
+	snap = stored(t, snap)
+
+	tests := []struct {
+		name     string
+		late     bson.M
+		replayed bool
+	}{
+		{name: "same timestamp, higher _id", late: usageDoc(11, 6, "Topup", int32(55), nil), replayed: true},
+		{name: "same timestamp, lower _id", late: usageDoc(0, 6, "Topup", int32(55), nil), replayed: false},
+		{name: "later timestamp", late: usageDoc(0, 7, "Topup", int32(55), nil), replayed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withLate := append(slices.Clone(docs), tt.late)
+			resumed, _ := replayDocs(snap, never, withLate)
+			want := docs
+			if tt.replayed {
+				want = withLate
+			}
+			full, _ := replayDocs(nil, never, want)
+			checkSameReplay(t, resumed, full)
+		})
+	}
+}
+
+// TestReplayFromCutoff checks that the candidate snapshot stops before the
+// cutoff and that resuming from it matches a full replay.
+func TestReplayFromCutoff(t *testing.T) {
+	docs := replayFixture()
+	never := at(1 << 20)
+	full, _ := replayDocs(nil, never, docs)
+
+	tests := []struct {
+		name      string
+		cutoff    time.Time
+		wantLast  primitive.ObjectID
+		wantCount int
+		wantNone  bool
+	}{
+		{name: "before every event", cutoff: at(0), wantNone: true},
+		{name: "event at the cutoff is left out", cutoff: at(1), wantLast: oid(1), wantCount: 1},
+		{name: "tied events at the cutoff are all left out", cutoff: at(2), wantLast: oid(2), wantCount: 2},
+		{name: "just past tied events", cutoff: at(2).Add(time.Millisecond), wantLast: oid(5), wantCount: 5},
+		{name: "malformed events are counted", cutoff: at(4), wantLast: oid(6), wantCount: 6},
+		{name: "after every event", cutoff: never, wantLast: oid(10), wantCount: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			book, next := replayDocs(nil, tt.cutoff, docs)
+			checkSameReplay(t, book, full)
+			if tt.wantNone {
+				if next != nil {
+					t.Fatalf("next snapshot = %+v, want none", next)
+				}
+				return
+			}
+			if next == nil {
+				t.Fatal("no next snapshot")
+			}
+			if next.LastEventID != tt.wantLast || next.EventCount != tt.wantCount {
+				t.Errorf("snapshot ends at %s after %d events, want %s after %d", next.LastEventID.Hex(), next.EventCount, tt.wantLast.Hex(), tt.wantCount)
+			}
+			if !next.LastEventTimeStamp.Before(tt.cutoff) {
+				t.Errorf("snapshot at %v is not before the cutoff %v", next.LastEventTimeStamp, tt.cutoff)
+			}
+			if next.Schema != domain.BalanceSnapshotSchema || next.Lots == nil {
+				t.Errorf("snapshot schema %d lots %v", next.Schema, next.Lots)
+			}
+
+			resumed, _ := replayDocs(stored(t, next), never, docs)
+			checkSameReplay(t, resumed, full)
+		})
+	}
+}
+
+// TestResumableSnapshot checks that snapshots from an older schema are not
+// resumed from, and that a full replay replaces them.
+func TestResumableSnapshot(t *testing.T) {
+	docs := replayFixture()
+	slices.SortStableFunc(docs, compareReplayOrder)
+	never := at(1 << 20)
+	full, _ := replayDocs(nil, never, docs)
+	_, current := replayDocs(nil, never, docs[:4])
+
+	// A schema 0 snapshot has the balance but no lots.
+	old := *current
+	old.Schema, old.Lots = 0, nil
+
+	tests := []struct {
+		name        string
+		snap        *domain.BalanceSnapshot
+		wantResume  bool
+		wantMigrate bool
+	}{
+		{name: "no snapshot"},
+		{name: "current schema", snap: current, wantResume: true},
+		{name: "older schema", snap: &old, wantMigrate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resume, migrate := resumableSnapshot(tt.snap)
+			if (resume != nil) != tt.wantResume || migrate != tt.wantMigrate {
+				t.Fatalf("resume = %v, migrate = %v", resume != nil, migrate)
+			}
+			book, _ := replayDocs(stored(t, resume), never, docs)
+			checkSameReplay(t, book, full)
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// balanceWatchRetry is how long WatchBalanceChanges waits before reopening
+// a change stream that failed.
+const balanceWatchRetry = 5 * time.Second
+
+// balanceHub fans balance changes out to the streams open on this process.
+// Each subscriber has a one-slot buffer that keeps only the latest balance,
+// so a slow client skips intermediate balances instead of stalling writers.
+type balanceHub struct {
+	mu     sync.Mutex
+	subs   map[string]map[chan domain.UserBalance]struct{}
+	closed bool
+	// watching is set while a change stream feeds the hub, which then
+	// delivers this process's own writes too.
+	watching bool
+}
+
+var balances = newBalanceHub()
+
+func newBalanceHub() *balanceHub {
+	return &balanceHub{subs: map[string]map[chan domain.UserBalance]struct{}{}}
+}
+
+// SubscribeBalance returns a channel that receives the user's balance each
+// time it is written, and a function that ends the subscription. The
+// channel is closed when the subscription ends or CloseBalanceStreams runs.
+func SubscribeBalance(userID string) (<-chan domain.UserBalance, func()) {
+	return balances.subscribe(userID)
+}
+
+// CloseBalanceStreams ends every subscription and refuses new ones, so open
+// streams finish and the server can shut down.
+func CloseBalanceStreams() {
+	balances.close()
+}
+
+func (h *balanceHub) subscribe(userID string) (<-chan domain.UserBalance, func()) {
+	ch := make(chan domain.UserBalance, 1)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if h.subs[userID] == nil {
+		h.subs[userID] = map[chan domain.UserBalance]struct{}{}
+	}
+	h.subs[userID][ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[userID][ch]; !ok {
+			return
+		}
+		delete(h.subs[userID], ch)
+		if len(h.subs[userID]) == 0 {
+			delete(h.subs, userID)
+		}
+		close(ch)
+	}
+}
+
+func (h *balanceHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for userID, subs := range h.subs {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(h.subs, userID)
+	}
+}
+
+func (h *balanceHub) publish(bal domain.UserBalance) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[bal.UserID] {
+		// Replace a balance the subscriber has not read yet.
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- bal:
+		default:
+		}
+	}
+}
+
+// wants reports whether a write by this process should be published
+// directly: someone here follows the user and no change stream will
+// deliver the write.
+func (h *balanceHub) wants(userID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.watching && len(h.subs[userID]) > 0
+}
+
+func (h *balanceHub) setWatching(on bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watching = on
+}
+
+// publishBalance tells this process's subscribers about a write to the
+// user's balance. bal is the balance written, or nil to read it back,
+// which is only done when someone is listening.
+func publishBalance(ctx context.Context, userID string, bal *domain.UserBalance) {
+	if !balances.wants(userID) {
+		return
+	}
+	if bal == nil {
+		stored, err := GetUserBalance(ctx, userID)
+		if err != nil {
+			log.Printf("Reading balance of user %s for its stream failed: %v", userID, err)
+			return
+		}
+		if stored == nil {
+			return
+		}
+		bal = stored
+	}
+	balances.publish(*bal)
+}
+
+// WatchBalanceChanges feeds the hub from a MongoDB change stream on
+// user_balance, so a write made by any replica reaches the streams open on
+// this one. While the stream is open, writes here are not published
+// directly. A failed stream, e.g. on a standalone server without change
+// streams, falls back to direct publishing and is reopened from where it
+// stopped after balanceWatchRetry, or from the current position when it
+// cannot be resumed.
+func WatchBalanceChanges(ctx context.Context) {
+	var resume bson.Raw
+	for {
+		resume = watchBalances(ctx, resume)
+		balances.setWatching(false)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(balanceWatchRetry):
+		}
+	}
+}
+
+// watchBalances runs one change stream until it fails or ctx ends and
+// returns the resume token of the last change it delivered.
+func watchBalances(ctx context.Context, resume bson.Raw) bson.Raw {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType": bson.M{"$in": bson.A{"insert", "update", "replace"}},
+	}}}}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resume != nil {
+		opts.SetResumeAfter(resume)
+	}
+	stream, err := mongodb.GetCollection(config.UserBalanceColl).Watch(ctx, pipeline, opts)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Opening the user_balance change stream failed: %v", err)
+		}
+		// The token may have fallen off the oplog; start afresh next time.
+		return nil
+	}
+	defer stream.Close(context.Background())
+	balances.setWatching(true)
+
+	for stream.Next(ctx) {
+		var change struct {
+			FullDocument *domain.UserBalance `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&change); err != nil {
+			log.Printf("Decoding a user_balance change failed: %v", err)
+		} else if change.FullDocument != nil {
+			balances.publish(*change.FullDocument)
+		}
+		resume = append(bson.Raw(nil), stream.ResumeToken()...)
+	}
+	if err := stream.Err(); err != nil && ctx.Err() == nil {
+		log.Printf("The user_balance change stream failed: %v", err)
+	}
+	return resume
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"testing"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+)
+
+// received returns the balance waiting on ch, if any, without blocking.
+func received(ch <-chan domain.UserBalance) (domain.UserBalance, bool, bool) {
+	select {
+	case bal, open := <-ch:
+		return bal, open, true
+	default:
+		return domain.UserBalance{}, true, false
+	}
+}
+
+func TestBalanceHubPublish(t *testing.T) {
+	h := newBalanceHub()
+	first, unsubFirst := h.subscribe("u1")
+	defer unsubFirst()
+	second, unsubSecond := h.subscribe("u1")
+	defer unsubSecond()
+	other, unsubOther := h.subscribe("u2")
+	defer unsubOther()
+
+	h.publish(domain.UserBalance{UserID: "u1", RemainingTokenBalance: 100})
+	h.publish(domain.UserBalance{UserID: "u1", RemainingTokenBalance: 90})
+
+	for name, ch := range map[string]<-chan domain.UserBalance{"first": first, "second": second} {
+		bal, _, ok := received(ch)
+		if !ok || bal.RemainingTokenBalance != 90 {
+			t.Errorf("%s subscriber got %+v (%v), want the latest balance 90", name, bal, ok)
+		}
+		if _, _, ok := received(ch); ok {
+			t.Errorf("%s subscriber got a stale balance after the latest", name)
+		}
+	}
+	if bal, _, ok := received(other); ok {
+		t.Errorf("other user's subscriber got %+v", bal)
+	}
+}
+
+func TestBalanceHubUnsubscribe(t *testing.T) {
+	h := newBalanceHub()
+	ch, unsubscribe := h.subscribe("u1")
+	kept, unsubKept := h.subscribe("u1")
+	defer unsubKept()
+
+	unsubscribe()
+	if _, open, ok := received(ch); !ok || open {
+		t.Fatal("channel still open after unsubscribing")
+	}
+	unsubscribe() // A second call must not close the channel again.
+
+	h.publish(domain.UserBalance{UserID: "u1", RemainingTokenBalance: 50})
+	if bal, _, ok := received(kept); !ok || bal.RemainingTokenBalance != 50 {
+		t.Errorf("remaining subscriber got %+v (%v), want 50", bal, ok)
+	}
+
+	unsubKept()
+	if _, ok := h.subs["u1"]; ok {
+		t.Error("user still listed after the last subscriber left")
+	}
+	h.publish(domain.UserBalance{UserID: "u1", RemainingTokenBalance: 40})
+}
+
+func TestBalanceHubClose(t *testing.T) {
+	h := newBalanceHub()
+	a, unsubA := h.subscribe("u1")
+	b, _ := h.subscribe("u2")
+
+	h.close()
+	for name, ch := range map[string]<-chan domain.UserBalance{"u1": a, "u2": b} {
+		if _, open, ok := received(ch); !ok || open {
+			t.Errorf("%s channel still open after close", name)
+		}
+	}
+	unsubA() // Ending a subscription the hub already closed is harmless.
+
+	late, unsubLate := h.subscribe("u1")
+	defer unsubLate()
+	if _, open, ok := received(late); !ok || open {
+		t.Error("subscription after close is open, want it closed at once")
+	}
+	h.publish(domain.UserBalance{UserID: "u1"})
+}
+
+func TestBalanceHubWants(t *testing.T) {
+	h := newBalanceHub()
+	if h.wants("u1") {
+		t.Error("wants = true with no subscribers")
+	}
+	_, unsubscribe := h.subscribe("u1")
+	defer unsubscribe()
+	if !h.wants("u1") {
+		t.Error("wants = false with a subscriber")
+	}
+	if h.wants("u2") {
+		t.Error("wants = true for a user nobody follows")
+	}
+	h.setWatching(true)
+	if h.wants("u1") {
+		t.Error("wants = true while a change stream delivers writes")
+	}
+}
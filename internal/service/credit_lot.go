@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidLotStatus = errors.New("Invalid credit lot status")
+
+// saveCreditLots writes the lots a replay touched to user_credit_lot. Lots
+// are keyed by the event that granted them, so rewriting them is safe.
+func saveCreditLots(ctx context.Context, lots []domain.CreditLot) error {
+	if len(lots) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, len(lots))
+	for i, lot := range lots {
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": lot.ID}).SetReplacement(lot).SetUpsert(true)
+	}
+	_, err := mongodb.GetCollection(config.CreditLotColl).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// ListCreditLots returns the user's lots as last saved, oldest first,
+// optionally only those with the given status. It does not replay: lots are
+// saved by every balance recompute, and RebuildStaleCreditLots catches up
+// with the charges and refunds that only adjust the stored balance.
+func ListCreditLots(ctx context.Context, userID, status string) ([]domain.CreditLot, error) {
+	switch status {
+	case "", domain.LotActive, domain.LotConsumed, domain.LotExpired, domain.LotRolledOver:
+	default:
+		return nil, errors.Join(ErrInvalidLotStatus, fmt.Errorf("status must be active, consumed, expired or rolled_over, got %q", status))
+	}
+
+	filter := bson.M{"userId": userID}
+	if status != "" {
+		filter["status"] = status
+	}
+	cursor, err := mongodb.GetCollection(config.CreditLotColl).Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "grantedAt", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	lots := []domain.CreditLot{}
+	if err := cursor.All(ctx, &lots); err != nil {
+		return nil, err
+	}
+	return lots, nil
+}
+
+// RebuildStaleCreditLots replays every user whose balance was changed
+// without a replay since their lots were last saved, which brings their
+// lots up to date. Such writes count themselves in lotsStale on
+// user_balance; the count is cleared only if no write came in during the
+// replay, so a user changed mid-way is picked up on the next run.
+func RebuildStaleCreditLots(ctx context.Context) error {
+	coll := mongodb.GetCollection(config.UserBalanceColl)
+	cursor, err := coll.Find(ctx, bson.M{"lotsStale": bson.M{"$gt": 0}},
+		options.Find().SetProjection(bson.M{"userId": 1, "lotsStale": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc struct {
+			UserID    string `bson:"userId"`
+			LotsStale int    `bson:"lotsStale"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if _, err := replayUserLedger(ctx, doc.UserID); err != nil {
+			log.Printf("Credit lot rebuild for user %s failed: %v", doc.UserID, err)
+			continue
+		}
+		if _, err := coll.UpdateOne(ctx,
+			bson.M{"userId": doc.UserID, "lotsStale": doc.LotsStale},
+			bson.M{"$unset": bson.M{"lotsStale": ""}},
+		); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// ExpireDueCreditLots expires what is left of every lot past its expiry.
+// Lots of the current main package period are left to renewals and plan
+// changes, which decide what rolls over.
+func ExpireDueCreditLots(ctx context.Context) error {
+	now := time.Now()
+	userIDs, err := mongodb.GetCollection(config.CreditLotColl).Distinct(ctx, "userId", bson.M{
+		"status":    domain.LotActive,
+		"expiresAt": bson.M{"$lte": now},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, v := range userIDs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		userID, _ := v.(string)
+		if err := expireUserLots(ctx, userID, now); err != nil {
+			log.Printf("Lot expiry for user %s failed: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// expireUserLots appends an expiry event for each of the user's due lots,
+// for the amount the lot still holds. Events are keyed by lot, so a retry
+// does not expire a lot twice.
+func expireUserLots(ctx context.Context, userID string, now time.Time) error {
+	book, err := replayUserLedger(ctx, userID)
+	if err != nil {
+		return err
+	}
+	periodActive, err := hasActiveMainPackage(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, lot := range book.ActiveLots() {
+		if lot.ExpiresAt == nil || lot.ExpiresAt.After(now) || lot.Remaining <= 0 {
+			continue
+		}
+		if periodActive && lot.Bucket == domain.BucketMain &&
+			(lot.Source == EvtSubscribe || lot.Source == EvtRollover) {
+			continue
+		}
+		eventType := EvtMainExpired
+		if lot.Bucket == domain.BucketTopup {
+			eventType = EvtTopupExpired
+		}
+		if err := insertLotExpiryEvent(ctx, lot, eventType, now); err != nil {
+			return err
+		}
+	}
+
+	_, err = RecomputeAndUpsertUserBalance(ctx, userID)
+	return err
+}
+
+func hasActiveMainPackage(ctx context.Context, userID string) (bool, error) {
+	n, err := mongodb.GetCollection(config.UserMainPackageColl).CountDocuments(ctx, bson.M{"userId": userID, "status": "A"})
+	return n > 0, err
+}
+
+func insertLotExpiryEvent(ctx context.Context, lot domain.CreditLot, eventType string, at time.Time) error {
+	lotID := lot.ID
+	doc := domain.UsageEventOut{
+		ID:             primitive.NewObjectID(),
+		EventTimeStamp: at,
+		UserID:         lot.UserID,
+		EventType:      eventType,
+		EggToken:       -lot.Remaining,
+		LotID:          &lotID,
+	}
+	_, err := mongodb.GetCollection(config.UsageEventColl).InsertOne(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("insert %s event: %w", eventType, err)
+	}
+	postEvents(ctx, &doc)
+	return nil
+}
+
+// activeCreditLots returns the user's active lots of both buckets as last
+// saved.
+func activeCreditLots(ctx context.Context, userID string) ([]domain.CreditLot, error) {
+	cursor, err := mongodb.GetCollection(config.CreditLotColl).Find(ctx, bson.M{"userId": userID, "status": domain.LotActive})
+	if err != nil {
+		return nil, err
+	}
+	var lots []domain.CreditLot
+	if err := cursor.All(ctx, &lots); err != nil {
+		return nil, err
+	}
+	return lots, nil
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EntitlementPolicy decides what happens when usage falls outside the
+// models a package allows: it is flagged, or also charged at a premium.
+type EntitlementPolicy struct {
+	Mode              string
+	PremiumMultiplier float64
+}
+
+// apply returns the price multiplier and flags for charging model under
+// packageID. An unresolved model counts as not entitled on a restricted
+// package, since it cannot be shown to be allowed.
+func (p EntitlementPolicy) apply(ctx context.Context, packageID string, model *domain.ProviderModel) (float64, []string, error) {
+	allowed, _, err := packageModels(ctx, packageID)
+	if err != nil {
+		return 0, nil, err
+	}
+	multiplier, flags := p.decide(allowed, model)
+	return multiplier, flags, nil
+}
+
+// decide applies the policy to model given the package's allowed models
+// (nil when unrestricted).
+func (p EntitlementPolicy) decide(allowed []string, model *domain.ProviderModel) (float64, []string) {
+	if allowed == nil || (model != nil && slices.Contains(allowed, model.ModelID)) {
+		return 1, nil
+	}
+	if p.Mode == domain.EntitlementPremium {
+		return p.PremiumMultiplier, []string{domain.FlagModelNotEntitled}
+	}
+	return 1, []string{domain.FlagModelNotEntitled}
+}
+
+// packageModels returns the allowed model IDs for a package, or nil when the
+// package is unrestricted.
+func packageModels(ctx context.Context, packageID string) ([]string, bool, error) {
+	var doc domain.PackageBestModels
+	err := mongodb.GetCollection(config.PackageBestModelsColl).FindOne(ctx, bson.M{"packageId": packageID}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if doc.ModelIDs == nil {
+		doc.ModelIDs = []string{}
+	}
+	return doc.ModelIDs, true, nil
+}
+
+func activeMainPackage(ctx context.Context, userID string) (*domain.UserMainPackage, error) {
+	var ump domain.UserMainPackage
+	err := mongodb.GetCollection(config.UserMainPackageColl).FindOne(ctx, bson.M{"userId": userID, "status": "A"}).Decode(&ump)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoMainPackage
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ump, nil
+}
+
+// entitledPackage returns the package whose models the user may run, and
+// the organization it belongs to when it is not the user's own.
+func entitledPackage(ctx context.Context, userID string) (string, string, error) {
+	var org *domain.Organization
+	member, err := findOrgMember(ctx, userID)
+	if err != nil {
+		return "", "", err
+	}
+	if member != nil {
+		if org, err = GetOrganization(ctx, member.OrgID); err != nil {
+			return "", "", err
+		}
+	}
+
+	var ump *domain.UserMainPackage
+	if org == nil || org.PackageID == "" {
+		ump, err = activeMainPackage(ctx, userID)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return pickEntitledPackage(org, ump)
+}
+
+// pickEntitledPackage chooses between the package of the organization the
+// user is a member of, which their usage is charged under, and their own
+// active main package. An organization without a package leaves the user
+// on their own.
+func pickEntitledPackage(org *domain.Organization, ump *domain.UserMainPackage) (string, string, error) {
+	if org != nil && org.PackageID != "" {
+		return org.PackageID, org.OrgID, nil
+	}
+	if ump == nil {
+		return "", "", ErrNoMainPackage
+	}
+	return ump.PackageID, "", nil
+}
+
+// GetEntitlements lists the models the user's package allows: their
+// organization's while they are a member of an active one, otherwise their
+// active main package's.
+func GetEntitlements(ctx context.Context, userID string) (*domain.Entitlements, error) {
+	packageID, orgID, err := entitledPackage(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	models, restricted, err := packageModels(ctx, packageID)
+	if err != nil {
+		return nil, err
+	}
+	if models == nil {
+		models = []string{}
+	}
+	return &domain.Entitlements{
+		UserID:     userID,
+		PackageID:  packageID,
+		OrgID:      orgID,
+		Restricted: restricted,
+		ModelIDs:   models,
+	}, nil
+}
+
+// CheckEntitlement is the preflight for running aiModel as userID, under
+// the same package GetEntitlements reports.
+func (p EntitlementPolicy) CheckEntitlement(ctx context.Context, userID, aiModel string) (*domain.EntitlementCheck, error) {
+	packageID, orgID, err := entitledPackage(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	model, err := ResolveModel(ctx, aiModel)
+	if err != nil && !errors.Is(err, ErrModelNotFound) {
+		return nil, err
+	}
+
+	multiplier, flags, err := p.apply(ctx, packageID, model)
+	if err != nil {
+		return nil, err
+	}
+
+	check := &domain.EntitlementCheck{
+		UserID:     userID,
+		PackageID:  packageID,
+		OrgID:      orgID,
+		AIModel:    aiModel,
+		Allowed:    len(flags) == 0,
+		Action:     "allow",
+		Multiplier: multiplier,
+	}
+	if model != nil {
+		check.ModelID = model.ModelID
+	}
+	if !check.Allowed {
+		check.Action = p.Mode
+	}
+	return check, nil
+}
+
+func (s *UsageSettler) Entitlements() EntitlementPolicy {
+	return s.entitlements
+}
+
+// SetPackageModels replaces the models a package may use. Every model must
+// exist in the registry.
+func SetPackageModels(ctx context.Context, packageID string, modelIDs []string) (*domain.PackageBestModels, error) {
+	if _, err := findPackage(ctx, packageID); err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, id := range modelIDs {
+		id = strings.TrimSpace(id)
+		if id == "" || slices.Contains(ids, id) {
+			continue
+		}
+		if _, err := GetModel(ctx, id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	doc := domain.PackageBestModels{PackageID: packageID, ModelIDs: ids}
+	opts := options.Replace().SetUpsert(true)
+	if _, err := mongodb.GetCollection(config.PackageBestModelsColl).ReplaceOne(ctx, bson.M{"packageId": packageID}, doc, opts); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// GetPackageModels returns the package's model list. A nil ModelIDs means
+// the package is unrestricted.
+func GetPackageModels(ctx context.Context, packageID string) (*domain.PackageBestModels, error) {
+	models, _, err := packageModels(ctx, packageID)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.PackageBestModels{PackageID: packageID, ModelIDs: models}, nil
+}
+
+// ClearPackageModels lifts all model restrictions from a package.
+func ClearPackageModels(ctx context.Context, packageID string) error {
+	_, err := mongodb.GetCollection(config.PackageBestModelsColl).DeleteOne(ctx, bson.M{"packageId": packageID})
+	return err
+}
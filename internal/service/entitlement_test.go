@@ -0,0 +1,66 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+)
+
+func TestPickEntitledPackage(t *testing.T) {
+	own := &domain.UserMainPackage{UserID: "u1", PackageID: "pro-monthly"}
+	org := &domain.Organization{OrgID: "acme", PackageID: "team-monthly"}
+
+	tests := []struct {
+		name        string
+		org         *domain.Organization
+		ump         *domain.UserMainPackage
+		wantPackage string
+		wantOrg     string
+		wantErr     error
+	}{
+		{name: "own package", ump: own, wantPackage: "pro-monthly"},
+		{name: "member uses the organization's package", org: org, ump: own, wantPackage: "team-monthly", wantOrg: "acme"},
+		{name: "member without a package of their own", org: org, wantPackage: "team-monthly", wantOrg: "acme"},
+		{name: "organization without a package", org: &domain.Organization{OrgID: "acme"}, ump: own, wantPackage: "pro-monthly"},
+		{name: "no package at all", wantErr: ErrNoMainPackage},
+		{name: "organization without a package and none of their own", org: &domain.Organization{OrgID: "acme"}, wantErr: ErrNoMainPackage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkg, orgID, err := pickEntitledPackage(tt.org, tt.ump)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("pickEntitledPackage error = %v, want %v", err, tt.wantErr)
+			}
+			if pkg != tt.wantPackage || orgID != tt.wantOrg {
+				t.Errorf("pickEntitledPackage = %q, %q, want %q, %q", pkg, orgID, tt.wantPackage, tt.wantOrg)
+			}
+		})
+	}
+}
+
+func TestEntitlementPolicyDecide(t *testing.T) {
+	allowed := []string{"gpt-4o"}
+	tests := []struct {
+		name           string
+		policy         EntitlementPolicy
+		allowed        []string
+		model          *domain.ProviderModel
+		wantMultiplier float64
+		wantFlagged    bool
+	}{
+		{name: "unrestricted", policy: EntitlementPolicy{Mode: domain.EntitlementFlag}, model: &domain.ProviderModel{ModelID: "o1"}, wantMultiplier: 1},
+		{name: "entitled", policy: EntitlementPolicy{Mode: domain.EntitlementFlag}, allowed: allowed, model: &domain.ProviderModel{ModelID: "gpt-4o"}, wantMultiplier: 1},
+		{name: "flagged", policy: EntitlementPolicy{Mode: domain.EntitlementFlag}, allowed: allowed, model: &domain.ProviderModel{ModelID: "o1"}, wantMultiplier: 1, wantFlagged: true},
+		{name: "premium", policy: EntitlementPolicy{Mode: domain.EntitlementPremium, PremiumMultiplier: 1.5}, allowed: allowed, model: &domain.ProviderModel{ModelID: "o1"}, wantMultiplier: 1.5, wantFlagged: true},
+		{name: "unresolved model on a restricted package", policy: EntitlementPolicy{Mode: domain.EntitlementFlag}, allowed: allowed, wantMultiplier: 1, wantFlagged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			multiplier, flags := tt.policy.decide(tt.allowed, tt.model)
+			if multiplier != tt.wantMultiplier || (len(flags) > 0) != tt.wantFlagged {
+				t.Errorf("decide = %v, %v, want %v, flagged %v", multiplier, flags, tt.wantMultiplier, tt.wantFlagged)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package service
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"github.com/parquet-go/parquet-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportChunkSize is how many events are fetched per cursor batch and
+// buffered before the output is flushed, which bounds export memory.
+const exportChunkSize = 5000
+
+var ErrInvalidExport = errors.New("Invalid export request")
+
+// ExportContentType is the MIME type of an export format.
+func ExportContentType(format string) string {
+	switch format {
+	case domain.ExportCSV:
+		return "text/csv; charset=utf-8"
+	case domain.ExportNDJSON:
+		return "application/x-ndjson"
+	default:
+		return "application/vnd.apache.parquet"
+	}
+}
+
+// ValidateExport checks the format and filter before any output is written.
+func ValidateExport(format string, f domain.UsageExportFilter) error {
+	var errs []error
+	if format != domain.ExportCSV && format != domain.ExportNDJSON && format != domain.ExportParquet {
+		errs = append(errs, fmt.Errorf("format must be csv, ndjson or parquet, got %q", format))
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && !f.To.After(f.From) {
+		errs = append(errs, errors.New("to must be after from"))
+	}
+	if len(errs) > 0 {
+		return errors.Join(append([]error{ErrInvalidExport}, errs...)...)
+	}
+	return nil
+}
+
+// ExportUsageEvents streams the matching usage events to w in eventTimeStamp
+// order and returns how many were written and how many malformed events were
+// skipped. Events are read and flushed in chunks, so the export never holds
+// more than one chunk in memory. A malformed event cannot stop an export
+// whose output has already started, so it is logged and left out; creditctl
+// quarantine records it for repair.
+func ExportUsageEvents(ctx context.Context, format string, f domain.UsageExportFilter, w io.Writer) (int, int, error) {
+	if err := ValidateExport(format, f); err != nil {
+		return 0, 0, err
+	}
+
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Find(ctx, exportQuery(f),
+		options.Find().SetSort(bson.D{{Key: "eventTimeStamp", Value: 1}, {Key: "_id", Value: 1}}).SetBatchSize(exportChunkSize),
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	out := newExportWriter(format, w)
+	n, skipped := 0, 0
+	for cursor.Next(ctx) {
+		var raw bson.M
+		err := cursor.Decode(&raw)
+		var ev *domain.UsageEventOut
+		if err == nil {
+			ev, err = decodeExportEvent(raw)
+		}
+		if err != nil {
+			log.Printf("Usage export skipped event %v: %v", raw["_id"], err)
+			skipped++
+			continue
+		}
+		if err := out.write(toExportRow(ev)); err != nil {
+			return n, skipped, err
+		}
+		n++
+		if n%exportChunkSize == 0 {
+			if err := out.flush(); err != nil {
+				return n, skipped, err
+			}
+			if err := flushWriter(w); err != nil {
+				return n, skipped, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return n, skipped, err
+	}
+	if err := out.close(); err != nil {
+		return n, skipped, err
+	}
+	return n, skipped, flushWriter(w)
+}
+
+// exportIntFields are the integer fields legacy events may hold as doubles
+// or numeric strings.
+var exportIntFields = []string{"eggToken", "mainToken", "topupToken", "chatToken", "websearchToken", "packageVersion", "refundedToken"}
+
+// decodeExportEvent decodes raw as read-only as the replay does: events the
+// replay would quarantine are rejected, and integers stored as doubles or
+// numeric strings are read the way the replay reads them.
+func decodeExportEvent(raw bson.M) (*domain.UsageEventOut, error) {
+	if _, err := DecodeLedgerEvent(raw); err != nil {
+		return nil, err
+	}
+	norm := make(bson.M, len(raw))
+	for k, v := range raw {
+		norm[k] = v
+	}
+	for _, k := range exportIntFields {
+		v, ok := norm[k]
+		if !ok || v == nil {
+			continue
+		}
+		n, err := ledgerInt(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrMalformedEvent, k, err)
+		}
+		norm[k] = int64(n)
+	}
+	data, err := bson.Marshal(norm)
+	if err != nil {
+		return nil, err
+	}
+	var ev domain.UsageEventOut
+	if err := bson.Unmarshal(data, &ev); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedEvent, err)
+	}
+	return &ev, nil
+}
+
+// flushWriter pushes buffered output, such as a streamed HTTP response, on
+// to its destination.
+func flushWriter(w io.Writer) error {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func exportQuery(f domain.UsageExportFilter) bson.M {
+	q := bson.M{}
+	ts := bson.M{}
+	if !f.From.IsZero() {
+		ts["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		ts["$lt"] = f.To
+	}
+	if len(ts) > 0 {
+		q["eventTimeStamp"] = ts
+	}
+	if len(f.UserIDs) > 0 {
+		q["userId"] = bson.M{"$in": f.UserIDs}
+	}
+	if f.AgentID != "" {
+		q["agentId"] = f.AgentID
+	}
+	return q
+}
+
+// exportRow is the flat export layout. Costs stay Decimal128 strings so no
+// precision is lost to floating point in any format.
+type exportRow struct {
+	ID               string  `json:"id" parquet:"id"`
+	EventTimeStamp   int64   `json:"-" parquet:"eventTimeStamp,timestamp(millisecond)"`
+	EventTime        string  `json:"eventTimeStamp" parquet:"-"`
+	UserID           string  `json:"userId" parquet:"userId"`
+	OrgID            *string `json:"orgId,omitempty" parquet:"orgId,optional"`
+	EventType        string  `json:"eventType" parquet:"eventType"`
+	SubscriptionID   *string `json:"subscriptionId,omitempty" parquet:"subscriptionId,optional"`
+	PackageID        *string `json:"packageId,omitempty" parquet:"packageId,optional"`
+	PackageVersion   *int64  `json:"packageVersion,omitempty" parquet:"packageVersion,optional"`
+	EggToken         int64   `json:"eggToken" parquet:"eggToken"`
+	MainToken        *int64  `json:"mainToken,omitempty" parquet:"mainToken,optional"`
+	TopupToken       *int64  `json:"topupToken,omitempty" parquet:"topupToken,optional"`
+	ChatToken        *int64  `json:"chatToken,omitempty" parquet:"chatToken,optional"`
+	WebsearchToken   *int64  `json:"websearchToken,omitempty" parquet:"websearchToken,optional"`
+	TotalCostUSD     *string `json:"totalCostUsd,omitempty" parquet:"totalCostUsd,optional"`
+	ChatCostUSD      *string `json:"chatCostUsd,omitempty" parquet:"chatCostUsd,optional"`
+	WebsearchCostUSD *string `json:"websearchCostUsd,omitempty" parquet:"websearchCostUsd,optional"`
+	TraceID          *string `json:"traceId,omitempty" parquet:"traceId,optional"`
+	AIModel          *string `json:"aiModel,omitempty" parquet:"aiModel,optional"`
+	ModelID          *string `json:"modelId,omitempty" parquet:"modelId,optional"`
+	AgentID          *string `json:"agentId,omitempty" parquet:"agentId,optional"`
+	Flags            *string `json:"flags,omitempty" parquet:"flags,optional"`
+	RefundedToken    int64   `json:"refundedToken,omitempty" parquet:"refundedToken"`
+	RefundOf         *string `json:"refundOf,omitempty" parquet:"refundOf,optional"`
+	Bucket           *string `json:"bucket,omitempty" parquet:"bucket,optional"`
+	Reason           *string `json:"reason,omitempty" parquet:"reason,optional"`
+}
+
+var exportColumns = []string{
+	"id", "eventTimeStamp", "userId", "orgId", "eventType", "subscriptionId", "packageId", "packageVersion",
+	"eggToken", "mainToken", "topupToken", "chatToken", "websearchToken",
+	"totalCostUsd", "chatCostUsd", "websearchCostUsd", "traceId", "aiModel", "modelId", "agentId",
+	"flags", "refundedToken", "refundOf", "bucket", "reason",
+}
+
+func toExportRow(ev *domain.UsageEventOut) exportRow {
+	r := exportRow{
+		ID:               ev.ID.Hex(),
+		EventTimeStamp:   ev.EventTimeStamp.UnixMilli(),
+		EventTime:        ev.EventTimeStamp.UTC().Format(time.RFC3339Nano),
+		UserID:           ev.UserID,
+		OrgID:            ev.OrgID,
+		EventType:        ev.EventType,
+		SubscriptionID:   ev.SubscriptionID,
+		PackageID:        ev.PackageID,
+		PackageVersion:   int64Ptr(ev.PackageVersion),
+		EggToken:         int64(ev.EggToken),
+		MainToken:        int64Ptr(ev.MainToken),
+		TopupToken:       int64Ptr(ev.TopupToken),
+		ChatToken:        int64Ptr(ev.ChatToken),
+		WebsearchToken:   int64Ptr(ev.WebsearchToken),
+		TotalCostUSD:     decimalPtr(ev.TotalCostUSD),
+		ChatCostUSD:      decimalPtr(ev.ChatCostUSD),
+		WebsearchCostUSD: decimalPtr(ev.WebsearchCostUSD),
+		TraceID:          ev.TraceID,
+		AIModel:          ev.AIModel,
+		ModelID:          ev.ModelID,
+		AgentID:          ev.AgentID,
+		RefundedToken:    int64(ev.RefundedToken),
+		Bucket:           ev.Bucket,
+		Reason:           ev.Reason,
+	}
+	if len(ev.Flags) > 0 {
+		flags := strings.Join(ev.Flags, ";")
+		r.Flags = &flags
+	}
+	if ev.RefundOf != nil {
+		id := ev.RefundOf.Hex()
+		r.RefundOf = &id
+	}
+	return r
+}
+
+func int64Ptr(v *int) *int64 {
+	if v == nil {
+		return nil
+	}
+	n := int64(*v)
+	return &n
+}
+
+func decimalPtr(v *primitive.Decimal128) *string {
+	if v == nil {
+		return nil
+	}
+	s := v.String()
+	return &s
+}
+
+type exportWriter interface {
+	write(r exportRow) error
+	flush() error
+	close() error
+}
+
+func newExportWriter(format string, w io.Writer) exportWriter {
+	switch format {
+	case domain.ExportCSV:
+		return &csvExport{w: csv.NewWriter(w)}
+	case domain.ExportNDJSON:
+		return &ndjsonExport{enc: json.NewEncoder(w)}
+	default:
+		return &parquetExport{w: parquet.NewGenericWriter[exportRow](w)}
+	}
+}
+
+type csvExport struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (e *csvExport) write(r exportRow) error {
+	if !e.wroteHeader {
+		if err := e.w.Write(exportColumns); err != nil {
+			return err
+		}
+		e.wroteHeader = true
+	}
+	str := func(p *string) string {
+		if p == nil {
+			return ""
+		}
+		return *p
+	}
+	num := func(p *int64) string {
+		if p == nil {
+			return ""
+		}
+		return strconv.FormatInt(*p, 10)
+	}
+	return e.w.Write([]string{
+		r.ID, r.EventTime, r.UserID, str(r.OrgID), r.EventType, str(r.SubscriptionID), str(r.PackageID), num(r.PackageVersion),
+		strconv.FormatInt(r.EggToken, 10), num(r.MainToken), num(r.TopupToken), num(r.ChatToken), num(r.WebsearchToken),
+		str(r.TotalCostUSD), str(r.ChatCostUSD), str(r.WebsearchCostUSD), str(r.TraceID), str(r.AIModel), str(r.ModelID), str(r.AgentID),
+		str(r.Flags), strconv.FormatInt(r.RefundedToken, 10), str(r.RefundOf), str(r.Bucket), str(r.Reason),
+	})
+}
+
+func (e *csvExport) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExport) close() error {
+	if !e.wroteHeader {
+		if err := e.w.Write(exportColumns); err != nil {
+			return err
+		}
+	}
+	return e.flush()
+}
+
+type ndjsonExport struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExport) write(r exportRow) error {
+	return e.enc.Encode(r)
+}
+
+func (e *ndjsonExport) flush() error { return nil }
+
+func (e *ndjsonExport) close() error { return nil }
+
+// parquetExport writes one row group per chunk.
+type parquetExport struct {
+	w *parquet.GenericWriter[exportRow]
+}
+
+func (e *parquetExport) write(r exportRow) error {
+	_, err := e.w.Write([]exportRow{r})
+	return err
+}
+
+func (e *parquetExport) flush() error {
+	return e.w.Flush()
+}
+
+func (e *parquetExport) close() error {
+	return e.w.Close()
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDecodeExportEvent(t *testing.T) {
+	at := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	base := func(extra bson.M) bson.M {
+		raw := bson.M{
+			"_id":            primitive.NewObjectIDFromTimestamp(at),
+			"userId":         "u1",
+			"eventType":      "Token Used",
+			"eventTimeStamp": primitive.NewDateTimeFromTime(at),
+			"eggToken":       int32(-40),
+		}
+		for k, v := range extra {
+			raw[k] = v
+		}
+		return raw
+	}
+
+	tests := []struct {
+		name      string
+		raw       bson.M
+		wantErr   bool
+		wantEgg   int
+		wantSplit *int
+	}{
+		{name: "typed event", raw: base(bson.M{"mainToken": int32(-40)}), wantEgg: -40, wantSplit: intPtr(-40)},
+		{name: "legacy string amount", raw: base(bson.M{"eggToken": " -25 "}), wantEgg: -25},
+		{name: "legacy double split", raw: base(bson.M{"mainToken": -12.0}), wantEgg: -40, wantSplit: intPtr(-12)},
+		{name: "garbage amount is rejected", raw: base(bson.M{"eggToken": "lots"}), wantErr: true},
+		{name: "unknown eventType is rejected", raw: base(bson.M{"eventType": "Bonus"}), wantErr: true},
+		{name: "malformed optional counter is rejected", raw: base(bson.M{"chatToken": "many"}), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, err := decodeExportEvent(tt.raw)
+			if tt.wantErr {
+				if !errors.Is(err, ErrMalformedEvent) {
+					t.Fatalf("err = %v, want ErrMalformedEvent", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ev.EggToken != tt.wantEgg || ev.UserID != "u1" {
+				t.Errorf("eggToken = %d userId = %q", ev.EggToken, ev.UserID)
+			}
+			if (ev.MainToken == nil) != (tt.wantSplit == nil) || ev.MainToken != nil && *ev.MainToken != *tt.wantSplit {
+				t.Errorf("mainToken = %v, want %v", ev.MainToken, tt.wantSplit)
+			}
+		})
+	}
+}
+
+func intPtr(n int) *int { return &n }
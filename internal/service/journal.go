@@ -0,0 +1,293 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// journalBatchSize is how many entries a backfill posts per write.
+const journalBatchSize = 1000
+
+var ErrJournalMismatch = errors.New("Journal accounts do not match the replayed balance")
+
+// postEvents posts the entries of usage events as they are recorded. Each
+// entry is the change its event records, so the journal is kept apart from
+// the balance replay and checks it. A posting that fails is only logged:
+// the next replay posts the entries that are missing.
+func postEvents(ctx context.Context, docs ...*domain.UsageEventOut) {
+	var entries []domain.JournalEntry
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			continue
+		}
+		var raw bson.M
+		if err := bson.Unmarshal(data, &raw); err != nil {
+			continue
+		}
+		ev, err := DecodeLedgerEvent(raw)
+		if err != nil || !ev.AffectsBalance() {
+			continue
+		}
+		if delta, ok := ev.RecordedDelta(); ok {
+			entries = append(entries, domain.UserJournalEntry(ev, delta))
+		}
+	}
+	if err := insertJournalEntries(ctx, entries); err != nil {
+		log.Printf("Posting journal entries failed: %v", err)
+	}
+}
+
+// insertJournalEntries writes the entries that are not posted yet. A user
+// event's entry is posted once and never rewritten.
+func insertJournalEntries(ctx context.Context, entries []domain.JournalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	now := time.Now()
+	docs := make([]interface{}, len(entries))
+	for i, e := range entries {
+		e.PostedAt = now
+		docs[i] = e
+	}
+	_, err := mongodb.GetCollection(config.JournalEntryColl).InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError == nil {
+		for _, we := range bwe.WriteErrors {
+			if !mongo.IsDuplicateKeyError(we) {
+				return we
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+// postJournalEntries writes entries to journal_entry, replacing any earlier
+// posting of the same event.
+func postJournalEntries(ctx context.Context, entries []domain.JournalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	now := time.Now()
+	models := make([]mongo.WriteModel, len(entries))
+	for i, e := range entries {
+		e.PostedAt = now
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": e.ID}).SetReplacement(e).SetUpsert(true)
+	}
+	_, err := mongodb.GetCollection(config.JournalEntryColl).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// postOrgPoolEvent posts a movement of an organization's pool. Pool events
+// are never replayed, so they are posted as they are recorded.
+func postOrgPoolEvent(ctx context.Context, ev domain.OrgPoolEvent) error {
+	return postJournalEntries(ctx, []domain.JournalEntry{domain.OrgJournalEntry(ev)})
+}
+
+// unpostEvents removes the entries of usage events that were rolled back.
+func unpostEvents(ctx context.Context, eventIDs []primitive.ObjectID) {
+	ids := make(bson.A, len(eventIDs))
+	for i, id := range eventIDs {
+		ids[i] = "evt:" + id.Hex()
+	}
+	if _, err := mongodb.GetCollection(config.JournalEntryColl).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		log.Printf("Removing journal entries of rolled back events failed: %v", err)
+	}
+}
+
+// JournalBalance returns what the user's main and topup journal accounts
+// hold: the totals saved with their snapshot plus the entries after it.
+func JournalBalance(ctx context.Context, userID string) (domain.Balance, error) {
+	stored, err := latestBalanceSnapshot(ctx, userID)
+	if err != nil {
+		return domain.Balance{}, err
+	}
+	snap, _ := resumableSnapshot(stored)
+	tail, err := userAccountBalances(ctx, userID, snap, nil)
+	if err != nil || snap == nil {
+		return tail, err
+	}
+	return snap.Accounts.Add(tail), nil
+}
+
+// VerifyUserJournal checks that the user's journal accounts hold their
+// replayed balance.
+func VerifyUserJournal(ctx context.Context, userID string) error {
+	journal, err := JournalBalance(ctx, userID)
+	if err != nil {
+		return err
+	}
+	replayed, err := replayUserBalance(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if journal != replayed {
+		return fmt.Errorf("%w: user %s journal main=%d topup=%d, replay main=%d topup=%d",
+			ErrJournalMismatch, userID, journal.Main, journal.Topup, replayed.Main, replayed.Topup)
+	}
+	return nil
+}
+
+// userAccountBalances sums the journal lines of the user's main and topup
+// accounts for the events after from up to and including through; nil
+// bounds are open.
+func userAccountBalances(ctx context.Context, userID string, from, through *domain.BalanceSnapshot) (domain.Balance, error) {
+	filter := bson.M{"userId": userID}
+	var bounds bson.A
+	if from != nil {
+		bounds = append(bounds, bson.M{"$or": bson.A{
+			bson.M{"eventAt": bson.M{"$gt": from.LastEventTimeStamp}},
+			bson.M{"eventAt": from.LastEventTimeStamp, "_id": bson.M{"$gt": "evt:" + from.LastEventID.Hex()}},
+		}})
+	}
+	if through != nil {
+		bounds = append(bounds, bson.M{"$or": bson.A{
+			bson.M{"eventAt": bson.M{"$lt": through.LastEventTimeStamp}},
+			bson.M{"eventAt": through.LastEventTimeStamp, "_id": bson.M{"$lte": "evt:" + through.LastEventID.Hex()}},
+		}})
+	}
+	if len(bounds) > 0 {
+		filter["$and"] = bounds
+	}
+
+	main := domain.UserAccount(userID, domain.BucketMain)
+	topup := domain.UserAccount(userID, domain.BucketTopup)
+	accounts, err := accountBalances(ctx, filter, bson.M{"lines.account": bson.M{"$in": bson.A{main, topup}}})
+	if err != nil {
+		return domain.Balance{}, err
+	}
+	var b domain.Balance
+	for _, a := range accounts {
+		switch a.Account {
+		case main:
+			b.Main = a.Balance
+		case topup:
+			b.Topup = a.Balance
+		}
+	}
+	return b, nil
+}
+
+// accountBalances totals the lines of the entries matching filter, per
+// account, for the lines matching lineFilter.
+func accountBalances(ctx context.Context, filter, lineFilter bson.M) ([]domain.AccountBalance, error) {
+	cursor, err := mongodb.GetCollection(config.JournalEntryColl).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$unwind", Value: "$lines"}},
+		{{Key: "$match", Value: lineFilter}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    "$lines.account",
+			"debit":  bson.M{"$sum": "$lines.debit"},
+			"credit": bson.M{"$sum": "$lines.credit"},
+		}}},
+		{{Key: "$addFields", Value: bson.M{"balance": bson.M{"$subtract": bson.A{"$credit", "$debit"}}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	accounts := []domain.AccountBalance{}
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// TrialBalance totals every account in the journal and lists the entries
+// whose own debits and credits differ.
+func TrialBalance(ctx context.Context) (*domain.TrialBalance, error) {
+	accounts, err := accountBalances(ctx, bson.M{}, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	tb := &domain.TrialBalance{Accounts: accounts, UnbalancedEntries: []string{}, GeneratedAt: time.Now()}
+	for _, a := range accounts {
+		tb.TotalDebit += a.Debit
+		tb.TotalCredit += a.Credit
+	}
+
+	cursor, err := mongodb.GetCollection(config.JournalEntryColl).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$project", Value: bson.M{
+			"net": bson.M{"$subtract": bson.A{bson.M{"$sum": "$lines.debit"}, bson.M{"$sum": "$lines.credit"}}},
+		}}},
+		{{Key: "$match", Value: bson.M{"net": bson.M{"$ne": 0}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	var unbalanced []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &unbalanced); err != nil {
+		return nil, err
+	}
+	for _, u := range unbalanced {
+		tb.UnbalancedEntries = append(tb.UnbalancedEntries, u.ID)
+	}
+
+	tb.Balanced = tb.TotalDebit == tb.TotalCredit && len(tb.UnbalancedEntries) == 0
+	return tb, nil
+}
+
+// ListJournalEntries returns the entries posted for a user's events and the
+// pool movements they caused, oldest first.
+func ListJournalEntries(ctx context.Context, userID string) ([]domain.JournalEntry, error) {
+	cursor, err := mongodb.GetCollection(config.JournalEntryColl).Find(ctx, bson.M{"userId": userID},
+		options.Find().SetSort(bson.D{{Key: "eventAt", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	entries := []domain.JournalEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// PostOrgPoolJournal posts every organization pool event, for pools funded
+// before the journal existed. It returns how many events were posted.
+func PostOrgPoolJournal(ctx context.Context) (int, error) {
+	cursor, err := mongodb.GetCollection(config.OrgPoolEventColl).Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var batch []domain.JournalEntry
+	n := 0
+	for cursor.Next(ctx) {
+		var ev domain.OrgPoolEvent
+		if err := cursor.Decode(&ev); err != nil {
+			return n, fmt.Errorf("decode pool event: %w", err)
+		}
+		batch = append(batch, domain.OrgJournalEntry(ev))
+		if len(batch) == journalBatchSize {
+			if err := postJournalEntries(ctx, batch); err != nil {
+				return n, err
+			}
+			n += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return n, err
+	}
+	if err := postJournalEntries(ctx, batch); err != nil {
+		return n, err
+	}
+	return n + len(batch), nil
+}
@@ -0,0 +1,374 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrMalformedEvent = errors.New("Malformed usage event")
+
+// DecodeLedgerEvent converts a stored usage event into a ledger event. It
+// accepts the numeric shapes older writers used for token amounts (int32,
+// int64, float64 and numeric strings; floats are truncated as before) and
+// reports anything else instead of dropping it.
+func DecodeLedgerEvent(raw bson.M) (domain.LedgerEvent, error) {
+	var ev domain.LedgerEvent
+	var errs []error
+
+	if id, ok := raw["_id"].(primitive.ObjectID); ok {
+		ev.ID = id.Hex()
+	}
+	ev.UserID, _ = raw["userId"].(string)
+
+	switch t := raw["eventType"].(type) {
+	case string:
+		ev.Type = domain.LedgerEventType(strings.TrimSpace(t))
+		if !ev.Type.Valid() {
+			errs = append(errs, fmt.Errorf("unknown eventType %q", t))
+		}
+	case nil:
+		errs = append(errs, errors.New("eventType is missing"))
+	default:
+		errs = append(errs, fmt.Errorf("eventType has type %T", t))
+	}
+
+	ev.Timestamp = eventTime(raw)
+	if ev.Timestamp.IsZero() {
+		errs = append(errs, errors.New("eventTimeStamp is missing or not a date"))
+	}
+
+	if v, ok := raw["orgId"]; ok && v != nil {
+		s, isString := v.(string)
+		if !isString {
+			errs = append(errs, fmt.Errorf("orgId has type %T", v))
+		}
+		ev.OrgID = s
+	}
+
+	if n, err := ledgerInt(raw["eggToken"]); err != nil {
+		errs = append(errs, fmt.Errorf("eggToken: %w", err))
+	} else {
+		ev.SignedAmount = n
+		ev.Amount = abs(n)
+	}
+
+	for _, f := range []struct {
+		name string
+		dst  **int
+	}{{"mainToken", &ev.MainToken}, {"topupToken", &ev.TopupToken}} {
+		v, ok := raw[f.name]
+		if !ok {
+			continue
+		}
+		n, err := ledgerInt(v)
+		if err != nil && v != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.name, err))
+			continue
+		}
+		*f.dst = &n
+	}
+
+	if v, ok := raw["bucket"]; ok && v != nil {
+		s, isString := v.(string)
+		if !isString || (s != domain.BucketMain && s != domain.BucketTopup) {
+			errs = append(errs, fmt.Errorf("bucket must be main or topup, got %v", v))
+		}
+		ev.Bucket = s
+	}
+
+	switch v := raw["expiresAt"].(type) {
+	case nil:
+	case primitive.DateTime:
+		at := v.Time()
+		ev.ExpiresAt = &at
+	default:
+		errs = append(errs, fmt.Errorf("expiresAt has type %T", v))
+	}
+
+	switch v := raw["lotId"].(type) {
+	case nil:
+	case string:
+		ev.LotID = v
+	default:
+		errs = append(errs, fmt.Errorf("lotId has type %T", v))
+	}
+
+	if v, ok := raw["deduction"]; ok && v != nil {
+		policy, err := decodeDeduction(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deduction: %w", err))
+		}
+		ev.Deduction = policy
+	}
+
+	if len(errs) > 0 {
+		return ev, errors.Join(append([]error{ErrMalformedEvent}, errs...)...)
+	}
+	return ev, nil
+}
+
+// decodeDeduction reads the deduction policy a Token Used event was charged
+// under.
+func decodeDeduction(v any) (*domain.DeductionPolicy, error) {
+	doc, ok := v.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("has type %T", v)
+	}
+	var p domain.DeductionPolicy
+	var errs []error
+	switch s, _ := doc["strategy"].(string); s {
+	case domain.DeductMainFirstThreshold, domain.DeductTopupFirst, domain.DeductEarliestExpiring:
+		p.Strategy = s
+	default:
+		errs = append(errs, fmt.Errorf("unknown strategy %v", doc["strategy"]))
+	}
+	if t, ok := doc["threshold"]; ok && t != nil {
+		n, err := ledgerInt(t)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("threshold: %w", err))
+		}
+		p.Threshold = &n
+	}
+	for _, f := range []struct {
+		name string
+		dst  **time.Time
+	}{{"mainExpiresAt", &p.MainExpiresAt}, {"topupExpiresAt", &p.TopupExpiresAt}} {
+		switch t := doc[f.name].(type) {
+		case nil:
+		case primitive.DateTime:
+			at := t.Time()
+			*f.dst = &at
+		default:
+			errs = append(errs, fmt.Errorf("%s has type %T", f.name, t))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &p, nil
+}
+
+func ledgerInt(v any) (int, error) {
+	switch n := v.(type) {
+	case int32:
+		return int(n), nil
+	case int64:
+		return int(n), nil
+	case int:
+		return n, nil
+	case float64:
+		return int(n), nil
+	case string:
+		i, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil {
+			return 0, fmt.Errorf("%q is not an integer", n)
+		}
+		return i, nil
+	case nil:
+		return 0, errors.New("missing")
+	default:
+		return 0, fmt.Errorf("unsupported type %T", v)
+	}
+}
+
+// decodeOrQuarantine decodes raw, recording it in the quarantine when it is
+// malformed. ok is false for events that must be skipped.
+func decodeOrQuarantine(ctx context.Context, raw bson.M) (domain.LedgerEvent, bool) {
+	ev, err := DecodeLedgerEvent(raw)
+	if err == nil {
+		return ev, true
+	}
+	if qerr := quarantineEvent(ctx, raw, err); qerr != nil {
+		log.Printf("Quarantine of event %v failed: %v", raw["_id"], qerr)
+	}
+	return ev, false
+}
+
+func quarantineEvent(ctx context.Context, raw bson.M, cause error) error {
+	id, ok := raw["_id"].(primitive.ObjectID)
+	if !ok {
+		return fmt.Errorf("event has no ObjectID: %w", cause)
+	}
+	userID, _ := raw["userId"].(string)
+	eventType, _ := raw["eventType"].(string)
+	_, err := mongodb.GetCollection(config.LedgerQuarantineColl).UpdateOne(ctx,
+		bson.M{"eventId": id.Hex()},
+		bson.M{
+			"$set": bson.M{
+				"userId":    userID,
+				"eventType": eventType,
+				"error":     cause.Error(),
+			},
+			"$setOnInsert": bson.M{"detectedAt": time.Now()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// quarantineReleaseBatch is how many quarantined events
+// ReleaseQuarantinedEvents re-checks per query.
+const quarantineReleaseBatch = 500
+
+// ListQuarantinedEvents returns the quarantined events, optionally for one
+// user, as recorded. Use ReleaseQuarantinedEvents to drop the ones fixed
+// since.
+func ListQuarantinedEvents(ctx context.Context, userID string) ([]domain.QuarantinedEvent, error) {
+	filter := bson.M{}
+	if userID != "" {
+		filter["userId"] = userID
+	}
+	cursor, err := mongodb.GetCollection(config.LedgerQuarantineColl).Find(ctx, filter, options.Find().SetSort(bson.M{"detectedAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	items := []domain.QuarantinedEvent{}
+	if err := cursor.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// ReleaseQuarantinedEvents decodes the quarantined events again, optionally
+// for one user, and releases those that were fixed or deleted since. Events
+// are loaded and released a batch at a time. It returns how many entries
+// were checked and how many were released.
+func ReleaseQuarantinedEvents(ctx context.Context, userID string) (int, int, error) {
+	filter := bson.M{}
+	if userID != "" {
+		filter["userId"] = userID
+	}
+	qColl := mongodb.GetCollection(config.LedgerQuarantineColl)
+	cursor, err := qColl.Find(ctx, filter, options.Find().SetProjection(bson.M{"eventId": 1}))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	checked, released := 0, 0
+	var batch []string
+	flush := func() error {
+		ids, err := fixedQuarantinedEvents(ctx, batch)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			res, err := qColl.DeleteMany(ctx, bson.M{"eventId": bson.M{"$in": ids}})
+			if err != nil {
+				return err
+			}
+			released += int(res.DeletedCount)
+		}
+		checked += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var q domain.QuarantinedEvent
+		if err := cursor.Decode(&q); err != nil {
+			return checked, released, err
+		}
+		batch = append(batch, q.EventID)
+		if len(batch) == quarantineReleaseBatch {
+			if err := flush(); err != nil {
+				return checked, released, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return checked, released, err
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return checked, released, err
+		}
+	}
+	return checked, released, nil
+}
+
+// fixedQuarantinedEvents loads the events with the given IDs in one query
+// and returns the IDs that may leave the quarantine.
+func fixedQuarantinedEvents(ctx context.Context, eventIDs []string) ([]string, error) {
+	oids := make([]primitive.ObjectID, 0, len(eventIDs))
+	for _, id := range eventIDs {
+		if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+			oids = append(oids, oid)
+		}
+	}
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Find(ctx, bson.M{"_id": bson.M{"$in": oids}})
+	if err != nil {
+		return nil, err
+	}
+	var raws []bson.M
+	if err := cursor.All(ctx, &raws); err != nil {
+		return nil, err
+	}
+	events := make(map[string]bson.M, len(raws))
+	for _, raw := range raws {
+		if oid, ok := raw["_id"].(primitive.ObjectID); ok {
+			events[oid.Hex()] = raw
+		}
+	}
+	return releasableEvents(eventIDs, events), nil
+}
+
+// releasableEvents returns the quarantined event IDs whose event is gone
+// from events or now decodes.
+func releasableEvents(eventIDs []string, events map[string]bson.M) []string {
+	var out []string
+	for _, id := range eventIDs {
+		raw, ok := events[id]
+		if !ok {
+			out = append(out, id)
+			continue
+		}
+		if _, err := DecodeLedgerEvent(raw); err == nil {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// ScanLedger decodes every usage event, optionally for one user, and
+// quarantines the malformed ones. It returns how many events were scanned
+// and how many failed.
+func ScanLedger(ctx context.Context, userID string) (int, int, error) {
+	filter := bson.M{}
+	if userID != "" {
+		filter["userId"] = userID
+	}
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Find(ctx, filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	scanned, failed := 0, 0
+	for cursor.Next(ctx) {
+		var raw bson.M
+		if err := cursor.Decode(&raw); err != nil {
+			return scanned, failed, err
+		}
+		scanned++
+		if _, err := DecodeLedgerEvent(raw); err != nil {
+			failed++
+			if err := quarantineEvent(ctx, raw, err); err != nil {
+				return scanned, failed, err
+			}
+		}
+	}
+	return scanned, failed, cursor.Err()
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDecodeLedgerEvent(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	expires := at.AddDate(0, 1, 0)
+	base := func(extra bson.M) bson.M {
+		raw := bson.M{
+			"_id":            primitive.NewObjectIDFromTimestamp(at),
+			"userId":         "u1",
+			"eventType":      "Token Used",
+			"eventTimeStamp": primitive.NewDateTimeFromTime(at),
+			"eggToken":       int32(40),
+		}
+		for k, v := range extra {
+			if v == nil {
+				delete(raw, k)
+				continue
+			}
+			raw[k] = v
+		}
+		return raw
+	}
+
+	tests := []struct {
+		name    string
+		raw     bson.M
+		wantErr bool
+		check   func(t *testing.T, ev domain.LedgerEvent)
+	}{
+		{
+			name: "int32 amount",
+			raw:  base(nil),
+			check: func(t *testing.T, ev domain.LedgerEvent) {
+				if ev.Type != domain.LedgerTokenUsed || ev.Amount != 40 || ev.UserID != "u1" || !ev.Timestamp.Equal(at) {
+					t.Errorf("decoded %+v", ev)
+				}
+			},
+		},
+		{
+			name:  "int64 amount",
+			raw:   base(bson.M{"eggToken": int64(41)}),
+			check: func(t *testing.T, ev domain.LedgerEvent) { wantAmount(t, ev, 41, 41) },
+		},
+		{
+			name:  "float amount is truncated",
+			raw:   base(bson.M{"eggToken": 42.9}),
+			check: func(t *testing.T, ev domain.LedgerEvent) { wantAmount(t, ev, 42, 42) },
+		},
+		{
+			name:  "numeric string amount",
+			raw:   base(bson.M{"eggToken": " 43 "}),
+			check: func(t *testing.T, ev domain.LedgerEvent) { wantAmount(t, ev, 43, 43) },
+		},
+		{
+			name:  "negative adjustment keeps its sign",
+			raw:   base(bson.M{"eventType": "Adjustment", "eggToken": int32(-15), "bucket": "topup"}),
+			check: func(t *testing.T, ev domain.LedgerEvent) { wantAmount(t, ev, 15, -15) },
+		},
+		{
+			name: "refund split and expiry",
+			raw:  base(bson.M{"eventType": "Refund", "mainToken": int32(10), "topupToken": nil, "expiresAt": primitive.NewDateTimeFromTime(expires)}),
+			check: func(t *testing.T, ev domain.LedgerEvent) {
+				if ev.MainToken == nil || *ev.MainToken != 10 || ev.TopupToken != nil {
+					t.Errorf("split = %v %v", ev.MainToken, ev.TopupToken)
+				}
+				if ev.ExpiresAt == nil || !ev.ExpiresAt.Equal(expires) {
+					t.Errorf("expiresAt = %v", ev.ExpiresAt)
+				}
+			},
+		},
+		{
+			name: "deduction policy",
+			raw: base(bson.M{"deduction": bson.M{
+				"strategy":      domain.DeductEarliestExpiring,
+				"mainExpiresAt": primitive.NewDateTimeFromTime(expires),
+			}}),
+			check: func(t *testing.T, ev domain.LedgerEvent) {
+				if ev.Deduction == nil || ev.Deduction.Strategy != domain.DeductEarliestExpiring || ev.Deduction.MainExpiresAt == nil {
+					t.Errorf("deduction = %+v", ev.Deduction)
+				}
+			},
+		},
+		{
+			name: "organization usage",
+			raw:  base(bson.M{"orgId": "acme"}),
+			check: func(t *testing.T, ev domain.LedgerEvent) {
+				if ev.OrgID != "acme" || ev.AffectsBalance() {
+					t.Errorf("orgId = %q", ev.OrgID)
+				}
+			},
+		},
+		{name: "missing eventType", raw: base(bson.M{"eventType": nil}), wantErr: true},
+		{name: "unknown eventType", raw: base(bson.M{"eventType": "Bonus"}), wantErr: true},
+		{name: "eventType not a string", raw: base(bson.M{"eventType": int32(1)}), wantErr: true},
+		{name: "missing timestamp", raw: base(bson.M{"eventTimeStamp": nil}), wantErr: true},
+		{name: "timestamp not a date", raw: base(bson.M{"eventTimeStamp": "2026-03-01"}), wantErr: true},
+		{name: "missing amount", raw: base(bson.M{"eggToken": nil}), wantErr: true},
+		{name: "non-numeric amount", raw: base(bson.M{"eggToken": "lots"}), wantErr: true},
+		{name: "orgId not a string", raw: base(bson.M{"orgId": int32(7)}), wantErr: true},
+		{name: "unknown bucket", raw: base(bson.M{"bucket": "bonus"}), wantErr: true},
+		{name: "unknown deduction strategy", raw: base(bson.M{"deduction": bson.M{"strategy": "random"}}), wantErr: true},
+		{name: "malformed split", raw: base(bson.M{"mainToken": "ten"}), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, err := DecodeLedgerEvent(tt.raw)
+			if tt.wantErr {
+				if !errors.Is(err, ErrMalformedEvent) {
+					t.Fatalf("err = %v, want ErrMalformedEvent", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.check != nil {
+				tt.check(t, ev)
+			}
+		})
+	}
+}
+
+func wantAmount(t *testing.T, ev domain.LedgerEvent, amount, signed int) {
+	t.Helper()
+	if ev.Amount != amount || ev.SignedAmount != signed {
+		t.Errorf("amount = %d signed = %d, want %d and %d", ev.Amount, ev.SignedAmount, amount, signed)
+	}
+}
+
+func TestReleasableEvents(t *testing.T) {
+	at := primitive.NewDateTimeFromTime(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	events := map[string]bson.M{
+		"fixed":  {"userId": "u1", "eventType": "Token Used", "eventTimeStamp": at, "eggToken": int32(-40)},
+		"broken": {"userId": "u1", "eventType": "Token Used", "eventTimeStamp": at, "eggToken": "forty"},
+		"typo":   {"userId": "u1", "eventType": "Token Usd", "eventTimeStamp": at, "eggToken": int32(-40)},
+	}
+	got := releasableEvents([]string{"fixed", "broken", "deleted", "typo"}, events)
+	want := []string{"fixed", "deleted"}
+	if len(got) != len(want) {
+		t.Fatalf("releasableEvents = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("releasableEvents = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrProviderNotFound = errors.New("Provider not found")
+	ErrModelNotFound    = errors.New("Model not found")
+	ErrInvalidRegistry  = errors.New("Invalid provider or model")
+	ErrRegistryExists   = errors.New("Provider or model already exists")
+)
+
+func ListProviders(ctx context.Context) ([]domain.Provider, error) {
+	cursor, err := mongodb.GetCollection(config.ProviderMasterColl).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"providerId": 1}))
+	if err != nil {
+		return nil, err
+	}
+	providers := []domain.Provider{}
+	if err := cursor.All(ctx, &providers); err != nil {
+		return nil, err
+	}
+	return providers, nil
+}
+
+func GetProvider(ctx context.Context, providerID string) (*domain.Provider, error) {
+	var p domain.Provider
+	err := mongodb.GetCollection(config.ProviderMasterColl).FindOne(ctx, bson.M{"providerId": providerID}).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrProviderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func CreateProvider(ctx context.Context, in domain.ProviderIn) (*domain.Provider, error) {
+	if strings.TrimSpace(in.ProviderID) == "" || strings.TrimSpace(in.DisplayName) == "" {
+		return nil, errors.Join(ErrInvalidRegistry, errors.New("providerId and displayName are required"))
+	}
+
+	now := time.Now()
+	p := domain.Provider{
+		ProviderID:  strings.TrimSpace(in.ProviderID),
+		DisplayName: strings.TrimSpace(in.DisplayName),
+		Enabled:     in.Enabled == nil || *in.Enabled,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if _, err := mongodb.GetCollection(config.ProviderMasterColl).InsertOne(ctx, p); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrRegistryExists
+		}
+		return nil, err
+	}
+	return &p, nil
+}
+
+func UpdateProvider(ctx context.Context, providerID string, in domain.ProviderIn) (*domain.Provider, error) {
+	set := bson.M{"updatedAt": time.Now()}
+	if name := strings.TrimSpace(in.DisplayName); name != "" {
+		set["displayName"] = name
+	}
+	if in.Enabled != nil {
+		set["enabled"] = *in.Enabled
+	}
+
+	var p domain.Provider
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := mongodb.GetCollection(config.ProviderMasterColl).FindOneAndUpdate(ctx, bson.M{"providerId": providerID}, bson.M{"$set": set}, opts).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrProviderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func ListModels(ctx context.Context, providerID string) ([]domain.ProviderModel, error) {
+	filter := bson.M{}
+	if providerID != "" {
+		filter["providerId"] = providerID
+	}
+	cursor, err := mongodb.GetCollection(config.ProviderModelsColl).Find(ctx, filter, options.Find().SetSort(bson.M{"modelId": 1}))
+	if err != nil {
+		return nil, err
+	}
+	models := []domain.ProviderModel{}
+	if err := cursor.All(ctx, &models); err != nil {
+		return nil, err
+	}
+	return models, nil
+}
+
+func GetModel(ctx context.Context, modelID string) (*domain.ProviderModel, error) {
+	var m domain.ProviderModel
+	err := mongodb.GetCollection(config.ProviderModelsColl).FindOne(ctx, bson.M{"modelId": modelID}).Decode(&m)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrModelNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func CreateModel(ctx context.Context, in domain.ProviderModelIn) (*domain.ProviderModel, error) {
+	if strings.TrimSpace(in.ModelID) == "" {
+		return nil, errors.Join(ErrInvalidRegistry, errors.New("modelId is required"))
+	}
+	if err := validateModel(in); err != nil {
+		return nil, err
+	}
+	if _, err := GetProvider(ctx, in.ProviderID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	m := domain.ProviderModel{
+		ModelID:             strings.TrimSpace(in.ModelID),
+		ProviderID:          in.ProviderID,
+		DisplayName:         strings.TrimSpace(in.DisplayName),
+		Aliases:             normalizeAliases(in.ModelID, in.Aliases),
+		InputPricePerToken:  in.InputPricePerToken,
+		OutputPricePerToken: in.OutputPricePerToken,
+		ContextWindow:       in.ContextWindow,
+		Enabled:             in.Enabled == nil || *in.Enabled,
+		CreatedAt:           now,
+		UpdatedAt:           now,
+	}
+	if _, err := mongodb.GetCollection(config.ProviderModelsColl).InsertOne(ctx, m); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrRegistryExists
+		}
+		return nil, err
+	}
+	return &m, nil
+}
+
+func UpdateModel(ctx context.Context, modelID string, in domain.ProviderModelIn) (*domain.ProviderModel, error) {
+	if err := validateModel(in); err != nil {
+		return nil, err
+	}
+	if _, err := GetProvider(ctx, in.ProviderID); err != nil {
+		return nil, err
+	}
+
+	set := bson.M{
+		"providerId":          in.ProviderID,
+		"displayName":         strings.TrimSpace(in.DisplayName),
+		"aliases":             normalizeAliases(modelID, in.Aliases),
+		"inputPricePerToken":  in.InputPricePerToken,
+		"outputPricePerToken": in.OutputPricePerToken,
+		"contextWindow":       in.ContextWindow,
+		"updatedAt":           time.Now(),
+	}
+	if in.Enabled != nil {
+		set["enabled"] = *in.Enabled
+	}
+
+	var m domain.ProviderModel
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := mongodb.GetCollection(config.ProviderModelsColl).FindOneAndUpdate(ctx, bson.M{"modelId": modelID}, bson.M{"$set": set}, opts).Decode(&m)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrModelNotFound
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrRegistryExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ResolveModel maps a raw Portkey ai_model string to its canonical model,
+// matching the model ID or any alias case-insensitively.
+func ResolveModel(ctx context.Context, aiModel string) (*domain.ProviderModel, error) {
+	key := aliasKey(aiModel)
+	if key == "" {
+		return nil, ErrModelNotFound
+	}
+
+	var m domain.ProviderModel
+	err := mongodb.GetCollection(config.ProviderModelsColl).FindOne(ctx, bson.M{"aliases": key}).Decode(&m)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrModelNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// resolveChargeModel resolves the model for a charge and returns the flags
+// to record on the usage event when it is unknown or disabled.
+func resolveChargeModel(ctx context.Context, aiModel string) (*domain.ProviderModel, []string, error) {
+	m, err := ResolveModel(ctx, aiModel)
+	if errors.Is(err, ErrModelNotFound) {
+		return nil, chargeModelFlags(nil, nil), nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	provider, err := GetProvider(ctx, m.ProviderID)
+	if err != nil && !errors.Is(err, ErrProviderNotFound) {
+		return nil, nil, err
+	}
+	return m, chargeModelFlags(m, provider), nil
+}
+
+// chargeModelFlags returns the flags for charging model m of provider.
+// Unknown models are charged and flagged. A model is disabled when it or
+// its provider is; a provider missing from the registry does not disable
+// its models.
+func chargeModelFlags(m *domain.ProviderModel, provider *domain.Provider) []string {
+	if m == nil {
+		return []string{domain.FlagUnknownModel}
+	}
+	if !m.Enabled || (provider != nil && !provider.Enabled) {
+		return []string{domain.FlagModelDisabled}
+	}
+	return nil
+}
+
+// ListUnknownModels summarises charges whose ai_model did not resolve.
+func ListUnknownModels(ctx context.Context) ([]domain.UnknownModelUsage, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"flags": domain.FlagUnknownModel}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       "$aiModel",
+			"events":    bson.M{"$sum": 1},
+			"eggToken":  bson.M{"$sum": "$eggToken"},
+			"firstSeen": bson.M{"$min": "$eventTimeStamp"},
+			"lastSeen":  bson.M{"$max": "$eventTimeStamp"},
+		}}},
+		{{Key: "$sort", Value: bson.M{"events": -1}}},
+	}
+
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	out := []domain.UnknownModelUsage{}
+	if err := cursor.All(ctx, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func validateModel(in domain.ProviderModelIn) error {
+	var errs []error
+	if strings.TrimSpace(in.ProviderID) == "" {
+		errs = append(errs, errors.New("providerId is required"))
+	}
+	if strings.TrimSpace(in.DisplayName) == "" {
+		errs = append(errs, errors.New("displayName is required"))
+	}
+	if in.InputPricePerToken < 0 || in.OutputPricePerToken < 0 {
+		errs = append(errs, errors.New("prices must not be negative"))
+	}
+	if in.ContextWindow <= 0 {
+		errs = append(errs, errors.New("contextWindow must be positive"))
+	}
+	if len(errs) > 0 {
+		return errors.Join(append([]error{ErrInvalidRegistry}, errs...)...)
+	}
+	return nil
+}
+
+// normalizeAliases lower-cases and dedupes aliases, always including the
+// model ID itself so it resolves to itself.
+func normalizeAliases(modelID string, aliases []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, a := range append([]string{modelID}, aliases...) {
+		a = aliasKey(a)
+		if a == "" || seen[a] {
+			continue
+		}
+		seen[a] = true
+		out = append(out, a)
+	}
+	return out
+}
+
+// aliasKey is the form aliases are stored and looked up in.
+func aliasKey(aiModel string) string {
+	return strings.ToLower(strings.TrimSpace(aiModel))
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"slices"
+	"testing"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+)
+
+func TestNormalizeAliases(t *testing.T) {
+	got := normalizeAliases("gpt-4o", []string{" GPT-4o-2024-08-06 ", "gpt-4o", "", "OpenAI/GPT-4o", "openai/gpt-4o"})
+	want := []string{"gpt-4o", "gpt-4o-2024-08-06", "openai/gpt-4o"}
+	if !slices.Equal(got, want) {
+		t.Errorf("normalizeAliases = %v, want %v", got, want)
+	}
+}
+
+func TestAliasKeyMatchesStoredAliases(t *testing.T) {
+	stored := normalizeAliases("claude-3-5-sonnet", []string{"Claude-3-5-Sonnet-20241022", "anthropic/claude-3.5-sonnet"})
+	tests := []struct {
+		aiModel string
+		want    bool
+	}{
+		{aiModel: "claude-3-5-sonnet", want: true},
+		{aiModel: "  CLAUDE-3-5-SONNET-20241022 ", want: true},
+		{aiModel: "Anthropic/Claude-3.5-Sonnet", want: true},
+		{aiModel: "claude-3-opus"},
+		{aiModel: "   "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.aiModel, func(t *testing.T) {
+			if got := slices.Contains(stored, aliasKey(tt.aiModel)); got != tt.want {
+				t.Errorf("alias %q resolves = %v, want %v", tt.aiModel, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChargeModelFlags(t *testing.T) {
+	enabled := &domain.ProviderModel{ModelID: "gpt-4o", ProviderID: "openai", Enabled: true}
+	disabled := &domain.ProviderModel{ModelID: "gpt-4", ProviderID: "openai"}
+	tests := []struct {
+		name     string
+		model    *domain.ProviderModel
+		provider *domain.Provider
+		want     []string
+	}{
+		{name: "unknown model is charged and flagged", want: []string{domain.FlagUnknownModel}},
+		{name: "enabled model and provider", model: enabled, provider: &domain.Provider{ProviderID: "openai", Enabled: true}},
+		{name: "disabled model", model: disabled, provider: &domain.Provider{ProviderID: "openai", Enabled: true}, want: []string{domain.FlagModelDisabled}},
+		{name: "disabled provider", model: enabled, provider: &domain.Provider{ProviderID: "openai"}, want: []string{domain.FlagModelDisabled}},
+		{name: "provider missing from the registry", model: enabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chargeModelFlags(tt.model, tt.provider); !slices.Equal(got, tt.want) {
+				t.Errorf("chargeModelFlags = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,496 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrOrgNotFound      = errors.New("Organization not found")
+	ErrOrgExists        = errors.New("Organization already exists")
+	ErrMemberNotFound   = errors.New("Organization member not found")
+	ErrAlreadyMember    = errors.New("User already belongs to an organization")
+	ErrScheduleNotFound = errors.New("Schedule not found")
+	ErrInvalidOrg       = errors.New("Invalid organization request")
+	ErrOrgPoolExhausted = errors.New("Organization credit pool is exhausted.")
+	ErrMemberCapReached = errors.New("Member has reached their credit cap.")
+)
+
+func CreateOrganization(ctx context.Context, in domain.OrganizationIn) (*domain.Organization, error) {
+	if strings.TrimSpace(in.OrgID) == "" || strings.TrimSpace(in.Name) == "" {
+		return nil, errors.Join(ErrInvalidOrg, errors.New("orgId and name are required"))
+	}
+
+	now := time.Now()
+	org := domain.Organization{
+		OrgID:     strings.TrimSpace(in.OrgID),
+		Name:      strings.TrimSpace(in.Name),
+		Status:    "A",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if _, err := mongodb.GetCollection(config.OrganizationColl).InsertOne(ctx, org); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrOrgExists
+		}
+		return nil, err
+	}
+	return &org, nil
+}
+
+func GetOrganization(ctx context.Context, orgID string) (*domain.Organization, error) {
+	var org domain.Organization
+	err := mongodb.GetCollection(config.OrganizationColl).FindOne(ctx, bson.M{"orgId": orgID}).Decode(&org)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrOrgNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// GetOrganizationDetail returns the organization with each member's
+// consumption.
+func GetOrganizationDetail(ctx context.Context, orgID string) (*domain.OrganizationDetail, error) {
+	org, err := GetOrganization(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := mongodb.GetCollection(config.OrgMemberColl).Find(ctx, bson.M{"orgId": orgID}, options.Find().SetSort(bson.M{"userId": 1}))
+	if err != nil {
+		return nil, err
+	}
+	members := []domain.OrgMember{}
+	if err := cursor.All(ctx, &members); err != nil {
+		return nil, err
+	}
+	return &domain.OrganizationDetail{Organization: *org, Members: members}, nil
+}
+
+// SetOrgMember adds userID to the organization or updates their cap.
+func SetOrgMember(ctx context.Context, orgID, userID string, in domain.OrgMemberIn) (*domain.OrgMember, error) {
+	if _, err := GetOrganization(ctx, orgID); err != nil {
+		return nil, err
+	}
+	if in.Cap != nil && *in.Cap < 0 {
+		return nil, errors.Join(ErrInvalidOrg, errors.New("cap must not be negative"))
+	}
+
+	now := time.Now()
+	update := bson.M{
+		"$set":         bson.M{"updatedAt": now},
+		"$setOnInsert": bson.M{"orgId": orgID, "userId": userID, "periodConsumed": 0, "totalConsumed": 0, "createdAt": now},
+	}
+	if in.Cap != nil {
+		update["$set"].(bson.M)["cap"] = *in.Cap
+	} else {
+		update["$unset"] = bson.M{"cap": ""}
+	}
+
+	var m domain.OrgMember
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := mongodb.GetCollection(config.OrgMemberColl).FindOneAndUpdate(ctx, bson.M{"orgId": orgID, "userId": userID}, update, opts).Decode(&m)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrAlreadyMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func RemoveOrgMember(ctx context.Context, orgID, userID string) error {
+	res, err := mongodb.GetCollection(config.OrgMemberColl).DeleteOne(ctx, bson.M{"orgId": orgID, "userId": userID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrMemberNotFound
+	}
+	return nil
+}
+
+// findOrgMember returns the user's membership of an active organization,
+// or nil when they pay from their own balance.
+func findOrgMember(ctx context.Context, userID string) (*domain.OrgMember, error) {
+	var m domain.OrgMember
+	err := mongodb.GetCollection(config.OrgMemberColl).FindOne(ctx, bson.M{"userId": userID}).Decode(&m)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	org, err := GetOrganization(ctx, m.OrgID)
+	if errors.Is(err, ErrOrgNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if org.Status != "A" {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+// settleOrgUsage charges a member's trace to their organization's pool
+// under the package the organization is funded with.
+func (s *UsageSettler) settleOrgUsage(ctx context.Context, payload domain.TokenUsedIn, member *domain.OrgMember) (*domain.TokenUsedResponse, error) {
+	org, err := GetOrganization(ctx, member.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	if org.PoolBalance <= 0 {
+		return nil, ErrOrgPoolExhausted
+	}
+	if member.Cap != nil && member.PeriodConsumed >= *member.Cap {
+		return nil, ErrMemberCapReached
+	}
+
+	cost, err := s.portkey.FetchTraceCost(ctx, payload.TraceID)
+	if err != nil {
+		return nil, err
+	}
+	model, flags, err := resolveChargeModel(ctx, cost.AIModel)
+	if err != nil {
+		return nil, err
+	}
+	multiplier, entFlags, err := s.entitlements.apply(ctx, org.PackageID, model)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := findPackage(ctx, org.PackageID)
+	if err != nil {
+		return nil, err
+	}
+
+	charge := priceUsage(cost, payload.WebsearchCost, pkg, multiplier)
+	charge.withModel(model, append(flags, entFlags...))
+	if memberOverCap(member, charge.eggToken) {
+		return nil, ErrMemberCapReached
+	}
+	if org.PoolBalance+charge.eggToken < 0 {
+		return nil, ErrOrgPoolExhausted
+	}
+
+	doc := newTokenUsedEvent(payload, "", pkg, charge, 0, 0, nil)
+	doc.OrgID = &org.OrgID
+	doc.MainToken, doc.TopupToken = nil, nil
+	if err := insertTokenUsedEvent(ctx, &doc); err != nil {
+		if errors.Is(err, errDuplicateUsage) {
+			if existing, findErr := findTokenUsedEvent(ctx, payload.TraceID); findErr == nil && existing != nil {
+				return tokenUsedResponse(existing, TxnDuplicate), nil
+			}
+		}
+		return nil, err
+	}
+
+	if err := applyOrgDelta(org.OrgID, payload.UserID, domain.OrgEventUsage, charge.eggToken, &payload.TraceID); err != nil {
+		bgCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, delErr := mongodb.GetCollection(config.UsageEventColl).DeleteOne(bgCtx, bson.M{"_id": doc.ID}); delErr != nil {
+			return nil, fmt.Errorf("%v (usage event not rolled back: %v)", err, delErr)
+		}
+		unpostEvents(bgCtx, []primitive.ObjectID{doc.ID})
+		return nil, err
+	}
+
+	return tokenUsedResponse(&doc, TxnSuccess), nil
+}
+
+// memberOverCap reports whether a charge of eggToken (negative) would take
+// the member's consumption this period past their cap.
+func memberOverCap(member *domain.OrgMember, eggToken int) bool {
+	return member.Cap != nil && member.PeriodConsumed-eggToken > *member.Cap
+}
+
+// applyOrgDelta moves delta tokens in or out of the organization pool and
+// the member's consumption, and records the movement. A charge that would
+// take the member past their cap is refused with ErrMemberCapReached, and
+// one the pool cannot cover with ErrOrgPoolExhausted. When a later step
+// fails, the steps before it are undone.
+func applyOrgDelta(orgID, userID, eventType string, delta int, traceID *string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	memberColl := mongodb.GetCollection(config.OrgMemberColl)
+	orgColl := mongodb.GetCollection(config.OrganizationColl)
+
+	memberKey := bson.M{"orgId": orgID, "userId": userID}
+	memberFilter := bson.M{"orgId": orgID, "userId": userID}
+	orgFilter := bson.M{"orgId": orgID}
+	if delta < 0 {
+		// Matching on the cap and the pool makes concurrent charges unable
+		// to overshoot either.
+		memberFilter["$or"] = bson.A{
+			bson.M{"cap": bson.M{"$exists": false}},
+			bson.M{"$expr": bson.M{"$lte": bson.A{bson.M{"$subtract": bson.A{"$periodConsumed", delta}}, "$cap"}}},
+		}
+		orgFilter["poolBalance"] = bson.M{"$gte": -delta}
+	}
+	res, err := memberColl.UpdateOne(ctx,
+		memberFilter,
+		bson.M{"$inc": bson.M{"periodConsumed": -delta, "totalConsumed": -delta}, "$set": bson.M{"updatedAt": now}},
+	)
+	if err != nil {
+		return fmt.Errorf("DB update failed: %v", err)
+	}
+	if delta < 0 && res.MatchedCount == 0 {
+		return ErrMemberCapReached
+	}
+	undoMember := func() error {
+		_, err := memberColl.UpdateOne(ctx, memberKey, bson.M{"$inc": bson.M{"periodConsumed": delta, "totalConsumed": delta}})
+		return err
+	}
+
+	res, err = orgColl.UpdateOne(ctx,
+		orgFilter,
+		bson.M{"$inc": bson.M{"poolBalance": delta}, "$set": bson.M{"updatedAt": now}},
+	)
+	if err == nil && res.MatchedCount == 0 {
+		err = ErrOrgPoolExhausted
+	} else if err != nil {
+		err = fmt.Errorf("DB update failed: %v", err)
+	}
+	if err != nil {
+		return undoOrgDelta(err, undoMember)
+	}
+	undoOrg := func() error {
+		_, err := orgColl.UpdateOne(ctx, bson.M{"orgId": orgID}, bson.M{"$inc": bson.M{"poolBalance": -delta}})
+		return err
+	}
+
+	ev := domain.OrgPoolEvent{
+		ID:             primitive.NewObjectID(),
+		OrgID:          orgID,
+		EventType:      eventType,
+		EggToken:       delta,
+		UserID:         &userID,
+		TraceID:        traceID,
+		EventTimeStamp: now,
+	}
+	if _, err := mongodb.GetCollection(config.OrgPoolEventColl).InsertOne(ctx, ev); err != nil {
+		return undoOrgDelta(err, undoOrg, undoMember)
+	}
+	// The movement has taken effect; creditctl journal posts pool events
+	// whose entry is missing.
+	if err := postOrgPoolEvent(ctx, ev); err != nil {
+		log.Printf("Journal entry for pool event %s of org %s failed: %v", ev.ID.Hex(), orgID, err)
+	}
+	return nil
+}
+
+// undoOrgDelta runs the undo steps of a failed applyOrgDelta and returns
+// cause, noting any step that could not be undone.
+func undoOrgDelta(cause error, undo ...func() error) error {
+	for _, u := range undo {
+		if err := u(); err != nil {
+			return fmt.Errorf("%w (not rolled back: %v)", cause, err)
+		}
+	}
+	return cause
+}
+
+func CreateB2BSchedule(ctx context.Context, orgID string, in domain.B2BScheduleIn) (*domain.B2BSchedule, error) {
+	if _, err := GetOrganization(ctx, orgID); err != nil {
+		return nil, err
+	}
+	pkg, err := findPackage(ctx, in.PackageID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := advanceInterval(time.Now(), in.Interval); err != nil {
+		return nil, errors.Join(ErrInvalidOrg, err)
+	}
+	if in.EggToken < 0 {
+		return nil, errors.Join(ErrInvalidOrg, errors.New("eggToken must not be negative"))
+	}
+
+	now := time.Now()
+	sched := domain.B2BSchedule{
+		ID:        primitive.NewObjectID(),
+		OrgID:     orgID,
+		PackageID: pkg.PackageID,
+		EggToken:  in.EggToken,
+		Interval:  in.Interval,
+		NextRunAt: now,
+		Status:    "A",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if sched.EggToken == 0 {
+		sched.EggToken = pkg.EggToken
+	}
+	if in.StartAt != nil {
+		sched.NextRunAt = *in.StartAt
+	}
+
+	if _, err := mongodb.GetCollection(config.B2BScheduleColl).InsertOne(ctx, sched); err != nil {
+		return nil, err
+	}
+	return &sched, nil
+}
+
+func ListB2BSchedules(ctx context.Context, orgID string) ([]domain.B2BSchedule, error) {
+	cursor, err := mongodb.GetCollection(config.B2BScheduleColl).Find(ctx, bson.M{"orgId": orgID}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	out := []domain.B2BSchedule{}
+	if err := cursor.All(ctx, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func CancelB2BSchedule(ctx context.Context, orgID, scheduleID string) error {
+	oid, err := primitive.ObjectIDFromHex(scheduleID)
+	if err != nil {
+		return ErrScheduleNotFound
+	}
+	res, err := mongodb.GetCollection(config.B2BScheduleColl).UpdateOne(ctx,
+		bson.M{"_id": oid, "orgId": orgID},
+		bson.M{"$set": bson.M{"status": "C", "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+// ApplyDueB2BSchedules funds every organization whose schedule is due,
+// one period at a time so missed periods are caught up.
+func ApplyDueB2BSchedules(ctx context.Context) error {
+	coll := mongodb.GetCollection(config.B2BScheduleColl)
+
+	for ctx.Err() == nil {
+		var sched domain.B2BSchedule
+		err := coll.FindOne(ctx, bson.M{"status": "A", "nextRunAt": bson.M{"$lte": time.Now()}}, options.FindOne().SetSort(bson.M{"nextRunAt": 1})).Decode(&sched)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		next, err := advanceInterval(sched.NextRunAt, sched.Interval)
+		if err != nil {
+			return fmt.Errorf("schedule %s: %w", sched.ID.Hex(), err)
+		}
+
+		org, err := GetOrganization(ctx, sched.OrgID)
+		if err != nil {
+			return fmt.Errorf("schedule %s: %w", sched.ID.Hex(), err)
+		}
+		// Inactive organizations skip the period instead of being funded.
+		if org.Status == "A" {
+			if err := fundOrganization(ctx, &sched); err != nil {
+				return fmt.Errorf("fund %s: %w", sched.OrgID, err)
+			}
+		}
+
+		// Only move on once the period is funded; a crash before this
+		// point funds the same period again, which is idempotent.
+		_, err = coll.UpdateOne(ctx,
+			bson.M{"_id": sched.ID, "nextRunAt": sched.NextRunAt},
+			bson.M{"$set": bson.M{"nextRunAt": next, "updatedAt": time.Now()}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// fundOrganization credits one schedule period to the pool and starts a new
+// consumption period for its members. The Fund event is unique per schedule
+// and period and is marked applied once the pool is credited, so a period
+// retried after a crash, or by another replica, completes the funding
+// without crediting it twice.
+func fundOrganization(ctx context.Context, sched *domain.B2BSchedule) error {
+	periodStart := sched.NextRunAt
+	ev := domain.OrgPoolEvent{
+		ID:             primitive.NewObjectID(),
+		OrgID:          sched.OrgID,
+		EventType:      domain.OrgEventFund,
+		EggToken:       sched.EggToken,
+		ScheduleID:     &sched.ID,
+		PeriodStart:    &periodStart,
+		EventTimeStamp: time.Now(),
+	}
+	eventColl := mongodb.GetCollection(config.OrgPoolEventColl)
+	_, err := eventColl.InsertOne(ctx, ev)
+	if mongo.IsDuplicateKeyError(err) {
+		filter := bson.M{"scheduleId": sched.ID, "periodStart": periodStart, "eventType": domain.OrgEventFund}
+		if err := eventColl.FindOne(ctx, filter).Decode(&ev); err != nil {
+			return err
+		}
+		if ev.AppliedAt != nil {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+	if err := postOrgPoolEvent(ctx, ev); err != nil {
+		return err
+	}
+
+	// The pool is credited together with the period it funds, so the
+	// credit lands once however often this runs.
+	now := time.Now()
+	funded := "fundedThrough." + sched.ID.Hex()
+	_, err = mongodb.GetCollection(config.OrganizationColl).UpdateOne(ctx,
+		bson.M{"orgId": sched.OrgID, funded: bson.M{"$not": bson.M{"$gte": periodStart}}},
+		bson.M{
+			"$inc": bson.M{"poolBalance": ev.EggToken},
+			"$set": bson.M{"packageId": sched.PackageID, funded: periodStart, "updatedAt": now},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = mongodb.GetCollection(config.OrgMemberColl).UpdateMany(ctx,
+		bson.M{"orgId": sched.OrgID},
+		bson.M{"$set": bson.M{"periodConsumed": 0, "updatedAt": now}},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = eventColl.UpdateOne(ctx, bson.M{"_id": ev.ID}, bson.M{"$set": bson.M{"appliedAt": now}})
+	return err
+}
+
+func advanceInterval(t time.Time, interval string) (time.Time, error) {
+	switch interval {
+	case domain.IntervalDaily:
+		return t.AddDate(0, 0, 1), nil
+	case domain.IntervalWeekly:
+		return t.AddDate(0, 0, 7), nil
+	case domain.IntervalMonthly:
+		return t.AddDate(0, 1, 0), nil
+	default:
+		return t, fmt.Errorf("interval must be daily, weekly or monthly, got %q", interval)
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+)
+
+func TestMemberOverCap(t *testing.T) {
+	capped := func(limit, consumed int) *domain.OrgMember {
+		return &domain.OrgMember{Cap: &limit, PeriodConsumed: consumed}
+	}
+	tests := []struct {
+		name     string
+		member   *domain.OrgMember
+		eggToken int
+		want     bool
+	}{
+		{name: "charge over the cap", member: capped(100, 80), eggToken: -30, want: true},
+		{name: "charge up to the cap", member: capped(100, 80), eggToken: -20},
+		{name: "charge well under the cap", member: capped(100, 10), eggToken: -5},
+		{name: "already at the cap", member: capped(100, 100), eggToken: -1, want: true},
+		{name: "no cap", member: &domain.OrgMember{PeriodConsumed: 1_000_000}, eggToken: -500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := memberOverCap(tt.member, tt.eggToken); got != tt.want {
+				t.Errorf("memberOverCap(consumed %d, charge %d) = %v, want %v", tt.member.PeriodConsumed, tt.eggToken, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUndoOrgDelta(t *testing.T) {
+	var undone []string
+	step := func(name string, err error) func() error {
+		return func() error {
+			undone = append(undone, name)
+			return err
+		}
+	}
+
+	err := undoOrgDelta(ErrOrgPoolExhausted, step("org", nil), step("member", nil))
+	if err != ErrOrgPoolExhausted {
+		t.Errorf("err = %v, want the cause", err)
+	}
+	if len(undone) != 2 || undone[0] != "org" || undone[1] != "member" {
+		t.Errorf("undone = %v, want org then member", undone)
+	}
+
+	undone = nil
+	err = undoOrgDelta(ErrOrgPoolExhausted, step("org", errors.New("connection reset")), step("member", nil))
+	if !errors.Is(err, ErrOrgPoolExhausted) || len(undone) != 1 {
+		t.Errorf("err = %v after %v, want the cause noting the failed undo", err, undone)
+	}
+}
@@ -0,0 +1,258 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidPackage  = errors.New("Invalid package")
+	ErrPackageExists   = errors.New("Package already exists")
+	ErrVersionConflict = errors.New("Package was modified concurrently, reload and retry")
+)
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+func ListPackages(ctx context.Context, activeOnly bool) ([]domain.PackageMaster, error) {
+	filter := bson.M{}
+	if activeOnly {
+		filter["active"] = bson.M{"$ne": false}
+	}
+	cursor, err := mongodb.GetCollection(config.PackageMasterV3Coll).Find(ctx, filter, options.Find().SetSort(bson.M{"packageId": 1}))
+	if err != nil {
+		return nil, err
+	}
+	pkgs := []domain.PackageMaster{}
+	if err := cursor.All(ctx, &pkgs); err != nil {
+		return nil, err
+	}
+	return pkgs, nil
+}
+
+func GetPackage(ctx context.Context, packageID string) (*domain.PackageMaster, error) {
+	return findPackage(ctx, packageID)
+}
+
+func CreatePackage(ctx context.Context, in domain.PackageIn) (*domain.PackageMaster, error) {
+	if strings.TrimSpace(in.PackageID) == "" {
+		return nil, errors.Join(ErrInvalidPackage, errors.New("packageId is required"))
+	}
+	if err := validatePackage(in); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	pkg := packageFromInput(in)
+	pkg.Version = 1
+	pkg.CreatedAt = now
+	pkg.UpdatedAt = now
+	if in.Active == nil {
+		pkg.Active = true
+	}
+
+	if _, err := mongodb.GetCollection(config.PackageMasterV3Coll).InsertOne(ctx, pkg); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrPackageExists
+		}
+		return nil, err
+	}
+	if err := recordPackageVersion(ctx, pkg, now); err != nil {
+		return nil, err
+	}
+	return &pkg, nil
+}
+
+// UpdatePackage replaces a package's terms as a new version.
+func UpdatePackage(ctx context.Context, packageID string, in domain.PackageIn) (*domain.PackageMaster, error) {
+	if err := validatePackage(in); err != nil {
+		return nil, err
+	}
+
+	current, err := findPackage(ctx, packageID)
+	if err != nil {
+		return nil, err
+	}
+	if in.Version != nil && *in.Version != current.Version {
+		return nil, ErrVersionConflict
+	}
+
+	next := packageFromInput(in)
+	next.PackageID = current.PackageID
+	next.CreatedAt = current.CreatedAt
+	if in.Active == nil {
+		next.Active = current.Active
+	}
+	return savePackageVersion(ctx, current, next)
+}
+
+// DeactivatePackage retires a package. It is kept, as a new version, so
+// existing subscriptions and past usage still resolve.
+func DeactivatePackage(ctx context.Context, packageID string) (*domain.PackageMaster, error) {
+	current, err := findPackage(ctx, packageID)
+	if err != nil {
+		return nil, err
+	}
+	next := *current
+	next.Active = false
+	return savePackageVersion(ctx, current, next)
+}
+
+func ListPackageVersions(ctx context.Context, packageID string) ([]domain.PackageVersion, error) {
+	cursor, err := mongodb.GetCollection(config.PackageVersionColl).Find(ctx, bson.M{"packageId": packageID}, options.Find().SetSort(bson.M{"version": -1}))
+	if err != nil {
+		return nil, err
+	}
+	versions := []domain.PackageVersion{}
+	if err := cursor.All(ctx, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// GetPackageVersion returns the package terms a usage event was charged under.
+func GetPackageVersion(ctx context.Context, packageID string, version int) (*domain.PackageVersion, error) {
+	var v domain.PackageVersion
+	err := mongodb.GetCollection(config.PackageVersionColl).FindOne(ctx, bson.M{"packageId": packageID, "version": version}).Decode(&v)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrPackageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// savePackageVersion swaps current for next if nobody else changed it in the
+// meantime, and records next in the version history.
+func savePackageVersion(ctx context.Context, current *domain.PackageMaster, next domain.PackageMaster) (*domain.PackageMaster, error) {
+	now := time.Now()
+
+	// Packages created before versioning have no history; keep their
+	// original terms as version 0 so older usage events still resolve.
+	if current.Version == 0 {
+		if err := recordPackageVersion(ctx, *current, current.UpdatedAt); err != nil && !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+	}
+
+	next.Version = current.Version + 1
+	next.UpdatedAt = now
+
+	filter := bson.M{"packageId": current.PackageID, "version": current.Version}
+	if current.Version == 0 {
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	res, err := mongodb.GetCollection(config.PackageMasterV3Coll).ReplaceOne(ctx, filter, next)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, ErrVersionConflict
+	}
+
+	if err := recordPackageVersion(ctx, next, now); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+func recordPackageVersion(ctx context.Context, pkg domain.PackageMaster, changedAt time.Time) error {
+	_, err := mongodb.GetCollection(config.PackageVersionColl).InsertOne(ctx, domain.PackageVersion{
+		PackageMaster: pkg,
+		ChangedAt:     changedAt,
+	})
+	return err
+}
+
+func packageFromInput(in domain.PackageIn) domain.PackageMaster {
+	pkg := domain.PackageMaster{
+		PackageID:       strings.TrimSpace(in.PackageID),
+		Name:            strings.TrimSpace(in.Name),
+		Price:           in.Price,
+		Currency:        in.Currency,
+		EggToken:        in.EggToken,
+		ConversionRatio: in.ConversionRatio,
+		ValidityDays:    in.ValidityDays,
+		Tier:            strings.TrimSpace(in.Tier),
+		Rollover:        in.Rollover,
+		Deduction:       in.Deduction,
+	}
+	if in.Active != nil {
+		pkg.Active = *in.Active
+	}
+	return pkg
+}
+
+func validatePackage(in domain.PackageIn) error {
+	var errs []error
+	if strings.TrimSpace(in.Name) == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if in.Price < 0 {
+		errs = append(errs, errors.New("price must not be negative"))
+	}
+	if !currencyPattern.MatchString(in.Currency) {
+		errs = append(errs, fmt.Errorf("currency must be an ISO 4217 code, got %q", in.Currency))
+	}
+	if in.EggToken <= 0 {
+		errs = append(errs, errors.New("eggToken must be positive"))
+	}
+	if in.ConversionRatio <= 0 {
+		errs = append(errs, errors.New("conversionRatio must be positive"))
+	}
+	if in.ValidityDays <= 0 {
+		errs = append(errs, errors.New("validityDays must be positive"))
+	}
+	if strings.TrimSpace(in.Tier) == "" {
+		errs = append(errs, errors.New("tier is required"))
+	}
+	if r := in.Rollover; r != nil {
+		switch r.Mode {
+		case domain.RolloverNone, domain.RolloverFull:
+		case domain.RolloverCap:
+			if r.Cap <= 0 {
+				errs = append(errs, errors.New("rollover.cap must be positive"))
+			}
+		case domain.RolloverPercent:
+			if r.Percent <= 0 || r.Percent > 100 {
+				errs = append(errs, errors.New("rollover.percent must be in (0, 100]"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("rollover.mode must be none, full, cap or percent, got %q", r.Mode))
+		}
+	}
+	if d := in.Deduction; d != nil {
+		switch d.Strategy {
+		case domain.DeductMainFirstThreshold:
+			if d.Threshold != nil && *d.Threshold < 0 {
+				errs = append(errs, errors.New("deduction.threshold must not be negative"))
+			}
+		case domain.DeductTopupFirst, domain.DeductEarliestExpiring:
+			if d.Threshold != nil {
+				errs = append(errs, fmt.Errorf("deduction.threshold only applies to %s", domain.DeductMainFirstThreshold))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("deduction.strategy must be %s, %s or %s, got %q",
+				domain.DeductMainFirstThreshold, domain.DeductTopupFirst, domain.DeductEarliestExpiring, d.Strategy))
+		}
+		if d.MainExpiresAt != nil || d.TopupExpiresAt != nil {
+			errs = append(errs, errors.New("deduction expiries are resolved at charge time and cannot be set"))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(append([]error{ErrInvalidPackage}, errs...)...)
+	}
+	return nil
+}
@@ -0,0 +1,511 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidSchedule = errors.New("Invalid package schedule")
+	ErrSchedulePending = errors.New("User already has a pending package schedule")
+
+	// errScheduleVoid marks a schedule that can no longer apply, such as an
+	// upgrade whose payment failed; it is cancelled rather than retried.
+	errScheduleVoid = errors.New("package schedule can no longer apply")
+	// errUpgradeUnpaid leaves an upgrade whose payment is still pending for
+	// a later run.
+	errUpgradeUnpaid = errors.New("upgrade payment is still pending")
+)
+
+const (
+	// upgradePaymentGrace is how long a due upgrade waits for its payment
+	// to settle before it is cancelled.
+	upgradePaymentGrace = 24 * time.Hour
+	// scheduleLease is how long a claimed schedule stays invisible to
+	// other workers. A schedule whose lease expires (e.g. the process died
+	// while applying it) is claimed again.
+	scheduleLease = 2 * time.Minute
+	// scheduleRetryDelay is how long a schedule that failed waits before
+	// it is tried again.
+	scheduleRetryDelay = time.Minute
+)
+
+// SchedulePackageChange records an upgrade, downgrade or cancellation that
+// takes effect at the end of the user's current main package period. An
+// upgrade reserves the payment that pays for it; downgrades and
+// cancellations need none.
+func SchedulePackageChange(ctx context.Context, userID string, in domain.PackageScheduleIn) (*domain.PackageSchedule, error) {
+	ump, err := activeMainPackage(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if ump.EndDate.IsZero() {
+		return nil, errors.Join(ErrInvalidSchedule, errors.New("current package has no end date"))
+	}
+
+	switch in.Action {
+	case domain.ScheduleCancel:
+		in.TargetPackageID, in.PaymentID = "", ""
+	case domain.ScheduleDowngrade:
+		in.PaymentID = ""
+		if err := validatePlanChange(ctx, ump.PackageID, in); err != nil {
+			return nil, err
+		}
+	case domain.ScheduleUpgrade:
+		if in.PaymentID == "" {
+			return nil, errors.Join(ErrInvalidSchedule, errors.New("paymentId is required for an upgrade"))
+		}
+		if err := validatePlanChange(ctx, ump.PackageID, in); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Join(ErrInvalidSchedule, errors.New("action must be upgrade, downgrade or cancel"))
+	}
+
+	now := time.Now()
+	sched := domain.PackageSchedule{
+		ID:              primitive.NewObjectID(),
+		UserID:          userID,
+		Action:          in.Action,
+		FromPackageID:   ump.PackageID,
+		TargetPackageID: in.TargetPackageID,
+		PaymentID:       in.PaymentID,
+		EffectiveAt:     ump.EndDate,
+		Status:          domain.SchedulePending,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if sched.PaymentID != "" {
+		if err := reserveUpgradePayment(ctx, &sched); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := mongodb.GetCollection(config.PackageScheduleColl).InsertOne(ctx, sched); err != nil {
+		releaseUpgradePayment(ctx, &sched)
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrSchedulePending
+		}
+		return nil, err
+	}
+	return &sched, nil
+}
+
+// reserveUpgradePayment ties the upgrade's payment to the schedule, so the
+// payment webhook leaves granting it to the schedule. Only a pending or
+// succeeded subscription payment by the user for the target package that
+// has not been granted or reserved qualifies.
+func reserveUpgradePayment(ctx context.Context, sched *domain.PackageSchedule) error {
+	res, err := mongodb.GetCollection(config.PaymentColl).UpdateOne(ctx,
+		bson.M{
+			"paymentId":  sched.PaymentID,
+			"userId":     sched.UserID,
+			"kind":       domain.PaymentKindSubscription,
+			"packageId":  sched.TargetPackageID,
+			"status":     bson.M{"$in": bson.A{domain.PaymentStatusPending, domain.PaymentStatusSucceeded}},
+			"grantedAt":  bson.M{"$exists": false},
+			"scheduleId": bson.M{"$exists": false},
+		},
+		bson.M{"$set": bson.M{"scheduleId": sched.ID, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.Join(ErrInvalidSchedule, errors.New("paymentId must be an unused subscription payment by the user for the target package"))
+	}
+	return nil
+}
+
+// releaseUpgradePayment undoes reserveUpgradePayment, so a payment that
+// succeeds later is granted by the webhook as usual.
+func releaseUpgradePayment(ctx context.Context, sched *domain.PackageSchedule) {
+	if sched.PaymentID == "" {
+		return
+	}
+	_, err := mongodb.GetCollection(config.PaymentColl).UpdateOne(ctx,
+		bson.M{"paymentId": sched.PaymentID, "scheduleId": sched.ID, "grantedAt": bson.M{"$exists": false}},
+		bson.M{"$unset": bson.M{"scheduleId": ""}, "$set": bson.M{"updatedAt": time.Now()}},
+	)
+	if err != nil {
+		log.Printf("Releasing payment %s of package schedule %s failed: %v", sched.PaymentID, sched.ID.Hex(), err)
+	}
+}
+
+func validatePlanChange(ctx context.Context, currentID string, in domain.PackageScheduleIn) error {
+	if in.TargetPackageID == "" {
+		return errors.Join(ErrInvalidSchedule, errors.New("targetPackageId is required"))
+	}
+	if in.TargetPackageID == currentID {
+		return errors.Join(ErrInvalidSchedule, errors.New("targetPackageId is the current package"))
+	}
+
+	target, err := findPackage(ctx, in.TargetPackageID)
+	if err != nil {
+		return err
+	}
+	if !target.Active {
+		return errors.Join(ErrInvalidSchedule, errors.New("target package is not active"))
+	}
+	current, err := findPackage(ctx, currentID)
+	if err != nil {
+		return err
+	}
+
+	if in.Action == domain.ScheduleUpgrade && target.Price < current.Price {
+		return errors.Join(ErrInvalidSchedule, errors.New("upgrade target is cheaper than the current package"))
+	}
+	if in.Action == domain.ScheduleDowngrade && target.Price > current.Price {
+		return errors.Join(ErrInvalidSchedule, errors.New("downgrade target is more expensive than the current package"))
+	}
+	return nil
+}
+
+func ListPackageSchedules(ctx context.Context, userID, status string) ([]domain.PackageSchedule, error) {
+	filter := bson.M{"userId": userID}
+	if status != "" {
+		filter["status"] = status
+	}
+	cursor, err := mongodb.GetCollection(config.PackageScheduleColl).Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	out := []domain.PackageSchedule{}
+	if err := cursor.All(ctx, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CancelPackageSchedule withdraws a schedule that has not been applied yet
+// and releases the payment an upgrade reserved.
+func CancelPackageSchedule(ctx context.Context, userID, scheduleID string) error {
+	oid, err := primitive.ObjectIDFromHex(scheduleID)
+	if err != nil {
+		return ErrScheduleNotFound
+	}
+	var sched domain.PackageSchedule
+	err = mongodb.GetCollection(config.PackageScheduleColl).FindOneAndUpdate(ctx,
+		bson.M{"_id": oid, "userId": userID, "status": domain.SchedulePending},
+		bson.M{"$set": bson.M{"status": domain.ScheduleCancelled, "updatedAt": time.Now()}},
+	).Decode(&sched)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrScheduleNotFound
+	}
+	if err != nil {
+		return err
+	}
+	releaseUpgradePayment(ctx, &sched)
+	return nil
+}
+
+// ApplyDuePackageSchedules applies every pending schedule whose effective
+// time has passed, and takes over schedules whose worker's lease expired.
+func ApplyDuePackageSchedules(ctx context.Context) error {
+	coll := mongodb.GetCollection(config.PackageScheduleColl)
+
+	for ctx.Err() == nil {
+		sched, err := claimPackageSchedule(ctx)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		applyCtx, cancel := context.WithTimeout(ctx, scheduleLease/2)
+		err = applyPackageSchedule(applyCtx, sched)
+		cancel()
+
+		if errors.Is(err, errScheduleVoid) {
+			log.Printf("Package schedule %s cancelled: %v", sched.ID.Hex(), err)
+			releaseUpgradePayment(ctx, sched)
+		} else if err != nil && !errors.Is(err, errUpgradeUnpaid) {
+			log.Printf("Package schedule %s failed: %v", sched.ID.Hex(), err)
+		}
+
+		// The outcome must be recorded even if we are shutting down.
+		bgCtx, bgCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = coll.UpdateOne(bgCtx, bson.M{"_id": sched.ID}, scheduleOutcome(err, time.Now()))
+		bgCancel()
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// scheduleOutcome is the update that records how applying a schedule went.
+// A void schedule is cancelled, one that failed goes back to pending and
+// waits scheduleRetryDelay, and one that succeeded is applied. The lease
+// is dropped in every case but a retry, whose claimedUntil holds it back.
+func scheduleOutcome(err error, now time.Time) bson.M {
+	set := bson.M{"updatedAt": now}
+	unset := bson.M{}
+	switch {
+	case errors.Is(err, errScheduleVoid):
+		set["status"] = domain.ScheduleCancelled
+		set["lastError"] = err.Error()
+		unset["claimedUntil"] = ""
+	case err != nil:
+		set["status"] = domain.SchedulePending
+		set["lastError"] = err.Error()
+		set["claimedUntil"] = now.Add(scheduleRetryDelay)
+	default:
+		set["status"] = domain.ScheduleApplied
+		set["appliedAt"] = now
+		unset["claimedUntil"] = ""
+		unset["lastError"] = ""
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// claimPackageSchedule atomically takes the next due schedule, or one whose
+// lease has expired, and leases it for scheduleLease. Schedules left
+// applying without a lease, by versions that did not lease them, are taken
+// over too.
+func claimPackageSchedule(ctx context.Context) (*domain.PackageSchedule, error) {
+	now := time.Now()
+	filter := claimableSchedules(now)
+	update := bson.M{"$set": bson.M{"status": domain.ScheduleApplying, "claimedUntil": now.Add(scheduleLease), "updatedAt": now}}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"effectiveAt": 1}).SetReturnDocument(options.After)
+
+	var sched domain.PackageSchedule
+	if err := mongodb.GetCollection(config.PackageScheduleColl).FindOneAndUpdate(ctx, filter, update, opts).Decode(&sched); err != nil {
+		return nil, err
+	}
+	return &sched, nil
+}
+
+// claimableSchedules matches the schedules a worker may claim at now:
+// pending ones that are due and not held back by a retry delay, and
+// applying ones whose lease expired or that were never leased.
+func claimableSchedules(now time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{
+			"status":      domain.SchedulePending,
+			"effectiveAt": bson.M{"$lte": now},
+			"$or":         bson.A{bson.M{"claimedUntil": bson.M{"$exists": false}}, bson.M{"claimedUntil": bson.M{"$lte": now}}},
+		},
+		bson.M{"status": domain.ScheduleApplying, "claimedUntil": bson.M{"$lte": now}},
+		bson.M{"status": domain.ScheduleApplying, "claimedUntil": bson.M{"$exists": false}},
+	}}
+}
+
+// applyPackageSchedule expires what is left of the current main package and,
+// for a plan change, switches the user to the target package and grants its
+// tokens. An upgrade applies only once its payment has succeeded, and
+// grants that payment. Every step is safe to repeat: events are keyed by
+// the schedule ID, and once the schedule has recorded an event the
+// expiry is not worked out again, since the balance then includes what
+// the schedule did.
+func applyPackageSchedule(ctx context.Context, sched *domain.PackageSchedule) error {
+	started, err := mongodb.GetCollection(config.UsageEventColl).CountDocuments(ctx, bson.M{"scheduleId": sched.ID}, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if started == 0 {
+		if _, err := activeMainPackage(ctx, sched.UserID); errors.Is(err, ErrNoMainPackage) {
+			return errors.Join(errScheduleVoid, err)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	var pay *domain.PaymentTransaction
+	if sched.Action == domain.ScheduleUpgrade {
+		if pay, err = upgradePayment(ctx, sched); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	if started == 0 {
+		replayed, err := replayUserBalance(ctx, sched.UserID)
+		if err != nil {
+			return err
+		}
+		if main := replayed.Main; main > 0 {
+			if err := insertScheduleEvent(ctx, sched, EvtMainExpired, sched.FromPackageID, nil, -main, now, nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	umpColl := mongodb.GetCollection(config.UserMainPackageColl)
+	if sched.Action == domain.ScheduleCancel {
+		_, err := umpColl.UpdateOne(ctx,
+			bson.M{"userId": sched.UserID, "status": "A"},
+			bson.M{"$set": bson.M{"status": "C", "updatedAt": now}},
+		)
+		if err != nil {
+			return err
+		}
+	} else {
+		pkg, err := findPackage(ctx, sched.TargetPackageID)
+		if err != nil {
+			return err
+		}
+		end := sched.EffectiveAt.AddDate(0, 0, pkg.ValidityDays)
+		subscriptionID := ""
+		if pay != nil {
+			subscriptionID = "sub_" + pay.PaymentID
+			_, err := mongodb.GetCollection(config.SubsColl).InsertOne(ctx, domain.SubscriptionTransaction{
+				SubscriptionID: subscriptionID,
+				PaymentID:      pay.PaymentID,
+				UserID:         pay.UserID,
+				PackageID:      pkg.PackageID,
+				Status:         "A",
+				StartDate:      sched.EffectiveAt,
+				EndDate:        end,
+				CreatedAt:      now,
+				UpdatedAt:      now,
+			})
+			if err != nil && !mongo.IsDuplicateKeyError(err) {
+				return err
+			}
+		}
+		if err := startMainPeriod(ctx, sched.UserID, pkg, sched.EffectiveAt, subscriptionID, now); err != nil {
+			return err
+		}
+		version := pkg.Version
+		if err := insertScheduleEvent(ctx, sched, EvtSubscribe, pkg.PackageID, &version, pkg.EggToken, now.Add(time.Millisecond), &end, pay); err != nil {
+			return err
+		}
+		if pay != nil {
+			_, err := mongodb.GetCollection(config.PaymentColl).UpdateOne(ctx,
+				bson.M{"paymentId": pay.PaymentID, "grantedAt": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{
+					"eggToken":       pkg.EggToken,
+					"subscriptionId": subscriptionID,
+					"grantedAt":      now,
+					"updatedAt":      now,
+				}},
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = RecomputeAndUpsertUserBalance(ctx, sched.UserID)
+	return err
+}
+
+// upgradePayment returns the succeeded payment that pays for an upgrade. A
+// payment that failed, was refunded, did not settle within
+// upgradePaymentGrace of the due time or was already granted elsewhere
+// voids the upgrade.
+func upgradePayment(ctx context.Context, sched *domain.PackageSchedule) (*domain.PaymentTransaction, error) {
+	if sched.PaymentID == "" {
+		return nil, errors.Join(errScheduleVoid, errors.New("upgrade has no payment"))
+	}
+	pay, err := findPayment(ctx, sched.PaymentID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errors.Join(errScheduleVoid, fmt.Errorf("payment %s not found", sched.PaymentID))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var granted *domain.UsageEventOut
+	var ev domain.UsageEventOut
+	err = mongodb.GetCollection(config.UsageEventColl).FindOne(ctx,
+		bson.M{"paymentId": pay.PaymentID, "eventType": EvtSubscribe},
+	).Decode(&ev)
+	if err == nil {
+		granted = &ev
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	if err := checkUpgradePayment(sched, pay, granted, time.Now()); err != nil {
+		return nil, err
+	}
+	return pay, nil
+}
+
+// checkUpgradePayment decides whether pay can pay for the upgrade at now.
+// granted is the Subscribe event that already granted the payment, if
+// any; one recorded by this schedule is from an earlier attempt at
+// applying it, so the upgrade goes ahead again.
+func checkUpgradePayment(sched *domain.PackageSchedule, pay *domain.PaymentTransaction, granted *domain.UsageEventOut, now time.Time) error {
+	switch pay.Status {
+	case domain.PaymentStatusSucceeded:
+	case domain.PaymentStatusPending:
+		if now.Sub(sched.EffectiveAt) > upgradePaymentGrace {
+			return errors.Join(errScheduleVoid, errors.New("payment did not settle in time"))
+		}
+		return errUpgradeUnpaid
+	default:
+		return errors.Join(errScheduleVoid, fmt.Errorf("payment %s", pay.Status))
+	}
+	if granted != nil && (granted.ScheduleID == nil || *granted.ScheduleID != sched.ID) {
+		return errors.Join(errScheduleVoid, errors.New("payment was already granted"))
+	}
+	return nil
+}
+
+// startMainPeriod points the user's active main package at pkg for a new
+// period beginning at start. A non-empty subscriptionID links the period to
+// the subscription that paid for it.
+func startMainPeriod(ctx context.Context, userID string, pkg *domain.PackageMaster, start time.Time, subscriptionID string, now time.Time) error {
+	set := bson.M{
+		"packageId": pkg.PackageID,
+		"startDate": start,
+		"endDate":   start.AddDate(0, 0, pkg.ValidityDays),
+		"updatedAt": now,
+	}
+	if subscriptionID != "" {
+		set["subscriptionId"] = subscriptionID
+	}
+	_, err := mongodb.GetCollection(config.UserMainPackageColl).UpdateOne(ctx,
+		bson.M{"userId": userID, "status": "A"},
+		bson.M{"$set": set, "$unset": bson.M{"renewal": ""}},
+	)
+	return err
+}
+
+// insertScheduleEvent records an event of the schedule. pay, when given, is
+// the payment the event grants.
+func insertScheduleEvent(ctx context.Context, sched *domain.PackageSchedule, eventType, packageID string, packageVersion *int, eggToken int, at time.Time, expiresAt *time.Time, pay *domain.PaymentTransaction) error {
+	doc := domain.UsageEventOut{
+		ID:             primitive.NewObjectID(),
+		EventTimeStamp: at,
+		UserID:         sched.UserID,
+		EventType:      eventType,
+		PackageID:      &packageID,
+		PackageVersion: packageVersion,
+		EggToken:       eggToken,
+		ScheduleID:     &sched.ID,
+		ExpiresAt:      expiresAt,
+	}
+	if pay != nil {
+		subscriptionID := "sub_" + pay.PaymentID
+		doc.PaymentID = &pay.PaymentID
+		doc.SubscriptionID = &subscriptionID
+	}
+	_, err := mongodb.GetCollection(config.UsageEventColl).InsertOne(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("insert %s event: %w", eventType, err)
+	}
+	postEvents(ctx, &doc)
+	return nil
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestClaimableSchedules(t *testing.T) {
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	clauses := claimableSchedules(now)["$or"].(bson.A)
+	if len(clauses) != 3 {
+		t.Fatalf("%d clauses, want 3", len(clauses))
+	}
+
+	pending := clauses[0].(bson.M)
+	if pending["status"] != domain.SchedulePending || pending["effectiveAt"].(bson.M)["$lte"] != now {
+		t.Errorf("pending clause = %v, want due pending schedules", pending)
+	}
+	if lease := pending["$or"].(bson.A); len(lease) != 2 ||
+		lease[0].(bson.M)["claimedUntil"].(bson.M)["$exists"] != false ||
+		lease[1].(bson.M)["claimedUntil"].(bson.M)["$lte"] != now {
+		t.Errorf("pending lease = %v, want no delay or an elapsed one", lease)
+	}
+
+	expired := clauses[1].(bson.M)
+	if expired["status"] != domain.ScheduleApplying || expired["claimedUntil"].(bson.M)["$lte"] != now {
+		t.Errorf("expired lease clause = %v", expired)
+	}
+	unleased := clauses[2].(bson.M)
+	if unleased["status"] != domain.ScheduleApplying || unleased["claimedUntil"].(bson.M)["$exists"] != false {
+		t.Errorf("unleased clause = %v", unleased)
+	}
+}
+
+func TestScheduleOutcome(t *testing.T) {
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus string
+		wantRetry  bool
+	}{
+		{name: "applied", wantStatus: domain.ScheduleApplied},
+		{name: "void is cancelled", err: errors.Join(errScheduleVoid, errors.New("payment failed")), wantStatus: domain.ScheduleCancelled},
+		{name: "unpaid waits", err: errUpgradeUnpaid, wantStatus: domain.SchedulePending, wantRetry: true},
+		{name: "failure retries", err: errors.New("write conflict"), wantStatus: domain.SchedulePending, wantRetry: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := scheduleOutcome(tt.err, now)
+			set := update["$set"].(bson.M)
+			unset, _ := update["$unset"].(bson.M)
+			if set["status"] != tt.wantStatus {
+				t.Errorf("status = %v, want %s", set["status"], tt.wantStatus)
+			}
+			if tt.wantRetry {
+				if set["claimedUntil"] != now.Add(scheduleRetryDelay) || unset != nil {
+					t.Errorf("update = %v, want claimedUntil held back by the retry delay", update)
+				}
+			} else if _, ok := unset["claimedUntil"]; !ok {
+				t.Errorf("update = %v, want the lease dropped", update)
+			}
+			if tt.err != nil && set["lastError"] != tt.err.Error() {
+				t.Errorf("lastError = %v, want %q", set["lastError"], tt.err.Error())
+			}
+			if tt.err == nil {
+				if _, ok := unset["lastError"]; !ok || set["appliedAt"] != now {
+					t.Errorf("update = %v, want appliedAt set and lastError cleared", update)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckUpgradePayment(t *testing.T) {
+	effective := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	sched := &domain.PackageSchedule{ID: primitive.NewObjectID(), Action: domain.ScheduleUpgrade, PaymentID: "pay_1", EffectiveAt: effective}
+	other := primitive.NewObjectID()
+	byThis := &domain.UsageEventOut{ScheduleID: &sched.ID}
+	byOther := &domain.UsageEventOut{ScheduleID: &other}
+	byWebhook := &domain.UsageEventOut{}
+
+	tests := []struct {
+		name    string
+		status  string
+		granted *domain.UsageEventOut
+		now     time.Time
+		want    error
+	}{
+		{name: "succeeded", status: domain.PaymentStatusSucceeded, now: effective},
+		{name: "granted by an earlier attempt", status: domain.PaymentStatusSucceeded, granted: byThis, now: effective},
+		{name: "granted by another schedule", status: domain.PaymentStatusSucceeded, granted: byOther, now: effective, want: errScheduleVoid},
+		{name: "granted by the webhook", status: domain.PaymentStatusSucceeded, granted: byWebhook, now: effective, want: errScheduleVoid},
+		{name: "pending within grace", status: domain.PaymentStatusPending, now: effective.Add(upgradePaymentGrace), want: errUpgradeUnpaid},
+		{name: "pending past grace", status: domain.PaymentStatusPending, now: effective.Add(upgradePaymentGrace + time.Second), want: errScheduleVoid},
+		{name: "failed", status: domain.PaymentStatusFailed, now: effective, want: errScheduleVoid},
+		{name: "refunded", status: domain.PaymentStatusRefunded, now: effective, want: errScheduleVoid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pay := &domain.PaymentTransaction{PaymentID: "pay_1", Status: tt.status}
+			err := checkUpgradePayment(sched, pay, tt.granted, tt.now)
+			if tt.want == nil && err != nil {
+				t.Errorf("checkUpgradePayment = %v, want nil", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("checkUpgradePayment = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCancelPackageScheduleBadID(t *testing.T) {
+	if err := CancelPackageSchedule(context.Background(), "u1", "not-an-id"); !errors.Is(err, ErrScheduleNotFound) {
+		t.Errorf("CancelPackageSchedule = %v, want ErrScheduleNotFound", err)
+	}
+}
+
+func TestDeferringSchedules(t *testing.T) {
+	end := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	filter := deferringSchedules(&domain.UserMainPackage{UserID: "u1", EndDate: end})
+
+	if filter["userId"] != "u1" {
+		t.Errorf("userId = %v, want u1", filter["userId"])
+	}
+	statuses := filter["status"].(bson.M)["$in"].(bson.A)
+	if len(statuses) != 2 || statuses[0] != domain.SchedulePending || statuses[1] != domain.ScheduleApplying {
+		t.Errorf("statuses = %v, want pending and applying", statuses)
+	}
+	if filter["effectiveAt"].(bson.M)["$lte"] != end {
+		t.Errorf("effectiveAt = %v, want schedules due by the period end", filter["effectiveAt"])
+	}
+}
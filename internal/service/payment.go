@@ -0,0 +1,589 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidSignature = errors.New("Invalid webhook signature")
+	ErrInvalidPayment   = errors.New("Invalid payment event")
+	ErrPaymentConflict  = errors.New("Payment was updated concurrently, retry")
+
+	// errPeriodPaid marks a recurring payment for a period another payment
+	// already pays. It is recorded but not granted.
+	errPeriodPaid = errors.New("renewal period is already paid")
+)
+
+// paymentAmountTolerance absorbs rounding in gateway amounts.
+const paymentAmountTolerance = 0.005
+
+// paymentTransitions lists the statuses each payment status may move to.
+// Failed payments may still succeed on a later attempt; a refund is final.
+// A payment that failed after it was granted is final too (see
+// canTransitionPayment): its credits were taken back and are not granted
+// again.
+var paymentTransitions = map[string][]string{
+	domain.PaymentStatusPending:   {domain.PaymentStatusSucceeded, domain.PaymentStatusFailed, domain.PaymentStatusRefunded},
+	domain.PaymentStatusFailed:    {domain.PaymentStatusSucceeded},
+	domain.PaymentStatusSucceeded: {domain.PaymentStatusFailed, domain.PaymentStatusRefunded},
+}
+
+// SignPayment returns the signature header for body, in the
+// "t=<unix>,v1=<hex hmac-sha256 of t.body>" form used by Stripe.
+func SignPayment(secret string, body []byte, at time.Time) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + ts + ",v1=" + paymentMAC(secret, ts, body)
+}
+
+// VerifyPaymentSignature checks a signature header produced by SignPayment
+// and rejects timestamps further than tolerance from now, so captured
+// deliveries cannot be replayed later.
+func VerifyPaymentSignature(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	if ts == "" || len(sigs) == 0 {
+		return ErrInvalidSignature
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > tolerance || d < -tolerance {
+		return errors.Join(ErrInvalidSignature, errors.New("timestamp outside tolerance"))
+	}
+
+	want := []byte(paymentMAC(secret, ts, body))
+	for _, sig := range sigs {
+		if hmac.Equal([]byte(sig), want) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func paymentMAC(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RecordPaymentEvent applies a verified webhook event to its payment. Events
+// already recorded are reported as duplicates. Credits are granted once a
+// payment succeeds and taken back if it later fails or is refunded; both
+// steps are safe to retry, so a failed delivery can simply be redelivered.
+// A successful payment must be for the package's price and currency.
+func RecordPaymentEvent(ctx context.Context, ev domain.PaymentWebhookEvent) (*domain.PaymentWebhookResponse, error) {
+	status, err := validatePaymentEvent(ev)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := mongodb.GetCollection(config.PaymentColl)
+	d := ev.Data
+	now := time.Now()
+
+	if status == domain.PaymentStatusSucceeded {
+		pkg, err := findPackage(ctx, d.PackageID)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPaymentAmount(d, pkg); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = coll.UpdateOne(ctx, bson.M{"paymentId": d.PaymentID}, bson.M{
+		"$setOnInsert": bson.M{
+			"userId":    d.UserID,
+			"kind":      d.Kind,
+			"packageId": d.PackageID,
+			"amount":    d.Amount,
+			"currency":  d.Currency,
+			"status":    domain.PaymentStatusPending,
+			"eventIds":  bson.A{},
+			"createdAt": now,
+			"updatedAt": now,
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	pay, err := findPayment(ctx, d.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	duplicate, err := checkPaymentEvent(pay, ev)
+	if err != nil {
+		return nil, err
+	}
+	if duplicate {
+		return &domain.PaymentWebhookResponse{Duplicate: true, Payment: *pay}, nil
+	}
+
+	if canTransitionPayment(pay, status) {
+		filter := bson.M{"paymentId": pay.PaymentID, "status": pay.Status}
+		if pay.GrantedAt == nil {
+			filter["grantedAt"] = bson.M{"$exists": false}
+		}
+		res, err := coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"status": status, "updatedAt": now}})
+		if err != nil {
+			return nil, err
+		}
+		if res.MatchedCount == 0 {
+			return nil, ErrPaymentConflict
+		}
+		pay.Status = status
+	}
+
+	if err := reconcilePayment(ctx, pay); err != nil {
+		return nil, err
+	}
+
+	if _, err := coll.UpdateOne(ctx,
+		bson.M{"paymentId": pay.PaymentID},
+		bson.M{"$addToSet": bson.M{"eventIds": ev.ID}},
+	); err != nil {
+		return nil, err
+	}
+	pay.EventIDs = append(pay.EventIDs, ev.ID)
+	return &domain.PaymentWebhookResponse{Payment: *pay}, nil
+}
+
+// checkPaymentEvent reports whether ev was already recorded for pay, and
+// rejects an event that describes a different payment.
+func checkPaymentEvent(pay *domain.PaymentTransaction, ev domain.PaymentWebhookEvent) (bool, error) {
+	if slices.Contains(pay.EventIDs, ev.ID) {
+		return true, nil
+	}
+	d := ev.Data
+	if pay.UserID != d.UserID || pay.PackageID != d.PackageID || pay.Kind != d.Kind {
+		return false, errors.Join(ErrInvalidPayment, errors.New("event does not match the recorded payment"))
+	}
+	return false, nil
+}
+
+// checkPaymentAmount rejects a payment that is not for the package's price
+// in the package's currency.
+func checkPaymentAmount(d domain.PaymentData, pkg *domain.PackageMaster) error {
+	if !strings.EqualFold(d.Currency, pkg.Currency) {
+		return errors.Join(ErrInvalidPayment, fmt.Errorf("currency %q does not match package currency %q", d.Currency, pkg.Currency))
+	}
+	if math.Abs(d.Amount-pkg.Price) > paymentAmountTolerance {
+		return errors.Join(ErrInvalidPayment, fmt.Errorf("amount %v does not match package price %v", d.Amount, pkg.Price))
+	}
+	return nil
+}
+
+// canTransitionPayment reports whether pay may move to status.
+func canTransitionPayment(pay *domain.PaymentTransaction, status string) bool {
+	if status == pay.Status || !slices.Contains(paymentTransitions[pay.Status], status) {
+		return false
+	}
+	return pay.Status != domain.PaymentStatusFailed || pay.GrantedAt == nil
+}
+
+func validatePaymentEvent(ev domain.PaymentWebhookEvent) (string, error) {
+	var errs []error
+	if strings.TrimSpace(ev.ID) == "" {
+		errs = append(errs, errors.New("id is required"))
+	}
+	d := ev.Data
+	if strings.TrimSpace(d.PaymentID) == "" {
+		errs = append(errs, errors.New("data.paymentId is required"))
+	}
+	if strings.TrimSpace(d.UserID) == "" {
+		errs = append(errs, errors.New("data.userId is required"))
+	}
+	if strings.TrimSpace(d.PackageID) == "" {
+		errs = append(errs, errors.New("data.packageId is required"))
+	}
+	if d.Kind != domain.PaymentKindSubscription && d.Kind != domain.PaymentKindTopup {
+		errs = append(errs, fmt.Errorf("data.kind must be subscription or topup, got %q", d.Kind))
+	}
+
+	var status string
+	switch ev.Type {
+	case domain.PaymentSucceeded:
+		status = domain.PaymentStatusSucceeded
+	case domain.PaymentFailed:
+		status = domain.PaymentStatusFailed
+	case domain.PaymentRefunded:
+		status = domain.PaymentStatusRefunded
+	default:
+		errs = append(errs, fmt.Errorf("unsupported event type %q", ev.Type))
+	}
+
+	if len(errs) > 0 {
+		return "", errors.Join(append([]error{ErrInvalidPayment}, errs...)...)
+	}
+	return status, nil
+}
+
+func findPayment(ctx context.Context, paymentID string) (*domain.PaymentTransaction, error) {
+	var pay domain.PaymentTransaction
+	if err := mongodb.GetCollection(config.PaymentColl).FindOne(ctx, bson.M{"paymentId": paymentID}).Decode(&pay); err != nil {
+		return nil, err
+	}
+	return &pay, nil
+}
+
+// reconcilePayment brings the user's credits in line with the payment's
+// status.
+func reconcilePayment(ctx context.Context, pay *domain.PaymentTransaction) error {
+	coll := mongodb.GetCollection(config.PaymentColl)
+	now := time.Now()
+
+	switch {
+	// A payment reserved by a scheduled upgrade is granted by the schedule.
+	case pay.Status == domain.PaymentStatusSucceeded && pay.GrantedAt == nil && pay.ScheduleID == nil:
+		err := grantPayment(ctx, pay)
+		if errors.Is(err, errPeriodPaid) {
+			log.Printf("Payment %s is not granted: %v", pay.PaymentID, err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pay.GrantedAt = &now
+		set := bson.M{
+			"subscriptionId": pay.SubscriptionID,
+			"grantedAt":      now,
+			"updatedAt":      now,
+		}
+		// The renewal that uses a recurring payment records its tokens.
+		if pay.RenewalPeriod == nil {
+			set["eggToken"] = pay.EggToken
+		}
+		_, err = coll.UpdateOne(ctx, bson.M{"paymentId": pay.PaymentID}, bson.M{"$set": set})
+		return err
+
+	case (pay.Status == domain.PaymentStatusFailed || pay.Status == domain.PaymentStatusRefunded) &&
+		pay.GrantedAt != nil && pay.RevokedAt == nil:
+		if err := revokePayment(ctx, pay); err != nil {
+			return err
+		}
+		pay.RevokedAt = &now
+		_, err := coll.UpdateOne(ctx, bson.M{"paymentId": pay.PaymentID}, bson.M{"$set": bson.M{
+			"revokedAt": now,
+			"updatedAt": now,
+		}})
+		return err
+	}
+	return nil
+}
+
+// grantPayment activates the paid subscription or adds the paid topup. A
+// payment for the package the user already subscribes to pays for the
+// subscription's next period instead; a subscription to another package
+// replaces the current one.
+func grantPayment(ctx context.Context, pay *domain.PaymentTransaction) error {
+	pkg, err := findPackage(ctx, pay.PackageID)
+	if err != nil {
+		return err
+	}
+	pay.EggToken = pkg.EggToken
+	now := time.Now()
+	version := pkg.Version
+
+	if pay.Kind == domain.PaymentKindTopup {
+		_, err := mongodb.GetCollection(config.TopupPackageEventColl).InsertOne(ctx, bson.M{
+			"topupId":   pay.PaymentID,
+			"userId":    pay.UserID,
+			"packageId": pay.PackageID,
+			"status":    "A",
+			"createdAt": now,
+		})
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		expires := now.AddDate(0, 0, pkg.ValidityDays)
+		if err := syncTopupPackage(ctx, pay.UserID, expires); err != nil {
+			return err
+		}
+		if err := insertPaymentEvent(ctx, pay, EvtTopup, &version, pkg.EggToken, now, &expires, nil); err != nil {
+			return err
+		}
+	} else {
+		ump, err := activeMainPackage(ctx, pay.UserID)
+		if err != nil && !errors.Is(err, ErrNoMainPackage) {
+			return err
+		}
+		// A retry finds the package this payment already started.
+		if ump != nil && ump.SubscriptionID != "sub_"+pay.PaymentID {
+			if renewsSubscription(ump, pay) {
+				return payRenewal(ctx, pay, ump)
+			}
+			if err := endMainPackage(ctx, ump, now); err != nil {
+				return err
+			}
+			now = now.Add(time.Millisecond)
+		}
+
+		pay.SubscriptionID = "sub_" + pay.PaymentID
+		end := now.AddDate(0, 0, pkg.ValidityDays)
+
+		_, err = mongodb.GetCollection(config.SubsColl).InsertOne(ctx, domain.SubscriptionTransaction{
+			SubscriptionID: pay.SubscriptionID,
+			PaymentID:      pay.PaymentID,
+			UserID:         pay.UserID,
+			PackageID:      pay.PackageID,
+			Status:         "A",
+			StartDate:      now,
+			EndDate:        end,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		})
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		_, err = mongodb.GetCollection(config.UserMainPackageColl).UpdateOne(ctx,
+			bson.M{"userId": pay.UserID},
+			bson.M{
+				"$set": bson.M{
+					"subscriptionId": pay.SubscriptionID,
+					"packageId":      pay.PackageID,
+					"status":         "A",
+					"startDate":      now,
+					"endDate":        end,
+					"updatedAt":      now,
+				},
+				"$unset":       bson.M{"renewal": ""},
+				"$setOnInsert": bson.M{"createdAt": now},
+			},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+		if err := insertPaymentEvent(ctx, pay, EvtSubscribe, &version, pkg.EggToken, now, &end, nil); err != nil {
+			return err
+		}
+	}
+
+	_, err = RecomputeAndUpsertUserBalance(ctx, pay.UserID)
+	return err
+}
+
+// renewsSubscription reports whether a subscription payment pays for the
+// next period of the user's current subscription rather than starting a new
+// one.
+func renewsSubscription(ump *domain.UserMainPackage, pay *domain.PaymentTransaction) bool {
+	return ump.SubscriptionID != "" && ump.PackageID == pay.PackageID
+}
+
+// payRenewal sets a recurring payment aside for the subscription period
+// starting at the current period's end; the renewal of that period grants
+// it. The renewal's Subscribe event is keyed by period, so the period is
+// granted once whether the worker or this payment gets there first. A
+// period that is already due is renewed now.
+func payRenewal(ctx context.Context, pay *domain.PaymentTransaction, ump *domain.UserMainPackage) error {
+	pay.SubscriptionID = ump.SubscriptionID
+	pay.EggToken = 0
+	if pay.RenewalPeriod == nil {
+		period := ump.EndDate
+		_, err := mongodb.GetCollection(config.PaymentColl).UpdateOne(ctx,
+			bson.M{"paymentId": pay.PaymentID},
+			bson.M{"$set": bson.M{"renewalPeriod": period, "subscriptionId": ump.SubscriptionID}},
+		)
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: %s", errPeriodPaid, period.Format(time.RFC3339))
+		}
+		if err != nil {
+			return err
+		}
+		pay.RenewalPeriod = &period
+	}
+	if pay.RenewalPeriod.After(time.Now()) {
+		return nil
+	}
+	return renewMainPackage(ctx, ump)
+}
+
+// endMainPackage ends the user's current main package before a new
+// subscription replaces it: its subscription is cancelled and what is left
+// of its main lots is expired, so the old balance does not carry over.
+// Expiries are keyed by lot, so a retry does not repeat them.
+func endMainPackage(ctx context.Context, ump *domain.UserMainPackage, at time.Time) error {
+	if ump.SubscriptionID != "" {
+		_, err := mongodb.GetCollection(config.SubsColl).UpdateOne(ctx,
+			bson.M{"subscriptionId": ump.SubscriptionID},
+			bson.M{"$set": bson.M{"status": "C", "updatedAt": at}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	book, err := replayUserLedger(ctx, ump.UserID)
+	if err != nil {
+		return err
+	}
+	for _, lot := range book.ActiveLots() {
+		if lot.Bucket != domain.BucketMain || lot.Remaining <= 0 {
+			continue
+		}
+		if err := insertLotExpiryEvent(ctx, lot, EvtMainExpired, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokePayment takes back what grantPayment gave. Tokens already spent
+// cannot be recovered; the expiry only removes what is left, down to zero,
+// starting with the lot the payment granted.
+func revokePayment(ctx context.Context, pay *domain.PaymentTransaction) error {
+	now := time.Now()
+	grantType := EvtSubscribe
+	if pay.Kind == domain.PaymentKindTopup {
+		grantType = EvtTopup
+	}
+	lotID, err := paymentLotID(ctx, pay.PaymentID, grantType)
+	if err != nil {
+		return err
+	}
+	// A recurring payment whose period has not been renewed yet granted
+	// nothing; it only gives the period back.
+	if pay.RenewalPeriod != nil && lotID == nil {
+		_, err := mongodb.GetCollection(config.PaymentColl).UpdateOne(ctx,
+			bson.M{"paymentId": pay.PaymentID},
+			bson.M{"$unset": bson.M{"renewalPeriod": ""}},
+		)
+		return err
+	}
+
+	if pay.Kind == domain.PaymentKindTopup {
+		_, err := mongodb.GetCollection(config.TopupPackageEventColl).UpdateOne(ctx,
+			bson.M{"topupId": pay.PaymentID},
+			bson.M{"$set": bson.M{"status": "R", "updatedAt": now}},
+		)
+		if err != nil {
+			return err
+		}
+		if err := syncTopupPackage(ctx, pay.UserID, time.Time{}); err != nil {
+			return err
+		}
+		if err := insertPaymentEvent(ctx, pay, EvtTopupExpired, nil, -pay.EggToken, now, nil, lotID); err != nil {
+			return err
+		}
+	} else {
+		_, err := mongodb.GetCollection(config.SubsColl).UpdateOne(ctx,
+			bson.M{"subscriptionId": pay.SubscriptionID},
+			bson.M{"$set": bson.M{"status": "C", "updatedAt": now}},
+		)
+		if err != nil {
+			return err
+		}
+		_, err = mongodb.GetCollection(config.UserMainPackageColl).UpdateOne(ctx,
+			bson.M{"userId": pay.UserID, "subscriptionId": pay.SubscriptionID},
+			bson.M{"$set": bson.M{"status": "C", "updatedAt": now}},
+		)
+		if err != nil {
+			return err
+		}
+		if err := insertPaymentEvent(ctx, pay, EvtMainExpired, nil, -pay.EggToken, now, nil, lotID); err != nil {
+			return err
+		}
+	}
+
+	_, err = RecomputeAndUpsertUserBalance(ctx, pay.UserID)
+	return err
+}
+
+// paymentLotID is the lot a payment's grant event opened, or nil when the
+// grant was never recorded.
+func paymentLotID(ctx context.Context, paymentID, eventType string) (*string, error) {
+	var ev domain.UsageEventOut
+	err := mongodb.GetCollection(config.UsageEventColl).FindOne(ctx, bson.M{"paymentId": paymentID, "eventType": eventType}).Decode(&ev)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lotID := ev.ID.Hex()
+	return &lotID, nil
+}
+
+// syncTopupPackage sets the user's topup total from their active topup
+// purchases. A non-zero endDate extends the topup validity.
+func syncTopupPackage(ctx context.Context, userID string, endDate time.Time) error {
+	total, err := RecomputeTotalTopupToken(ctx, userID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	set := bson.M{"totalTopupToken": total, "status": "A", "updatedAt": now}
+	if !endDate.IsZero() {
+		set["endDate"] = endDate
+	}
+	_, err = mongodb.GetCollection(config.UserTopupPackageColl).UpdateOne(ctx,
+		bson.M{"userId": userID},
+		bson.M{"$set": set, "$setOnInsert": bson.M{"startDate": now, "createdAt": now}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func insertPaymentEvent(ctx context.Context, pay *domain.PaymentTransaction, eventType string, packageVersion *int, eggToken int, at time.Time, expiresAt *time.Time, lotID *string) error {
+	doc := domain.UsageEventOut{
+		ID:             primitive.NewObjectID(),
+		EventTimeStamp: at,
+		UserID:         pay.UserID,
+		EventType:      eventType,
+		PackageID:      &pay.PackageID,
+		PackageVersion: packageVersion,
+		EggToken:       eggToken,
+		PaymentID:      &pay.PaymentID,
+		ExpiresAt:      expiresAt,
+		LotID:          lotID,
+	}
+	if pay.SubscriptionID != "" {
+		doc.SubscriptionID = &pay.SubscriptionID
+	}
+	_, err := mongodb.GetCollection(config.UsageEventColl).InsertOne(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("insert %s event: %w", eventType, err)
+	}
+	postEvents(ctx, &doc)
+	return nil
+}
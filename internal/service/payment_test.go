@@ -0,0 +1,183 @@
+package service
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+)
+
+func TestVerifyPaymentSignature(t *testing.T) {
+	const secret = "whsec_test"
+	body := []byte(`{"id":"evt_1"}`)
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	signed := SignPayment(secret, body, now)
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	tests := []struct {
+		name    string
+		secret  string
+		header  string
+		body    []byte
+		now     time.Time
+		wantErr bool
+	}{
+		{name: "valid", secret: secret, header: signed, body: body, now: now},
+		{name: "within tolerance", secret: secret, header: signed, body: body, now: now.Add(4 * time.Minute)},
+		{name: "one of several signatures matches", secret: secret, header: "t=" + ts + ",v1=deadbeef," + signed[len("t="+ts+","):], body: body, now: now},
+		{name: "wrong secret", secret: "other", header: signed, body: body, now: now, wantErr: true},
+		{name: "tampered body", secret: secret, header: signed, body: []byte(`{"id":"evt_2"}`), now: now, wantErr: true},
+		{name: "too old", secret: secret, header: signed, body: body, now: now.Add(6 * time.Minute), wantErr: true},
+		{name: "from the future", secret: secret, header: signed, body: body, now: now.Add(-6 * time.Minute), wantErr: true},
+		{name: "missing timestamp", secret: secret, header: signed[len("t="+ts+","):], body: body, now: now, wantErr: true},
+		{name: "missing signature", secret: secret, header: "t=" + ts, body: body, now: now, wantErr: true},
+		{name: "bad timestamp", secret: secret, header: "t=soon,v1=00", body: body, now: now, wantErr: true},
+		{name: "empty header", secret: secret, body: body, now: now, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyPaymentSignature(tt.secret, tt.header, tt.body, 5*time.Minute, tt.now)
+			if tt.wantErr && !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("VerifyPaymentSignature = %v, want ErrInvalidSignature", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("VerifyPaymentSignature = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestValidatePaymentEvent(t *testing.T) {
+	data := domain.PaymentData{PaymentID: "pay_1", UserID: "u1", Kind: domain.PaymentKindSubscription, PackageID: "pro-monthly", Amount: 299, Currency: "THB"}
+	tests := []struct {
+		name       string
+		ev         domain.PaymentWebhookEvent
+		wantStatus string
+	}{
+		{name: "succeeded", ev: domain.PaymentWebhookEvent{ID: "evt_1", Type: domain.PaymentSucceeded, Data: data}, wantStatus: domain.PaymentStatusSucceeded},
+		{name: "failed", ev: domain.PaymentWebhookEvent{ID: "evt_1", Type: domain.PaymentFailed, Data: data}, wantStatus: domain.PaymentStatusFailed},
+		{name: "refunded", ev: domain.PaymentWebhookEvent{ID: "evt_1", Type: domain.PaymentRefunded, Data: data}, wantStatus: domain.PaymentStatusRefunded},
+		{name: "unknown type", ev: domain.PaymentWebhookEvent{ID: "evt_1", Type: "payment.disputed", Data: data}},
+		{name: "missing id", ev: domain.PaymentWebhookEvent{Type: domain.PaymentSucceeded, Data: data}},
+		{name: "unknown kind", ev: domain.PaymentWebhookEvent{ID: "evt_1", Type: domain.PaymentSucceeded, Data: domain.PaymentData{PaymentID: "pay_1", UserID: "u1", Kind: "gift", PackageID: "pro-monthly"}}},
+		{name: "missing payment id", ev: domain.PaymentWebhookEvent{ID: "evt_1", Type: domain.PaymentSucceeded, Data: domain.PaymentData{UserID: "u1", Kind: domain.PaymentKindTopup, PackageID: "topup-100"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := validatePaymentEvent(tt.ev)
+			if tt.wantStatus == "" {
+				if !errors.Is(err, ErrInvalidPayment) {
+					t.Errorf("validatePaymentEvent = %v, want ErrInvalidPayment", err)
+				}
+				return
+			}
+			if err != nil || status != tt.wantStatus {
+				t.Errorf("validatePaymentEvent = %q, %v, want %q", status, err, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCheckPaymentEvent(t *testing.T) {
+	pay := &domain.PaymentTransaction{PaymentID: "pay_1", UserID: "u1", Kind: domain.PaymentKindSubscription, PackageID: "pro-monthly", EventIDs: []string{"evt_1"}}
+	data := domain.PaymentData{PaymentID: "pay_1", UserID: "u1", Kind: domain.PaymentKindSubscription, PackageID: "pro-monthly"}
+
+	tests := []struct {
+		name          string
+		ev            domain.PaymentWebhookEvent
+		wantDuplicate bool
+		wantErr       bool
+	}{
+		{name: "redelivered event", ev: domain.PaymentWebhookEvent{ID: "evt_1", Data: data}, wantDuplicate: true},
+		{name: "new event", ev: domain.PaymentWebhookEvent{ID: "evt_2", Data: data}},
+		{name: "other user", ev: domain.PaymentWebhookEvent{ID: "evt_2", Data: domain.PaymentData{PaymentID: "pay_1", UserID: "u2", Kind: data.Kind, PackageID: data.PackageID}}, wantErr: true},
+		{name: "other package", ev: domain.PaymentWebhookEvent{ID: "evt_2", Data: domain.PaymentData{PaymentID: "pay_1", UserID: "u1", Kind: data.Kind, PackageID: "pro-yearly"}}, wantErr: true},
+		{name: "other kind", ev: domain.PaymentWebhookEvent{ID: "evt_2", Data: domain.PaymentData{PaymentID: "pay_1", UserID: "u1", Kind: domain.PaymentKindTopup, PackageID: data.PackageID}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			duplicate, err := checkPaymentEvent(pay, tt.ev)
+			if tt.wantErr != errors.Is(err, ErrInvalidPayment) {
+				t.Fatalf("checkPaymentEvent error = %v, want error %v", err, tt.wantErr)
+			}
+			if duplicate != tt.wantDuplicate {
+				t.Errorf("duplicate = %v, want %v", duplicate, tt.wantDuplicate)
+			}
+		})
+	}
+}
+
+func TestCheckPaymentAmount(t *testing.T) {
+	pkg := &domain.PackageMaster{PackageID: "pro-monthly", Price: 299, Currency: "THB"}
+	tests := []struct {
+		name    string
+		amount  float64
+		curr    string
+		wantErr bool
+	}{
+		{name: "exact", amount: 299, curr: "THB"},
+		{name: "currency case", amount: 299, curr: "thb"},
+		{name: "rounding", amount: 299.004, curr: "THB"},
+		{name: "underpaid", amount: 29.9, curr: "THB", wantErr: true},
+		{name: "overpaid", amount: 300, curr: "THB", wantErr: true},
+		{name: "other currency", amount: 299, curr: "USD", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPaymentAmount(domain.PaymentData{Amount: tt.amount, Currency: tt.curr}, pkg)
+			if tt.wantErr != errors.Is(err, ErrInvalidPayment) {
+				t.Errorf("checkPaymentAmount = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCanTransitionPayment(t *testing.T) {
+	granted := time.Now()
+	tests := []struct {
+		name    string
+		pay     domain.PaymentTransaction
+		status  string
+		allowed bool
+	}{
+		{name: "pending succeeds", pay: domain.PaymentTransaction{Status: domain.PaymentStatusPending}, status: domain.PaymentStatusSucceeded, allowed: true},
+		{name: "pending fails", pay: domain.PaymentTransaction{Status: domain.PaymentStatusPending}, status: domain.PaymentStatusFailed, allowed: true},
+		{name: "pending is refunded", pay: domain.PaymentTransaction{Status: domain.PaymentStatusPending}, status: domain.PaymentStatusRefunded, allowed: true},
+		{name: "failed before grant succeeds later", pay: domain.PaymentTransaction{Status: domain.PaymentStatusFailed}, status: domain.PaymentStatusSucceeded, allowed: true},
+		{name: "failed after grant is final", pay: domain.PaymentTransaction{Status: domain.PaymentStatusFailed, GrantedAt: &granted}, status: domain.PaymentStatusSucceeded},
+		{name: "succeeded is refunded", pay: domain.PaymentTransaction{Status: domain.PaymentStatusSucceeded, GrantedAt: &granted}, status: domain.PaymentStatusRefunded, allowed: true},
+		{name: "succeeded fails", pay: domain.PaymentTransaction{Status: domain.PaymentStatusSucceeded, GrantedAt: &granted}, status: domain.PaymentStatusFailed, allowed: true},
+		{name: "refund is final", pay: domain.PaymentTransaction{Status: domain.PaymentStatusRefunded}, status: domain.PaymentStatusSucceeded},
+		{name: "same status", pay: domain.PaymentTransaction{Status: domain.PaymentStatusSucceeded}, status: domain.PaymentStatusSucceeded},
+		{name: "back to pending", pay: domain.PaymentTransaction{Status: domain.PaymentStatusFailed}, status: domain.PaymentStatusPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canTransitionPayment(&tt.pay, tt.status); got != tt.allowed {
+				t.Errorf("canTransitionPayment(%s -> %s) = %v, want %v", tt.pay.Status, tt.status, got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestRenewsSubscription(t *testing.T) {
+	pay := &domain.PaymentTransaction{PaymentID: "pay_2", PackageID: "pro-monthly"}
+	tests := []struct {
+		name string
+		ump  domain.UserMainPackage
+		want bool
+	}{
+		{name: "same package", ump: domain.UserMainPackage{SubscriptionID: "sub_pay_1", PackageID: "pro-monthly"}, want: true},
+		{name: "switch to another package", ump: domain.UserMainPackage{SubscriptionID: "sub_pay_1", PackageID: "basic-monthly"}},
+		{name: "package without a subscription", ump: domain.UserMainPackage{PackageID: "pro-monthly"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renewsSubscription(&tt.ump, pay); got != tt.want {
+				t.Errorf("renewsSubscription = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
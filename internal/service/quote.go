@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"munggonegg/credit-service-go/internal/adapter/client"
+	"munggonegg/credit-service-go/internal/core/domain"
+)
+
+var ErrInvalidQuote = errors.New("Invalid quote")
+
+// Quote estimates what a run would cost the user before it starts. The
+// model's registry prices stand in for the Portkey trace cost and each web
+// search costs WEBSEARCH_PRICE_USD; from there the charge is priced exactly
+// as SettleTokenUsage prices it, entitlement premium included. Nothing is
+// deducted or recorded.
+func (s *UsageSettler) Quote(ctx context.Context, in domain.QuoteIn) (*domain.Quote, error) {
+	if err := validateQuote(in); err != nil {
+		return nil, err
+	}
+
+	model, err := ResolveModel(ctx, in.Model)
+	if err != nil {
+		return nil, err
+	}
+	flags := []string{}
+	if !model.Enabled {
+		flags = append(flags, domain.FlagModelDisabled)
+	}
+
+	q := &domain.Quote{UserID: in.UserID, Model: in.Model, ModelID: model.ModelID}
+
+	// Members of an organization draw from its shared pool instead.
+	member, err := findOrgMember(ctx, in.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if member != nil {
+		org, err := GetOrganization(ctx, member.OrgID)
+		if err != nil {
+			return nil, err
+		}
+		q.PackageID, q.OrgID = org.PackageID, org.OrgID
+		q.Available = memberAvailable(org, member)
+	} else {
+		ump, err := activeMainPackage(ctx, in.UserID)
+		if err != nil {
+			return nil, err
+		}
+		bal, err := GetUserBalance(ctx, in.UserID)
+		if err != nil {
+			return nil, err
+		}
+		q.PackageID = ump.PackageID
+		if bal != nil {
+			q.Available = bal.RemainingTokenBalance
+		}
+	}
+
+	multiplier, entFlags, err := s.entitlements.apply(ctx, q.PackageID, model)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := findPackage(ctx, q.PackageID)
+	if err != nil {
+		return nil, err
+	}
+
+	priceQuote(q, in, model, pkg, multiplier, append(flags, entFlags...), s.websearchPrice)
+	return q, nil
+}
+
+// memberAvailable is what a member may draw from the organization's pool:
+// the pool, limited by what is left of the member's cap this period.
+func memberAvailable(org *domain.Organization, member *domain.OrgMember) int {
+	if member.Cap == nil {
+		return org.PoolBalance
+	}
+	return min(org.PoolBalance, *member.Cap-member.PeriodConsumed)
+}
+
+// priceQuote prices in with the model's registry prices and fills in the
+// cost, tokens and affordability of q, whose Available must already be
+// set. websearchPrice is the USD cost of one web search.
+func priceQuote(q *domain.Quote, in domain.QuoteIn, model *domain.ProviderModel, pkg *domain.PackageMaster, multiplier float64, flags []string, websearchPrice float64) {
+	chatCost := float64(in.PromptTokens)*model.InputPricePerToken + float64(in.CompletionTokens)*model.OutputPricePerToken
+	var websearchCost *float64
+	if in.WebsearchCount > 0 {
+		cost := float64(in.WebsearchCount) * websearchPrice
+		websearchCost = &cost
+	}
+	charge := priceUsage(&client.TraceCost{TotalCents: chatCost * 100, AIModel: in.Model}, websearchCost, pkg, multiplier)
+	charge.withModel(model, flags)
+
+	q.TotalCostUsd = fmt.Sprintf("%.6f", charge.totalCost)
+	q.ChatCostUsd = fmt.Sprintf("%.6f", charge.chatCost)
+	q.WebsearchCostUsd = fmt.Sprintf("%.6f", charge.websearchCost)
+	q.ChatToken, q.WebsearchToken, q.EggToken = -charge.chatToken, -charge.websearchToken, -charge.eggToken
+	if charge.multiplier != 1 {
+		q.PremiumMultiplier = charge.multiplier
+	}
+	if len(charge.flags) > 0 {
+		q.Flags = charge.flags
+	}
+	q.Affordable = q.Available >= q.EggToken
+	if !q.Affordable {
+		q.Shortfall = q.EggToken - q.Available
+	}
+}
+
+func validateQuote(in domain.QuoteIn) error {
+	if strings.TrimSpace(in.UserID) == "" || strings.TrimSpace(in.Model) == "" {
+		return errors.Join(ErrInvalidQuote, errors.New("userId and model are required"))
+	}
+	if in.PromptTokens < 0 || in.CompletionTokens < 0 {
+		return errors.Join(ErrInvalidQuote, errors.New("promptTokens and completionTokens must not be negative"))
+	}
+	if in.WebsearchCount < 0 {
+		return errors.Join(ErrInvalidQuote, errors.New("websearchCount must not be negative"))
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+)
+
+func TestValidateQuote(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      domain.QuoteIn
+		wantErr bool
+	}{
+		{name: "valid", in: domain.QuoteIn{UserID: "u1", Model: "gpt-4o", PromptTokens: 100, CompletionTokens: 50}},
+		{name: "with web searches", in: domain.QuoteIn{UserID: "u1", Model: "gpt-4o", WebsearchCount: 2}},
+		{name: "missing user", in: domain.QuoteIn{UserID: " ", Model: "gpt-4o"}, wantErr: true},
+		{name: "missing model", in: domain.QuoteIn{UserID: "u1"}, wantErr: true},
+		{name: "negative prompt tokens", in: domain.QuoteIn{UserID: "u1", Model: "gpt-4o", PromptTokens: -1}, wantErr: true},
+		{name: "negative completion tokens", in: domain.QuoteIn{UserID: "u1", Model: "gpt-4o", CompletionTokens: -1}, wantErr: true},
+		{name: "negative web searches", in: domain.QuoteIn{UserID: "u1", Model: "gpt-4o", WebsearchCount: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateQuote(tt.in)
+			if tt.wantErr != errors.Is(err, ErrInvalidQuote) {
+				t.Errorf("validateQuote = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemberAvailable(t *testing.T) {
+	org := &domain.Organization{OrgID: "org1", PoolBalance: 500}
+	capped := func(cap, consumed int) *domain.OrgMember {
+		return &domain.OrgMember{OrgID: "org1", Cap: &cap, PeriodConsumed: consumed}
+	}
+	tests := []struct {
+		name   string
+		member *domain.OrgMember
+		want   int
+	}{
+		{name: "no cap", member: &domain.OrgMember{OrgID: "org1", PeriodConsumed: 900}, want: 500},
+		{name: "cap above pool", member: capped(1000, 100), want: 500},
+		{name: "cap limits", member: capped(300, 100), want: 200},
+		{name: "cap used up", member: capped(300, 300), want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := memberAvailable(org, tt.member); got != tt.want {
+				t.Errorf("memberAvailable = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPriceQuote(t *testing.T) {
+	// Prices that are exact in binary, so the token amounts are too: 2048
+	// prompt tokens cost $2 (70 THB) and a web search $0.5 (17.5 THB).
+	model := &domain.ProviderModel{ModelID: "openai/gpt-4o", InputPricePerToken: 1.0 / 1024, OutputPricePerToken: 1.0 / 512}
+	pkg := &domain.PackageMaster{PackageID: "pro-monthly"}
+
+	tests := []struct {
+		name       string
+		in         domain.QuoteIn
+		available  int
+		multiplier float64
+		flags      []string
+		want       domain.Quote
+	}{
+		{
+			name:       "chat only",
+			in:         domain.QuoteIn{Model: "gpt-4o", PromptTokens: 2048},
+			available:  100,
+			multiplier: 1,
+			want: domain.Quote{
+				TotalCostUsd: "2.000000", ChatCostUsd: "2.000000", WebsearchCostUsd: "0.000000",
+				ChatToken: 70, EggToken: 70, Available: 100, Affordable: true,
+			},
+		},
+		{
+			name:       "completion priced separately",
+			in:         domain.QuoteIn{Model: "gpt-4o", PromptTokens: 1024, CompletionTokens: 512},
+			available:  70,
+			multiplier: 1,
+			want: domain.Quote{
+				TotalCostUsd: "2.000000", ChatCostUsd: "2.000000", WebsearchCostUsd: "0.000000",
+				ChatToken: 70, EggToken: 70, Available: 70, Affordable: true,
+			},
+		},
+		{
+			name:       "web searches",
+			in:         domain.QuoteIn{Model: "gpt-4o", PromptTokens: 2048, WebsearchCount: 1},
+			available:  100,
+			multiplier: 1,
+			want: domain.Quote{
+				TotalCostUsd: "2.500000", ChatCostUsd: "2.000000", WebsearchCostUsd: "0.500000",
+				ChatToken: 70, WebsearchToken: 18, EggToken: 88, Available: 100, Affordable: true,
+			},
+		},
+		{
+			name:       "premium scales the chat only",
+			in:         domain.QuoteIn{Model: "gpt-4o", PromptTokens: 2048, WebsearchCount: 1},
+			available:  200,
+			multiplier: 1.5,
+			flags:      []string{domain.FlagModelDisabled},
+			want: domain.Quote{
+				TotalCostUsd: "2.500000", ChatCostUsd: "2.000000", WebsearchCostUsd: "0.500000",
+				ChatToken: 105, WebsearchToken: 18, EggToken: 123, PremiumMultiplier: 1.5,
+				Flags: []string{domain.FlagModelDisabled}, Available: 200, Affordable: true,
+			},
+		},
+		{
+			name:       "shortfall",
+			in:         domain.QuoteIn{Model: "gpt-4o", PromptTokens: 2048, WebsearchCount: 1},
+			available:  50,
+			multiplier: 1,
+			want: domain.Quote{
+				TotalCostUsd: "2.500000", ChatCostUsd: "2.000000", WebsearchCostUsd: "0.500000",
+				ChatToken: 70, WebsearchToken: 18, EggToken: 88, Available: 50, Shortfall: 38,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &domain.Quote{Available: tt.available}
+			priceQuote(q, tt.in, model, pkg, tt.multiplier, tt.flags, 0.5)
+			if !reflect.DeepEqual(*q, tt.want) {
+				t.Errorf("quote = %+v\nwant    %+v", *q, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrUsageNotFound  = errors.New("No usage event found for traceId.")
+	ErrInvalidRefund  = errors.New("Refund amount must be positive.")
+	ErrRefundExceeds  = errors.New("Refund amount exceeds the refundable tokens.")
+	ErrRefundConflict = errors.New("A concurrent refund changed this usage event, please retry.")
+)
+
+// GetTokenUsedEvent returns the Token Used event for traceID, or nil.
+func GetTokenUsedEvent(ctx context.Context, traceID string) (*domain.UsageEventOut, error) {
+	return findTokenUsedEvent(ctx, traceID)
+}
+
+// RefundUsage appends a Refund event that gives back amount tokens of the
+// Token Used event for traceID, or everything not yet refunded when amount is
+// nil. Tokens go back to the bucket they were deducted from, main first.
+// actor is the ID of the API key that requested the refund.
+func RefundUsage(ctx context.Context, traceID string, amount *int, reason, actor string) (*domain.UsageEventOut, error) {
+	orig, err := findTokenUsedEvent(ctx, traceID)
+	if err != nil {
+		return nil, err
+	}
+	if orig == nil {
+		return nil, ErrUsageNotFound
+	}
+
+	origMain, origTopup, err := usageSplit(ctx, orig)
+	if err != nil {
+		return nil, err
+	}
+	mainRefund, topupRefund, err := planRefund(origMain, origTopup, orig.RefundedToken, amount)
+	if err != nil {
+		return nil, err
+	}
+	refund := mainRefund + topupRefund
+	before := orig.RefundedToken
+
+	// Claim the amount on the original event. Matching on the previous total
+	// makes concurrent refunds of the same trace fail instead of over-refunding.
+	uueColl := mongodb.GetCollection(config.UsageEventColl)
+	claim := bson.M{"_id": orig.ID, "refundedToken": before}
+	if before == 0 {
+		claim["refundedToken"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	res, err := uueColl.UpdateOne(ctx, claim, bson.M{"$inc": bson.M{"refundedToken": refund}})
+	if err != nil {
+		return nil, err
+	}
+	if res.ModifiedCount == 0 {
+		return nil, ErrRefundConflict
+	}
+
+	doc := domain.UsageEventOut{
+		ID:             primitive.NewObjectID(),
+		EventTimeStamp: time.Now(),
+		UserID:         orig.UserID,
+		EventType:      EvtRefund,
+		SubscriptionID: orig.SubscriptionID,
+		PackageID:      orig.PackageID,
+		EggToken:       refund,
+		MainToken:      &mainRefund,
+		TopupToken:     &topupRefund,
+		TraceID:        orig.TraceID,
+		AIModel:        orig.AIModel,
+		AgentID:        orig.AgentID,
+		OrgID:          orig.OrgID,
+		RefundOf:       &orig.ID,
+		Actor:          &actor,
+	}
+	if reason != "" {
+		doc.Reason = &reason
+	}
+
+	// The claim is already taken, so finish on a detached context.
+	bgCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := uueColl.InsertOne(bgCtx, doc); err != nil {
+		if _, undoErr := uueColl.UpdateOne(bgCtx, bson.M{"_id": orig.ID}, bson.M{"$inc": bson.M{"refundedToken": -refund}}); undoErr != nil {
+			log.Printf("Failed to release refund claim on %s: %v", orig.ID.Hex(), undoErr)
+		}
+		return nil, err
+	}
+	postEvents(bgCtx, &doc)
+
+	// Organization usage goes back to the pool it was drawn from.
+	if orig.OrgID != nil {
+		if err := applyOrgDelta(*orig.OrgID, orig.UserID, domain.OrgEventRefund, refund, orig.TraceID); err != nil {
+			return nil, err
+		}
+		return &doc, nil
+	}
+
+	update := bson.M{
+		"$inc": bson.M{
+			"totalToken":            refund,
+			"remainingTokenBalance": refund,
+			"mainTokenBalance":      mainRefund,
+			"topupTokenBalance":     topupRefund,
+			"lotsStale":             1,
+		},
+		"$set": bson.M{
+			"updatedAt": time.Now(),
+		},
+	}
+	if _, err := mongodb.GetCollection(config.UserBalanceColl).UpdateOne(bgCtx, bson.M{"userId": orig.UserID}, update); err != nil {
+		return nil, fmt.Errorf("DB update failed: %v", err)
+	}
+	publishBalance(bgCtx, orig.UserID, nil)
+
+	return &doc, nil
+}
+
+// planRefund splits a refund of amount (everything not yet refunded when
+// nil) of a charge that took origMain and origTopup, of which refunded is
+// already back. Refunds restore main first, so the split follows from the
+// running total.
+func planRefund(origMain, origTopup, refunded int, amount *int) (int, int, error) {
+	refundable := origMain + origTopup - refunded
+	refund := refundable
+	if amount != nil {
+		refund = *amount
+	}
+	if refund <= 0 {
+		if amount == nil && refundable <= 0 {
+			return 0, 0, ErrRefundExceeds
+		}
+		return 0, 0, ErrInvalidRefund
+	}
+	if refund > refundable {
+		return 0, 0, ErrRefundExceeds
+	}
+
+	after := refunded + refund
+	mainRefund := min(after, origMain) - min(refunded, origMain)
+	return mainRefund, refund - mainRefund, nil
+}
+
+// usageSplit returns how many tokens a Token Used event took from main and
+// from topup, as positive amounts. Events recorded before the split was
+// stored are resolved by replaying the user's earlier events.
+func usageSplit(ctx context.Context, ev *domain.UsageEventOut) (int, int, error) {
+	if ev.MainToken != nil && ev.TopupToken != nil {
+		return -*ev.MainToken, -*ev.TopupToken, nil
+	}
+	if ev.OrgID != nil {
+		return abs(ev.EggToken), 0, nil
+	}
+
+	filter := bson.M{"userId": ev.UserID, "eventTimeStamp": bson.M{"$lt": ev.EventTimeStamp}}
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Find(ctx, filter, options.Find().SetSort(bson.M{"eventTimeStamp": 1}))
+	if err != nil {
+		return 0, 0, err
+	}
+	var events []bson.M
+	if err := cursor.All(ctx, &events); err != nil {
+		return 0, 0, err
+	}
+
+	main, topup, _ := RollupBalances(events)
+	deduction := ev.EggToken
+	if deduction < 0 {
+		deduction = -deduction
+	}
+	mainDeduction, topupDeduction := splitDeduction(main, topup, deduction, ev.Deduction)
+	return mainDeduction, topupDeduction, nil
+}
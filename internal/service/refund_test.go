@@ -0,0 +1,45 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPlanRefund(t *testing.T) {
+	amount := func(n int) *int { return &n }
+
+	tests := []struct {
+		name      string
+		origMain  int
+		origTopup int
+		refunded  int
+		amount    *int
+		wantMain  int
+		wantTopup int
+		wantErr   error
+	}{
+		{name: "full refund", origMain: 60, origTopup: 40, wantMain: 60, wantTopup: 40},
+		{name: "partial refund restores main first", origMain: 60, origTopup: 40, amount: amount(50), wantMain: 50},
+		{name: "partial refund across buckets", origMain: 60, origTopup: 40, amount: amount(80), wantMain: 60, wantTopup: 20},
+		{name: "second partial refund continues where the first stopped", origMain: 60, origTopup: 40, refunded: 50, amount: amount(30), wantMain: 10, wantTopup: 20},
+		{name: "full refund of the rest", origMain: 60, origTopup: 40, refunded: 70, wantTopup: 30},
+		{name: "topup only charge", origTopup: 25, wantTopup: 25},
+		{name: "over-refund", origMain: 60, origTopup: 40, amount: amount(101), wantErr: ErrRefundExceeds},
+		{name: "over-refund after a partial refund", origMain: 60, origTopup: 40, refunded: 90, amount: amount(20), wantErr: ErrRefundExceeds},
+		{name: "already refunded", origMain: 60, origTopup: 40, refunded: 100, wantErr: ErrRefundExceeds},
+		{name: "already refunded with an amount", origMain: 60, origTopup: 40, refunded: 100, amount: amount(1), wantErr: ErrRefundExceeds},
+		{name: "zero amount", origMain: 60, origTopup: 40, amount: amount(0), wantErr: ErrInvalidRefund},
+		{name: "negative amount", origMain: 60, origTopup: 40, amount: amount(-5), wantErr: ErrInvalidRefund},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			main, topup, err := planRefund(tt.origMain, tt.origTopup, tt.refunded, tt.amount)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("planRefund error = %v, want %v", err, tt.wantErr)
+			}
+			if main != tt.wantMain || topup != tt.wantTopup {
+				t.Errorf("planRefund = main %d topup %d, want main %d topup %d", main, topup, tt.wantMain, tt.wantTopup)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RenewDueMainPackages starts the next period of every active main package
+// whose period has ended. Users with a due plan change are left to
+// ApplyDuePackageSchedules. A package several periods behind advances one
+// period per run.
+func RenewDueMainPackages(ctx context.Context) error {
+	cursor, err := mongodb.GetCollection(config.UserMainPackageColl).Find(ctx,
+		bson.M{"status": "A", "endDate": bson.M{"$lte": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var ump domain.UserMainPackage
+		if err := cursor.Decode(&ump); err != nil {
+			return err
+		}
+		if err := renewMainPackage(ctx, &ump); err != nil {
+			log.Printf("Renewal for user %s failed: %v", ump.UserID, err)
+		}
+	}
+	return cursor.Err()
+}
+
+// deferringSchedules matches the schedules that take over ump's renewal:
+// those still to apply that fall due by the end of its period. The
+// schedule worker starts the next period for them instead.
+func deferringSchedules(ump *domain.UserMainPackage) bson.M {
+	return bson.M{
+		"userId":      ump.UserID,
+		"status":      bson.M{"$in": bson.A{domain.SchedulePending, domain.ScheduleApplying}},
+		"effectiveAt": bson.M{"$lte": ump.EndDate},
+	}
+}
+
+// renewMainPackage emits the renewal events for the period starting at
+// ump.EndDate and then advances the package. Events are keyed by user, type
+// and period, and the rollover is decided once and saved with the package,
+// so a renewal interrupted before the period moved is safe to retry. A
+// subscription started by a payment renews only on a recurring payment for
+// the period, which is recorded on its Subscribe event; without one it
+// lapses, and a later payment starts a new subscription.
+func renewMainPackage(ctx context.Context, ump *domain.UserMainPackage) error {
+	n, err := mongodb.GetCollection(config.PackageScheduleColl).CountDocuments(ctx, deferringSchedules(ump))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	period := ump.EndDate
+	pay, err := periodPayment(ctx, ump.UserID, period)
+	if err != nil {
+		return err
+	}
+	if pay == nil {
+		billed, err := billedSubscription(ctx, ump)
+		if err != nil {
+			return err
+		}
+		if billed {
+			return lapseMainPackage(ctx, ump)
+		}
+	}
+
+	pkg, err := findPackage(ctx, ump.PackageID)
+	if err != nil {
+		return err
+	}
+	if pkg.ValidityDays <= 0 {
+		return fmt.Errorf("package %s has no validity period", pkg.PackageID)
+	}
+
+	plan, err := planRenewal(ctx, ump, pkg)
+	if err != nil {
+		return err
+	}
+
+	end := period.AddDate(0, 0, pkg.ValidityDays)
+	now := time.Now()
+
+	var paymentID *string
+	if pay != nil {
+		// Recorded before the grant, so a revoke always knows how much
+		// the payment gave.
+		_, err := mongodb.GetCollection(config.PaymentColl).UpdateOne(ctx,
+			bson.M{"paymentId": pay.PaymentID},
+			bson.M{"$set": bson.M{"eggToken": pkg.EggToken, "updatedAt": now}},
+		)
+		if err != nil {
+			return err
+		}
+		paymentID = &pay.PaymentID
+	}
+
+	if plan.Forfeited > 0 {
+		if err := insertRenewalEvent(ctx, ump, EvtMainExpired, pkg, -plan.Forfeited, period, now, nil, nil); err != nil {
+			return err
+		}
+	}
+	if plan.Carried > 0 {
+		if err := insertRenewalEvent(ctx, ump, EvtRollover, pkg, plan.Carried, period, now.Add(time.Millisecond), &end, nil); err != nil {
+			return err
+		}
+	}
+	if err := insertRenewalEvent(ctx, ump, EvtSubscribe, pkg, pkg.EggToken, period, now.Add(2*time.Millisecond), &end, paymentID); err != nil {
+		return err
+	}
+
+	res, err := mongodb.GetCollection(config.UserMainPackageColl).UpdateOne(ctx,
+		bson.M{"userId": ump.UserID, "status": "A", "endDate": ump.EndDate},
+		bson.M{
+			"$set": bson.M{
+				"startDate": period,
+				"endDate":   end,
+				"updatedAt": now,
+			},
+			"$unset": bson.M{"renewal": ""},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.New("main package changed during renewal")
+	}
+
+	_, err = RecomputeAndUpsertUserBalance(ctx, ump.UserID)
+	return err
+}
+
+// planRenewal returns the rollover for the period starting at ump.EndDate:
+// the one saved by an earlier attempt, or a new one worked out from the
+// balance before any of the period's events and saved before they are.
+func planRenewal(ctx context.Context, ump *domain.UserMainPackage, pkg *domain.PackageMaster) (domain.RenewalPlan, error) {
+	period := ump.EndDate
+	if ump.Renewal != nil && ump.Renewal.Period.Equal(period) {
+		return *ump.Renewal, nil
+	}
+
+	replayed, err := replayUserBalance(ctx, ump.UserID)
+	if err != nil {
+		return domain.RenewalPlan{}, err
+	}
+	plan := newRenewalPlan(pkg.Rollover, replayed.Main, period)
+
+	coll := mongodb.GetCollection(config.UserMainPackageColl)
+	res, err := coll.UpdateOne(ctx,
+		bson.M{"userId": ump.UserID, "status": "A", "endDate": period, "renewal.period": bson.M{"$ne": period}},
+		bson.M{"$set": bson.M{"renewal": plan}},
+	)
+	if err != nil {
+		return domain.RenewalPlan{}, err
+	}
+	if res.MatchedCount > 0 {
+		return plan, nil
+	}
+
+	// Another run saved its plan first; use that one.
+	var current domain.UserMainPackage
+	if err := coll.FindOne(ctx, bson.M{"userId": ump.UserID}).Decode(&current); err != nil {
+		return domain.RenewalPlan{}, err
+	}
+	if current.Status != "A" || !current.EndDate.Equal(period) || current.Renewal == nil || !current.Renewal.Period.Equal(period) {
+		return domain.RenewalPlan{}, errors.New("main package changed during renewal")
+	}
+	return *current.Renewal, nil
+}
+
+// newRenewalPlan splits the unused main balance with the rollover policy.
+func newRenewalPlan(policy *domain.RolloverPolicy, main int, period time.Time) domain.RenewalPlan {
+	carried := rolloverAmount(policy, main)
+	return domain.RenewalPlan{Period: period, Carried: carried, Forfeited: max(main-carried, 0)}
+}
+
+// billedSubscription reports whether the user's package is a subscription
+// started by a payment, which needs a payment for every period. Packages
+// without a subscription record, such as those set up by admins or older
+// versions, renew without one.
+func billedSubscription(ctx context.Context, ump *domain.UserMainPackage) (bool, error) {
+	if ump.SubscriptionID == "" {
+		return false, nil
+	}
+	n, err := mongodb.GetCollection(config.SubsColl).CountDocuments(ctx, bson.M{"subscriptionId": ump.SubscriptionID})
+	return n > 0, err
+}
+
+// periodPayment returns the recurring payment that pays for the period
+// starting at period, or nil when none has succeeded.
+func periodPayment(ctx context.Context, userID string, period time.Time) (*domain.PaymentTransaction, error) {
+	var pay domain.PaymentTransaction
+	err := mongodb.GetCollection(config.PaymentColl).FindOne(ctx, bson.M{
+		"userId":        userID,
+		"renewalPeriod": period,
+		"status":        domain.PaymentStatusSucceeded,
+		"revokedAt":     bson.M{"$exists": false},
+	}).Decode(&pay)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pay, nil
+}
+
+// lapseMainPackage ends a main package that is not renewed, along with its
+// subscription. What is left of its lots is expired by the credit lot
+// worker.
+func lapseMainPackage(ctx context.Context, ump *domain.UserMainPackage) error {
+	log.Printf("Main package of user %s lapses: subscription %s has no payment for the period from %s",
+		ump.UserID, ump.SubscriptionID, ump.EndDate.Format(time.RFC3339))
+	now := time.Now()
+	res, err := mongodb.GetCollection(config.UserMainPackageColl).UpdateOne(ctx,
+		bson.M{"userId": ump.UserID, "status": "A", "endDate": ump.EndDate},
+		bson.M{"$set": bson.M{"status": "C", "updatedAt": now}},
+	)
+	if err != nil || res.MatchedCount == 0 {
+		return err
+	}
+	_, err = mongodb.GetCollection(config.SubsColl).UpdateOne(ctx,
+		bson.M{"subscriptionId": ump.SubscriptionID},
+		bson.M{"$set": bson.M{"status": "C", "updatedAt": now}},
+	)
+	return err
+}
+
+// rolloverAmount is how much of the unused main balance the policy carries.
+func rolloverAmount(policy *domain.RolloverPolicy, main int) int {
+	if policy == nil || main <= 0 {
+		return 0
+	}
+	switch policy.Mode {
+	case domain.RolloverFull:
+		return main
+	case domain.RolloverCap:
+		return min(main, policy.Cap)
+	case domain.RolloverPercent:
+		return int(math.Floor(float64(main) * policy.Percent / 100))
+	default:
+		return 0
+	}
+}
+
+func insertRenewalEvent(ctx context.Context, ump *domain.UserMainPackage, eventType string, pkg *domain.PackageMaster, eggToken int, period, at time.Time, expiresAt *time.Time, paymentID *string) error {
+	version := pkg.Version
+	doc := domain.UsageEventOut{
+		ID:             primitive.NewObjectID(),
+		EventTimeStamp: at,
+		UserID:         ump.UserID,
+		EventType:      eventType,
+		SubscriptionID: &ump.SubscriptionID,
+		PackageID:      &pkg.PackageID,
+		PackageVersion: &version,
+		EggToken:       eggToken,
+		RenewalPeriod:  &period,
+		ExpiresAt:      expiresAt,
+		PaymentID:      paymentID,
+	}
+	_, err := mongodb.GetCollection(config.UsageEventColl).InsertOne(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("insert %s event: %w", eventType, err)
+	}
+	postEvents(ctx, &doc)
+	return nil
+}
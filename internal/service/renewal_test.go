@@ -0,0 +1,36 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+)
+
+func TestNewRenewalPlan(t *testing.T) {
+	period := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		policy        *domain.RolloverPolicy
+		main          int
+		wantCarried   int
+		wantForfeited int
+	}{
+		{name: "no policy forfeits everything", main: 300, wantForfeited: 300},
+		{name: "full carries everything", policy: &domain.RolloverPolicy{Mode: domain.RolloverFull}, main: 300, wantCarried: 300},
+		{name: "cap", policy: &domain.RolloverPolicy{Mode: domain.RolloverCap, Cap: 100}, main: 300, wantCarried: 100, wantForfeited: 200},
+		{name: "cap above the balance", policy: &domain.RolloverPolicy{Mode: domain.RolloverCap, Cap: 500}, main: 300, wantCarried: 300},
+		{name: "percent rounds down", policy: &domain.RolloverPolicy{Mode: domain.RolloverPercent, Percent: 50}, main: 301, wantCarried: 150, wantForfeited: 151},
+		{name: "nothing left", policy: &domain.RolloverPolicy{Mode: domain.RolloverFull}, main: 0},
+		{name: "negative main forfeits nothing", main: -20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := newRenewalPlan(tt.policy, tt.main, period)
+			if plan.Carried != tt.wantCarried || plan.Forfeited != tt.wantForfeited || !plan.Period.Equal(period) {
+				t.Errorf("plan = %+v, want carried %d forfeited %d", plan, tt.wantCarried, tt.wantForfeited)
+			}
+		})
+	}
+}
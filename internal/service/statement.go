@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrInvalidMonth = errors.New("Month must be in YYYY-MM format")
+
+// BuildStatement summarises a user's events for one calendar month (UTC).
+// Amounts are replayed with the same rules as RollupBalances, so a charge
+// that could only partly be covered shows what was actually deducted.
+// Building a statement only reads: malformed events are left out without
+// being quarantined.
+func BuildStatement(ctx context.Context, userID, month string) (*domain.Statement, error) {
+	start, err := time.Parse("2006-01", month)
+	if err != nil {
+		return nil, ErrInvalidMonth
+	}
+	end := start.AddDate(0, 1, 0)
+
+	events, err := loadUserEvents(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	prices := newThbPricer(ctx, userID)
+
+	st := &domain.Statement{
+		UserID:        userID,
+		Month:         month,
+		PeriodStart:   start,
+		PeriodEnd:     end,
+		Subscriptions: []domain.StatementLine{},
+		Topups:        []domain.StatementLine{},
+		Usage:         []domain.StatementUsage{},
+		Expiries:      []domain.StatementLine{},
+		GeneratedAt:   time.Now(),
+	}
+
+	type usageKey struct{ model, agent string }
+	usage := map[usageKey]*domain.StatementUsage{}
+
+	var r domain.Balance
+	opened := false
+	for _, raw := range events {
+		at := eventTime(raw)
+		if !at.Before(end) {
+			break
+		}
+		if !opened && !at.Before(start) {
+			st.Opening = prices.balance(r)
+			opened = true
+		}
+
+		ev, err := DecodeLedgerEvent(raw)
+		if err != nil || !ev.AffectsBalance() {
+			continue
+		}
+		before := r.Total()
+		r = r.Apply(ev)
+		if at.Before(start) {
+			continue
+		}
+		amount := prices.amount(raw, r.Total()-before)
+
+		eventType := string(ev.Type)
+		packageID, _ := raw["packageId"].(string)
+		line := domain.StatementLine{Date: at, EventType: eventType, PackageID: packageID, StatementAmount: amount}
+
+		switch eventType {
+		case EvtSubscribe:
+			st.Subscriptions = append(st.Subscriptions, line)
+		case EvtTopup:
+			st.Topups = append(st.Topups, line)
+		case EvtTokenUsed:
+			key := usageKey{model: usageModel(raw)}
+			key.agent, _ = raw["agentId"].(string)
+			u, ok := usage[key]
+			if !ok {
+				u = &domain.StatementUsage{AIModel: key.model, AgentID: key.agent}
+				usage[key] = u
+			}
+			addAmount(&u.StatementAmount, amount)
+		case EvtRefund:
+			addAmount(&st.Refunds, amount)
+		case EvtGrant, EvtAdjustment:
+			addAmount(&st.Adjustments, amount)
+		default:
+			st.Expiries = append(st.Expiries, line)
+		}
+	}
+	if !opened {
+		st.Opening = prices.balance(r)
+	}
+	st.Closing = prices.balance(r)
+
+	for _, u := range usage {
+		st.Usage = append(st.Usage, *u)
+	}
+	sort.Slice(st.Usage, func(i, j int) bool {
+		if st.Usage[i].AIModel != st.Usage[j].AIModel {
+			return st.Usage[i].AIModel < st.Usage[j].AIModel
+		}
+		return st.Usage[i].AgentID < st.Usage[j].AgentID
+	})
+	return st, nil
+}
+
+func addAmount(total *domain.StatementAmount, a domain.StatementAmount) {
+	total.Count += a.Count
+	total.EggToken += a.EggToken
+	total.Thb = roundThb(total.Thb + a.Thb)
+}
+
+func usageModel(ev bson.M) string {
+	if id, _ := ev["modelId"].(string); id != "" {
+		return id
+	}
+	if m, _ := ev["aiModel"].(string); m != "" {
+		return m
+	}
+	return "unknown"
+}
+
+func eventTime(ev bson.M) time.Time {
+	switch v := ev["eventTimeStamp"].(type) {
+	case primitive.DateTime:
+		return v.Time().UTC()
+	case time.Time:
+		return v.UTC()
+	}
+	return time.Time{}
+}
+
+func roundThb(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// thbPricer values egg tokens in THB at the price of the package version
+// they were issued under, falling back to the package's current terms for
+// events that record no version and to the user's current main package for
+// events without a package.
+type thbPricer struct {
+	ctx      context.Context
+	fallback float64
+	packages map[packagePriceKey]float64
+}
+
+type packagePriceKey struct {
+	packageID string
+	version   int
+	versioned bool
+}
+
+func newThbPricer(ctx context.Context, userID string) *thbPricer {
+	p := &thbPricer{ctx: ctx, fallback: 1, packages: map[packagePriceKey]float64{}}
+	if ump, err := activeMainPackage(ctx, userID); err == nil {
+		p.fallback = p.price(packagePriceKey{packageID: ump.PackageID})
+	}
+	return p
+}
+
+func (p *thbPricer) price(key packagePriceKey) float64 {
+	if key.packageID == "" {
+		return p.fallback
+	}
+	if v, ok := p.packages[key]; ok {
+		return v
+	}
+	v := p.fallback
+	if key.versioned {
+		if pv, err := GetPackageVersion(p.ctx, key.packageID, key.version); err == nil {
+			v = eggThbPrice(&pv.PackageMaster)
+		} else {
+			v = p.price(packagePriceKey{packageID: key.packageID})
+		}
+	} else if pkg, err := findPackage(p.ctx, key.packageID); err == nil {
+		v = eggThbPrice(pkg)
+	}
+	p.packages[key] = v
+	return v
+}
+
+func (p *thbPricer) amount(ev bson.M, tokens int) domain.StatementAmount {
+	return domain.StatementAmount{Count: 1, EggToken: tokens, Thb: roundThb(float64(tokens) * p.price(eventPriceKey(ev)))}
+}
+
+// eventPriceKey is the package and version an event was issued under.
+// Packages never edited have no history, so their current terms are used.
+func eventPriceKey(ev bson.M) packagePriceKey {
+	key := packagePriceKey{}
+	key.packageID, _ = ev["packageId"].(string)
+	if v, ok := ev["packageVersion"]; ok && v != nil {
+		if n, err := ledgerInt(v); err == nil {
+			key.version, key.versioned = n, true
+		}
+	}
+	return key
+}
+
+func (p *thbPricer) balance(r domain.Balance) domain.StatementBalance {
+	total := r.Total()
+	return domain.StatementBalance{
+		MainToken:  r.Main,
+		TopupToken: r.Topup,
+		EggToken:   total,
+		Thb:        roundThb(float64(total) * p.fallback),
+	}
+}
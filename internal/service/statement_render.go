@@ -0,0 +1,135 @@
+package service
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// statementRow is one line of a rendered statement, shared by the CSV and
+// PDF layouts.
+type statementRow struct {
+	section     string
+	date        string
+	description string
+	count       string
+	eggToken    int
+	thb         float64
+}
+
+func statementRows(st *domain.Statement) []statementRow {
+	balance := func(section string, b domain.StatementBalance) statementRow {
+		return statementRow{
+			section:     section,
+			description: fmt.Sprintf("main %d, topup %d", b.MainToken, b.TopupToken),
+			eggToken:    b.EggToken,
+			thb:         b.Thb,
+		}
+	}
+	line := func(section string, l domain.StatementLine) statementRow {
+		return statementRow{
+			section:     section,
+			date:        l.Date.Format("2006-01-02"),
+			description: l.PackageID,
+			count:       strconv.Itoa(l.Count),
+			eggToken:    l.EggToken,
+			thb:         l.Thb,
+		}
+	}
+
+	rows := []statementRow{balance("Opening balance", st.Opening)}
+	for _, l := range st.Subscriptions {
+		rows = append(rows, line("Subscription", l))
+	}
+	for _, l := range st.Topups {
+		rows = append(rows, line("Topup", l))
+	}
+	for _, u := range st.Usage {
+		desc := u.AIModel
+		if u.AgentID != "" {
+			desc += " / " + u.AgentID
+		}
+		rows = append(rows, statementRow{section: "Usage", description: desc, count: strconv.Itoa(u.Count), eggToken: u.EggToken, thb: u.Thb})
+	}
+	if st.Refunds.Count > 0 {
+		rows = append(rows, statementRow{section: "Refunds", count: strconv.Itoa(st.Refunds.Count), eggToken: st.Refunds.EggToken, thb: st.Refunds.Thb})
+	}
+	if st.Adjustments.Count > 0 {
+		rows = append(rows, statementRow{section: "Adjustments", count: strconv.Itoa(st.Adjustments.Count), eggToken: st.Adjustments.EggToken, thb: st.Adjustments.Thb})
+	}
+	for _, l := range st.Expiries {
+		r := line("Expiry", l)
+		r.description = l.EventType
+		rows = append(rows, r)
+	}
+	return append(rows, balance("Closing balance", st.Closing))
+}
+
+// WriteStatementCSV renders st as CSV, one row per statement line.
+func WriteStatementCSV(w io.Writer, st *domain.Statement) error {
+	cw := csv.NewWriter(w)
+	records := [][]string{
+		{"userId", st.UserID},
+		{"month", st.Month},
+		{},
+		{"section", "date", "description", "count", "egg_token", "thb"},
+	}
+	for _, r := range statementRows(st) {
+		records = append(records, []string{
+			r.section, r.date, r.description, r.count,
+			strconv.Itoa(r.eggToken), strconv.FormatFloat(r.thb, 'f', 2, 64),
+		})
+	}
+	if err := cw.WriteAll(records); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// WriteStatementPDF renders st as a single-table A4 PDF.
+func WriteStatementPDF(w io.Writer, st *domain.Statement) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle("Statement "+st.Month, false)
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.Cell(0, 10, "Monthly Statement")
+	pdf.Ln(10)
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.Cell(0, 6, "User: "+st.UserID)
+	pdf.Ln(6)
+	pdf.Cell(0, 6, fmt.Sprintf("Period: %s to %s (UTC)", st.PeriodStart.Format("2006-01-02"), st.PeriodEnd.AddDate(0, 0, -1).Format("2006-01-02")))
+	pdf.Ln(10)
+
+	widths := []float64{32, 22, 66, 14, 28, 28}
+	header := []string{"Section", "Date", "Description", "Count", "Egg tokens", "THB"}
+	pdf.SetFont("Helvetica", "B", 9)
+	for i, h := range header {
+		align := "L"
+		if i >= 3 {
+			align = "R"
+		}
+		pdf.CellFormat(widths[i], 7, h, "B", 0, align, false, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Helvetica", "", 9)
+	for _, r := range statementRows(st) {
+		cells := []string{r.section, r.date, r.description, r.count, strconv.Itoa(r.eggToken), strconv.FormatFloat(r.thb, 'f', 2, 64)}
+		for i, c := range cells {
+			align := "L"
+			if i >= 3 {
+				align = "R"
+			}
+			pdf.CellFormat(widths[i], 6, c, "", 0, align, false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+
+	return pdf.Output(w)
+}
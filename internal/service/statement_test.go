@@ -0,0 +1,29 @@
+package service
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestEventPriceKey(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   bson.M
+		want packagePriceKey
+	}{
+		{name: "no package", ev: bson.M{}, want: packagePriceKey{}},
+		{name: "package without a version", ev: bson.M{"packageId": "pro"}, want: packagePriceKey{packageID: "pro"}},
+		{name: "versioned package", ev: bson.M{"packageId": "pro", "packageVersion": int32(3)}, want: packagePriceKey{packageID: "pro", version: 3, versioned: true}},
+		{name: "version 0 predates the history", ev: bson.M{"packageId": "pro", "packageVersion": int64(0)}, want: packagePriceKey{packageID: "pro", versioned: true}},
+		{name: "malformed version", ev: bson.M{"packageId": "pro", "packageVersion": "latest"}, want: packagePriceKey{packageID: "pro"}},
+		{name: "null version", ev: bson.M{"packageId": "pro", "packageVersion": nil}, want: packagePriceKey{packageID: "pro"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := eventPriceKey(tt.ev); got != tt.want {
+				t.Errorf("key = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/client"
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	TxnSuccess   = "Success"
+	TxnDuplicate = "Duplicate"
+)
+
+var (
+	ErrNoMainPackage   = errors.New("User has no main package.")
+	ErrNoTokenBalance  = errors.New("No token balance remaining.")
+	ErrPackageNotFound = errors.New("Package not found")
+
+	errDuplicateUsage = errors.New("usage already recorded for traceId")
+)
+
+// usageCharge is the priced cost of one trace. Token amounts are negative,
+// matching how deductions are stored on usage events.
+type usageCharge struct {
+	aiModel        string
+	modelID        string
+	flags          []string
+	totalCost      float64
+	chatCost       float64
+	websearchCost  float64
+	eggToken       int
+	chatToken      int
+	websearchToken int
+	multiplier     float64
+}
+
+// UsageSettler prices Portkey traces and settles them against user balances.
+type UsageSettler struct {
+	portkey      *client.PortkeyClient
+	entitlements EntitlementPolicy
+	// websearchPrice is the USD estimate of one web search in quotes.
+	websearchPrice float64
+}
+
+func NewUsageSettler(cfg *config.Config, portkey *client.PortkeyClient) *UsageSettler {
+	return &UsageSettler{
+		portkey: portkey,
+		entitlements: EntitlementPolicy{
+			Mode:              cfg.EntitlementMode,
+			PremiumMultiplier: cfg.EntitlementPremiumMultiplier,
+		},
+		websearchPrice: cfg.WebsearchPriceUSD,
+	}
+}
+
+// SettleTokenUsage prices a Portkey trace, deducts the egg tokens from the
+// user's balance and records the usage event. Settling a traceId that was
+// already recorded returns the original charge with a Duplicate status.
+func (s *UsageSettler) SettleTokenUsage(ctx context.Context, payload domain.TokenUsedIn) (*domain.TokenUsedResponse, error) {
+	if existing, err := findTokenUsedEvent(ctx, payload.TraceID); err != nil {
+		return nil, err
+	} else if existing != nil {
+		return tokenUsedResponse(existing, TxnDuplicate), nil
+	}
+
+	// Members of an organization draw from its shared pool instead.
+	member, err := findOrgMember(ctx, payload.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if member != nil {
+		return s.settleOrgUsage(ctx, payload, member)
+	}
+
+	// 1. Parallel Fetching: UserMainPackage and UserBalance
+	ump, bal, err := loadUsageAccount(ctx, payload.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if balance is positive
+	if bal.RemainingTokenBalance <= 0 {
+		return nil, ErrNoTokenBalance
+	}
+
+	// 2. Call Portkey
+	cost, err := s.portkey.FetchTraceCost(ctx, payload.TraceID)
+	if err != nil {
+		return nil, err
+	}
+	model, flags, err := resolveChargeModel(ctx, cost.AIModel)
+	if err != nil {
+		return nil, err
+	}
+	multiplier, entFlags, err := s.entitlements.apply(ctx, ump.PackageID, model)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. Fetch Package Master (for conversion ratio)
+	pkg, err := findPackage(ctx, ump.PackageID)
+	if err != nil {
+		return nil, err
+	}
+	charge := priceUsage(cost, payload.WebsearchCost, pkg, multiplier)
+	charge.withModel(model, append(flags, entFlags...))
+
+	// 4. Calculate Split (Main vs Topup) with the package's strategy
+	policy, err := resolveDeduction(ctx, pkg, ump)
+	if err != nil {
+		return nil, err
+	}
+	mainDeduction, topupDeduction := splitDeduction(bal.MainTokenBalance, bal.TopupTokenBalance, -charge.eggToken, policy)
+
+	// 5. Record the event first; the unique traceId index makes concurrent
+	// retries of the same trace settle exactly once.
+	doc := newTokenUsedEvent(payload, ump.SubscriptionID, pkg, charge, mainDeduction, topupDeduction, policy)
+	if err := insertTokenUsedEvent(ctx, &doc); err != nil {
+		if errors.Is(err, errDuplicateUsage) {
+			existing, findErr := findTokenUsedEvent(ctx, payload.TraceID)
+			if findErr != nil || existing == nil {
+				return nil, err
+			}
+			return tokenUsedResponse(existing, TxnDuplicate), nil
+		}
+		return nil, err
+	}
+
+	// 6. Atomic Update
+	// If the user's balance changed concurrently, this update will still apply the deduction.
+	// This might cause main/topup to go slightly negative if they were near 0, but Total/Remaining will be correct relative to usage.
+	if err := applyDeduction(payload.UserID, []primitive.ObjectID{doc.ID}, charge.eggToken, mainDeduction, topupDeduction); err != nil {
+		return nil, err
+	}
+
+	// 7. Return simplified response
+	return tokenUsedResponse(&doc, TxnSuccess), nil
+}
+
+func loadUsageAccount(ctx context.Context, userID string) (*domain.UserMainPackage, *domain.UserBalance, error) {
+	balColl := mongodb.GetCollection(config.UserBalanceColl)
+
+	var ump *domain.UserMainPackage
+	var bal domain.UserBalance
+
+	g, gCtx := errgroup.WithContext(ctx)
+
+	// Fetch the active Main Package; a lapsed or cancelled one is not charged
+	g.Go(func() (err error) {
+		ump, err = activeMainPackage(gCtx, userID)
+		return err
+	})
+
+	// Fetch Balance
+	g.Go(func() error {
+		if err := balColl.FindOne(gCtx, bson.M{"userId": userID}).Decode(&bal); err != nil {
+			return ErrNoTokenBalance
+		}
+		return nil
+	})
+
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+	return ump, &bal, nil
+}
+
+func findPackage(ctx context.Context, packageID string) (*domain.PackageMaster, error) {
+	var pkg domain.PackageMaster
+	err := mongodb.GetCollection(config.PackageMasterV3Coll).FindOne(ctx, bson.M{"packageId": packageID}).Decode(&pkg)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrPackageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pkg, nil
+}
+
+// eggThbPrice is the THB price of one egg token under pkg.
+func eggThbPrice(pkg *domain.PackageMaster) float64 {
+	if pkg.ConversionRatio == 0 {
+		return 1.0
+	}
+	return pkg.ConversionRatio
+}
+
+// priceUsage converts a trace's USD cost into egg tokens. multiplier scales
+// the chat (model) portion, e.g. the premium for a model outside the
+// user's entitlements; it is 1 for normal charges.
+func priceUsage(cost *client.TraceCost, websearchCost *float64, pkg *domain.PackageMaster, multiplier float64) usageCharge {
+	price := eggThbPrice(pkg)
+
+	ch := usageCharge{
+		aiModel:    cost.AIModel,
+		chatCost:   cost.TotalCents / 100.0,
+		multiplier: multiplier,
+	}
+	if websearchCost != nil {
+		ch.websearchCost = *websearchCost
+	}
+
+	ch.totalCost = ch.chatCost + ch.websearchCost
+	thb := (ch.chatCost*multiplier + ch.websearchCost) * config.ThbPerUsd
+	ch.eggToken = -int(math.Ceil(thb / price)) // Negative for deduction
+
+	ch.chatToken = -int(math.Ceil((ch.chatCost * multiplier * config.ThbPerUsd) / price))
+	if ch.websearchCost > 0 {
+		ch.websearchToken = -int(math.Ceil((ch.websearchCost * config.ThbPerUsd) / price))
+	}
+	return ch
+}
+
+// withModel records the registry resolution of the charged model.
+func (ch *usageCharge) withModel(model *domain.ProviderModel, flags []string) {
+	if model != nil {
+		ch.modelID = model.ModelID
+	}
+	ch.flags = append(ch.flags, flags...)
+}
+
+// splitDeduction splits a charge between main and topup with the same
+// strategy replays use, so the stored split matches the rollup.
+func splitDeduction(currentMain, currentTopup, deduction int, policy *domain.DeductionPolicy) (mainDeduction, topupDeduction int) {
+	d := policy.Resolve().Split(domain.Balance{Main: currentMain, Topup: currentTopup}, deduction)
+	return d.Main, d.Topup
+}
+
+// resolveDeduction returns the package's deduction policy for this user,
+// with the user's active lots in drawing order, and the earliest lot expiry
+// of each bucket, filled in when the strategy needs them. The result is
+// stored on the event so replays split it the same way.
+func resolveDeduction(ctx context.Context, pkg *domain.PackageMaster, ump *domain.UserMainPackage) (*domain.DeductionPolicy, error) {
+	if pkg.Deduction == nil {
+		return nil, nil
+	}
+	policy := *pkg.Deduction
+	if policy.Strategy != domain.DeductEarliestExpiring {
+		return &policy, nil
+	}
+
+	lots, err := activeCreditLots(ctx, ump.UserID)
+	if err != nil {
+		return nil, err
+	}
+	policy.Runs = domain.LotRuns(lots)
+	for _, lot := range lots {
+		if lot.ExpiresAt == nil {
+			continue
+		}
+		earliest := &policy.MainExpiresAt
+		if lot.Bucket == domain.BucketTopup {
+			earliest = &policy.TopupExpiresAt
+		}
+		if *earliest == nil || lot.ExpiresAt.Before(**earliest) {
+			*earliest = lot.ExpiresAt
+		}
+	}
+	return &policy, nil
+}
+
+func newTokenUsedEvent(payload domain.TokenUsedIn, subscriptionID string, pkg *domain.PackageMaster, ch usageCharge, mainDeduction, topupDeduction int, policy *domain.DeductionPolicy) domain.UsageEventOut {
+	pkgIDStr := pkg.PackageID
+	pkgVersion := pkg.Version
+	traceID := payload.TraceID
+	aiModel := ch.aiModel
+	chatToken := ch.chatToken
+	websearchToken := ch.websearchToken
+	mainToken := -mainDeduction
+	topupToken := -topupDeduction
+
+	// Convert float64 to Decimal128
+	totalCostDec, _ := primitive.ParseDecimal128(fmt.Sprintf("%.6f", ch.totalCost))
+	chatCostDec, _ := primitive.ParseDecimal128(fmt.Sprintf("%.6f", ch.chatCost))
+	websearchCostDec, _ := primitive.ParseDecimal128(fmt.Sprintf("%.6f", ch.websearchCost))
+
+	ev := domain.UsageEventOut{
+		ID:               primitive.NewObjectID(),
+		EventTimeStamp:   time.Now(),
+		UserID:           payload.UserID,
+		EventType:        EvtTokenUsed,
+		PackageID:        &pkgIDStr,
+		PackageVersion:   &pkgVersion,
+		EggToken:         ch.eggToken,
+		MainToken:        &mainToken,
+		TopupToken:       &topupToken,
+		Deduction:        policy,
+		ChatToken:        &chatToken,
+		WebsearchToken:   &websearchToken,
+		TotalCostUSD:     &totalCostDec,
+		ChatCostUSD:      &chatCostDec,
+		WebsearchCostUSD: &websearchCostDec,
+		TraceID:          &traceID,
+		AIModel:          &aiModel,
+		AgentID:          payload.AgentID,
+		Flags:            ch.flags,
+	}
+	if subscriptionID != "" {
+		ev.SubscriptionID = &subscriptionID
+	}
+	if ch.modelID != "" {
+		modelID := ch.modelID
+		ev.ModelID = &modelID
+	}
+	if ch.multiplier != 1 {
+		multiplier := ch.multiplier
+		ev.PremiumMultiplier = &multiplier
+	}
+	return ev
+}
+
+func findTokenUsedEvent(ctx context.Context, traceID string) (*domain.UsageEventOut, error) {
+	var ev domain.UsageEventOut
+	err := mongodb.GetCollection(config.UsageEventColl).
+		FindOne(ctx, bson.M{"traceId": traceID, "eventType": EvtTokenUsed}).
+		Decode(&ev)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+func insertTokenUsedEvent(ctx context.Context, doc *domain.UsageEventOut) error {
+	_, err := mongodb.GetCollection(config.UsageEventColl).InsertOne(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return errDuplicateUsage
+	}
+	if err != nil {
+		return err
+	}
+	postEvents(ctx, doc)
+	return nil
+}
+
+// applyDeduction decrements the user's balance. The usage events have already
+// been written, so the update runs on a detached context to complete even if
+// the client disconnects; if it fails the events are removed again so the
+// traces can be retried.
+func applyDeduction(userID string, eventIDs []primitive.ObjectID, eggToken, mainDeduction, topupDeduction int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$inc": bson.M{
+			"totalToken":            eggToken,
+			"remainingTokenBalance": eggToken,
+			"mainTokenBalance":      -mainDeduction,
+			"topupTokenBalance":     -topupDeduction,
+			"lotsStale":             1,
+		},
+		"$set": bson.M{
+			"updatedAt": time.Now(),
+		},
+	}
+
+	_, err := mongodb.GetCollection(config.UserBalanceColl).UpdateOne(ctx, bson.M{"userId": userID}, update)
+	if err == nil {
+		publishBalance(ctx, userID, nil)
+		return nil
+	}
+
+	if _, delErr := mongodb.GetCollection(config.UsageEventColl).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": eventIDs}}); delErr != nil {
+		return fmt.Errorf("DB update failed: %v (usage events not rolled back: %v)", err, delErr)
+	}
+	unpostEvents(ctx, eventIDs)
+	return fmt.Errorf("DB update failed: %v", err)
+}
+
+func tokenUsedResponse(ev *domain.UsageEventOut, status string) *domain.TokenUsedResponse {
+	resp := &domain.TokenUsedResponse{
+		TotalToken:        ev.EggToken,
+		TransactionStatus: status,
+	}
+	if ev.TraceID != nil {
+		resp.TraceID = *ev.TraceID
+	}
+	if ev.TotalCostUSD != nil {
+		resp.TotalCostUsd = ev.TotalCostUSD.String()
+	}
+	if ev.ModelID != nil {
+		resp.ModelID = *ev.ModelID
+	}
+	resp.Flags = ev.Flags
+	return resp
+}
@@ -0,0 +1,274 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"munggonegg/credit-service-go/internal/adapter/client"
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/sync/errgroup"
+)
+
+var ErrDuplicateInBatch = errors.New("traceId appears more than once in the batch")
+
+// BatchResult is the outcome of one batch item. Exactly one of Response and
+// Err is set.
+type BatchResult struct {
+	Item     domain.TokenUsedIn
+	Response *domain.TokenUsedResponse
+	Err      error
+}
+
+type batchItem struct {
+	index int
+	in    domain.TokenUsedIn
+	cost  *client.TraceCost
+	model *domain.ProviderModel
+	flags []string
+	// multiplier is the entitlement premium, resolved once the account is known.
+	multiplier float64
+	charge     usageCharge
+	event      domain.UsageEventOut
+}
+
+type batchAccount struct {
+	// member is set for organization members, whose items are settled
+	// one by one against the organization pool.
+	member *domain.OrgMember
+	ump    *domain.UserMainPackage
+	bal    *domain.UserBalance
+	pkg    *domain.PackageMaster
+	policy *domain.DeductionPolicy
+	err    error
+}
+
+// SettleTokenUsageBatch settles many traces at once. Portkey costs are
+// resolved with at most `concurrency` requests in flight, and each user's
+// deductions are applied in a single balance update. Items of organization
+// members are settled individually against the organization pool. Items fail
+// independently; already-recorded traceIds come back as Duplicate.
+func (s *UsageSettler) SettleTokenUsageBatch(ctx context.Context, items []domain.TokenUsedIn, concurrency int) ([]BatchResult, error) {
+	results := make([]BatchResult, len(items))
+	for i, in := range items {
+		results[i].Item = in
+	}
+
+	// 1. Drop repeated traceIds and those already settled.
+	seen := make(map[string]bool, len(items))
+	traceIDs := make([]string, 0, len(items))
+	for i, in := range items {
+		if seen[in.TraceID] {
+			results[i].Err = ErrDuplicateInBatch
+			continue
+		}
+		seen[in.TraceID] = true
+		traceIDs = append(traceIDs, in.TraceID)
+	}
+
+	existing, err := findTokenUsedEvents(ctx, traceIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	byUser := make(map[string][]*batchItem)
+	for i, in := range items {
+		if results[i].Err != nil {
+			continue
+		}
+		if ev, ok := existing[in.TraceID]; ok {
+			results[i].Response = tokenUsedResponse(ev, TxnDuplicate)
+			continue
+		}
+		byUser[in.UserID] = append(byUser[in.UserID], &batchItem{index: i, in: in})
+	}
+
+	// 2. Load each user's package, balance and package terms.
+	accounts := make(map[string]*batchAccount, len(byUser))
+	var mu sync.Mutex
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for userID := range byUser {
+		g.Go(func() error {
+			acct := &batchAccount{}
+			acct.member, acct.err = findOrgMember(gCtx, userID)
+			if acct.err == nil && acct.member == nil {
+				acct.ump, acct.bal, acct.err = loadUsageAccount(gCtx, userID)
+			}
+			if acct.err == nil && acct.member == nil {
+				acct.pkg, acct.err = findPackage(gCtx, acct.ump.PackageID)
+			}
+			if acct.err == nil && acct.member == nil {
+				acct.policy, acct.err = resolveDeduction(gCtx, acct.pkg, acct.ump)
+			}
+			mu.Lock()
+			accounts[userID] = acct
+			mu.Unlock()
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	// 3. Resolve Portkey costs concurrently for users that can be charged.
+	g, gCtx = errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for userID, userItems := range byUser {
+		if accounts[userID].err != nil || accounts[userID].member != nil {
+			continue
+		}
+		for _, it := range userItems {
+			g.Go(func() error {
+				cost, err := s.portkey.FetchTraceCost(gCtx, it.in.TraceID)
+				if err != nil {
+					results[it.index].Err = err
+					return nil
+				}
+				model, flags, err := resolveChargeModel(gCtx, cost.AIModel)
+				if err != nil {
+					results[it.index].Err = err
+					return nil
+				}
+				multiplier, entFlags, err := s.entitlements.apply(gCtx, accounts[userID].ump.PackageID, model)
+				if err != nil {
+					results[it.index].Err = err
+					return nil
+				}
+				it.cost, it.model, it.multiplier = cost, model, multiplier
+				it.flags = append(flags, entFlags...)
+				return nil
+			})
+		}
+	}
+	_ = g.Wait()
+
+	// 4. Settle each user's items in order with one balance update.
+	for userID, userItems := range byUser {
+		acct := accounts[userID]
+		if acct.err != nil {
+			for _, it := range userItems {
+				results[it.index].Err = acct.err
+			}
+			continue
+		}
+		if acct.member != nil {
+			for _, it := range userItems {
+				results[it.index].Response, results[it.index].Err = s.SettleTokenUsage(ctx, it.in)
+			}
+			continue
+		}
+		settleUserBatch(ctx, acct, userItems, results)
+	}
+
+	return results, nil
+}
+
+// batchBalance is a user's balance as a batch charges it item by item.
+type batchBalance struct {
+	main, topup, remaining int
+}
+
+// take splits a deduction of -eggToken tokens with policy and removes it
+// from the balance.
+func (b *batchBalance) take(eggToken int, policy *domain.DeductionPolicy) (mainDeduction, topupDeduction int) {
+	mainDeduction, topupDeduction = splitDeduction(b.main, b.topup, -eggToken, policy)
+	b.main -= mainDeduction
+	b.topup -= topupDeduction
+	b.remaining += eggToken
+	return mainDeduction, topupDeduction
+}
+
+// giveBack undoes take for an item that was not recorded, so the items after
+// it are split as if it had never been charged.
+func (b *batchBalance) giveBack(eggToken, mainDeduction, topupDeduction int) {
+	b.main += mainDeduction
+	b.topup += topupDeduction
+	b.remaining -= eggToken
+}
+
+// settleUserBatch records the user's items one by one, each split against
+// the balance left by the items recorded before it, and applies them in one
+// balance update. An item that cannot be recorded, such as a traceId another
+// request settled first, is given back before the next item is split.
+func settleUserBatch(ctx context.Context, acct *batchAccount, items []*batchItem, results []BatchResult) {
+	running := batchBalance{
+		main:      acct.bal.MainTokenBalance,
+		topup:     acct.bal.TopupTokenBalance,
+		remaining: acct.bal.RemainingTokenBalance,
+	}
+
+	var eventIDs []primitive.ObjectID
+	eggToken, mainDeduction, topupDeduction := 0, 0, 0
+	var applied []*batchItem
+	for _, it := range items {
+		if it.cost == nil {
+			continue
+		}
+		if running.remaining <= 0 {
+			results[it.index].Err = ErrNoTokenBalance
+			continue
+		}
+
+		it.charge = priceUsage(it.cost, it.in.WebsearchCost, acct.pkg, it.multiplier)
+		it.charge.withModel(it.model, it.flags)
+		itemMain, itemTopup := running.take(it.charge.eggToken, acct.policy)
+		it.event = newTokenUsedEvent(it.in, acct.ump.SubscriptionID, acct.pkg, it.charge, itemMain, itemTopup, acct.policy)
+
+		if err := insertTokenUsedEvent(ctx, &it.event); err != nil {
+			running.giveBack(it.charge.eggToken, itemMain, itemTopup)
+			if errors.Is(err, errDuplicateUsage) {
+				if ev, findErr := findTokenUsedEvent(ctx, it.in.TraceID); findErr == nil && ev != nil {
+					results[it.index].Response = tokenUsedResponse(ev, TxnDuplicate)
+					continue
+				}
+			}
+			results[it.index].Err = err
+			continue
+		}
+		eventIDs = append(eventIDs, it.event.ID)
+		eggToken += it.charge.eggToken
+		mainDeduction -= *it.event.MainToken
+		topupDeduction -= *it.event.TopupToken
+		applied = append(applied, it)
+	}
+	if len(applied) == 0 {
+		return
+	}
+
+	if err := applyDeduction(acct.bal.UserID, eventIDs, eggToken, mainDeduction, topupDeduction); err != nil {
+		for _, it := range applied {
+			results[it.index].Err = err
+		}
+		return
+	}
+	for _, it := range applied {
+		results[it.index].Response = tokenUsedResponse(&it.event, TxnSuccess)
+	}
+}
+
+func findTokenUsedEvents(ctx context.Context, traceIDs []string) (map[string]*domain.UsageEventOut, error) {
+	out := make(map[string]*domain.UsageEventOut)
+	if len(traceIDs) == 0 {
+		return out, nil
+	}
+
+	filter := bson.M{"traceId": bson.M{"$in": traceIDs}, "eventType": EvtTokenUsed}
+	cursor, err := mongodb.GetCollection(config.UsageEventColl).Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var events []domain.UsageEventOut
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	for i := range events {
+		if events[i].TraceID != nil {
+			out[*events[i].TraceID] = &events[i]
+		}
+	}
+	return out, nil
+}
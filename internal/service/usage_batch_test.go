@@ -0,0 +1,38 @@
+package service
+
+import (
+	"testing"
+
+	"munggonegg/credit-service-go/internal/core/domain"
+)
+
+func TestBatchBalanceGiveBack(t *testing.T) {
+	// Topup is used below the threshold, so whether the second item lands
+	// on main or topup depends on what the first one took.
+	threshold := 100
+	policy := &domain.DeductionPolicy{Strategy: domain.DeductMainFirstThreshold, Threshold: &threshold}
+
+	want := batchBalance{main: 120, topup: 50, remaining: 170}
+	wantMain, wantTopup := want.take(-30, policy)
+
+	b := batchBalance{main: 120, topup: 50, remaining: 170}
+	firstMain, firstTopup := b.take(-40, policy)
+	if firstMain != 40 || firstTopup != 0 {
+		t.Fatalf("first item split %d/%d, want 40/0", firstMain, firstTopup)
+	}
+	b.giveBack(-40, firstMain, firstTopup)
+	if b != (batchBalance{main: 120, topup: 50, remaining: 170}) {
+		t.Fatalf("balance after giving back = %+v", b)
+	}
+
+	gotMain, gotTopup := b.take(-30, policy)
+	if gotMain != wantMain || gotTopup != wantTopup {
+		t.Errorf("second item split %d/%d, want %d/%d as if the first was never charged", gotMain, gotTopup, wantMain, wantTopup)
+	}
+	if b != want {
+		t.Errorf("balance = %+v, want %+v", b, want)
+	}
+	if wantMain != 30 || wantTopup != 0 {
+		t.Errorf("split %d/%d, want 30/0 from main above the threshold", wantMain, wantTopup)
+	}
+}
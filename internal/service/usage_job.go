@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/client"
+	"munggonegg/credit-service-go/internal/adapter/repository/mongodb"
+	"munggonegg/credit-service-go/internal/config"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// jobLease is how long a claimed job stays invisible to other workers.
+	// A job whose lease expires (e.g. the process died) is picked up again.
+	jobLease = 2 * time.Minute
+
+	jobBaseBackoff = 2 * time.Second
+	jobMaxBackoff  = time.Minute
+)
+
+var ErrJobNotFound = errors.New("Usage job not found")
+
+// UsageJobQueue persists token_used requests in Mongo and settles them in a
+// pool of background workers, retrying while Portkey has not logged the trace.
+type UsageJobQueue struct {
+	settler      *UsageSettler
+	workers      int
+	maxAttempts  int
+	pollInterval time.Duration
+}
+
+func NewUsageJobQueue(cfg *config.Config, settler *UsageSettler) *UsageJobQueue {
+	return &UsageJobQueue{
+		settler:      settler,
+		workers:      cfg.UsageJobWorkers,
+		maxAttempts:  cfg.UsageJobMaxAttempts,
+		pollInterval: cfg.UsageJobPollInterval,
+	}
+}
+
+// Enqueue queues payload, or returns the job already queued for its traceId
+// unless that job failed, so a request retried by the client is settled by
+// one job.
+func (q *UsageJobQueue) Enqueue(ctx context.Context, payload domain.TokenUsedIn) (*domain.UsageJob, error) {
+	coll := mongodb.GetCollection(config.UsageJobColl)
+	now := time.Now()
+	job := domain.UsageJob{
+		ID:            primitive.NewObjectID(),
+		Status:        domain.JobPending,
+		Request:       payload,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		DedupKey:      payload.TraceID,
+	}
+	filter := bson.M{"dedupKey": payload.TraceID}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var out domain.UsageJob
+	err := coll.FindOneAndUpdate(ctx, filter, bson.M{"$setOnInsert": job}, opts).Decode(&out)
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent request queued the trace first.
+		err = coll.FindOne(ctx, filter).Decode(&out)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (q *UsageJobQueue) Get(ctx context.Context, id string) (*domain.UsageJob, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrJobNotFound
+	}
+	var job domain.UsageJob
+	err = mongodb.GetCollection(config.UsageJobColl).FindOne(ctx, bson.M{"_id": oid}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Run starts the worker pool and blocks until ctx is cancelled.
+func (q *UsageJobQueue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *UsageJobQueue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := q.claim(ctx)
+		if err != nil {
+			if !errors.Is(err, mongo.ErrNoDocuments) && ctx.Err() == nil {
+				log.Printf("Usage job claim failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(q.pollInterval):
+			}
+			continue
+		}
+		q.process(ctx, job)
+	}
+}
+
+// claim atomically takes the next due job, or one whose lease has expired.
+func (q *UsageJobQueue) claim(ctx context.Context) (*domain.UsageJob, error) {
+	now := time.Now()
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": domain.JobPending, "nextAttemptAt": bson.M{"$lte": now}},
+		bson.M{"status": domain.JobRunning, "lockedUntil": bson.M{"$lte": now}},
+	}}
+	update := bson.M{
+		"$set": bson.M{"status": domain.JobRunning, "lockedUntil": now.Add(jobLease), "updatedAt": now},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.M{"nextAttemptAt": 1}).
+		SetReturnDocument(options.After)
+
+	var job domain.UsageJob
+	if err := mongodb.GetCollection(config.UsageJobColl).FindOneAndUpdate(ctx, filter, update, opts).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (q *UsageJobQueue) process(ctx context.Context, job *domain.UsageJob) {
+	settleCtx, cancel := context.WithTimeout(ctx, jobLease/2)
+	defer cancel()
+
+	result, err := q.settler.SettleTokenUsage(settleCtx, job.Request)
+
+	// The job outcome must be recorded even if we are shutting down.
+	bgCtx, bgCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer bgCancel()
+
+	update := jobOutcome(job, result, err, q.maxAttempts, time.Now())
+	if _, err := mongodb.GetCollection(config.UsageJobColl).UpdateOne(bgCtx, bson.M{"_id": job.ID}, update); err != nil {
+		log.Printf("Failed to update usage job %s: %v", job.ID.Hex(), err)
+	}
+}
+
+// jobOutcome is the update that records an attempt of job: it succeeded,
+// goes back to pending after a retryable error while attempts remain, or
+// failed. A failed job releases its traceId so the trace can be queued again.
+func jobOutcome(job *domain.UsageJob, result *domain.TokenUsedResponse, err error, maxAttempts int, now time.Time) bson.M {
+	set := bson.M{"updatedAt": now}
+	unset := bson.M{"lockedUntil": ""}
+
+	switch {
+	case err == nil:
+		set["status"] = domain.JobSucceeded
+		set["result"] = result
+		set["completedAt"] = now
+		unset["lastError"] = ""
+	case client.Retryable(err) && job.Attempts < maxAttempts:
+		set["status"] = domain.JobPending
+		set["nextAttemptAt"] = now.Add(backoff(job.Attempts))
+		set["lastError"] = err.Error()
+	default:
+		set["status"] = domain.JobFailed
+		set["completedAt"] = now
+		set["lastError"] = err.Error()
+		unset["dedupKey"] = ""
+	}
+	return bson.M{"$set": set, "$unset": unset}
+}
+
+func backoff(attempt int) time.Duration {
+	d := jobBaseBackoff
+	for i := 1; i < attempt && d < jobMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > jobMaxBackoff {
+		d = jobMaxBackoff
+	}
+	return d
+}
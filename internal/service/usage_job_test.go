@@ -0,0 +1,94 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"munggonegg/credit-service-go/internal/adapter/client"
+	"munggonegg/credit-service-go/internal/core/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestJobOutcome(t *testing.T) {
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	result := &domain.TokenUsedResponse{TraceID: "t1", TransactionStatus: TxnSuccess}
+
+	tests := []struct {
+		name         string
+		attempts     int
+		result       *domain.TokenUsedResponse
+		err          error
+		wantStatus   string
+		wantRetryAt  time.Time
+		wantReleased bool
+	}{
+		{name: "settled", attempts: 1, result: result, wantStatus: domain.JobSucceeded},
+		{name: "trace not logged yet", attempts: 1, err: client.ErrTraceNotFound, wantStatus: domain.JobPending, wantRetryAt: now.Add(2 * time.Second)},
+		{name: "portkey down on a later attempt", attempts: 4, err: client.ErrPortkeyUnavailable, wantStatus: domain.JobPending, wantRetryAt: now.Add(16 * time.Second)},
+		{name: "out of attempts", attempts: 5, err: client.ErrTraceNotFound, wantStatus: domain.JobFailed, wantReleased: true},
+		{name: "not retryable", attempts: 1, err: ErrNoTokenBalance, wantStatus: domain.JobFailed, wantReleased: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &domain.UsageJob{Attempts: tt.attempts, DedupKey: "t1"}
+			update := jobOutcome(job, tt.result, tt.err, 5, now)
+			set, unset := update["$set"].(bson.M), update["$unset"].(bson.M)
+
+			if set["status"] != tt.wantStatus {
+				t.Fatalf("status = %v, want %s", set["status"], tt.wantStatus)
+			}
+			if _, ok := unset["lockedUntil"]; !ok {
+				t.Error("lease is not released")
+			}
+			if _, released := unset["dedupKey"]; released != tt.wantReleased {
+				t.Errorf("traceId released = %v, want %v", released, tt.wantReleased)
+			}
+			switch tt.wantStatus {
+			case domain.JobSucceeded:
+				if set["result"] != tt.result || set["completedAt"] != now {
+					t.Errorf("set = %v", set)
+				}
+				if _, ok := unset["lastError"]; !ok {
+					t.Error("lastError is kept on success")
+				}
+			case domain.JobPending:
+				if set["nextAttemptAt"] != tt.wantRetryAt || set["lastError"] != tt.err.Error() {
+					t.Errorf("set = %v", set)
+				}
+			case domain.JobFailed:
+				if set["completedAt"] != now || set["lastError"] != tt.err.Error() {
+					t.Errorf("set = %v", set)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: 2 * time.Second},
+		{attempt: 2, want: 4 * time.Second},
+		{attempt: 5, want: 32 * time.Second},
+		{attempt: 6, want: time.Minute},
+		{attempt: 20, want: time.Minute},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryableJobErrors(t *testing.T) {
+	if !client.Retryable(errors.Join(errors.New("fetch trace"), client.ErrTraceNotFound)) {
+		t.Error("a wrapped trace-not-found error must be retried")
+	}
+	if client.Retryable(ErrNoTokenBalance) {
+		t.Error("an empty balance must not be retried")
+	}
+}